@@ -12,6 +12,8 @@ type BaseCommand struct {
 }
 
 // initBaseConfig initializes the base configuration for the command.
+// Config items can be overridden through MATRIXOS_* environment variables,
+// see config.WithEnvOverrides.
 func (c *BaseCommand) initBaseConfig() error {
 	cfg, err := config.NewBaseConfig()
 	if err != nil {
@@ -20,11 +22,12 @@ func (c *BaseCommand) initBaseConfig() error {
 	if err := cfg.Load(); err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
-	c.cfg = cfg
+	c.cfg = config.WithEnvOverrides(cfg)
 	return nil
 }
 
 // initClientConfig initializes the client configuration for the command.
+// Like initBaseConfig, it honors MATRIXOS_* environment overrides.
 func (c *BaseCommand) initClientConfig() error {
 	cfg, err := config.NewClientConfig()
 	if err != nil {
@@ -33,7 +36,7 @@ func (c *BaseCommand) initClientConfig() error {
 	if err := cfg.Load(); err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
-	c.cfg = cfg
+	c.cfg = config.WithEnvOverrides(cfg)
 	return nil
 }
 
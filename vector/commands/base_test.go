@@ -0,0 +1,22 @@
+package commands
+
+import (
+	"matrixos/vector/lib/config"
+	"testing"
+)
+
+func TestInitBaseConfigEnvOverrides(t *testing.T) {
+	t.Setenv(config.EnvOverrideName("Imager.ImageSize"), "64G")
+
+	c := &BaseCommand{}
+	if err := c.initBaseConfig(); err != nil {
+		t.Fatalf("initBaseConfig failed: %v", err)
+	}
+	got, err := c.cfg.GetItem("Imager.ImageSize")
+	if err != nil {
+		t.Fatalf("GetItem failed: %v", err)
+	}
+	if got != "64G" {
+		t.Errorf("Imager.ImageSize = %q, want the environment override 64G", got)
+	}
+}
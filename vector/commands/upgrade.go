@@ -179,7 +179,7 @@ func (c *UpgradeCommand) getCurrentState() (string, string, error) {
 		}
 	}
 
-	return "", "", fmt.Errorf("no booted deployment found")
+	return "", "", cds.ErrNoBootedDeployment
 }
 
 func (c *UpgradeCommand) upgradePull() error {
@@ -1,7 +1,10 @@
 package cds
 
 import (
+	"context"
+	"path"
 	"strings"
+	"time"
 
 	fslib "matrixos/vector/lib/filesystems"
 )
@@ -32,10 +35,21 @@ type MockOstree struct {
 
 	BootCommitResult string
 	BootCommitErr    error
+
+	RollbackCalled bool
+	RollbackErr    error
+
+	SignedFiles []string
+	GpgSignErr  error
 }
 
 // Config accessors — return zero values (not used in branch/upgrade tests).
 func (m *MockOstree) FullBranchSuffix() (string, error)                       { return "-full", nil }
+func (m *MockOstree) PruneDepth() (int, error)                                { return 5, nil }
+func (m *MockOstree) PruneRefsOnly() (bool, error)                            { return true, nil }
+func (m *MockOstree) RemoteExtraArgs() ([]string, error)                      { return nil, nil }
+func (m *MockOstree) TlsClientCert() (string, error)                          { return "", nil }
+func (m *MockOstree) TlsClientKey() (string, error)                           { return "", nil }
 func (m *MockOstree) IsBranchFullSuffixed(string) (bool, error)               { return false, nil }
 func (m *MockOstree) BranchShortnameToFull(_, _, _, _ string) (string, error) { return "", nil }
 func (m *MockOstree) BranchToFull(string) (string, error)                     { return "", nil }
@@ -49,6 +63,17 @@ func (m *MockOstree) RemoveFullFromBranch(ref string) (string, error) {
 	// Default: strip -full suffix if present.
 	return strings.TrimSuffix(ref, "-full"), nil
 }
+func (m *MockOstree) RefToShortName(ref, osName, arch string) (string, error) {
+	_, name, err := ParseNormalBranch(ref, osName, arch)
+	if err != nil {
+		return "", err
+	}
+	name, err = m.RemoveFullFromBranch(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(name), nil
+}
 func (m *MockOstree) GpgEnabled() (bool, error)                  { return false, nil }
 func (m *MockOstree) GpgPrivateKeyPath() (string, error)         { return "", nil }
 func (m *MockOstree) GpgPublicKeyPath() (string, error)          { return "", nil }
@@ -64,10 +89,15 @@ func (m *MockOstree) GpgBestPubKeyPath() (string, error)         { return "", ni
 func (m *MockOstree) ClientSideGpgArgs() ([]string, error)       { return nil, nil }
 func (m *MockOstree) GpgHomeDir() (string, error)                { return "", nil }
 func (m *MockOstree) GpgKeyID() (string, error)                  { return "", nil }
+func (m *MockOstree) GpgKeyExpiry() (time.Time, bool, error)     { return time.Time{}, false, nil }
 func (m *MockOstree) GpgArgs() ([]string, error)                 { return nil, nil }
 func (m *MockOstree) SetupEtc(string) error                      { return nil }
 func (m *MockOstree) PrepareFilesystemHierarchy(string) error    { return nil }
 func (m *MockOstree) ValidateFilesystemHierarchy(string) error   { return nil }
+func (m *MockOstree) UndoFilesystemHierarchy(string) error       { return nil }
+func (m *MockOstree) PrepareFilesystemHierarchyDryRun(string) ([]string, error) {
+	return nil, nil
+}
 func (m *MockOstree) BootCommit(string) (string, error) {
 	if m.BootCommitErr != nil {
 		return "", m.BootCommitErr
@@ -77,29 +107,101 @@ func (m *MockOstree) BootCommit(string) (string, error) {
 	}
 	return "abc123commit", nil
 }
-func (m *MockOstree) ListRemotes(bool) ([]string, error)                           { return nil, nil }
-func (m *MockOstree) ImportGpgKey(string) error                                    { return nil }
-func (m *MockOstree) GpgSignFile(string) error                                     { return nil }
-func (m *MockOstree) GpgKeys() ([]string, error)                                   { return nil, nil }
-func (m *MockOstree) InitializeSigningGpg(bool) error                              { return nil }
-func (m *MockOstree) InitializeRemoteSigningGpg(string, string, bool) error        { return nil }
-func (m *MockOstree) MaybeInitializeGpg(bool) error                                { return nil }
-func (m *MockOstree) MaybeInitializeGpgForRepo(string, string, bool) error         { return nil }
-func (m *MockOstree) MaybeInitializeRemote(bool) error                             { return nil }
-func (m *MockOstree) Pull(string, bool) error                                      { return nil }
-func (m *MockOstree) PullWithRemote(string, string, bool) error                    { return nil }
-func (m *MockOstree) Prune(string, bool) error                                     { return nil }
-func (m *MockOstree) GenerateStaticDelta(string, bool) error                       { return nil }
-func (m *MockOstree) UpdateSummary(bool) error                                     { return nil }
-func (m *MockOstree) AddRemote(bool) error                                         { return nil }
-func (m *MockOstree) AddRemoteWithSysroot(string, bool) error                      { return nil }
+func (m *MockOstree) ListRemotes(bool) ([]string, error)                    { return nil, nil }
+func (m *MockOstree) GpgExportPublicKey(string) error                       { return nil }
+func (m *MockOstree) ImportGpgKeys([]string) error                          { return nil }
+func (m *MockOstree) ImportGpgKey(string) error                             { return nil }
+func (m *MockOstree) GpgKeys() ([]string, error)                            { return nil, nil }
+func (m *MockOstree) InitializeSigningGpg(bool) error                       { return nil }
+func (m *MockOstree) InitializeRemoteSigningGpg(string, string, bool) error { return nil }
+func (m *MockOstree) MaybeInitializeGpg(bool) error                         { return nil }
+func (m *MockOstree) MaybeInitializeGpgForRepo(string, string, bool) error  { return nil }
+func (m *MockOstree) MaybeInitializeRemote(bool) error                      { return nil }
+func (m *MockOstree) Pull(string, bool) error                               { return nil }
+func (m *MockOstree) PullWithRemote(string, string, bool) error             { return nil }
+func (m *MockOstree) PullWithDepth(string, int, bool) error                 { return nil }
+func (m *MockOstree) MirrorRemote(bool) error                               { return nil }
+func (m *MockOstree) PruneInRoot(string, bool) error                        { return nil }
+func (m *MockOstree) GenerateStaticDeltaInRoot(string, bool) error          { return nil }
+func (m *MockOstree) PrunePreview(string, bool) (uint64, int, error)        { return 0, 0, nil }
+func (m *MockOstree) Prune(string, bool) error                              { return nil }
+func (m *MockOstree) GenerateStaticDelta(string, bool) error                { return nil }
+func (m *MockOstree) GenerateStaticDeltaBetween(string, string, bool) error { return nil }
+func (m *MockOstree) SignSummary(bool) error                                { return nil }
+func (m *MockOstree) UpdateSummary(bool) error                              { return nil }
+func (m *MockOstree) SummaryRefs(bool) (map[string]string, error) {
+	return nil, nil
+}
+func (m *MockOstree) AddRemote(bool) error                    { return nil }
+func (m *MockOstree) AddRemoteWithSysroot(string, bool) error { return nil }
+func (m *MockOstree) LocalRefsWithCommits(bool) (map[string]string, error) {
+	return nil, nil
+}
+func (m *MockOstree) RepoSize() (uint64, error)                                    { return 0, nil }
 func (m *MockOstree) LocalRefs(bool) ([]string, error)                             { return nil, nil }
+func (m *MockOstree) ReadFile(string, string, bool) ([]byte, error)                { return nil, nil }
+func (m *MockOstree) FindPath(string, string, bool) (*fslib.PathInfo, error)       { return nil, nil }
 func (m *MockOstree) ListContents(string, string, bool) (*[]fslib.PathInfo, error) { return nil, nil }
 func (m *MockOstree) ListEtcChanges(string, string) ([]EtcChange, error)           { return nil, nil }
 func (m *MockOstree) DeployedRootfs(string, bool) (string, error)                  { return "", nil }
 func (m *MockOstree) BootedRef(bool) (string, error)                               { return "", nil }
 func (m *MockOstree) BootedHash(bool) (string, error)                              { return "", nil }
 func (m *MockOstree) Deploy(string, []string, bool) error                          { return nil }
+func (m *MockOstree) Undeploy(int, bool) error                                     { return nil }
+func (m *MockOstree) PinDeployment(int, bool, bool) error                          { return nil }
+func (m *MockOstree) CurrentKargs(bool) ([]string, error)                          { return nil, nil }
+func (m *MockOstree) KargMigrationNeeded([]string, bool) ([]string, []string, error) {
+	return nil, nil, nil
+}
+func (m *MockOstree) SetKargs([]string, []string, bool) error   { return nil }
+func (m *MockOstree) GetKargs(bool) ([]string, error)           { return nil, nil }
+func (m *MockOstree) CommitComplete(string, bool) (bool, error) { return true, nil }
+func (m *MockOstree) PullVerified(string, bool) error           { return nil }
+func (m *MockOstree) PullRetry(string, int, time.Duration, bool) error {
+	return nil
+}
+func (m *MockOstree) VerifyCommitSignature(string, bool) error { return nil }
+func (m *MockOstree) Commit(string, string, string, bool) (string, error) {
+	return "", nil
+}
+func (m *MockOstree) DiffPackages(string, string, bool) (*PackageDiff, error) {
+	return nil, nil
+}
+func (m *MockOstree) Changelog(string, string, bool) ([]ChangelogEntry, error) {
+	return nil, nil
+}
+func (m *MockOstree) UpgradeReport(string, string, bool) (*UpgradeReport, error) {
+	return nil, nil
+}
+func (m *MockOstree) PullContext(context.Context, string, bool) error { return nil }
+func (m *MockOstree) GenerateStaticDeltaContext(context.Context, string, bool) error {
+	return nil
+}
+func (m *MockOstree) DeployContext(context.Context, string, []string, bool) error { return nil }
+func (m *MockOstree) PullWithProgress(string, func(PullProgress), bool) error     { return nil }
+func (m *MockOstree) RemoteDelete(bool) error                                     { return nil }
+func (m *MockOstree) RemoteSetURL(string, bool) error                             { return nil }
+func (m *MockOstree) DiffCommits(string, string, bool) (map[string][]string, error) {
+	return nil, nil
+}
+func (m *MockOstree) DeleteLocalRef(string, bool) error            { return nil }
+func (m *MockOstree) Fsck(bool) error                              { return nil }
+func (m *MockOstree) FsckWithDelta(bool) error                     { return nil }
+func (m *MockOstree) ListStaticDeltas(bool) ([]StaticDelta, error) { return nil, nil }
+func (m *MockOstree) ListEtcChangesChecksummed(string, string) ([]EtcChange, error) {
+	return nil, nil
+}
+func (m *MockOstree) ApplyEtcChanges([]EtcChange, bool) ([]EtcChange, error) {
+	return nil, nil
+}
+func (m *MockOstree) BackupConflicts([]EtcChange, string) ([]string, error) {
+	return nil, nil
+}
+func (m *MockOstree) EtcChangesJSON(string, string) ([]byte, error) { return nil, nil }
+func (m *MockOstree) DeployStaged(string, []string, bool) error     { return nil }
+func (m *MockOstree) DeployWithOptions(string, []string, DeployOptions, bool) error {
+	return nil
+}
 
 // Methods with configurable behavior for tests.
 func (m *MockOstree) Root() (string, error) {
@@ -113,10 +215,48 @@ func (m *MockOstree) ListDeployments(_ bool) ([]Deployment, error) {
 	return m.Deployments, m.DeploymentsErr
 }
 
+func (m *MockOstree) DeploymentByRef(refspec string, _ bool) (*Deployment, error) {
+	if m.DeploymentsErr != nil {
+		return nil, m.DeploymentsErr
+	}
+	for i := range m.Deployments {
+		if m.Deployments[i].Refspec == refspec {
+			return &m.Deployments[i], nil
+		}
+	}
+	return nil, &DeploymentNotFoundError{Refspec: refspec}
+}
+
+func (m *MockOstree) BootedDeployment(_ bool) (*Deployment, error) {
+	if m.DeploymentsErr != nil {
+		return nil, m.DeploymentsErr
+	}
+	for i := range m.Deployments {
+		if m.Deployments[i].Booted {
+			return &m.Deployments[i], nil
+		}
+	}
+	return nil, ErrNoBootedDeployment
+}
+
 func (m *MockOstree) RemoteRefs(_ bool) ([]string, error) {
 	return m.Refs, m.RefsErr
 }
 
+func (m *MockOstree) RemoteRefsWithPrefix(prefix string, _ bool) ([]string, error) {
+	if m.RefsErr != nil {
+		return nil, m.RefsErr
+	}
+	var matching []string
+	for _, ref := range m.Refs {
+		_, bare, _ := strings.Cut(ref, ":")
+		if strings.HasPrefix(ref, prefix) || strings.HasPrefix(bare, prefix) {
+			matching = append(matching, ref)
+		}
+	}
+	return matching, nil
+}
+
 func (m *MockOstree) Switch(ref string, _ bool) error {
 	m.SwitchRef = ref
 	return m.SwitchErr
@@ -126,6 +266,16 @@ func (m *MockOstree) LastCommit(ref string, _ bool) (string, error) {
 	return m.LastCommit_, m.LastCommitErr
 }
 
+func (m *MockOstree) GpgSignFile(file string) error {
+	m.SignedFiles = append(m.SignedFiles, file)
+	return m.GpgSignErr
+}
+
+func (m *MockOstree) Rollback(_ bool) error {
+	m.RollbackCalled = true
+	return m.RollbackErr
+}
+
 func (m *MockOstree) Upgrade(args []string, _ bool) error {
 	m.UpgradeArgs = args
 	return m.UpgradeErr
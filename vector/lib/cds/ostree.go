@@ -3,6 +3,7 @@ package cds
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,12 +13,18 @@ import (
 	fslib "matrixos/vector/lib/filesystems"
 	"matrixos/vector/lib/runner"
 	"os"
+	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 const (
@@ -38,15 +45,37 @@ const (
 	EtcActionUserOnly EtcChangeAction = "user-only"
 )
 
+// Errors returned, possibly wrapped, for common ostree failures. Use
+// errors.Is to check for them.
+var (
+	// ErrNoRemotePrefix means that a ref lacks the "remote:" prefix.
+	ErrNoRemotePrefix = errors.New("does not contain the remote: prefix")
+	// ErrNoBootedDeployment means that no deployment is marked as booted.
+	ErrNoBootedDeployment = errors.New("no booted deployment found")
+	// ErrRefNotFound means that a ref does not resolve to any commit.
+	ErrRefNotFound = errors.New("no commit found for ref")
+	// ErrRepoDirMissing means that Ostree.RepoDir is not configured.
+	ErrRepoDirMissing = errors.New("invalid Ostree.RepoDir")
+	// ErrEmptyConfigItem means that a required config item is set to an
+	// empty value.
+	ErrEmptyConfigItem = errors.New("must not be empty")
+)
+
 // IOstree defines the interface for ostree operations.
 // It mirrors all public methods of Ostree for testability.
 type IOstree interface {
 	// Config accessors
 	FullBranchSuffix() (string, error)
+	PruneDepth() (int, error)
+	PruneRefsOnly() (bool, error)
+	RemoteExtraArgs() ([]string, error)
+	TlsClientCert() (string, error)
+	TlsClientKey() (string, error)
 	IsBranchFullSuffixed(ref string) (bool, error)
 	BranchShortnameToFull(shortName, relStage, osName, arch string) (string, error)
 	BranchToFull(ref string) (string, error)
 	RemoveFullFromBranch(ref string) (string, error)
+	RefToShortName(ref, osName, arch string) (string, error)
 	GpgEnabled() (bool, error)
 	GpgPrivateKeyPath() (string, error)
 	GpgPublicKeyPath() (string, error)
@@ -63,19 +92,25 @@ type IOstree interface {
 	ClientSideGpgArgs() ([]string, error)
 	GpgHomeDir() (string, error)
 	GpgKeyID() (string, error)
+	GpgKeyExpiry() (time.Time, bool, error)
 	GpgArgs() ([]string, error)
 
 	// Filesystem operations
 	SetupEtc(imageDir string) error
 	PrepareFilesystemHierarchy(imageDir string) error
+	PrepareFilesystemHierarchyDryRun(imageDir string) ([]string, error)
+	UndoFilesystemHierarchy(imageDir string) error
 	ValidateFilesystemHierarchy(imageDir string) error
 
 	// Repo operations
 	BootCommit(sysroot string) (string, error)
 	ListRemotes(verbose bool) ([]string, error)
 	LastCommit(ref string, verbose bool) (string, error)
+	VerifyCommitSignature(ref string, verbose bool) error
 	ImportGpgKey(keyPath string) error
+	ImportGpgKeys(keyPaths []string) error
 	GpgSignFile(file string) error
+	GpgExportPublicKey(outPath string) error
 	GpgKeys() ([]string, error)
 	InitializeSigningGpg(verbose bool) error
 	InitializeRemoteSigningGpg(remote, repoDir string, verbose bool) error
@@ -83,29 +118,78 @@ type IOstree interface {
 	MaybeInitializeGpgForRepo(remote, repoDir string, verbose bool) error
 	MaybeInitializeRemote(verbose bool) error
 	Pull(ref string, verbose bool) error
+	PullContext(ctx context.Context, ref string, verbose bool) error
 	PullWithRemote(remote, ref string, verbose bool) error
+	MirrorRemote(verbose bool) error
+	PullWithDepth(ref string, depth int, verbose bool) error
+	PullWithProgress(ref string, onProgress func(PullProgress), verbose bool) error
+	Fsck(verbose bool) error
+	FsckWithDelta(verbose bool) error
+	CommitComplete(commit string, verbose bool) (bool, error)
+	PullVerified(ref string, verbose bool) error
+	PullRetry(ref string, attempts int, baseDelay time.Duration, verbose bool) error
+	Commit(branch, subject, dir string, verbose bool) (string, error)
 	Prune(ref string, verbose bool) error
+	PruneInRoot(ref string, verbose bool) error
+	PrunePreview(ref string, verbose bool) (freedBytes uint64, prunedObjects int, err error)
 	GenerateStaticDelta(ref string, verbose bool) error
+	GenerateStaticDeltaInRoot(ref string, verbose bool) error
+	GenerateStaticDeltaBetween(fromCommit, toCommit string, verbose bool) error
+	GenerateStaticDeltaContext(ctx context.Context, ref string, verbose bool) error
+	ListStaticDeltas(verbose bool) ([]StaticDelta, error)
 	UpdateSummary(verbose bool) error
+	SignSummary(verbose bool) error
+	SummaryRefs(verbose bool) (map[string]string, error)
 	AddRemote(verbose bool) error
 	AddRemoteWithSysroot(sysroot string, verbose bool) error
+	RemoteDelete(verbose bool) error
+	RemoteSetURL(url string, verbose bool) error
 	LocalRefs(verbose bool) ([]string, error)
+	LocalRefsWithCommits(verbose bool) (map[string]string, error)
+	RepoSize() (uint64, error)
+	DeleteLocalRef(ref string, verbose bool) error
 	RemoteRefs(verbose bool) ([]string, error)
+	RemoteRefsWithPrefix(prefix string, verbose bool) ([]string, error)
 	ListDeployments(verbose bool) ([]Deployment, error)
+	DeploymentByRef(refspec string, verbose bool) (*Deployment, error)
 	DeployedRootfs(ref string, verbose bool) (string, error)
+	BootedDeployment(verbose bool) (*Deployment, error)
 	BootedRef(verbose bool) (string, error)
 	BootedHash(verbose bool) (string, error)
+	CurrentKargs(verbose bool) ([]string, error)
+	KargMigrationNeeded(desired []string, verbose bool) ([]string, []string, error)
+	SetKargs(appends []string, deletes []string, verbose bool) error
+	GetKargs(verbose bool) ([]string, error)
 	Switch(ref string, verbose bool) error
+	Rollback(verbose bool) error
+	Undeploy(index int, verbose bool) error
+	PinDeployment(index int, pinned bool, verbose bool) error
 	Deploy(ref string, bootArgs []string, verbose bool) error
+	DeployWithOptions(ref string, bootArgs []string, opts DeployOptions, verbose bool) error
+	DeployContext(ctx context.Context, ref string, bootArgs []string, verbose bool) error
+	DeployStaged(ref string, bootArgs []string, verbose bool) error
 	Upgrade(args []string, verbose bool) error
 	ListPackages(commit string, verbose bool) ([]string, error)
 	ListContents(commit, path string, verbose bool) (*[]fslib.PathInfo, error)
+	FindPath(commit, path string, verbose bool) (*fslib.PathInfo, error)
+	ReadFile(commit, path string, verbose bool) ([]byte, error)
 	ListEtcChanges(oldSHA, newSHA string) ([]EtcChange, error)
+	ListEtcChangesChecksummed(oldSHA, newSHA string) ([]EtcChange, error)
+	EtcChangesJSON(oldSHA, newSHA string) ([]byte, error)
+	ApplyEtcChanges(changes []EtcChange, dryRun bool) ([]EtcChange, error)
+	BackupConflicts(changes []EtcChange, backupDir string) ([]string, error)
+	DiffPackages(fromCommit, toCommit string, verbose bool) (*PackageDiff, error)
+	Changelog(fromCommit, toCommit string, verbose bool) ([]ChangelogEntry, error)
+	UpgradeReport(fromCommit, toCommit string, verbose bool) (*UpgradeReport, error)
+	DiffCommits(fromRef, toRef string, verbose bool) (map[string][]string, error)
 }
 
 // runCommand runs a generic binary with args and stdout/stderr handling.
 var runCommand runner.Func = runner.Run
 
+// runCommandCtx is the context-aware variant of runCommand.
+var runCommandCtx runner.FuncCtx = runner.RunContext
+
 func readerToList(reader io.Reader) ([]string, error) {
 	var elements []string
 	scanner := bufio.NewScanner(reader)
@@ -177,12 +261,56 @@ func CleanRemoteFromRef(ref string) string {
 	return ref
 }
 
+// ValidateRefFormat checks that ref is a well-formed ostree ref, optionally
+// prefixed by a remote (e.g. "origin:matrixos/amd64/dev/gnome"). It rejects
+// whitespace, multiple ":" separators, leading or trailing slashes and empty
+// path components.
+func ValidateRefFormat(ref string) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	if strings.IndexFunc(ref, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid ref %q: contains whitespace", ref)
+	}
+	if strings.Count(ref, ":") > 1 {
+		return fmt.Errorf("invalid ref %q: more than one ':' separator", ref)
+	}
+	if remote, _, ok := strings.Cut(ref, ":"); ok && remote == "" {
+		return fmt.Errorf("invalid ref %q: empty remote", ref)
+	}
+	path := CleanRemoteFromRef(ref)
+	if path == "" {
+		return fmt.Errorf("invalid ref %q: empty path", ref)
+	}
+	if strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("invalid ref %q: leading or trailing slash", ref)
+	}
+	if slices.Contains(strings.Split(path, "/"), "") {
+		return fmt.Errorf("invalid ref %q: empty path component", ref)
+	}
+	return nil
+}
+
 // IsBranchShortName returns true if the branch is a short name.
 // E.g. "gnome" -> true, "matrixos/dev/gnome" -> false.
 func IsBranchShortName(branch string) bool {
 	return !strings.Contains(branch, "/")
 }
 
+// ValidReleaseStages lists the release stages a branch can belong to. "prod"
+// branches have no stage component in their name.
+var ValidReleaseStages = []string{"dev", "staging", "prod"}
+
+// validateReleaseStage returns an error if relStage is not one of
+// ValidReleaseStages.
+func validateReleaseStage(relStage string) error {
+	if !slices.Contains(ValidReleaseStages, relStage) {
+		return fmt.Errorf("invalid release stage %q (valid: %s)",
+			relStage, strings.Join(ValidReleaseStages, ", "))
+	}
+	return nil
+}
+
 // BranchShortnameToNormal converts a short branch name to a normal one.
 func BranchShortnameToNormal(relStage, shortname, osName, arch string) (string, error) {
 	if relStage == "" {
@@ -197,6 +325,9 @@ func BranchShortnameToNormal(relStage, shortname, osName, arch string) (string,
 	if arch == "" {
 		return "", errors.New("invalid arch parameter")
 	}
+	if err := validateReleaseStage(relStage); err != nil {
+		return "", err
+	}
 
 	nameArch := fmt.Sprintf("%s/%s", osName, arch)
 	if relStage == "prod" {
@@ -205,6 +336,40 @@ func BranchShortnameToNormal(relStage, shortname, osName, arch string) (string,
 	return fmt.Sprintf("%s/%s/%s", nameArch, relStage, shortname), nil
 }
 
+// ParseNormalBranch is the reverse of BranchShortnameToNormal: it splits a
+// normal branch name (e.g. matrixos/amd64/dev/gnome) into its release stage
+// and short name. Branches without a stage are "prod" branches. A remote:
+// prefix, if any, is ignored.
+func ParseNormalBranch(ref, osName, arch string) (relStage, shortname string, err error) {
+	if ref == "" {
+		return "", "", errors.New("invalid ref parameter")
+	}
+	if osName == "" {
+		return "", "", errors.New("invalid os name parameter")
+	}
+	if arch == "" {
+		return "", "", errors.New("invalid arch parameter")
+	}
+
+	prefix := fmt.Sprintf("%s/%s/", osName, arch)
+	rest, ok := strings.CutPrefix(CleanRemoteFromRef(ref), prefix)
+	if !ok || rest == "" {
+		return "", "", fmt.Errorf("%s does not start with %s", ref, prefix)
+	}
+
+	stage, name, hasStage := strings.Cut(rest, "/")
+	if !hasStage {
+		return "prod", rest, nil
+	}
+	if stage == "" || name == "" {
+		return "", "", fmt.Errorf("invalid branch %s", ref)
+	}
+	if err := validateReleaseStage(stage); err != nil {
+		return "", "", err
+	}
+	return stage, name, nil
+}
+
 // ClientSideGpgArgs returns arguments for client-side GPG verification.
 func ClientSideGpgArgs(gpgEnabled bool, pubKeyPath string) ([]string, error) {
 	var gpgArgs []string
@@ -271,9 +436,53 @@ type AddRemoteOptions struct {
 	Remote    string
 	RemoteURL string
 	GpgArgs   []string
-	RepoDir   string
-	Sysroot   string
-	Verbose   bool
+	// ExtraArgs are passed to "ostree remote add" right before the remote
+	// name, e.g. --set=tls-permissive=true. See validateRemoteExtraArgs.
+	ExtraArgs []string
+	// TlsClientCert and TlsClientKey are the client certificate and key used
+	// to authenticate against the remote. They must be set together.
+	TlsClientCert string
+	TlsClientKey  string
+	RepoDir       string
+	Sysroot       string
+	Verbose       bool
+}
+
+// remoteExtraArgRe matches the --key and --key=value forms accepted in
+// AddRemoteOptions.ExtraArgs.
+var remoteExtraArgRe = regexp.MustCompile(`^--[A-Za-z0-9][A-Za-z0-9-]*(=.*)?$`)
+
+// validateRemoteExtraArgs makes sure that every extra argument is an option,
+// so that it cannot be mistaken for the remote name or URL.
+func validateRemoteExtraArgs(args []string) error {
+	for _, arg := range args {
+		if !remoteExtraArgRe.MatchString(arg) {
+			return fmt.Errorf("invalid remote extra argument %q, expected --key or --key=value", arg)
+		}
+	}
+	return nil
+}
+
+// remoteTlsArgs returns the "ostree remote add" options that configure TLS
+// client authentication with the given certificate and key. Both must be
+// either empty or existing files.
+func remoteTlsArgs(cert, key string) ([]string, error) {
+	if cert == "" && key == "" {
+		return nil, nil
+	}
+	if cert == "" || key == "" {
+		return nil, errors.New("TLS client cert and key must be set together")
+	}
+	if !fileExists(cert) {
+		return nil, fmt.Errorf("TLS client cert %s does not exist", cert)
+	}
+	if !fileExists(key) {
+		return nil, fmt.Errorf("TLS client key %s does not exist", key)
+	}
+	return []string{
+		"--set=tls-client-cert-path=" + cert,
+		"--set=tls-client-key-path=" + key,
+	}, nil
 }
 
 func AddRemoteWithOptions(opts AddRemoteOptions, verbose bool) error {
@@ -289,6 +498,13 @@ func AddRemoteWithOptions(opts AddRemoteOptions, verbose bool) error {
 	if opts.Sysroot != "" && !directoryExists(opts.Sysroot) {
 		return fmt.Errorf("sysroot %s does not exist", opts.Sysroot)
 	}
+	if err := validateRemoteExtraArgs(opts.ExtraArgs); err != nil {
+		return err
+	}
+	tlsArgs, err := remoteTlsArgs(opts.TlsClientCert, opts.TlsClientKey)
+	if err != nil {
+		return err
+	}
 	args := []string{
 		"remote",
 		"add",
@@ -302,6 +518,8 @@ func AddRemoteWithOptions(opts AddRemoteOptions, verbose bool) error {
 
 	args = append(args, "--force")
 	args = append(args, opts.GpgArgs...)
+	args = append(args, tlsArgs...)
+	args = append(args, opts.ExtraArgs...)
 	args = append(args, opts.Remote, opts.RemoteURL)
 	return Run(verbose, args...)
 }
@@ -463,7 +681,7 @@ func BootedRefWithSysroot(sysroot string, verbose bool) (string, error) {
 		}
 	}
 
-	return "", errors.New("no booted deployment found")
+	return "", ErrNoBootedDeployment
 }
 
 // BootedHash returns the commit hash of the booted deployment.
@@ -483,7 +701,7 @@ func BootedHashWithSysroot(sysroot string, verbose bool) (string, error) {
 		}
 	}
 
-	return "", errors.New("no booted deployment found")
+	return "", ErrNoBootedDeployment
 }
 
 // PatchGpgHomeDir sets the correct permissions on the GPG homedir.
@@ -534,6 +752,28 @@ func GpgSignedFilePath(filePath string) string {
 	return filePath + ".asc"
 }
 
+// PullWithDepth is like Pull, but fetches at most depth parent commits of
+// ref: -1 fetches the full history and 0 only the commit itself.
+func (o *Ostree) PullWithDepth(ref string, depth int, verbose bool) error {
+	if err := ValidateRefFormat(ref); err != nil {
+		return err
+	}
+	if depth < -1 {
+		return fmt.Errorf("invalid depth %d: must be -1 or greater", depth)
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote := ExtractRemoteFromRef(ref)
+	if remote == "" {
+		return fmt.Errorf("%v %w (e.g. origin:)", ref, ErrNoRemotePrefix)
+	}
+	ref = CleanRemoteFromRef(ref)
+	fmt.Printf("Pulling ostree from %s %s:%s (depth %d) ...\n", repoDir, remote, ref, depth)
+	return o.ostreeRun(verbose, "--repo="+repoDir, "pull", "--depth="+strconv.Itoa(depth), remote, ref)
+}
+
 // PullWithRemote runs `ostree pull` assuming that the provided ref is
 // clean from the remote prefix.
 func PullWithRemote(repoDir, remote, ref string, verbose bool) error {
@@ -562,7 +802,7 @@ func Pull(repoDir, ref string, verbose bool) error {
 
 	remote := ExtractRemoteFromRef(ref)
 	if remote == "" {
-		return fmt.Errorf("%v does not contain the remote: prefix (e.g. origin:)", ref)
+		return fmt.Errorf("%v %w (e.g. origin:)", ref, ErrNoRemotePrefix)
 	}
 	ref = CleanRemoteFromRef(ref)
 	return PullWithRemote(repoDir, remote, ref, verbose)
@@ -592,8 +832,9 @@ func Prune(repoDir, ref, keepObjectsYoungerThan string, verbose bool) error {
 }
 
 type Ostree struct {
-	cfg    config.IConfig
-	runner runner.Func
+	cfg       config.IConfig
+	runner    runner.Func
+	runnerCtx runner.FuncCtx
 }
 
 // NewOstree creates a new Ostree instance.
@@ -602,35 +843,56 @@ func NewOstree(cfg config.IConfig) (*Ostree, error) {
 		return nil, errors.New("missing config parameter")
 	}
 	return &Ostree{
-		cfg:    cfg,
-		runner: runCommand,
+		cfg:       cfg,
+		runner:    runCommand,
+		runnerCtx: runCommandCtx,
 	}, nil
 }
 
 // runCmd runs a command via the instance's command runner, adding --verbose
 // and the "ostree" binary name automatically.
-func (o *Ostree) runCmd(stdout, stderr io.Writer, verbose bool, args ...string) error {
+func (o *Ostree) runCmd(stdin io.Reader, stdout, stderr io.Writer, verbose bool, args ...string) error {
+	return o.runCmdContext(context.Background(), stdin, stdout, stderr, verbose, args...)
+}
+
+// runCmdContext is like runCmd, but the command is killed when ctx is done.
+// Contexts that can never be cancelled go through the plain runner, so that
+// callers not using a context behave exactly as before.
+func (o *Ostree) runCmdContext(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, verbose bool, args ...string) error {
 	var finalArgs []string
 	if verbose {
 		finalArgs = append(finalArgs, "--verbose")
 		fmt.Fprintf(stderr, ">> Executing: ostree --verbose %s\n", strings.Join(args, " "))
 	}
 	finalArgs = append(finalArgs, args...)
-	return o.runner(nil, stdout, stderr, "ostree", finalArgs...)
+	if ctx.Done() == nil {
+		return o.runner(stdin, stdout, stderr, "ostree", finalArgs...)
+	}
+	return o.runnerCtx(ctx, stdin, stdout, stderr, "ostree", finalArgs...)
 }
 
 // ostreeRun runs an ostree command with stdout/stderr directed to os.Stdout/os.Stderr.
 func (o *Ostree) ostreeRun(verbose bool, args ...string) error {
-	return o.runCmd(os.Stdout, os.Stderr, verbose, args...)
+	return o.ostreeRunContext(context.Background(), verbose, args...)
+}
+
+// ostreeRunContext is the context-aware variant of ostreeRun.
+func (o *Ostree) ostreeRunContext(ctx context.Context, verbose bool, args ...string) error {
+	return o.runCmdContext(ctx, nil, os.Stdout, os.Stderr, verbose, args...)
 }
 
 // ostreeRunCapture runs an ostree command and captures its stdout.
 func (o *Ostree) ostreeRunCapture(verbose bool, args ...string) (io.Reader, error) {
+	return o.ostreeRunCaptureContext(context.Background(), verbose, args...)
+}
+
+// ostreeRunCaptureContext is the context-aware variant of ostreeRunCapture.
+func (o *Ostree) ostreeRunCaptureContext(ctx context.Context, verbose bool, args ...string) (io.Reader, error) {
 	if verbose {
 		fmt.Fprintf(os.Stderr, ">> Executing: ostree (stdout capture) %s\n", strings.Join(args, " "))
 	}
 	stdo := new(bytes.Buffer)
-	err := o.runCmd(stdo, os.Stderr, false, args...)
+	err := o.runCmdContext(ctx, nil, stdo, os.Stderr, false, args...)
 	return stdo, err
 }
 
@@ -646,16 +908,44 @@ func (o *Ostree) listRemotesFromRepo(repoDir string, verbose bool) ([]string, er
 	return readerToList(stdout)
 }
 
+// remoteURLFromRepo returns the URL of remote using the instance runner.
+func (o *Ostree) remoteURLFromRepo(repoDir, remote string, verbose bool) (string, error) {
+	if repoDir == "" {
+		return "", errors.New("invalid repoDir parameter")
+	}
+	if remote == "" {
+		return "", errors.New("invalid remote parameter")
+	}
+	stdout, err := o.ostreeRunCapture(verbose, "--repo="+repoDir, "remote", "show-url", remote)
+	if err != nil {
+		return "", err
+	}
+	return readerToFirstNonEmptyLine(stdout)
+}
+
 // lastCommitFromRepo returns the last commit for a ref using the instance runner.
 func (o *Ostree) lastCommitFromRepo(repoDir, ref string, verbose bool) (string, error) {
+	return o.lastCommitFromRepoContext(context.Background(), repoDir, ref, verbose)
+}
+
+// lastCommitFromRepoContext is the context-aware variant of lastCommitFromRepo.
+func (o *Ostree) lastCommitFromRepoContext(ctx context.Context, repoDir, ref string, verbose bool) (string, error) {
 	if repoDir == "" {
 		return "", errors.New("invalid repoDir parameter")
 	}
 	if ref == "" {
 		return "", errors.New("invalid ref parameter")
 	}
-	stdout, err := o.ostreeRunCapture(verbose, "rev-parse", "--repo="+repoDir, ref)
+	if verbose {
+		fmt.Fprintf(os.Stderr, ">> Executing: ostree (stdout capture) rev-parse --repo=%s %s\n", repoDir, ref)
+	}
+	stdout := new(bytes.Buffer)
+	var stderr bytes.Buffer
+	err := o.runCmdContext(ctx, nil, stdout, io.MultiWriter(os.Stderr, &stderr), false, "rev-parse", "--repo="+repoDir, ref)
 	if err != nil {
+		if strings.Contains(stderr.String(), "not found") {
+			return "", fmt.Errorf("%w %s: %w", ErrRefNotFound, ref, err)
+		}
 		return "", err
 	}
 	lines, err := readerToList(stdout)
@@ -663,7 +953,7 @@ func (o *Ostree) lastCommitFromRepo(repoDir, ref string, verbose bool) (string,
 		return "", err
 	}
 	if len(lines) == 0 {
-		return "", fmt.Errorf("no commit found for ref %s", ref)
+		return "", fmt.Errorf("%w %s", ErrRefNotFound, ref)
 	}
 	return lines[0], nil
 }
@@ -731,6 +1021,13 @@ func (o *Ostree) addRemote(opts AddRemoteOptions, verbose bool) error {
 	if opts.Sysroot != "" && !directoryExists(opts.Sysroot) {
 		return fmt.Errorf("sysroot %s does not exist", opts.Sysroot)
 	}
+	if err := validateRemoteExtraArgs(opts.ExtraArgs); err != nil {
+		return err
+	}
+	tlsArgs, err := remoteTlsArgs(opts.TlsClientCert, opts.TlsClientKey)
+	if err != nil {
+		return err
+	}
 	args := []string{"remote", "add"}
 	if opts.Sysroot != "" {
 		args = append(args, "--sysroot="+opts.Sysroot)
@@ -740,12 +1037,19 @@ func (o *Ostree) addRemote(opts AddRemoteOptions, verbose bool) error {
 	}
 	args = append(args, "--force")
 	args = append(args, opts.GpgArgs...)
+	args = append(args, tlsArgs...)
+	args = append(args, opts.ExtraArgs...)
 	args = append(args, opts.Remote, opts.RemoteURL)
 	return o.ostreeRun(verbose, args...)
 }
 
 // pullFromRepo pulls an ostree ref using the instance runner.
 func (o *Ostree) pullFromRepo(repoDir, remote, ref string, verbose bool) error {
+	return o.pullFromRepoContext(context.Background(), repoDir, remote, ref, verbose)
+}
+
+// pullFromRepoContext is the context-aware variant of pullFromRepo.
+func (o *Ostree) pullFromRepoContext(ctx context.Context, repoDir, remote, ref string, verbose bool) error {
 	if repoDir == "" {
 		return errors.New("invalid repoDir parameter")
 	}
@@ -756,30 +1060,105 @@ func (o *Ostree) pullFromRepo(repoDir, remote, ref string, verbose bool) error {
 		return errors.New("invalid ref parameter")
 	}
 	fmt.Printf("Pulling ostree from %s %s:%s ...\n", repoDir, remote, ref)
-	return o.ostreeRun(verbose, "--repo="+repoDir, "pull", remote, ref)
+	return o.ostreeRunContext(ctx, verbose, "--repo="+repoDir, "pull", remote, ref)
+}
+
+// pruneOptions holds the configured ostree prune settings.
+type pruneOptions struct {
+	keepObjectsYoungerThan string
+	depth                  int
+	refsOnly               bool
+}
+
+// pruneOptions reads the prune settings from the configuration.
+func (o *Ostree) pruneOptions() (pruneOptions, error) {
+	keepObjectsYoungerThan, err := o.cfg.GetItem("Ostree.KeepObjectsYoungerThan")
+	if err != nil {
+		return pruneOptions{}, err
+	}
+	depth, err := o.PruneDepth()
+	if err != nil {
+		return pruneOptions{}, err
+	}
+	refsOnly, err := o.PruneRefsOnly()
+	if err != nil {
+		return pruneOptions{}, err
+	}
+	return pruneOptions{
+		keepObjectsYoungerThan: keepObjectsYoungerThan,
+		depth:                  depth,
+		refsOnly:               refsOnly,
+	}, nil
 }
 
 // pruneFromRepo prunes an ostree repo using the instance runner.
-func (o *Ostree) pruneFromRepo(repoDir, ref, keepObjectsYoungerThan string, verbose bool) error {
+func (o *Ostree) pruneFromRepo(repoDir, ref string, opts pruneOptions, verbose bool) error {
 	if repoDir == "" {
 		return errors.New("invalid repoDir parameter")
 	}
 	if ref == "" {
 		return errors.New("invalid ref parameter")
 	}
-	if keepObjectsYoungerThan == "" {
+	if opts.keepObjectsYoungerThan == "" {
 		return errors.New("invalid keepObjectsYoungerThan parameter")
 	}
 	fmt.Printf("Pruning ostree repo for %s ...\n", repoDir)
-	return o.ostreeRun(verbose,
-		"--repo="+repoDir, "prune",
-		"--depth=5",
-		"--refs-only",
-		"--keep-younger-than="+keepObjectsYoungerThan,
+	return o.ostreeRun(verbose, pruneArgs(repoDir, ref, opts)...)
+}
+
+// pruneArgs returns the ostree prune arguments shared by Prune and
+// PrunePreview.
+func pruneArgs(repoDir, ref string, opts pruneOptions) []string {
+	args := []string{
+		"--repo=" + repoDir, "prune",
+		"--depth=" + strconv.Itoa(opts.depth),
+	}
+	if opts.refsOnly {
+		args = append(args, "--refs-only")
+	}
+	return append(args,
+		"--keep-younger-than="+opts.keepObjectsYoungerThan,
 		"--only-branch="+ref,
 	)
 }
 
+// defaultPruneDepth is the prune depth used when Ostree.PruneDepth is unset.
+const defaultPruneDepth = 5
+
+// PruneDepth returns the number of parent commits that prune keeps for each
+// ref (-1 keeps the full history). It defaults to 5 when unset.
+func (o *Ostree) PruneDepth() (int, error) {
+	v, err := o.cfg.GetItem("Ostree.PruneDepth")
+	if err != nil {
+		return 0, err
+	}
+	if v == "" {
+		return defaultPruneDepth, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < -1 {
+		return 0, fmt.Errorf("invalid Ostree.PruneDepth %q", v)
+	}
+	return n, nil
+}
+
+// PruneRefsOnly returns whether prune only considers the objects reachable
+// from refs (--refs-only). It defaults to true when unset.
+func (o *Ostree) PruneRefsOnly() (bool, error) {
+	v, err := o.cfg.GetItem("Ostree.PruneRefsOnly")
+	if err != nil {
+		return false, err
+	}
+	if v == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid Ostree.PruneRefsOnly %q", v)
+	}
+	return b, nil
+}
+
 func (o *Ostree) FullBranchSuffix() (string, error) {
 	suffix, err := o.cfg.GetItem("Ostree.FullBranchSuffix")
 	if err != nil {
@@ -817,6 +1196,9 @@ func (o *Ostree) BranchShortnameToFull(shortName, relStage, osName, arch string)
 	if arch == "" {
 		return "", errors.New("invalid arch parameter")
 	}
+	if err := validateReleaseStage(relStage); err != nil {
+		return "", err
+	}
 
 	suffixed, err := o.IsBranchFullSuffixed(shortName)
 	if err != nil {
@@ -877,14 +1259,37 @@ func (o *Ostree) RemoveFullFromBranch(ref string) (string, error) {
 	return strings.TrimSuffix(ref, "-"+suffix), nil
 }
 
+// RefToShortName is the reverse of BranchShortnameToFull: it turns a ref such as
+// origin:matrixos/amd64/dev/gnome-full into its short name (gnome). The ref must
+// belong to osName/arch.
+func (o *Ostree) RefToShortName(ref, osName, arch string) (string, error) {
+	_, name, err := ParseNormalBranch(ref, osName, arch)
+	if err != nil {
+		return "", err
+	}
+	name, err = o.RemoveFullFromBranch(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(name), nil
+}
+
 func run(stdout, stderr io.Writer, verbose bool, args ...string) error {
+	return runContext(context.Background(), stdout, stderr, verbose, args...)
+}
+
+// runContext is like run, but the ostree process is killed when ctx is done.
+func runContext(ctx context.Context, stdout, stderr io.Writer, verbose bool, args ...string) error {
 	var finalArgs []string
 	if verbose {
 		finalArgs = append(finalArgs, "--verbose")
 		fmt.Fprintf(stderr, ">> Executing: ostree --verbose %s\n", strings.Join(args, " "))
 	}
 	finalArgs = append(finalArgs, args...)
-	return runCommand(nil, stdout, stderr, "ostree", finalArgs...)
+	if ctx.Done() == nil {
+		return runCommand(nil, stdout, stderr, "ostree", finalArgs...)
+	}
+	return runCommandCtx(ctx, nil, stdout, stderr, "ostree", finalArgs...)
 }
 
 // Run runs an ostree command with --verbose if requested.
@@ -895,11 +1300,30 @@ var Run = func(verbose bool, args ...string) error {
 // RunWithStdoutCapture runs an ostree command and captures its stdout,
 // with --verbose if requested.
 var RunWithStdoutCapture = func(verbose bool, args ...string) (io.Reader, error) {
+	return RunWithStdoutCaptureTimeout(0, verbose, args...)
+}
+
+// RunWithStdoutCaptureTimeout is like RunWithStdoutCapture, but kills the
+// ostree process if it does not complete within d. The returned error then
+// wraps context.DeadlineExceeded. A d <= 0 means no timeout.
+func RunWithStdoutCaptureTimeout(d time.Duration, verbose bool, args ...string) (io.Reader, error) {
 	if verbose {
 		fmt.Fprintf(os.Stderr, ">> Executing: ostree (stdout capture) %s\n", strings.Join(args, " "))
 	}
+	ctx := context.Background()
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
 	stdo := new(bytes.Buffer)
-	err := run(stdo, os.Stderr, false /* do not run ostree with verbose! */, args...)
+	err := runContext(ctx, stdo, os.Stderr, false /* do not run ostree with verbose! */, args...)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w (%v)", context.DeadlineExceeded, err)
+		}
+		return stdo, fmt.Errorf("ostree %s timed out after %v: %w", strings.Join(args, " "), d, err)
+	}
 	return stdo, err
 }
 
@@ -919,6 +1343,11 @@ func CollectionIDArgs(collectionID string) ([]string, error) {
 var pathExists = fslib.PathExists
 var fileExists = fslib.FileExists
 var directoryExists = fslib.DirectoryExists
+var listLocalContents = fslib.ListContents
+
+// liveEtcDir is the live /etc used when applying /etc changes. Tests point
+// it at a temp tree.
+var liveEtcDir = "/etc"
 
 // GpgEnabled returns whether GPG signing and verification is enabled.
 func (o *Ostree) GpgEnabled() (bool, error) {
@@ -964,89 +1393,97 @@ func (o *Ostree) GpgOfficialPubKeyPath() (string, error) {
 	return pk, nil
 }
 
-// OsName returns the name of the OS as defined in the config.
-func (o *Ostree) OsName() (string, error) {
-	name, err := o.cfg.GetItem("matrixOS.OsName")
+// requiredItem returns the value of the config item key, failing with an
+// error wrapping ErrEmptyConfigItem if it is empty.
+func (o *Ostree) requiredItem(key string) (string, error) {
+	value, err := o.cfg.GetItem(key)
 	if err != nil {
 		return "", err
 	}
-	if name == "" {
-		return "", errors.New("invalid matrixOS.OsName")
+	if value == "" {
+		return "", fmt.Errorf("invalid %s: %w", key, ErrEmptyConfigItem)
 	}
-	return name, nil
+	return value, nil
+}
+
+// OsName returns the name of the OS as defined in the config.
+func (o *Ostree) OsName() (string, error) {
+	return o.requiredItem("matrixOS.OsName")
 }
 
 // Arch returns the build architecture as defined in the config.
 func (o *Ostree) Arch() (string, error) {
-	arch, err := o.cfg.GetItem("matrixOS.Arch")
-	if err != nil {
-		return "", err
-	}
-	if arch == "" {
-		return "", errors.New("invalid matrixOS.Arch")
-	}
-	return arch, nil
+	return o.requiredItem("matrixOS.Arch")
 }
 
 // RepoDir returns the path to the ostree repository.
 func (o *Ostree) RepoDir() (string, error) {
-	repoDir, err := o.cfg.GetItem("Ostree.RepoDir")
-	if err != nil {
-		return "", err
-	}
-	if repoDir == "" {
-		return "", errors.New("invalid Ostree.RepoDir")
+	repoDir, err := o.requiredItem("Ostree.RepoDir")
+	if errors.Is(err, ErrEmptyConfigItem) {
+		return "", fmt.Errorf("%w: %w", ErrRepoDirMissing, ErrEmptyConfigItem)
 	}
-	return repoDir, nil
+	return repoDir, err
 }
 
 // Sysroot returns the path to the ostree sysroot directory. Usually /sysroot.
 func (o *Ostree) Sysroot() (string, error) {
-	sysroot, err := o.cfg.GetItem("Ostree.Sysroot")
-	if err != nil {
-		return "", err
-	}
-	if sysroot == "" {
-		return "", errors.New("invalid Ostree.Sysroot")
-	}
-	return sysroot, nil
+	return o.requiredItem("Ostree.Sysroot")
 }
 
 // Root returns the path to the root filesystem directory used as root for
 // ostree operations (i.e. --sysroot).
 func (o *Ostree) Root() (string, error) {
-	root, err := o.cfg.GetItem("Ostree.Root")
-	if err != nil {
-		return "", err
-	}
-	if root == "" {
-		return "", errors.New("invalid Ostree.Root")
-	}
-	return root, nil
+	return o.requiredItem("Ostree.Root")
 }
 
 // Remote returns the name of the remote.
 func (o *Ostree) Remote() (string, error) {
-	remote, err := o.cfg.GetItem("Ostree.Remote")
+	return o.requiredItem("Ostree.Remote")
+}
+
+// RemoteURL returns the URL of the remote.
+func (o *Ostree) RemoteURL() (string, error) {
+	return o.requiredItem("Ostree.RemoteUrl")
+}
+
+// RemoteExtraArgs returns the extra "ostree remote add" options configured in
+// Ostree.RemoteExtraArgs, split on whitespace. It is empty when unset.
+func (o *Ostree) RemoteExtraArgs() ([]string, error) {
+	v, err := o.cfg.GetItem("Ostree.RemoteExtraArgs")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if remote == "" {
-		return "", errors.New("invalid Ostree.Remote")
+	args := strings.Fields(v)
+	if err := validateRemoteExtraArgs(args); err != nil {
+		return nil, fmt.Errorf("invalid Ostree.RemoteExtraArgs: %w", err)
 	}
-	return remote, nil
+	return args, nil
 }
 
-// RemoteURL returns the URL of the remote.
-func (o *Ostree) RemoteURL() (string, error) {
-	url, err := o.cfg.GetItem("Ostree.RemoteUrl")
+// TlsClientCert returns the path to the TLS client certificate used to
+// authenticate against the remote, or an empty string when unset.
+func (o *Ostree) TlsClientCert() (string, error) {
+	return o.cfg.GetItem("Ostree.TlsClientCert")
+}
+
+// TlsClientKey returns the path to the private key of TlsClientCert, or an
+// empty string when unset.
+func (o *Ostree) TlsClientKey() (string, error) {
+	return o.cfg.GetItem("Ostree.TlsClientKey")
+}
+
+// remoteTlsArgs returns the TLS client authentication options for the
+// configured remote.
+func (o *Ostree) remoteTlsArgs() ([]string, error) {
+	cert, err := o.TlsClientCert()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if url == "" {
-		return "", errors.New("invalid Ostree.RemoteUrl")
+	key, err := o.TlsClientKey()
+	if err != nil {
+		return nil, err
 	}
-	return url, nil
+	return remoteTlsArgs(cert, key)
 }
 
 // AvailableGpgPubKeyPaths returns the list of available (file exists)
@@ -1108,15 +1545,15 @@ func (o *Ostree) ClientSideGpgArgs() ([]string, error) {
 
 // SetupEtc moves the /etc directory to /usr/etc.
 func (o *Ostree) SetupEtc(imageDir string) error {
-	fmt.Println("Setting up /etc...")
-	etcDir := filepath.Join(imageDir, "etc")
-	usrEtcDir := filepath.Join(imageDir, "usr", "etc")
-
-	fmt.Printf("Moving %s to %s\n", etcDir, usrEtcDir)
-	return os.Rename(etcDir, usrEtcDir)
+	return setupEtc(newHierarchyFs(imageDir, false))
 }
 
-// BootCommit returns the boot commit from an ostree sysroot.
+// BootCommit returns the boot commit from an ostree sysroot, i.e. the name
+// of the single directory in ostree/boot.1/<OsName>. The directory must
+// belong to one of the sysroot deployments: ostree links its entries
+// (ostree/boot.1/<OsName>/<bootcsum>/<serial>) to the deployment dirs
+// (ostree/deploy/<OsName>/deploy/<checksum>.<serial>), and the checksum
+// must be the one of a deployment listed by ostree admin status.
 func (o *Ostree) BootCommit(sysroot string) (string, error) {
 	osName, err := o.OsName()
 	if err != nil {
@@ -1127,10 +1564,44 @@ func (o *Ostree) BootCommit(sysroot string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if len(files) == 0 {
+	var bootDirs []string
+	for _, f := range files {
+		if f.IsDir() {
+			bootDirs = append(bootDirs, f.Name())
+		}
+	}
+	switch len(bootDirs) {
+	case 0:
 		return "", fmt.Errorf("no commit found in %s", bootPrefix)
+	case 1:
+	default:
+		return "", fmt.Errorf("ambiguous boot commit, multiple boot directories in %s: %s",
+			bootPrefix, strings.Join(bootDirs, ", "))
+	}
+	bootCommit := bootDirs[0]
+
+	deployments, err := o.listDeploymentsFromSysroot(sysroot, false)
+	if err != nil {
+		return "", err
+	}
+	bootDir := filepath.Join(bootPrefix, bootCommit)
+	entries, err := os.ReadDir(bootDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(bootDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		checksum, _, _ := strings.Cut(filepath.Base(target), ".")
+		for _, d := range deployments {
+			if d.Checksum == checksum {
+				return bootCommit, nil
+			}
+		}
 	}
-	return files[0].Name(), nil
+	return "", fmt.Errorf("boot directory %s does not match any deployment", bootDir)
 }
 
 // ListRemotes lists all the remote refs in the configuration's ostree repository.
@@ -1151,6 +1622,42 @@ func (o *Ostree) LastCommit(ref string, verbose bool) (string, error) {
 	return o.lastCommitFromRepo(repoDir, ref, verbose)
 }
 
+// VerifyCommitSignature verifies the GPG signature of the commit ref points
+// to, using the keys imported for the configured remote. It returns nil only
+// if the commit carries a valid signature.
+func (o *Ostree) VerifyCommitSignature(ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	gpgEnabled, err := o.GpgEnabled()
+	if err != nil {
+		return err
+	}
+	if !gpgEnabled {
+		return fmt.Errorf("GPG is disabled (Ostree.Gpg=false), cannot verify the signature of %s", ref)
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote, err := o.Remote()
+	if err != nil {
+		return err
+	}
+
+	commit, err := o.lastCommitFromRepo(repoDir, ref, verbose)
+	if err != nil {
+		return fmt.Errorf("failed to resolve commit for %s: %w", ref, err)
+	}
+
+	fmt.Printf("Verifying GPG signature of %s (%s) ...\n", ref, commit)
+	err = o.ostreeRun(verbose, "show", "--repo="+repoDir, "--gpg-verify-remote="+remote, commit)
+	if err != nil {
+		return fmt.Errorf("GPG signature verification failed for %s (%s): %w", ref, commit, err)
+	}
+	return nil
+}
+
 func (o *Ostree) getDevGpgHomedir() (string, error) {
 	dir, err := o.cfg.GetItem("Ostree.DevGpgHomedir")
 	if err != nil {
@@ -1176,16 +1683,64 @@ func (o *Ostree) GpgHomeDir() (string, error) {
 
 // GpgKeyID returns the GPG key ID to use for signing.
 func (o *Ostree) GpgKeyID() (string, error) {
-	homeDir, err := o.GpgHomeDir()
+	fields, err := o.gpgPubKeyFields()
 	if err != nil {
 		return "", err
 	}
-	pubkeyPath, err := o.GpgBestPubKeyPath()
-	if err != nil {
-		return "", err
+
+	var keyID string
+	if len(fields) >= 5 {
+		keyID = strings.TrimSpace(fields[4])
+	}
+	if keyID == "" {
+		return keyID, errors.New("cannot find gpg ostree key id.")
 	}
+	return keyID, nil
+}
 
-	out := new(bytes.Buffer)
+// GpgKeyExpiry returns the expiration time of the signing key and whether it
+// has already expired. Keys without an expiration date return a zero time
+// and false.
+func (o *Ostree) GpgKeyExpiry() (time.Time, bool, error) {
+	fields, err := o.gpgPubKeyFields()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if fields == nil {
+		return time.Time{}, false, errors.New("cannot find gpg ostree key.")
+	}
+	return parseGpgKeyExpiry(fields, time.Now())
+}
+
+// parseGpgKeyExpiry extracts the expiration date (field 7) from the fields
+// of a `pub` colon-delimited gpg line and compares it against now.
+func parseGpgKeyExpiry(fields []string, now time.Time) (time.Time, bool, error) {
+	if len(fields) < 7 || strings.TrimSpace(fields[6]) == "" {
+		return time.Time{}, false, nil
+	}
+	// gpg prints the expiration date as seconds since the epoch.
+	secs, err := strconv.ParseInt(strings.TrimSpace(fields[6]), 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid gpg key expiration date %q: %w", fields[6], err)
+	}
+	expiry := time.Unix(secs, 0)
+	return expiry, !now.Before(expiry), nil
+}
+
+// gpgPubKeyFields returns the colon-delimited fields of the `pub` line
+// printed by `gpg --show-keys --with-colons` for the best public key, or nil
+// if gpg printed no such line.
+func (o *Ostree) gpgPubKeyFields() ([]string, error) {
+	homeDir, err := o.GpgHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	pubkeyPath, err := o.GpgBestPubKeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
 	err = o.runner(
 		nil,
 		out,
@@ -1200,10 +1755,10 @@ func (o *Ostree) GpgKeyID() (string, error) {
 		pubkeyPath,
 	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var keyID string
+	var fields []string
 	scanner := bufio.NewScanner(out)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -1213,20 +1768,15 @@ func (o *Ostree) GpgKeyID() (string, error) {
 
 		parts := strings.Split(line, ":")
 		if len(parts) >= 5 {
-			keyID = strings.TrimSpace(parts[4])
+			fields = parts
 			break
 		}
 	}
 
-	err = scanner.Err()
-	if err != nil {
-		return "", err
-	}
-
-	if keyID == "" {
-		return keyID, errors.New("cannot find gpg ostree key id.")
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	return keyID, nil
+	return fields, nil
 }
 
 // ImportGpgKey imports a GPG key into the GPG homedir.
@@ -1296,6 +1846,50 @@ func (o *Ostree) GpgSignFile(file string) error {
 	return nil
 }
 
+// GpgExportPublicKey writes the ASCII armored public key of the signing key
+// to outPath, so that it can be published next to the release artifacts.
+func (o *Ostree) GpgExportPublicKey(outPath string) error {
+	if outPath == "" {
+		return errors.New("missing outPath parameter")
+	}
+
+	homeDir, err := o.GpgHomeDir()
+	if err != nil {
+		return err
+	}
+	keyID, err := o.GpgKeyID()
+	if err != nil {
+		return err
+	}
+
+	out := new(bytes.Buffer)
+	err = o.runner(
+		nil,
+		out,
+		os.Stderr,
+		"gpg",
+		"--homedir", homeDir,
+		"--armor",
+		"--export", keyID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to export gpg key %s: %w", keyID, err)
+	}
+	if out.Len() == 0 {
+		return fmt.Errorf("gpg exported no public key for %s", keyID)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(outPath, out.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("GPG public key %s exported to %v.\n", keyID, outPath)
+	return nil
+}
+
 // GpgKeys returns the list of GPG key paths used for signing and verification.
 // The list contains the private key, the best available public key, and
 // (if different) the official public key.
@@ -1334,16 +1928,8 @@ func (o *Ostree) InitializeSigningGpg(verbose bool) error {
 	}
 
 	fmt.Println("Signing GPG signing enabled.")
-	for _, key := range keys {
-		if !fileExists(key) {
-			fmt.Fprintf(os.Stderr, "WARNING: Signing GPG key %s not present, skipping import ...\n", key)
-			continue
-		}
-		if err := o.ImportGpgKey(key); err != nil {
-			return fmt.Errorf("failed to import gpg key %s: %w", key, err)
-		}
-	}
-	return nil
+	_, err = o.importGpgKeysLocal(keys)
+	return err
 }
 
 // InitializeRemoteSigningGpg imports GPG keys into the remote ostree repository.
@@ -1366,10 +1952,74 @@ func (o *Ostree) InitializeRemoteSigningGpg(remote, repoDir string, verbose bool
 			fmt.Fprintf(os.Stderr, "WARNING: Remote signing GPG key %s not present, skipping import ...\n", key)
 			continue
 		}
-		err := o.ostreeRun(verbose, "--repo="+repoDir, "remote", "gpg-import", remote, "-k", key)
-		if err != nil {
-			return fmt.Errorf("failed to import gpg key %s to remote %s: %w", key, remote, err)
+		if err := o.importRemoteGpgKey(remote, repoDir, key, verbose); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportGpgKeys imports keyPaths into the local GPG keyring with a single
+// gpg invocation, then into the configured remote of the configured repo.
+// Missing key files are skipped with a warning.
+func (o *Ostree) ImportGpgKeys(keyPaths []string) error {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote, err := o.Remote()
+	if err != nil {
+		return err
+	}
+
+	imported, err := o.importGpgKeysLocal(keyPaths)
+	if err != nil {
+		return err
+	}
+	for _, key := range imported {
+		if err := o.importRemoteGpgKey(remote, repoDir, key, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importGpgKeysLocal imports the existing keyPaths into the local GPG keyring
+// with a single `gpg --import` call and returns the imported paths.
+func (o *Ostree) importGpgKeysLocal(keyPaths []string) ([]string, error) {
+	var keys []string
+	for _, key := range keyPaths {
+		if !fileExists(key) {
+			fmt.Fprintf(os.Stderr, "WARNING: Signing GPG key %s not present, skipping import ...\n", key)
+			continue
 		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	homeDir, err := o.GpgHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"--homedir", homeDir,
+		"--batch", "--yes",
+		"--import",
+	}
+	args = append(args, keys...)
+	if err := o.runner(nil, os.Stdout, os.Stderr, "gpg", args...); err != nil {
+		return nil, fmt.Errorf("failed to import gpg keys %s: %w", strings.Join(keys, ", "), err)
+	}
+	return keys, nil
+}
+
+// importRemoteGpgKey imports key into the trusted keys of remote in repoDir.
+func (o *Ostree) importRemoteGpgKey(remote, repoDir, key string, verbose bool) error {
+	err := o.ostreeRun(verbose, "--repo="+repoDir, "remote", "gpg-import", remote, "-k", key)
+	if err != nil {
+		return fmt.Errorf("failed to import gpg key %s to remote %s: %w", key, remote, err)
 	}
 	return nil
 }
@@ -1441,17 +2091,46 @@ func (o *Ostree) MaybeInitializeRemote(verbose bool) error {
 	if err != nil {
 		return err
 	}
+	tlsArgs, err := o.remoteTlsArgs()
+	if err != nil {
+		return err
+	}
 	remoteFound := slices.Contains(remotes, remote)
 	if remoteFound {
-		fmt.Printf("Remote %v already exists, reusing ...\n", remote)
+		currentURL, err := o.remoteURLFromRepo(repoDir, remote, verbose)
+		if err != nil {
+			return err
+		}
+		if currentURL == remoteURL {
+			fmt.Printf("Remote %v already exists, reusing ...\n", remote)
+		} else {
+			fmt.Printf("Remote %v URL changed from %v to %v, updating ...\n", remote, currentURL, remoteURL)
+			err := o.remoteSetURLInRepo(repoDir, remote, remoteURL, verbose)
+			if err != nil {
+				return err
+			}
+		}
+		if len(tlsArgs) > 0 {
+			fmt.Printf("Updating TLS client authentication of remote %v ...\n", remote)
+			err := o.remoteSetOptionsInRepo(repoDir, remote, tlsArgs, verbose)
+			if err != nil {
+				return err
+			}
+		}
 	} else {
 		fmt.Printf("Initializing remote %v at %v ...\n", remote, repoDir)
 		gpgArgs, err := o.ClientSideGpgArgs()
 		if err != nil {
 			return err
 		}
+		extraArgs, err := o.RemoteExtraArgs()
+		if err != nil {
+			return err
+		}
 		args := []string{"--repo=" + repoDir, "remote", "add"}
 		args = append(args, gpgArgs...)
+		args = append(args, tlsArgs...)
+		args = append(args, extraArgs...)
 		args = append(args, remote, remoteURL)
 		err = o.ostreeRun(verbose, args...)
 		if err != nil {
@@ -1466,8 +2145,13 @@ func (o *Ostree) MaybeInitializeRemote(verbose bool) error {
 
 // Pull pulls an ostree ref from a remote.
 func (o *Ostree) Pull(ref string, verbose bool) error {
-	if ref == "" {
-		return errors.New("invalid ref parameter")
+	return o.PullContext(context.Background(), ref, verbose)
+}
+
+// PullContext is like Pull, but the ostree process is killed when ctx is done.
+func (o *Ostree) PullContext(ctx context.Context, ref string, verbose bool) error {
+	if err := ValidateRefFormat(ref); err != nil {
+		return err
 	}
 	repoDir, err := o.RepoDir()
 	if err != nil {
@@ -1475,10 +2159,10 @@ func (o *Ostree) Pull(ref string, verbose bool) error {
 	}
 	remote := ExtractRemoteFromRef(ref)
 	if remote == "" {
-		return fmt.Errorf("%v does not contain the remote: prefix (e.g. origin:)", ref)
+		return fmt.Errorf("%v %w (e.g. origin:)", ref, ErrNoRemotePrefix)
 	}
 	ref = CleanRemoteFromRef(ref)
-	return o.pullFromRepo(repoDir, remote, ref, verbose)
+	return o.pullFromRepoContext(ctx, repoDir, remote, ref, verbose)
 }
 
 // PullWithRemote runs `ostree pull` assuming that the provided ref is
@@ -1497,90 +2181,482 @@ func (o *Ostree) PullWithRemote(remote, ref string, verbose bool) error {
 	return o.pullFromRepo(repoDir, remote, ref, verbose)
 }
 
-// GpgArgs returns the gpg arguments for ostree commands.
-func (o *Ostree) GpgArgs() ([]string, error) {
-	gpgEnabled, err := o.GpgEnabled()
+// MirrorRemote pulls every ref advertised by the configured remote into the
+// local repository. A failing ref does not stop the mirror: all the errors
+// are returned together once every ref has been attempted.
+func (o *Ostree) MirrorRemote(verbose bool) error {
+	repoDir, err := o.RepoDir()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !gpgEnabled {
-		return nil, nil
+	remote, err := o.Remote()
+	if err != nil {
+		return err
 	}
-
-	keyID, err := o.GpgKeyID()
+	refs, err := o.RemoteRefs(verbose)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to list refs of remote %s: %w", remote, err)
 	}
 
-	homeDir, err := o.GpgHomeDir()
+	var errs []error
+	for _, ref := range refs {
+		ref = CleanRemoteFromRef(ref)
+		if err := o.pullFromRepo(repoDir, remote, ref, verbose); err != nil {
+			errs = append(errs, fmt.Errorf("failed to mirror %s:%s: %w", remote, ref, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PullProgress is a snapshot of the progress of an ostree pull, as parsed
+// from the progress lines ostree prints on stderr.
+type PullProgress struct {
+	Percent          int    // Overall completion percentage (0-100)
+	ObjectsFetched   int    // Number of objects fetched so far
+	ObjectsTotal     int    // Total number of objects to fetch
+	BytesTransferred uint64 // Bytes transferred so far
+}
+
+// pullProgressRe matches ostree pull progress lines such as:
+//
+//	Receiving objects: 45% (1234/2740) 12.3 MB/s 56.7 MB
+var pullProgressRe = regexp.MustCompile(
+	`Receiving objects: (\d+)% \((\d+)/(\d+)\)(?: +[\d.]+ [kMGT]?B/s)?(?: +([\d.]+ [kMGT]?B))?`)
+
+// sizeUnits maps the GLib SI size suffixes to their multiplier.
+var sizeUnits = map[string]float64{
+	"byte":  1,
+	"bytes": 1,
+	"B":     1,
+	"kB":    1e3,
+	"MB":    1e6,
+	"GB":    1e9,
+	"TB":    1e12,
+}
+
+// parseSize parses a size such as "56.7 MB" into a number of bytes.
+func parseSize(size string) (uint64, error) {
+	value, unit, ok := strings.Cut(size, " ")
+	if !ok {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit: %s", unit)
+	}
+	v, err := strconv.ParseFloat(value, 64)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("invalid size: %s: %w", size, err)
 	}
+	return uint64(v * mult), nil
+}
 
-	return []string{
-		"--gpg-sign=" + keyID,
-		"--gpg-homedir=" + homeDir,
-	}, nil
+// parsePullProgressLine parses a single ostree pull progress line. It returns
+// false if the line is not a progress line.
+func parsePullProgressLine(line string) (PullProgress, bool) {
+	m := pullProgressRe.FindStringSubmatch(line)
+	if m == nil {
+		return PullProgress{}, false
+	}
+	var p PullProgress
+	p.Percent, _ = strconv.Atoi(m[1])
+	p.ObjectsFetched, _ = strconv.Atoi(m[2])
+	p.ObjectsTotal, _ = strconv.Atoi(m[3])
+	if m[4] != "" {
+		p.BytesTransferred, _ = parseSize(m[4])
+	}
+	return p, true
 }
 
-// Prune prunes the ostree repo for the given ref.
-func (o *Ostree) Prune(ref string, verbose bool) error {
+// PullWithProgress is like Pull, but calls onProgress every time ostree
+// reports progress. Lines that are not progress lines are ignored.
+func (o *Ostree) PullWithProgress(ref string, onProgress func(PullProgress), verbose bool) error {
 	if ref == "" {
 		return errors.New("invalid ref parameter")
 	}
+	if onProgress == nil {
+		return errors.New("missing onProgress parameter")
+	}
 	repoDir, err := o.RepoDir()
 	if err != nil {
 		return err
 	}
-	keepObjectsYoungerThan, err := o.cfg.GetItem("Ostree.KeepObjectsYoungerThan")
+	remote := ExtractRemoteFromRef(ref)
+	if remote == "" {
+		return fmt.Errorf("%v %w (e.g. origin:)", ref, ErrNoRemotePrefix)
+	}
+	ref = CleanRemoteFromRef(ref)
+
+	pw := &runner.LineWriter{Out: os.Stderr, OnLine: func(line string) {
+		if progress, ok := parsePullProgressLine(line); ok {
+			onProgress(progress)
+		}
+	}}
+	fmt.Printf("Pulling ostree from %s %s:%s ...\n", repoDir, remote, ref)
+	err = o.runCmd(nil, os.Stdout, pw, verbose, "--repo="+repoDir, "pull", remote, ref)
+	pw.Flush()
+	return err
+}
+
+// Fsck runs `ostree fsck` to check the integrity of the repository.
+func (o *Ostree) Fsck(verbose bool) error {
+	return o.fsck(nil, verbose)
+}
+
+// FsckWithDelta is like Fsck, but also deletes corrupted objects
+// (`ostree fsck --delete`), so that they can be fetched again.
+func (o *Ostree) FsckWithDelta(verbose bool) error {
+	return o.fsck([]string{"--delete"}, verbose)
+}
+
+func (o *Ostree) fsck(extraArgs []string, verbose bool) error {
+	repoDir, err := o.RepoDir()
 	if err != nil {
 		return err
 	}
-	return o.pruneFromRepo(repoDir, ref, keepObjectsYoungerThan, verbose)
+	args := append([]string{"fsck", "--repo=" + repoDir}, extraArgs...)
+	fmt.Printf("Checking integrity of %s ...\n", repoDir)
+	if err := o.ostreeRun(verbose, args...); err != nil {
+		return fmt.Errorf("ostree fsck failed for %s: %w", repoDir, err)
+	}
+	return nil
 }
 
-// GenerateStaticDelta generates a static delta for an ostree repository.
-func (o *Ostree) GenerateStaticDelta(ref string, verbose bool) error {
+// CommitComplete returns whether all the objects of commit are present in
+// the repository. A commit is incomplete if ostree still has it marked as
+// partial, or if walking its tree (`ostree ls -R`) fails on a missing or
+// unreadable object. Failures to run ostree at all are returned as errors.
+func (o *Ostree) CommitComplete(commit string, verbose bool) (bool, error) {
+	if commit == "" {
+		return false, errors.New("invalid commit parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return false, err
+	}
+
+	partialMarker := filepath.Join(repoDir, "state", commit+".commitpartial")
+	if fileExists(partialMarker) {
+		fmt.Fprintf(os.Stderr, "Commit %s is partial.\n", commit)
+		return false, nil
+	}
+	err = o.runCmd(nil, io.Discard, os.Stderr, verbose, "--repo="+repoDir, "ls", "-R", commit)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "Commit %s has missing or corrupted objects: %v\n", commit, err)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to verify commit %s: %w", commit, err)
+	}
+	return true, nil
+}
+
+// PullVerified runs `ostree pull` like Pull does, then verifies that the
+// pulled commit is complete. If it is not, the pull is retried once.
+func (o *Ostree) PullVerified(ref string, verbose bool) error {
 	if ref == "" {
 		return errors.New("invalid ref parameter")
 	}
-
 	repoDir, err := o.RepoDir()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Generating static delta for %s and ref %s ...\n", repoDir, ref)
+	const attempts = 2
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := o.Pull(ref, verbose); err != nil {
+			return err
+		}
+		commit, err := o.lastCommitFromRepo(repoDir, ref, verbose)
+		if err != nil {
+			return fmt.Errorf("failed to resolve pulled commit for %s: %w", ref, err)
+		}
+		complete, err := o.CommitComplete(commit, verbose)
+		if err != nil {
+			return err
+		}
+		if complete {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Pulled commit %s for %s is incomplete (attempt %d/%d).\n",
+			commit, ref, attempt, attempts)
+	}
+	return fmt.Errorf("commit for %s is still incomplete after %d pull attempts", ref, attempts)
+}
 
-	stdout, err := o.ostreeRunCapture(
-		verbose,
-		"--repo="+repoDir,
-		"rev-parse",
-		ref,
-	)
-	if err != nil {
+// PullRetry runs Pull up to attempts times, waiting baseDelay before the
+// first retry and doubling the delay after each failed attempt. The ref is
+// validated once upfront, so that a malformed ref is not retried.
+func (o *Ostree) PullRetry(ref string, attempts int, baseDelay time.Duration, verbose bool) error {
+	if attempts < 1 {
+		return fmt.Errorf("invalid attempts parameter: %d", attempts)
+	}
+	if baseDelay < 0 {
+		return fmt.Errorf("invalid baseDelay parameter: %v", baseDelay)
+	}
+	if err := ValidateRefFormat(ref); err != nil {
 		return err
 	}
+	if ExtractRemoteFromRef(ref) == "" {
+		return fmt.Errorf("%v %w (e.g. origin:)", ref, ErrNoRemotePrefix)
+	}
 
-	revNew, err := readerToFirstNonEmptyLine(stdout)
-	if err != nil {
-		return err
+	delay := baseDelay
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = o.Pull(ref, verbose); err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Pull of %s failed (attempt %d/%d): %v. Retrying in %v ...\n",
+			ref, attempt, attempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
+	return fmt.Errorf("pull of %s failed after %d attempts: %w", ref, attempts, err)
+}
 
-	stdout, err = o.ostreeRunCapture(
-		verbose,
-		"--repo="+repoDir,
-		"rev-parse",
-		ref+"^",
-	)
+// GpgArgs returns the gpg arguments for ostree commands.
+func (o *Ostree) GpgArgs() ([]string, error) {
+	gpgEnabled, err := o.GpgEnabled()
 	if err != nil {
-		// This is not a fatal error, the branch might not have a previous commit.
+		return nil, err
+	}
+	if !gpgEnabled {
+		return nil, nil
 	}
-	revOld, _ := readerToFirstNonEmptyLine(stdout)
 
-	if revOld != "" {
-		err := o.runCmd(
-			io.Discard,
+	keyID, err := o.GpgKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	homeDir, err := o.GpgHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		"--gpg-sign=" + keyID,
+		"--gpg-homedir=" + homeDir,
+	}, nil
+}
+
+// Commit runs `ostree commit` to commit the content of dir to branch, signing
+// it when GPG is enabled. It returns the checksum of the new commit.
+func (o *Ostree) Commit(branch, subject, dir string, verbose bool) (string, error) {
+	if branch == "" {
+		return "", errors.New("missing branch parameter")
+	}
+	if subject == "" {
+		return "", errors.New("missing subject parameter")
+	}
+	if dir == "" {
+		return "", errors.New("missing dir parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return "", err
+	}
+	gpgArgs, err := o.GpgArgs()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{
+		"commit",
+		"--repo=" + repoDir,
+		"--branch=" + branch,
+		"--subject=" + subject,
+	}
+	args = append(args, gpgArgs...)
+	args = append(args, dir)
+
+	fmt.Printf("Committing %s to %s:%s ...\n", dir, repoDir, branch)
+	stdout, err := o.ostreeRunCapture(verbose, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to commit %s to %s: %w", dir, branch, err)
+	}
+	lines, err := readerToList(stdout)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no commit hash returned for %s", branch)
+	}
+	return lines[len(lines)-1], nil
+}
+
+// Prune prunes the ostree repo for the given ref.
+func (o *Ostree) Prune(ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	opts, err := o.pruneOptions()
+	if err != nil {
+		return err
+	}
+	return o.pruneFromRepo(repoDir, ref, opts, verbose)
+}
+
+// PruneInRoot is like Prune, but operates on the <Root>/ostree/repo
+// repository instead of Ostree.RepoDir.
+func (o *Ostree) PruneInRoot(ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	repoDir, err := o.rootRepoDir()
+	if err != nil {
+		return err
+	}
+	opts, err := o.pruneOptions()
+	if err != nil {
+		return err
+	}
+	return o.pruneFromRepo(repoDir, ref, opts, verbose)
+}
+
+// rootRepoDir returns the path to the ostree repository of the Root
+// filesystem.
+func (o *Ostree) rootRepoDir() (string, error) {
+	root, err := o.Root()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, "ostree", "repo"), nil
+}
+
+// pruneSummaryRe matches the summary printed by ostree prune --no-prune:
+//
+//	Would delete: 1234 objects, freeing 56.7 MB
+var pruneSummaryRe = regexp.MustCompile(`Would delete: (\d+) objects?, freeing (.+)`)
+
+// PrunePreview runs Prune with --no-prune and returns how many objects would
+// be deleted and how many bytes that would free, without deleting anything.
+func (o *Ostree) PrunePreview(ref string, verbose bool) (freedBytes uint64, prunedObjects int, err error) {
+	if ref == "" {
+		return 0, 0, errors.New("invalid ref parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return 0, 0, err
+	}
+	opts, err := o.pruneOptions()
+	if err != nil {
+		return 0, 0, err
+	}
+	if opts.keepObjectsYoungerThan == "" {
+		return 0, 0, errors.New("invalid keepObjectsYoungerThan parameter")
+	}
+
+	args := append(pruneArgs(repoDir, ref, opts), "--no-prune")
+	stdout, err := o.ostreeRunCapture(verbose, args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parsePruneSummary(stdout)
+}
+
+// parsePruneSummary parses the output of ostree prune --no-prune. Output
+// without a "Would delete" line (e.g. "No unreachable objects") means that
+// nothing would be pruned.
+func parsePruneSummary(r io.Reader) (uint64, int, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := pruneSummaryRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		objects, err := strconv.Atoi(m[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid prune object count %q: %w", m[1], err)
+		}
+		freed, err := parseSize(strings.TrimSpace(m[2]))
+		if err != nil {
+			return 0, 0, err
+		}
+		return freed, objects, nil
+	}
+	return 0, 0, scanner.Err()
+}
+
+// GenerateStaticDelta generates a static delta for an ostree repository.
+func (o *Ostree) GenerateStaticDelta(ref string, verbose bool) error {
+	return o.GenerateStaticDeltaContext(context.Background(), ref, verbose)
+}
+
+// GenerateStaticDeltaContext is like GenerateStaticDelta, but the running
+// ostree process is killed when ctx is done.
+func (o *Ostree) GenerateStaticDeltaContext(ctx context.Context, ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	return o.generateStaticDeltaForRef(ctx, repoDir, ref, verbose)
+}
+
+// GenerateStaticDeltaInRoot is like GenerateStaticDelta, but operates on the
+// <Root>/ostree/repo repository instead of Ostree.RepoDir.
+func (o *Ostree) GenerateStaticDeltaInRoot(ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	repoDir, err := o.rootRepoDir()
+	if err != nil {
+		return err
+	}
+	return o.generateStaticDeltaForRef(context.Background(), repoDir, ref, verbose)
+}
+
+// generateStaticDeltaForRef generates a static delta in repoDir from the
+// parent of ref (if any) to ref.
+func (o *Ostree) generateStaticDeltaForRef(ctx context.Context, repoDir, ref string, verbose bool) error {
+	fmt.Printf("Generating static delta for %s and ref %s ...\n", repoDir, ref)
+
+	stdout, err := o.ostreeRunCaptureContext(
+		ctx,
+		verbose,
+		"--repo="+repoDir,
+		"rev-parse",
+		ref,
+	)
+	if err != nil {
+		return err
+	}
+
+	revNew, err := readerToFirstNonEmptyLine(stdout)
+	if err != nil {
+		return err
+	}
+
+	stdout, err = o.ostreeRunCaptureContext(
+		ctx,
+		verbose,
+		"--repo="+repoDir,
+		"rev-parse",
+		ref+"^",
+	)
+	if err != nil {
+		// This is not a fatal error, the branch might not have a previous commit.
+	}
+	revOld, _ := readerToFirstNonEmptyLine(stdout)
+
+	if revOld != "" {
+		err := o.runCmdContext(
+			ctx,
+			nil,
+			io.Discard,
 			os.Stderr,
 			verbose,
 			"--repo="+repoDir,
@@ -1598,7 +2674,9 @@ func (o *Ostree) GenerateStaticDelta(ref string, verbose bool) error {
 	}
 	// SAFETY CHECK: Does the parent object actually exist?
 	if revOld != "" {
-		err := o.runCmd(
+		err := o.runCmdContext(
+			ctx,
+			nil,
 			io.Discard,
 			os.Stderr,
 			verbose,
@@ -1616,6 +2694,26 @@ func (o *Ostree) GenerateStaticDelta(ref string, verbose bool) error {
 		}
 	}
 
+	return o.generateStaticDelta(ctx, repoDir, revOld, revNew, verbose)
+}
+
+// GenerateStaticDeltaBetween generates a static delta between two explicit
+// commits. An empty fromCommit generates a full (--empty) delta to toCommit.
+func (o *Ostree) GenerateStaticDeltaBetween(fromCommit, toCommit string, verbose bool) error {
+	if toCommit == "" {
+		return errors.New("missing toCommit parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generating static delta for %s from %q to %s ...\n", repoDir, fromCommit, toCommit)
+	return o.generateStaticDelta(context.Background(), repoDir, fromCommit, toCommit, verbose)
+}
+
+// generateStaticDelta runs `ostree static-delta generate` from revOld to
+// revNew, or from scratch if revOld is empty.
+func (o *Ostree) generateStaticDelta(ctx context.Context, repoDir, revOld, revNew string, verbose bool) error {
 	args := []string{
 		"--repo=" + repoDir,
 		"static-delta", "generate",
@@ -1632,7 +2730,45 @@ func (o *Ostree) GenerateStaticDelta(ref string, verbose bool) error {
 		args = append(args, "--from="+revOld)
 	}
 
-	return o.ostreeRun(verbose, args...)
+	return o.ostreeRunContext(ctx, verbose, args...)
+}
+
+// StaticDelta identifies a static delta between two commits. From is empty
+// for deltas generated from scratch (--empty).
+type StaticDelta struct {
+	From string
+	To   string
+}
+
+// ListStaticDeltas runs `ostree static-delta list` and returns the static
+// deltas available in the repository.
+func (o *Ostree) ListStaticDeltas(verbose bool) ([]StaticDelta, error) {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := o.ostreeRunCapture(verbose, "static-delta", "list", "--repo="+repoDir)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := readerToList(stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := []StaticDelta{}
+	for _, line := range lines {
+		// Printed by ostree when the repository has no deltas.
+		if line == "(No static deltas)" {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "-")
+		if !ok {
+			from, to = "", line
+		}
+		deltas = append(deltas, StaticDelta{From: from, To: to})
+	}
+	return deltas, nil
 }
 
 // UpdateSummary updates the summary of an ostree repository.
@@ -1659,6 +2795,88 @@ func (o *Ostree) UpdateSummary(verbose bool) error {
 	return o.ostreeRun(verbose, args...)
 }
 
+// SignSummary (re)signs the existing summary of the repo, without
+// regenerating it. It fails if GPG signing is disabled.
+func (o *Ostree) SignSummary(verbose bool) error {
+	gpgEnabled, err := o.GpgEnabled()
+	if err != nil {
+		return err
+	}
+	if !gpgEnabled {
+		return errors.New("cannot sign summary: Ostree.Gpg is disabled")
+	}
+
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	gpgArgs, err := o.GpgArgs()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Signing ostree summary ...")
+	args := append([]string{"--repo=" + repoDir, "summary"}, gpgArgs...)
+	return o.ostreeRun(verbose, args...)
+}
+
+// SummaryNotFoundError is returned by SummaryRefs when the repo has no
+// summary file.
+type SummaryNotFoundError struct {
+	RepoDir string
+}
+
+func (e *SummaryNotFoundError) Error() string {
+	return fmt.Sprintf("no summary in repo %s", e.RepoDir)
+}
+
+// SummaryRefs returns the refs advertised by the repo summary, mapped to
+// their latest commit, as printed by "ostree summary --view". A
+// *SummaryNotFoundError is returned if the repo has no summary (see
+// UpdateSummary).
+func (o *Ostree) SummaryRefs(verbose bool) (map[string]string, error) {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+	if !fileExists(filepath.Join(repoDir, "summary")) {
+		return nil, &SummaryNotFoundError{RepoDir: repoDir}
+	}
+
+	stdout, err := o.ostreeRunCapture(verbose, "--repo="+repoDir, "summary", "--view")
+	if err != nil {
+		return nil, err
+	}
+	return parseSummaryView(stdout)
+}
+
+// parseSummaryView parses the refs section of "ostree summary --view",
+// where each ref is introduced by a "* <ref>" line and followed by a
+// "Latest Commit (...):" line with the checksum on the next line.
+func parseSummaryView(r io.Reader) (map[string]string, error) {
+	refs := make(map[string]string)
+	var ref string
+	wantCommit := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "* "):
+			ref = strings.TrimPrefix(line, "* ")
+			wantCommit = false
+		case ref != "" && strings.HasPrefix(line, "Latest Commit"):
+			wantCommit = true
+		case wantCommit && line != "":
+			refs[ref] = line
+			ref, wantCommit = "", false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read summary: %w", err)
+	}
+	return refs, nil
+}
+
 // AddRemote adds a remote to an ostree repo.
 func (o *Ostree) AddRemote(verbose bool) error {
 	repoDir, err := o.RepoDir()
@@ -1679,11 +2897,21 @@ func (o *Ostree) AddRemote(verbose bool) error {
 	if err != nil {
 		return err
 	}
+	extraArgs, err := o.RemoteExtraArgs()
+	if err != nil {
+		return err
+	}
+	tlsArgs, err := o.remoteTlsArgs()
+	if err != nil {
+		return err
+	}
 
 	opts := AddRemoteOptions{
 		Remote:    remote,
 		RemoteURL: remoteURL,
 		GpgArgs:   gpgArgs,
+		// The TLS options are already validated, pass them as they are.
+		ExtraArgs: append(tlsArgs, extraArgs...),
 		RepoDir:   repoDir,
 		Verbose:   verbose,
 	}
@@ -1705,17 +2933,82 @@ func (o *Ostree) AddRemoteWithSysroot(sysroot string, verbose bool) error {
 	if err != nil {
 		return err
 	}
+	extraArgs, err := o.RemoteExtraArgs()
+	if err != nil {
+		return err
+	}
+	tlsArgs, err := o.remoteTlsArgs()
+	if err != nil {
+		return err
+	}
 
 	opts := AddRemoteOptions{
 		Remote:    remote,
 		RemoteURL: remoteURL,
 		GpgArgs:   gpgArgs,
+		// The TLS options are already validated, pass them as they are.
+		ExtraArgs: append(tlsArgs, extraArgs...),
 		Sysroot:   sysroot,
 		Verbose:   verbose,
 	}
 	return o.addRemote(opts, verbose)
 }
 
+// RemoteDelete removes the configured remote from the repository.
+func (o *Ostree) RemoteDelete(verbose bool) error {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote, err := o.Remote()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleting remote %s from %s ...\n", remote, repoDir)
+	return o.ostreeRun(verbose, "remote", "delete", "--repo="+repoDir, remote)
+}
+
+// RemoteSetURL changes the URL of the configured remote.
+func (o *Ostree) RemoteSetURL(url string, verbose bool) error {
+	if url == "" {
+		return errors.New("missing url parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote, err := o.Remote()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Setting URL of remote %s in %s to %s ...\n", remote, repoDir, url)
+	return o.remoteSetURLInRepo(repoDir, remote, url, verbose)
+}
+
+// remoteSetURLInRepo changes the URL of remote in repoDir. ostree has no
+// "remote set-url" subcommand, so the url key of the remote section of the
+// repo config is rewritten instead, keeping all the other remote options.
+func (o *Ostree) remoteSetURLInRepo(repoDir, remote, url string, verbose bool) error {
+	return o.ostreeRun(verbose, "--repo="+repoDir, "config", "set", `remote "`+remote+`".url`, url)
+}
+
+// remoteSetOptionsInRepo applies --set=key=value options, as passed to
+// "ostree remote add", to an existing remote of repoDir.
+func (o *Ostree) remoteSetOptionsInRepo(repoDir, remote string, setArgs []string, verbose bool) error {
+	for _, arg := range setArgs {
+		kv, ok := strings.CutPrefix(arg, "--set=")
+		key, value, found := strings.Cut(kv, "=")
+		if !ok || !found || key == "" {
+			return fmt.Errorf("invalid remote option %q, expected --set=key=value", arg)
+		}
+		err := o.ostreeRun(verbose, "--repo="+repoDir, "config", "set", `remote "`+remote+`".`+key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // LocalRefs lists the locally available ostree refs.
 func (o *Ostree) LocalRefs(verbose bool) ([]string, error) {
 	repoDir, err := o.RepoDir()
@@ -1725,6 +3018,86 @@ func (o *Ostree) LocalRefs(verbose bool) ([]string, error) {
 	return o.listLocalRefsFromRepo(repoDir, verbose)
 }
 
+// LocalRefsWithCommits returns the locally available ostree refs mapped to
+// the commit each of them points to. The ostree-metadata ref is excluded.
+func (o *Ostree) LocalRefsWithCommits(verbose bool) (map[string]string, error) {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := o.listLocalRefsFromRepo(repoDir, verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		if ref == ostreeMetadataRef {
+			continue
+		}
+		commit, err := o.lastCommitFromRepo(repoDir, ref, verbose)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve ref %s: %w", ref, err)
+		}
+		commits[ref] = commit
+	}
+	return commits, nil
+}
+
+// RepoSize returns the disk usage, in bytes, of the object store of the
+// repository, summing the sizes of the files under <RepoDir>/objects.
+func (o *Ostree) RepoSize() (uint64, error) {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return 0, err
+	}
+	objectsDir := filepath.Join(repoDir, "objects")
+	if !directoryExists(objectsDir) {
+		return 0, fmt.Errorf("%s is not an ostree repository: %s does not exist", repoDir, objectsDir)
+	}
+
+	var size uint64
+	err = filepath.WalkDir(objectsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += uint64(info.Size())
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute the size of %s: %w", objectsDir, err)
+	}
+	return size, nil
+}
+
+// ostreeMetadataRef is the special ref ostree uses to store repository
+// metadata. It must never be deleted.
+const ostreeMetadataRef = "ostree-metadata"
+
+// DeleteLocalRef deletes a local ref from the repository. The objects it
+// points to are only removed by a later prune.
+func (o *Ostree) DeleteLocalRef(ref string, verbose bool) error {
+	if ref == "" {
+		return errors.New("invalid ref parameter")
+	}
+	if ref == ostreeMetadataRef {
+		return fmt.Errorf("refusing to delete the %s ref", ostreeMetadataRef)
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleting ref %s from %s ...\n", ref, repoDir)
+	return o.ostreeRun(verbose, "refs", "--repo="+repoDir, "--delete", ref)
+}
+
 // RemoteRefs lists the remote available ostree refs.
 func (o *Ostree) RemoteRefs(verbose bool) ([]string, error) {
 	repoDir, err := o.RepoDir()
@@ -1735,81 +3108,384 @@ func (o *Ostree) RemoteRefs(verbose bool) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return o.listRemoteRefsFromRepo(repoDir, remote, verbose)
+	return o.listRemoteRefsFromRepo(repoDir, remote, verbose)
+}
+
+// RemoteRefsWithPrefix lists the remote refs starting with prefix, preserving
+// the order returned by RemoteRefs. The prefix is matched both against the
+// full ref and against the ref without its "remote:" part, so "matrixos/amd64/"
+// matches "origin:matrixos/amd64/gnome".
+func (o *Ostree) RemoteRefsWithPrefix(prefix string, verbose bool) ([]string, error) {
+	if prefix == "" {
+		return nil, errors.New("missing prefix parameter")
+	}
+	refs, err := o.RemoteRefs(verbose)
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, ref := range refs {
+		_, bare, _ := strings.Cut(ref, ":")
+		if strings.HasPrefix(ref, prefix) || strings.HasPrefix(bare, prefix) {
+			matching = append(matching, ref)
+		}
+	}
+	return matching, nil
+}
+
+// ListDeployments lists the deployments in the / filesystem.
+func (o *Ostree) ListDeployments(verbose bool) ([]Deployment, error) {
+	root, err := o.Root()
+	if err != nil {
+		return nil, err
+	}
+	return o.listDeploymentsFromSysroot(root, verbose)
+}
+
+// DeploymentNotFoundError is returned by DeploymentByRef when no deployment
+// matches the requested refspec.
+type DeploymentNotFoundError struct {
+	Refspec string
+}
+
+func (e *DeploymentNotFoundError) Error() string {
+	return fmt.Sprintf("no deployment found for %s", e.Refspec)
+}
+
+// DeploymentByRef returns the first deployment in the / filesystem whose
+// refspec matches refspec. A *DeploymentNotFoundError is returned if there
+// is none.
+func (o *Ostree) DeploymentByRef(refspec string, verbose bool) (*Deployment, error) {
+	if refspec == "" {
+		return nil, errors.New("missing refspec parameter")
+	}
+	root, err := o.Root()
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deployments {
+		if deployments[i].Refspec == refspec {
+			return &deployments[i], nil
+		}
+	}
+	return nil, &DeploymentNotFoundError{Refspec: refspec}
+}
+
+// DeployedRootfs returns the path to the deployed rootfs.
+func (o *Ostree) DeployedRootfs(ref string, verbose bool) (string, error) {
+	sysroot, err := o.Sysroot()
+	if err != nil {
+		return "", err
+	}
+
+	if ref == "" {
+		return "", errors.New("invalid ref parameter")
+	}
+	osName, err := o.OsName()
+	if err != nil {
+		return "", err
+	}
+
+	ostreeCommit, err := o.LastCommit(ref, verbose)
+	if err != nil {
+		return "", fmt.Errorf("cannot get last ostree commit: %w", err)
+	}
+
+	rootfs := BuildDeploymentRootfs(sysroot, osName, ostreeCommit, 0)
+	return rootfs, nil
+}
+
+// BootedDeployment returns the booted deployment, or ErrNoBootedDeployment if
+// none is marked as booted.
+func (o *Ostree) BootedDeployment(verbose bool) (*Deployment, error) {
+	root, err := o.Root()
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deployments {
+		if deployments[i].Booted {
+			return &deployments[i], nil
+		}
+	}
+	return nil, ErrNoBootedDeployment
+}
+
+// BootedRef returns the ref of the booted deployment.
+func (o *Ostree) BootedRef(verbose bool) (string, error) {
+	d, err := o.BootedDeployment(verbose)
+	if err != nil {
+		return "", err
+	}
+	return d.Refspec, nil
+}
+
+// BootedHash returns the commit hash of the booted deployment.
+func (o *Ostree) BootedHash(verbose bool) (string, error) {
+	d, err := o.BootedDeployment(verbose)
+	if err != nil {
+		return "", err
+	}
+	return d.Checksum, nil
+}
+
+// kargKey returns the key part of a kernel argument (e.g. "root" for
+// "root=UUID=abc", "quiet" for "quiet").
+func kargKey(karg string) string {
+	key, _, _ := strings.Cut(karg, "=")
+	return key
+}
+
+// ComputeKargDelta computes the kernel arguments that must be appended and
+// deleted to turn the current set into the desired one. Only the keys present
+// in desired are managed: a current karg is deleted only when desired sets the
+// same key to a different value. Kargs not mentioned in desired are left alone.
+func ComputeKargDelta(current, desired []string) ([]string, []string) {
+	var toAdd, toDelete []string
+	for _, d := range desired {
+		if slices.Contains(current, d) || slices.Contains(toAdd, d) {
+			continue
+		}
+		toAdd = append(toAdd, d)
+		key := kargKey(d)
+		for _, c := range current {
+			if kargKey(c) == key && !slices.Contains(desired, c) && !slices.Contains(toDelete, c) {
+				toDelete = append(toDelete, c)
+			}
+		}
+	}
+	return toAdd, toDelete
+}
+
+// CurrentKargs returns the kernel arguments of the booted deployment, as read
+// from <Root>/proc/cmdline.
+func (o *Ostree) CurrentKargs(verbose bool) ([]string, error) {
+	root, err := o.Root()
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(deployments, func(d Deployment) bool { return d.Booted }) {
+		return nil, ErrNoBootedDeployment
+	}
+
+	cmdline := filepath.Join(root, "proc", "cmdline")
+	data, err := os.ReadFile(cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", cmdline, err)
+	}
+	// strings.Fields trims surrounding whitespace and skips empty tokens.
+	return strings.Fields(string(data)), nil
+}
+
+// GetKargs returns the kernel arguments of the booted deployment. It is the
+// IOstree counterpart of SetKargs and reads the same command line as
+// CurrentKargs.
+func (o *Ostree) GetKargs(verbose bool) ([]string, error) {
+	return o.CurrentKargs(verbose)
+}
+
+// KargMigrationNeeded returns the kernel arguments to append and delete so
+// that the booted deployment matches the desired kargs. Two empty slices mean
+// that no migration is needed.
+func (o *Ostree) KargMigrationNeeded(desired []string, verbose bool) ([]string, []string, error) {
+	current, err := o.CurrentKargs(verbose)
+	if err != nil {
+		return nil, nil, err
+	}
+	toAdd, toDelete := ComputeKargDelta(current, desired)
+	return toAdd, toDelete, nil
+}
+
+// SetKargs edits the kernel arguments of the booted deployment in place,
+// appending the given arguments when missing and deleting the given ones when
+// present.
+func (o *Ostree) SetKargs(appends []string, deletes []string, verbose bool) error {
+	if len(appends) == 0 && len(deletes) == 0 {
+		return errors.New("missing appends or deletes parameter")
+	}
+	sysroot, err := o.Sysroot()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"admin", "kargs", "edit-in-place", "--sysroot=" + sysroot}
+	for _, karg := range appends {
+		args = append(args, "--append-if-missing="+karg)
+	}
+	for _, karg := range deletes {
+		args = append(args, "--delete-if-present="+karg)
+	}
+	return o.ostreeRun(verbose, args...)
+}
+
+// hierarchyFs performs the filesystem operations of PrepareFilesystemHierarchy
+// inside imageDir. In dry-run mode nothing is touched: every operation is
+// recorded as a human-readable string (with paths relative to imageDir) and the
+// paths it would create or remove are tracked, so that later existence checks
+// observe the planned state rather than the untouched tree.
+type hierarchyFs struct {
+	imageDir string
+	dryRun   bool
+	ops      []string
+	created  map[string]bool
+	removed  map[string]bool
+	stdout   io.Writer
+	stderr   io.Writer
+}
+
+func newHierarchyFs(imageDir string, dryRun bool) *hierarchyFs {
+	h := &hierarchyFs{
+		imageDir: imageDir,
+		dryRun:   dryRun,
+		created:  map[string]bool{},
+		removed:  map[string]bool{},
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+	}
+	if dryRun {
+		h.stdout = io.Discard
+		h.stderr = io.Discard
+	}
+	return h
+}
+
+// path joins elems onto imageDir.
+func (h *hierarchyFs) path(elems ...string) string {
+	return filepath.Join(append([]string{h.imageDir}, elems...)...)
+}
+
+func (h *hierarchyFs) rel(path string) string {
+	if rel, err := filepath.Rel(h.imageDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func (h *hierarchyFs) record(created, removed, format string, args ...any) {
+	h.ops = append(h.ops, fmt.Sprintf(format, args...))
+	if created != "" {
+		h.created[created] = true
+		delete(h.removed, created)
+	}
+	if removed != "" {
+		h.removed[removed] = true
+		delete(h.created, removed)
+	}
+}
+
+// exists reports whether path exists, following symlinks.
+func (h *hierarchyFs) exists(path string) bool {
+	if h.dryRun {
+		if h.created[path] {
+			return true
+		}
+		if h.removed[path] {
+			return false
+		}
+	}
+	return pathExists(path)
 }
 
-// ListDeployments lists the deployments in the / filesystem.
-func (o *Ostree) ListDeployments(verbose bool) ([]Deployment, error) {
-	root, err := o.Root()
-	if err != nil {
-		return nil, err
+// lexists reports whether path exists, without following symlinks.
+func (h *hierarchyFs) lexists(path string) bool {
+	if h.dryRun {
+		if h.created[path] {
+			return true
+		}
+		if h.removed[path] {
+			return false
+		}
 	}
-	return o.listDeploymentsFromSysroot(root, verbose)
+	_, err := os.Lstat(path)
+	return err == nil
 }
 
-// DeployedRootfs returns the path to the deployed rootfs.
-func (o *Ostree) DeployedRootfs(ref string, verbose bool) (string, error) {
-	sysroot, err := o.Sysroot()
-	if err != nil {
-		return "", err
+func (h *hierarchyFs) mkdir(path string) error {
+	if h.dryRun {
+		h.record(path, "", "mkdir %s", h.rel(path))
+		return nil
 	}
+	return os.Mkdir(path, 0755)
+}
 
-	if ref == "" {
-		return "", errors.New("invalid ref parameter")
-	}
-	osName, err := o.OsName()
-	if err != nil {
-		return "", err
+func (h *hierarchyFs) mkdirAll(path string) error {
+	if h.dryRun {
+		if !h.exists(path) {
+			h.record(path, "", "mkdir -p %s", h.rel(path))
+		}
+		return nil
 	}
+	return os.MkdirAll(path, 0755)
+}
 
-	ostreeCommit, err := o.LastCommit(ref, verbose)
-	if err != nil {
-		return "", fmt.Errorf("cannot get last ostree commit: %w", err)
+func (h *hierarchyFs) rename(src, dst string) error {
+	if h.dryRun {
+		h.record(dst, src, "move %s -> %s", h.rel(src), h.rel(dst))
+		return nil
 	}
-
-	rootfs := BuildDeploymentRootfs(sysroot, osName, ostreeCommit, 0)
-	return rootfs, nil
+	return os.Rename(src, dst)
 }
 
-// BootedRef returns the ref of the booted deployment.
-func (o *Ostree) BootedRef(verbose bool) (string, error) {
-	root, err := o.Root()
-	if err != nil {
-		return "", err
+func (h *hierarchyFs) remove(path string) error {
+	if h.dryRun {
+		h.record("", path, "remove %s", h.rel(path))
+		return nil
 	}
-	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
-	if err != nil {
-		return "", err
+	return os.Remove(path)
+}
+
+func (h *hierarchyFs) removeAll(path string) error {
+	if h.dryRun {
+		h.record("", path, "remove -r %s", h.rel(path))
+		return nil
 	}
-	for _, d := range deployments {
-		if d.Booted {
-			return d.Refspec, nil
-		}
+	return os.RemoveAll(path)
+}
+
+func (h *hierarchyFs) symlink(target, link string) error {
+	if h.dryRun {
+		h.record(link, "", "symlink %s -> %s", h.rel(link), target)
+		return nil
 	}
-	return "", errors.New("no booted deployment found")
+	return os.Symlink(target, link)
 }
 
-// BootedHash returns the commit hash of the booted deployment.
-func (o *Ostree) BootedHash(verbose bool) (string, error) {
-	root, err := o.Root()
-	if err != nil {
-		return "", err
+// truncate replaces path with an empty regular file.
+func (h *hierarchyFs) truncate(path string) error {
+	if h.dryRun {
+		h.record(path, "", "truncate %s", h.rel(path))
+		return nil
 	}
-	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
+	_ = os.Remove(path)
+	f, err := os.Create(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-	for _, d := range deployments {
-		if d.Booted {
-			return d.Checksum, nil
-		}
+	return f.Close()
+}
+
+func (h *hierarchyFs) writeFile(path string, data []byte) error {
+	if h.dryRun {
+		h.record(path, "", "create %s", h.rel(path))
+		return nil
 	}
-	return "", errors.New("no booted deployment found")
+	return os.WriteFile(path, data, 0644)
 }
 
-func (o *Ostree) prepareVarHome(imageDir, homeName, varHomeName string) error {
-	homeDir := filepath.Join(imageDir, homeName)
-	varHomeDir := filepath.Join(imageDir, "var", varHomeName)
+func (o *Ostree) prepareVarHome(h *hierarchyFs, homeName, varHomeName string) error {
+	homeDir := h.path(homeName)
+	varHomeDir := h.path("var", varHomeName)
 
 	homeInfo, err := os.Lstat(homeDir)
 	homeExists := err == nil
@@ -1818,10 +3494,10 @@ func (o *Ostree) prepareVarHome(imageDir, homeName, varHomeName string) error {
 		if info, err := os.Stat(varHomeDir); err == nil && info.IsDir() {
 			link, _ := os.Readlink(homeDir)
 			if strings.HasSuffix(link, "var/"+varHomeName) {
-				fmt.Printf("%s is a symlink and %s is a directory. All good.\n", homeDir, varHomeDir)
+				fmt.Fprintf(h.stdout, "%s is a symlink and %s is a directory. All good.\n", homeDir, varHomeDir)
 			} else {
 				fmt.Fprintf(
-					os.Stderr,
+					h.stderr,
 					"%s symlink points to an unexpected path: %s\n",
 					homeDir,
 					link,
@@ -1831,24 +3507,24 @@ func (o *Ostree) prepareVarHome(imageDir, homeName, varHomeName string) error {
 		}
 	} else if homeExists && homeInfo.IsDir() {
 		if pathExists(varHomeDir) { // path exists is correct.
-			fmt.Println("WARNING: removing " + varHomeDir)
-			os.RemoveAll(varHomeDir)
+			fmt.Fprintln(h.stdout, "WARNING: removing "+varHomeDir)
+			h.removeAll(varHomeDir)
 		}
-		if err := os.Rename(homeDir, varHomeDir); err != nil {
+		if err := h.rename(homeDir, varHomeDir); err != nil {
 			return fmt.Errorf("failed to move home: %w", err)
 		}
 	} else if homeExists {
-		if err := os.Remove(homeDir); err != nil {
+		if err := h.remove(homeDir); err != nil {
 			return fmt.Errorf("failed to remove home: %w", err)
 		}
 	}
-	if _, err := os.Stat(varHomeDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(varHomeDir, 0755); err != nil {
+	if !h.exists(varHomeDir) {
+		if err := h.mkdirAll(varHomeDir); err != nil {
 			return fmt.Errorf("failed to create %v: %w", varHomeDir, err)
 		}
 	}
 	// && !os.IsExist(err) done because of the complexity of the conditions above.
-	if err := os.Symlink("var/"+varHomeName, homeDir); err != nil && !os.IsExist(err) {
+	if err := h.symlink("var/"+varHomeName, homeDir); err != nil && !os.IsExist(err) {
 		return fmt.Errorf("failed to symlink %v: %w", homeDir, err)
 	}
 	return nil
@@ -1857,28 +3533,28 @@ func (o *Ostree) prepareVarHome(imageDir, homeName, varHomeName string) error {
 // moveDirToTargetAndSymlink moves srcDir to targetDir (if srcDir exists as a real
 // directory or removes it if it's a non-directory), ensures targetDir exists, and
 // creates a symlink at srcDir pointing to symlinkTarget.
-func moveDirToTargetAndSymlink(srcDir, targetDir, symlinkTarget string) error {
+func moveDirToTargetAndSymlink(h *hierarchyFs, srcDir, targetDir, symlinkTarget string) error {
 	if info, err := os.Lstat(srcDir); err == nil {
 		if info.IsDir() {
 			if pathExists(targetDir) {
-				os.RemoveAll(targetDir)
+				h.removeAll(targetDir)
 			}
-			fmt.Fprintf(os.Stderr, "WARNING: moving %s to %s.\n", srcDir, targetDir)
-			if err := os.Rename(srcDir, targetDir); err != nil {
+			fmt.Fprintf(h.stderr, "WARNING: moving %s to %s.\n", srcDir, targetDir)
+			if err := h.rename(srcDir, targetDir); err != nil {
 				return fmt.Errorf("failed to move %s: %w", srcDir, err)
 			}
 		} else {
-			if err := os.Remove(srcDir); err != nil {
+			if err := h.remove(srcDir); err != nil {
 				return fmt.Errorf("failed to remove %s: %w", srcDir, err)
 			}
 		}
 	}
 
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
+	if err := h.mkdirAll(targetDir); err != nil {
 		return fmt.Errorf("failed to create %s: %w", targetDir, err)
 	}
 
-	if err := os.Symlink(symlinkTarget, srcDir); err != nil && !os.IsExist(err) {
+	if err := h.symlink(symlinkTarget, srcDir); err != nil && !os.IsExist(err) {
 		return fmt.Errorf("failed to symlink %s: %w", srcDir, err)
 	}
 	return nil
@@ -1886,99 +3562,107 @@ func moveDirToTargetAndSymlink(srcDir, targetDir, symlinkTarget string) error {
 
 // prepareSysrootAndOstreeLink creates the /sysroot directory and the
 // /ostree -> sysroot/ostree symlink inside imageDir.
-func prepareSysrootAndOstreeLink(imageDir string) error {
-	if err := os.Mkdir(filepath.Join(imageDir, "sysroot"), 0755); err != nil {
+func prepareSysrootAndOstreeLink(h *hierarchyFs) error {
+	if err := h.mkdir(h.path("sysroot")); err != nil {
 		return fmt.Errorf("failed to create sysroot: %w", err)
 	}
 
-	ostreeLink := filepath.Join(imageDir, "ostree")
-	if _, err := os.Lstat(ostreeLink); err == nil {
-		if err := os.Remove(ostreeLink); err != nil {
+	ostreeLink := h.path("ostree")
+	if h.lexists(ostreeLink) {
+		if err := h.remove(ostreeLink); err != nil {
 			return fmt.Errorf("failed to remove existing ostree link: %w", err)
 		}
 	}
-	if err := os.Symlink("sysroot/ostree", ostreeLink); err != nil {
+	if err := h.symlink("sysroot/ostree", ostreeLink); err != nil {
 		return fmt.Errorf("failed to symlink ostree: %w", err)
 	}
 	return nil
 }
 
 // prepareTmpDir moves /tmp into /sysroot/tmp and replaces it with a symlink.
-func prepareTmpDir(imageDir string) error {
-	tmpDir := filepath.Join(imageDir, "tmp")
-	sysrootTmp := filepath.Join(imageDir, "sysroot", "tmp")
+func prepareTmpDir(h *hierarchyFs) error {
+	tmpDir := h.path("tmp")
+	sysrootTmp := h.path("sysroot", "tmp")
 
 	// Move tmpDir only if it exists as a real directory (not a symlink).
 	if info, err := os.Lstat(tmpDir); err == nil && info.IsDir() && (info.Mode()&os.ModeSymlink == 0) {
-		if err := os.Rename(tmpDir, sysrootTmp); err != nil {
+		if err := h.rename(tmpDir, sysrootTmp); err != nil {
 			return fmt.Errorf("failed to move tmp to sysroot/tmp: %w", err)
 		}
 	}
 
-	if _, err := os.Lstat(tmpDir); err == nil {
-		os.Remove(tmpDir)
+	if h.lexists(tmpDir) {
+		h.remove(tmpDir)
 	}
-	if err := os.Symlink("sysroot/tmp", tmpDir); err != nil {
+	if err := h.symlink("sysroot/tmp", tmpDir); err != nil {
 		return fmt.Errorf("failed to symlink tmp: %w", err)
 	}
 	return nil
 }
 
 // prepareMachineID resets /etc/machine-id to an empty file.
-func prepareMachineID(imageDir string) error {
-	machineID := filepath.Join(imageDir, "etc", "machine-id")
-	_ = os.Remove(machineID)
-	f, err := os.Create(machineID)
-	if err != nil {
+func prepareMachineID(h *hierarchyFs) error {
+	if err := h.truncate(h.path("etc", "machine-id")); err != nil {
 		return fmt.Errorf("failed to touch machine-id: %w", err)
 	}
-	f.Close()
 	return nil
 }
 
+// setupEtc moves the /etc directory to /usr/etc.
+func setupEtc(h *hierarchyFs) error {
+	fmt.Fprintln(h.stdout, "Setting up /etc...")
+	etcDir := h.path("etc")
+	usrEtcDir := h.path("usr", "etc")
+
+	fmt.Fprintf(h.stdout, "Moving %s to %s\n", etcDir, usrEtcDir)
+	return h.rename(etcDir, usrEtcDir)
+}
+
 // prepareVarDbPkg moves var/db/pkg to the read-only VDB location and creates
 // a relative symlink back.
-func prepareVarDbPkg(imageDir, roVdbPath string) error {
-	fmt.Println("Setting up /var/db/pkg...")
-	varDbPkg := filepath.Join(imageDir, "var", "db", "pkg")
-	usrVarDbPkg := filepath.Join(imageDir, roVdbPath)
+func prepareVarDbPkg(h *hierarchyFs, roVdbPath string) error {
+	fmt.Fprintln(h.stdout, "Setting up /var/db/pkg...")
+	varDbPkg := h.path("var", "db", "pkg")
+	usrVarDbPkg := h.path(roVdbPath)
 
-	fmt.Printf("Moving %s to %s\n", varDbPkg, usrVarDbPkg)
-	if err := os.MkdirAll(filepath.Dir(usrVarDbPkg), 0755); err != nil {
+	fmt.Fprintf(h.stdout, "Moving %s to %s\n", varDbPkg, usrVarDbPkg)
+	if err := h.mkdirAll(filepath.Dir(usrVarDbPkg)); err != nil {
 		return fmt.Errorf("failed to create parent of usrVarDbPkg: %w", err)
 	}
-	if err := os.Rename(varDbPkg, usrVarDbPkg); err != nil {
+	if err := h.rename(varDbPkg, usrVarDbPkg); err != nil {
 		return fmt.Errorf("failed to move var/db/pkg: %w", err)
 	}
 
-	if err := os.Symlink(filepath.Join("..", "..", roVdbPath), varDbPkg); err != nil {
+	if err := h.symlink(filepath.Join("..", "..", roVdbPath), varDbPkg); err != nil {
 		return fmt.Errorf("failed to symlink var/db/pkg: %w", err)
 	}
 	return nil
 }
 
 // prepareOpt moves /opt to /usr/opt and symlinks it.
-func prepareOpt(imageDir string) error {
-	fmt.Println("Setting up /opt...")
+func prepareOpt(h *hierarchyFs) error {
+	fmt.Fprintln(h.stdout, "Setting up /opt...")
 	return moveDirToTargetAndSymlink(
-		filepath.Join(imageDir, "opt"),
-		filepath.Join(imageDir, "usr", "opt"),
+		h,
+		h.path("opt"),
+		h.path("usr", "opt"),
 		"usr/opt",
 	)
 }
 
 // prepareSrv moves /srv to /var/srv and symlinks it.
-func prepareSrv(imageDir string) error {
-	fmt.Println("Setting up /srv...")
+func prepareSrv(h *hierarchyFs) error {
+	fmt.Fprintln(h.stdout, "Setting up /srv...")
 	return moveDirToTargetAndSymlink(
-		filepath.Join(imageDir, "srv"),
-		filepath.Join(imageDir, "var", "srv"),
+		h,
+		h.path("srv"),
+		h.path("var", "srv"),
 		"var/srv",
 	)
 }
 
 // prepareStaticDirs creates /lab, /snap, and /usr/src directories.
-func prepareStaticDirs(imageDir string) error {
+func prepareStaticDirs(h *hierarchyFs) error {
 	dirs := []struct {
 		path string
 		desc string
@@ -1988,8 +3672,8 @@ func prepareStaticDirs(imageDir string) error {
 		{filepath.Join("usr", "src"), "Setting up /usr/src (for snap) ..."},
 	}
 	for _, d := range dirs {
-		fmt.Println(d.desc)
-		if err := os.MkdirAll(filepath.Join(imageDir, d.path), 0755); err != nil {
+		fmt.Fprintln(h.stdout, d.desc)
+		if err := h.mkdirAll(h.path(d.path)); err != nil {
 			return fmt.Errorf("failed to create %s: %w", d.path, err)
 		}
 	}
@@ -1997,20 +3681,20 @@ func prepareStaticDirs(imageDir string) error {
 }
 
 // prepareUsrLocal moves /usr/local to /var/usrlocal and symlinks it.
-func prepareUsrLocal(imageDir string) error {
-	fmt.Println("Setting up /usr/local...")
-	usrLocalDir := filepath.Join(imageDir, "usr", "local")
+func prepareUsrLocal(h *hierarchyFs) error {
+	fmt.Fprintln(h.stdout, "Setting up /usr/local...")
+	usrLocalDir := h.path("usr", "local")
 	relUsrLocal := "var/usrlocal"
-	imageUsrLocal := filepath.Join(imageDir, relUsrLocal)
+	imageUsrLocal := h.path(relUsrLocal)
 
 	if pathExists(usrLocalDir) {
-		if err := os.Rename(usrLocalDir, imageUsrLocal); err != nil {
+		if err := h.rename(usrLocalDir, imageUsrLocal); err != nil {
 			return fmt.Errorf("failed to move usr/local: %w", err)
 		}
 	} else {
-		os.MkdirAll(imageUsrLocal, 0755)
+		h.mkdirAll(imageUsrLocal)
 	}
-	if err := os.Symlink(filepath.Join("..", relUsrLocal), usrLocalDir); err != nil {
+	if err := h.symlink(filepath.Join("..", relUsrLocal), usrLocalDir); err != nil {
 		return fmt.Errorf("failed to symlink usr/local: %w", err)
 	}
 	return nil
@@ -2019,24 +3703,39 @@ func prepareUsrLocal(imageDir string) error {
 // PrepareFilesystemHierarchy prepares the filesystem hierarchy for OSTree.
 // It ports the logic from ostree_lib.prepare_filesystem_hierarchy in ostree_lib.sh.
 func (o *Ostree) PrepareFilesystemHierarchy(imageDir string) error {
-	marker := filepath.Join(imageDir, "var", ".matrixos-prepared")
+	return o.prepareFilesystemHierarchy(newHierarchyFs(imageDir, false))
+}
+
+// PrepareFilesystemHierarchyDryRun returns the ordered list of operations that
+// PrepareFilesystemHierarchy would perform on imageDir (e.g. "move etc -> usr/etc",
+// "symlink opt -> usr/opt"), without modifying the filesystem.
+func (o *Ostree) PrepareFilesystemHierarchyDryRun(imageDir string) ([]string, error) {
+	h := newHierarchyFs(imageDir, true)
+	if err := o.prepareFilesystemHierarchy(h); err != nil {
+		return nil, err
+	}
+	return h.ops, nil
+}
+
+func (o *Ostree) prepareFilesystemHierarchy(h *hierarchyFs) error {
+	marker := h.path("var", ".matrixos-prepared")
 	if fileExists(marker) {
 		return fmt.Errorf("filesystem hierarchy already prepared: %s exists", marker)
 	}
 
-	if err := prepareSysrootAndOstreeLink(imageDir); err != nil {
+	if err := prepareSysrootAndOstreeLink(h); err != nil {
 		return err
 	}
 
-	if err := prepareTmpDir(imageDir); err != nil {
+	if err := prepareTmpDir(h); err != nil {
 		return err
 	}
 
-	if err := prepareMachineID(imageDir); err != nil {
+	if err := prepareMachineID(h); err != nil {
 		return err
 	}
 
-	if err := o.SetupEtc(imageDir); err != nil {
+	if err := setupEtc(h); err != nil {
 		return err
 	}
 
@@ -2047,28 +3746,28 @@ func (o *Ostree) PrepareFilesystemHierarchy(imageDir string) error {
 	if matrixOsRoVdb == "" {
 		return fmt.Errorf("config item Releaser.ReadOnlyVdb is not set")
 	}
-	if err := prepareVarDbPkg(imageDir, matrixOsRoVdb); err != nil {
+	if err := prepareVarDbPkg(h, matrixOsRoVdb); err != nil {
 		return err
 	}
 
-	if err := prepareOpt(imageDir); err != nil {
+	if err := prepareOpt(h); err != nil {
 		return err
 	}
 
-	if err := prepareSrv(imageDir); err != nil {
+	if err := prepareSrv(h); err != nil {
 		return err
 	}
 
-	if err := prepareStaticDirs(imageDir); err != nil {
+	if err := prepareStaticDirs(h); err != nil {
 		return err
 	}
 
-	fmt.Println("Setting up /home ...")
-	if err := o.prepareVarHome(imageDir, "home", "home"); err != nil {
+	fmt.Fprintln(h.stdout, "Setting up /home ...")
+	if err := o.prepareVarHome(h, "home", "home"); err != nil {
 		return err
 	}
-	fmt.Println("Setting up /root ...")
-	if err := o.prepareVarHome(imageDir, "root", "roothome"); err != nil {
+	fmt.Fprintln(h.stdout, "Setting up /root ...")
+	if err := o.prepareVarHome(h, "root", "roothome"); err != nil {
 		return err
 	}
 
@@ -2079,20 +3778,100 @@ func (o *Ostree) PrepareFilesystemHierarchy(imageDir string) error {
 	if efiRoot == "" {
 		return fmt.Errorf("config item Imager.EfiRoot is not set")
 	}
-	fmt.Printf("Setting up %s...\n", efiRoot)
-	os.MkdirAll(filepath.Join(imageDir, efiRoot), 0755)
+	fmt.Fprintf(h.stdout, "Setting up %s...\n", efiRoot)
+	h.mkdirAll(h.path(efiRoot))
 
-	if err := prepareUsrLocal(imageDir); err != nil {
+	if err := prepareUsrLocal(h); err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(marker, []byte("prepared"), 0644); err != nil {
+	if err := h.writeFile(marker, []byte("prepared")); err != nil {
 		return fmt.Errorf("failed to create marker file: %w", err)
 	}
 
 	return nil
 }
 
+// undoMoveAndSymlink removes the symlink at linkPath and moves movedDir back
+// in its place, reversing moveDirToTargetAndSymlink and friends.
+func undoMoveAndSymlink(h *hierarchyFs, linkPath, movedDir string) error {
+	if info, err := os.Lstat(linkPath); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s is not a symlink, refusing to overwrite it", linkPath)
+		}
+		if err := h.remove(linkPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", linkPath, err)
+		}
+	}
+	if !directoryExists(movedDir) {
+		return nil
+	}
+	fmt.Fprintf(h.stdout, "Moving %s to %s\n", movedDir, linkPath)
+	if err := h.rename(movedDir, linkPath); err != nil {
+		return fmt.Errorf("failed to move %s: %w", movedDir, err)
+	}
+	return nil
+}
+
+// UndoFilesystemHierarchy reverses the moves and symlinks performed by
+// PrepareFilesystemHierarchy and removes its marker file. The machine-id
+// contents and the directories created from scratch (e.g. /lab, /snap, the
+// EFI root) are not restored. It refuses to run on a tree that has not been
+// prepared.
+func (o *Ostree) UndoFilesystemHierarchy(imageDir string) error {
+	if imageDir == "" {
+		return errors.New("missing imageDir parameter")
+	}
+	h := newHierarchyFs(imageDir, false)
+	marker := h.path("var", ".matrixos-prepared")
+	if !fileExists(marker) {
+		return fmt.Errorf("filesystem hierarchy not prepared: %s does not exist", marker)
+	}
+
+	matrixOsRoVdb, err := o.cfg.GetItem("Releaser.ReadOnlyVdb")
+	if err != nil {
+		return err
+	}
+	if matrixOsRoVdb == "" {
+		return fmt.Errorf("config item Releaser.ReadOnlyVdb is not set")
+	}
+
+	steps := []struct {
+		link  string
+		moved string
+	}{
+		{h.path("usr", "local"), h.path("var", "usrlocal")},
+		{h.path("root"), h.path("var", "roothome")},
+		{h.path("home"), h.path("var", "home")},
+		{h.path("srv"), h.path("var", "srv")},
+		{h.path("opt"), h.path("usr", "opt")},
+		{h.path("var", "db", "pkg"), h.path(matrixOsRoVdb)},
+		{h.path("etc"), h.path("usr", "etc")},
+		{h.path("tmp"), h.path("sysroot", "tmp")},
+	}
+	for _, s := range steps {
+		if err := undoMoveAndSymlink(h, s.link, s.moved); err != nil {
+			return err
+		}
+	}
+
+	ostreeLink := h.path("ostree")
+	if info, err := os.Lstat(ostreeLink); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := h.remove(ostreeLink); err != nil {
+			return fmt.Errorf("failed to remove ostree link: %w", err)
+		}
+	}
+	// Only remove sysroot if it is empty, it may contain a deployment by now.
+	if err := h.remove(h.path("sysroot")); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(h.stderr, "WARNING: not removing sysroot: %v\n", err)
+	}
+
+	if err := h.remove(marker); err != nil {
+		return fmt.Errorf("failed to remove marker file: %w", err)
+	}
+	return nil
+}
+
 // ValidateFilesystemHierarchy validates the filesystem hierarchy for OSTree.
 func (o *Ostree) ValidateFilesystemHierarchy(imageDir string) error {
 	if imageDir == "" {
@@ -2137,6 +3916,9 @@ func (o *Ostree) ValidateFilesystemHierarchy(imageDir string) error {
 
 // Switch runs `ostree admin switch` to switch to the given ref.
 func (o *Ostree) Switch(ref string, verbose bool) error {
+	if err := ValidateRefFormat(ref); err != nil {
+		return err
+	}
 	sysroot, err := o.Sysroot()
 	if err != nil {
 		return err
@@ -2144,65 +3926,207 @@ func (o *Ostree) Switch(ref string, verbose bool) error {
 	return o.ostreeRun(verbose, "admin", "switch", "--sysroot="+sysroot, ref)
 }
 
-// Deploy deploys an ostree commit.
-func (o *Ostree) Deploy(ref string, bootArgs []string, verbose bool) error {
-	sysroot, err := o.Sysroot()
+// Rollback promotes the rollback deployment by redeploying its commit with
+// `ostree admin deploy --retain`, keeping the currently booted deployment.
+// The commit checksum is deployed rather than the refspec, which ostree would
+// resolve to the current tip of the ref (usually the booted commit). The
+// refspec is only recorded in the origin of the new deployment, so that
+// later upgrades keep following it.
+func (o *Ostree) Rollback(verbose bool) error {
+	root, err := o.Root()
 	if err != nil {
 		return err
 	}
-	repoDir, err := o.RepoDir()
+	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
 	if err != nil {
 		return err
 	}
-	remote, err := o.Remote()
-	if err != nil {
-		return err
+
+	var booted, rollback *Deployment
+	for i := range deployments {
+		d := &deployments[i]
+		if d.Booted && booted == nil {
+			booted = d
+		}
+		if d.Rollback && rollback == nil {
+			rollback = d
+		}
+	}
+	if booted == nil {
+		return ErrNoBootedDeployment
+	}
+	if rollback == nil {
+		return fmt.Errorf("no rollback deployment found (booted: %s)", booted.Checksum)
+	}
+	if rollback.Refspec == "" {
+		return fmt.Errorf("rollback deployment %s has no refspec", rollback.Checksum)
 	}
 
-	fmt.Printf("Creating %s ...\n", sysroot)
-	if err := os.MkdirAll(sysroot, 0755); err != nil {
+	originFile, err := os.CreateTemp("", "rollback-*.origin")
+	if err != nil {
 		return err
 	}
+	defer os.Remove(originFile.Name())
+	if _, err := fmt.Fprintf(originFile, "[origin]\nrefspec=%s\n", rollback.Refspec); err != nil {
+		originFile.Close()
+		return fmt.Errorf("failed to write origin file: %w", err)
+	}
+	if err := originFile.Close(); err != nil {
+		return fmt.Errorf("failed to write origin file: %w", err)
+	}
 
-	ostreeCommit, err := o.lastCommitFromRepo(repoDir, ref, verbose)
-	if err != nil {
-		return fmt.Errorf("cannot get last ostree commit: %w", err)
+	args := []string{"admin", "deploy", "--sysroot=" + root, "--retain"}
+	if rollback.Stateroot != "" {
+		args = append(args, "--os="+rollback.Stateroot)
 	}
+	args = append(args, "--origin-file="+originFile.Name(), rollback.Checksum)
 
-	fmt.Printf("Initializing ostree dir structure into %s ...\n", sysroot)
-	if err := o.ostreeRun(verbose, "admin", "init-fs", sysroot); err != nil {
+	fmt.Printf("Rolling back from %s to %s (%s) ...\n", booted.Checksum, rollback.Checksum, rollback.Refspec)
+	return o.ostreeRun(verbose, args...)
+}
+
+// Undeploy runs `ostree admin undeploy` to remove the deployment at the given
+// index.
+func (o *Ostree) Undeploy(index int, verbose bool) error {
+	if index < 0 {
+		return fmt.Errorf("invalid index parameter: %d", index)
+	}
+	sysroot, err := o.Sysroot()
+	if err != nil {
 		return err
 	}
+	return o.ostreeRun(verbose, "admin", "undeploy", "--sysroot="+sysroot, strconv.Itoa(index))
+}
 
-	osName, err := o.OsName()
+// PinDeployment runs `ostree admin pin` to protect the deployment at the
+// given index from being garbage collected. If pinned is false, the
+// deployment is unpinned instead.
+func (o *Ostree) PinDeployment(index int, pinned bool, verbose bool) error {
+	if index < 0 {
+		return fmt.Errorf("invalid index parameter: %d", index)
+	}
+	sysroot, err := o.Sysroot()
 	if err != nil {
 		return err
 	}
+	args := []string{"admin", "pin", "--sysroot=" + sysroot, strconv.Itoa(index)}
+	if !pinned {
+		args = append(args, "--unpin")
+	}
+	return o.ostreeRun(verbose, args...)
+}
 
-	fmt.Println("ostree os-init ...")
-	if err := o.ostreeRun(verbose, "admin", "os-init", osName, "--sysroot="+sysroot); err != nil {
-		return err
+// DeployOptions tunes how "ostree admin deploy" handles existing
+// deployments and /etc.
+type DeployOptions struct {
+	// RetainRollback keeps the rollback deployment (--retain-rollback).
+	RetainRollback bool
+	// Retain keeps all existing deployments (--retain).
+	Retain bool
+	// NoMerge does not merge the current /etc into the new deployment
+	// (--no-merge).
+	NoMerge bool
+}
+
+// args returns the ostree admin deploy flags matching opts.
+func (opts DeployOptions) args() []string {
+	var args []string
+	if opts.RetainRollback {
+		args = append(args, "--retain-rollback")
+	}
+	if opts.Retain {
+		args = append(args, "--retain")
 	}
+	if opts.NoMerge {
+		args = append(args, "--no-merge")
+	}
+	return args
+}
 
-	sysrootRepo := filepath.Join(sysroot, "ostree", "repo")
-	fmt.Println("ostree pull-local ...")
-	if err := o.ostreeRun(verbose, "pull-local", "--repo="+sysrootRepo, repoDir, ostreeCommit); err != nil {
+// Deploy deploys an ostree commit.
+func (o *Ostree) Deploy(ref string, bootArgs []string, verbose bool) error {
+	return o.DeployWithOptions(ref, bootArgs, DeployOptions{}, verbose)
+}
+
+// DeployWithOptions is like Deploy, but passes the retention and /etc merge
+// flags selected in opts to "ostree admin deploy".
+func (o *Ostree) DeployWithOptions(ref string, bootArgs []string, opts DeployOptions, verbose bool) error {
+	return o.deploy(context.Background(), ref, bootArgs, opts.args(), false, verbose)
+}
+
+// DeployContext is like Deploy, but the running ostree process is killed
+// when ctx is done.
+func (o *Ostree) DeployContext(ctx context.Context, ref string, bootArgs []string, verbose bool) error {
+	return o.deploy(ctx, ref, bootArgs, nil, false, verbose)
+}
+
+// DeployStaged is like Deploy, but stages the deployment with
+// "ostree admin deploy --stage", so that it only becomes active on the next
+// reboot. If the sysroot is already initialized for the OS (that is,
+// ostree/deploy/<os> exists), the init-fs, os-init and pull-local bootstrap
+// steps are skipped and the ref is deployed from the sysroot repository.
+func (o *Ostree) DeployStaged(ref string, bootArgs []string, verbose bool) error {
+	return o.deploy(context.Background(), ref, bootArgs, []string{"--stage"}, true, verbose)
+}
+
+// deploy implements DeployContext and its variants. extraDeployArgs are
+// passed to "ostree admin deploy" before the ref. If reuseSysroot is true
+// and the sysroot is already initialized for the OS, the bootstrap steps
+// are skipped.
+func (o *Ostree) deploy(
+	ctx context.Context,
+	ref string,
+	bootArgs []string,
+	extraDeployArgs []string,
+	reuseSysroot bool,
+	verbose bool,
+) error {
+	if err := ValidateRefFormat(ref); err != nil {
+		return err
+	}
+	sysroot, err := o.Sysroot()
+	if err != nil {
 		return err
 	}
-	if err := o.ostreeRun(verbose, "refs", "--repo="+sysrootRepo, "--create="+remote+":"+ref, ostreeCommit); err != nil {
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return err
+	}
+	remote, err := o.Remote()
+	if err != nil {
 		return err
 	}
 
-	fmt.Println("ostree setting bootloader to none (using blscfg instead) ...")
-	if err := o.ostreeRun(verbose, "config", "--repo="+sysrootRepo, "set", "sysroot.bootloader", "none"); err != nil {
+	fmt.Printf("Creating %s ...\n", sysroot)
+	if err := os.MkdirAll(sysroot, 0755); err != nil {
 		return err
 	}
 
-	fmt.Println("ostree setting bootprefix = false, given separate boot partition ...")
-	if err := o.ostreeRun(verbose, "config", "--repo="+sysrootRepo, "set", "sysroot.bootprefix", "false"); err != nil {
+	osName, err := o.OsName()
+	if err != nil {
 		return err
 	}
 
+	// ostreeCommit is the commit that <remote>:<ref> points to in the
+	// sysroot repository, i.e. the one actually deployed.
+	var ostreeCommit string
+	if reuseSysroot && directoryExists(filepath.Join(sysroot, "ostree", "deploy", osName)) {
+		fmt.Printf("%s is already initialized for %s, skipping bootstrap ...\n", sysroot, osName)
+		sysrootRepo := filepath.Join(sysroot, "ostree", "repo")
+		ostreeCommit, err = o.lastCommitFromRepoContext(ctx, sysrootRepo, remote+":"+ref, verbose)
+		if err != nil {
+			return fmt.Errorf("cannot get deployed ostree commit from %s: %w", sysrootRepo, err)
+		}
+	} else {
+		ostreeCommit, err = o.lastCommitFromRepoContext(ctx, repoDir, ref, verbose)
+		if err != nil {
+			return fmt.Errorf("cannot get last ostree commit: %w", err)
+		}
+		if err := o.bootstrapSysroot(ctx, sysroot, repoDir, remote, osName, ref, ostreeCommit, verbose); err != nil {
+			return err
+		}
+	}
+
 	fmt.Println("ostree admin deploy ...")
 	deployArgs := []string{
 		"admin", "deploy",
@@ -2212,9 +4136,10 @@ func (o *Ostree) Deploy(ref string, bootArgs []string, verbose bool) error {
 	for _, ba := range bootArgs {
 		deployArgs = append(deployArgs, "--karg-append="+ba)
 	}
+	deployArgs = append(deployArgs, extraDeployArgs...)
 	deployArgs = append(deployArgs, remote+":"+ref)
 
-	if err := o.ostreeRun(verbose, deployArgs...); err != nil {
+	if err := o.ostreeRunContext(ctx, verbose, deployArgs...); err != nil {
 		return err
 	}
 
@@ -2222,6 +4147,45 @@ func (o *Ostree) Deploy(ref string, bootArgs []string, verbose bool) error {
 	return nil
 }
 
+// bootstrapSysroot initializes the ostree directory structure and the OS
+// stateroot in sysroot, imports ostreeCommit from repoDir as <remote>:<ref>
+// and configures the sysroot repository for BLS boot entries.
+func (o *Ostree) bootstrapSysroot(
+	ctx context.Context,
+	sysroot, repoDir, remote, osName, ref, ostreeCommit string,
+	verbose bool,
+) error {
+	fmt.Printf("Initializing ostree dir structure into %s ...\n", sysroot)
+	if err := o.ostreeRunContext(ctx, verbose, "admin", "init-fs", sysroot); err != nil {
+		return err
+	}
+
+	fmt.Println("ostree os-init ...")
+	if err := o.ostreeRunContext(ctx, verbose, "admin", "os-init", osName, "--sysroot="+sysroot); err != nil {
+		return err
+	}
+
+	sysrootRepo := filepath.Join(sysroot, "ostree", "repo")
+	fmt.Println("ostree pull-local ...")
+	if err := o.ostreeRunContext(ctx, verbose, "pull-local", "--repo="+sysrootRepo, repoDir, ostreeCommit); err != nil {
+		return err
+	}
+	if err := o.ostreeRunContext(ctx, verbose, "refs", "--repo="+sysrootRepo, "--create="+remote+":"+ref, ostreeCommit); err != nil {
+		return err
+	}
+
+	fmt.Println("ostree setting bootloader to none (using blscfg instead) ...")
+	if err := o.ostreeRunContext(ctx, verbose, "config", "--repo="+sysrootRepo, "set", "sysroot.bootloader", "none"); err != nil {
+		return err
+	}
+
+	fmt.Println("ostree setting bootprefix = false, given separate boot partition ...")
+	if err := o.ostreeRunContext(ctx, verbose, "config", "--repo="+sysrootRepo, "set", "sysroot.bootprefix", "false"); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Upgrade runs `ostree admin upgrade`.
 func (o *Ostree) Upgrade(args []string, verbose bool) error {
 	root, err := o.Root()
@@ -2370,10 +4334,88 @@ func (o *Ostree) listContentsOfPath(commit, repoDir, path string, verbose bool)
 		pis = append(pis, *pi)
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &pis, nil
+}
+
+// PathNotFoundError is returned by FindPath when the path does not exist in
+// the commit.
+type PathNotFoundError struct {
+	Commit string
+	Path   string
+}
+
+func (e *PathNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found in commit %s", e.Path, e.Commit)
+}
+
+// FindPath returns the metadata of a single path in a commit, without
+// listing the content of directories. A *PathNotFoundError is returned if
+// the path does not exist in the commit.
+func (o *Ostree) FindPath(commit, path string, verbose bool) (*fslib.PathInfo, error) {
+	if commit == "" {
+		return nil, errors.New("missing commit parameter")
+	}
+	if path == "" {
+		return nil, errors.New("missing path parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := new(bytes.Buffer)
+	var stderr bytes.Buffer
+	err = o.runCmd(
+		nil,
+		stdout,
+		io.MultiWriter(os.Stderr, &stderr),
+		verbose,
+		"--repo="+repoDir,
+		"ls",
+		"-C",
+		"-d",
+		commit,
+		"--",
+		path,
+	)
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return nil, &PathNotFoundError{Commit: commit, Path: path}
+		}
+		return nil, err
+	}
+
+	line, err := readerToFirstNonEmptyLine(stdout)
+	if err != nil {
 		return nil, err
 	}
-	return &pis, nil
+	if line == "" {
+		return nil, &PathNotFoundError{Commit: commit, Path: path}
+	}
+	return ParseOstreeLsChecksumLine(line)
+}
+
+// ReadFile returns the content of the file at path in commit, without
+// checking the commit out.
+func (o *Ostree) ReadFile(commit, path string, verbose bool) ([]byte, error) {
+	if commit == "" {
+		return nil, errors.New("missing commit parameter")
+	}
+	if path == "" {
+		return nil, errors.New("missing path parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := o.ostreeRunCapture(verbose, "--repo="+repoDir, "cat", commit, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from commit %s: %w", path, commit, err)
+	}
+	return io.ReadAll(stdout)
 }
 
 // EtcChangeAction describes what will happen to a file in /etc during merge.
@@ -2381,11 +4423,11 @@ type EtcChangeAction string
 
 // EtcChange describes a single change detected by the 3-way /etc diff.
 type EtcChange struct {
-	Path   string          // Relative path within /etc (e.g. "conf.d/foo")
-	Action EtcChangeAction // What will happen to this path
-	Old    *fslib.PathInfo // State in old commit (nil if absent)
-	New    *fslib.PathInfo // State in new commit (nil if absent)
-	User   *fslib.PathInfo // Current live state (nil if absent)
+	Path   string          `json:"path"`           // Relative path within /etc (e.g. "conf.d/foo")
+	Action EtcChangeAction `json:"action"`         // What will happen to this path
+	Old    *fslib.PathInfo `json:"old,omitempty"`  // State in old commit (nil if absent)
+	New    *fslib.PathInfo `json:"new,omitempty"`  // State in new commit (nil if absent)
+	User   *fslib.PathInfo `json:"user,omitempty"` // Current live state (nil if absent)
 }
 
 // indexPathInfoSlice builds a map from relative path to *PathInfo.
@@ -2557,15 +4599,294 @@ func (o *Ostree) ListEtcChanges(oldSHA, newSHA string) ([]EtcChange, error) {
 	if err != nil {
 		return nil, err
 	}
-	userEtcContent, err := fslib.ListContents("/etc")
+	userEtcContent, err := listLocalContents("/etc")
+	if err != nil {
+		return nil, err
+	}
+
+	changes := computeEtcDiff(oldEtcContent, newEtcContent, userEtcContent)
+	return changes, nil
+}
+
+// EtcChangesJSON returns the result of ListEtcChanges encoded as a JSON
+// array, for consumption by external tooling. Permission bits are encoded
+// as octal strings (e.g. "0644").
+func (o *Ostree) EtcChangesJSON(oldSHA, newSHA string) ([]byte, error) {
+	changes, err := o.ListEtcChanges(oldSHA, newSHA)
+	if err != nil {
+		return nil, err
+	}
+	if changes == nil {
+		changes = []EtcChange{}
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode /etc changes: %w", err)
+	}
+	return data, nil
+}
+
+// ListEtcChangesChecksummed is like ListEtcChanges, but guarantees that every
+// live /etc regular file carries a real content checksum, so that edits that
+// keep the file size unchanged are always detected. Files whose checksum
+// could not be computed while listing are hashed again, and a failure to do
+// so is returned as an error instead of being ignored.
+func (o *Ostree) ListEtcChangesChecksummed(oldSHA, newSHA string) ([]EtcChange, error) {
+	oldEtcContent, err := o.ListContents(oldSHA, "/usr/etc", false)
+	if err != nil {
+		return nil, err
+	}
+	newEtcContent, err := o.ListContents(newSHA, "/usr/etc", false)
+	if err != nil {
+		return nil, err
+	}
+	userEtcContent, err := listLocalContents("/etc")
 	if err != nil {
 		return nil, err
 	}
+	if err := fillMissingChecksums(userEtcContent); err != nil {
+		return nil, err
+	}
 
 	changes := computeEtcDiff(oldEtcContent, newEtcContent, userEtcContent)
 	return changes, nil
 }
 
+// fillMissingChecksums computes the OSTree content checksum of every regular
+// file in pis that lacks one.
+func fillMissingChecksums(pis []*fslib.PathInfo) error {
+	for _, pi := range pis {
+		if pi.Mode.Type != "-" || pi.HasChecksum() {
+			continue
+		}
+		ck, err := fslib.OstreeChecksumFileAt(pi.Path, fslib.OstreeObjectTypeFile, fslib.OstreeChecksumFlagsNone)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", pi.Path, err)
+		}
+		pi.OSTreeChecksum = ck
+	}
+	return nil
+}
+
+// pathInfoFileMode converts the mode of pi into an fs.FileMode, including
+// the setuid, setgid and sticky bits.
+func pathInfoFileMode(pi *fslib.PathInfo) fs.FileMode {
+	mode := pi.Mode.Perms.Perm()
+	if pi.Mode.SetUID {
+		mode |= fs.ModeSetuid
+	}
+	if pi.Mode.SetGID {
+		mode |= fs.ModeSetgid
+	}
+	if pi.Mode.Sticky {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// copyFileWithMode copies the regular file src to dst through a temporary
+// file in the destination directory, so that dst is replaced atomically,
+// and sets the given mode and ownership on the result.
+func copyFileWithMode(src, dst string, mode fs.FileMode, uid, gid int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Lchown(tmpPath, uid, gid); err != nil {
+		return err
+	}
+	// Chmod after chown: chown clears the setuid/setgid bits.
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
+
+// applyEtcEntry makes the live /etc path relPath match the pristine entry pi
+// found in the /usr/etc of the deployment rooted at newDeployRoot.
+func applyEtcEntry(newDeployRoot, relPath string, pi *fslib.PathInfo) error {
+	dst := filepath.Join(liveEtcDir, relPath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory of %s: %w", dst, err)
+	}
+	uid, gid := int(pi.Uid), int(pi.Gid)
+
+	switch pi.Mode.Type {
+	case "d":
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dst, err)
+		}
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", dst, err)
+		}
+		if err := os.Chmod(dst, pathInfoFileMode(pi)); err != nil {
+			return fmt.Errorf("failed to chmod %s: %w", dst, err)
+		}
+	case "l":
+		if err := os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dst, err)
+		}
+		if err := os.Symlink(pi.Link, dst); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", dst, err)
+		}
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", dst, err)
+		}
+	case "-":
+		src := filepath.Join(newDeployRoot, "usr", "etc", relPath)
+		if err := copyFileWithMode(src, dst, pathInfoFileMode(pi), uid, gid); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+		}
+	default:
+		return fmt.Errorf("unsupported file type %q for %s", pi.Mode.Type, relPath)
+	}
+	return nil
+}
+
+// pendingDeploymentRoot returns the root of the deployment that is going to
+// be booted next (pending or staged), as listed by ostree admin status.
+func (o *Ostree) pendingDeploymentRoot(verbose bool) (string, error) {
+	root, err := o.Root()
+	if err != nil {
+		return "", err
+	}
+	deployments, err := o.listDeploymentsFromSysroot(root, verbose)
+	if err != nil {
+		return "", err
+	}
+	for _, d := range deployments {
+		if d.Pending || d.Staged {
+			return BuildDeploymentRootfs(root, d.Stateroot, d.Checksum, d.Serial), nil
+		}
+	}
+	return "", errors.New("no pending deployment to merge /etc from")
+}
+
+// ApplyEtcChanges performs the 3-way /etc merge described by changes, as
+// returned by ListEtcChanges. Added and updated paths are copied from the
+// /usr/etc of the pending deployment (not the booted one, which still holds
+// the old defaults) into /etc with the mode and ownership of their New
+// state, and removed paths are deleted from /etc. Conflicts and user-only
+// changes are left untouched. Removals are applied deepest first, so that
+// directories are emptied before being deleted.
+// In dryRun mode nothing is modified. It returns the changes that were
+// (or, in dryRun mode, would be) applied.
+func (o *Ostree) ApplyEtcChanges(changes []EtcChange, dryRun bool) ([]EtcChange, error) {
+	// newDeployRoot is looked up on the first added or updated path.
+	var newDeployRoot string
+	var applied []EtcChange
+	var removals []EtcChange
+	for _, c := range changes {
+		switch c.Action {
+		case EtcActionAdd, EtcActionUpdate:
+			if c.New == nil {
+				return applied, fmt.Errorf("missing new state for %s %s", c.Action, c.Path)
+			}
+			if !dryRun {
+				if newDeployRoot == "" {
+					root, err := o.pendingDeploymentRoot(false)
+					if err != nil {
+						return applied, err
+					}
+					newDeployRoot = root
+				}
+				if err := applyEtcEntry(newDeployRoot, c.Path, c.New); err != nil {
+					return applied, err
+				}
+			}
+			applied = append(applied, c)
+		case EtcActionRemove:
+			removals = append(removals, c)
+		}
+	}
+
+	sort.SliceStable(removals, func(i, j int) bool {
+		return removals[i].Path > removals[j].Path
+	})
+	for _, c := range removals {
+		if !dryRun {
+			dst := filepath.Join(liveEtcDir, c.Path)
+			if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return applied, fmt.Errorf("failed to remove %s: %w", dst, err)
+			}
+		}
+		applied = append(applied, c)
+	}
+	return applied, nil
+}
+
+// BackupConflicts copies the live /etc file of every conflicting change into
+// backupDir, as <backupDir>/<path>.orig, preserving its mode and ownership.
+// Symlinks are recreated as symlinks; directories and paths the user has
+// removed have nothing to back up and are skipped. It returns the backup
+// paths that were created.
+func (o *Ostree) BackupConflicts(changes []EtcChange, backupDir string) ([]string, error) {
+	if backupDir == "" {
+		return nil, errors.New("missing backupDir parameter")
+	}
+
+	var backups []string
+	for _, c := range changes {
+		if c.Action != EtcActionConflict {
+			continue
+		}
+		src := filepath.Join(liveEtcDir, c.Path)
+		info, err := os.Lstat(src)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return backups, fmt.Errorf("failed to stat %s: %w", src, err)
+		}
+		if info.IsDir() {
+			continue
+		}
+
+		dst := filepath.Join(backupDir, c.Path+".orig")
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return backups, fmt.Errorf("failed to create backup directory for %s: %w", dst, err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				return backups, fmt.Errorf("failed to read symlink %s: %w", src, err)
+			}
+			if err := os.RemoveAll(dst); err != nil {
+				return backups, fmt.Errorf("failed to replace %s: %w", dst, err)
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return backups, fmt.Errorf("failed to back up %s: %w", src, err)
+			}
+		} else {
+			uid, gid := os.Getuid(), os.Getgid()
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				uid, gid = int(st.Uid), int(st.Gid)
+			}
+			if err := copyFileWithMode(src, dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky), uid, gid); err != nil {
+				return backups, fmt.Errorf("failed to back up %s to %s: %w", src, dst, err)
+			}
+		}
+		backups = append(backups, dst)
+	}
+	return backups, nil
+}
+
 // ListPackages lists the packages in a commit.
 func (o *Ostree) ListPackages(commit string, verbose bool) ([]string, error) {
 	if commit == "" {
@@ -2648,10 +4969,41 @@ func (o *Ostree) listPackagesFromPath(root, path, commit string, verbose bool) (
 	return pkgs, nil
 }
 
-// ConfigDiff runs "ostree admin --sysroot=<root> config-diff" and returns a
-// map whose keys are the status letter (e.g. "A", "M", "D") and whose values
-// are sorted slices of paths that have that status.
-func (o *Ostree) ConfigDiff(verbose bool) (map[string][]string, error) {
+// ConfigDiffStatus is the status of a path reported by ConfigDiffStructured.
+type ConfigDiffStatus string
+
+const (
+	// ConfigAdded means the path exists in /etc but not in the default
+	// configuration.
+	ConfigAdded ConfigDiffStatus = "A"
+	// ConfigModified means the path differs from the default configuration.
+	ConfigModified ConfigDiffStatus = "M"
+	// ConfigDeleted means the path was removed from /etc.
+	ConfigDeleted ConfigDiffStatus = "D"
+	// ConfigUnknown is used for any status letter not listed above.
+	ConfigUnknown ConfigDiffStatus = "?"
+)
+
+// ConfigDiffEntry is a single path reported by ConfigDiffStructured.
+type ConfigDiffEntry struct {
+	Status ConfigDiffStatus
+	Path   string
+}
+
+// parseConfigDiffStatus converts a status letter printed by
+// "ostree admin config-diff" into a ConfigDiffStatus.
+func parseConfigDiffStatus(letter string) ConfigDiffStatus {
+	switch s := ConfigDiffStatus(letter); s {
+	case ConfigAdded, ConfigModified, ConfigDeleted:
+		return s
+	default:
+		return ConfigUnknown
+	}
+}
+
+// ConfigDiffStructured runs "ostree admin --sysroot=<root> config-diff" and
+// returns the reported paths sorted by path.
+func (o *Ostree) ConfigDiffStructured(verbose bool) ([]ConfigDiffEntry, error) {
 	root, err := o.Root()
 	if err != nil {
 		return nil, err
@@ -2667,9 +5019,96 @@ func (o *Ostree) ConfigDiff(verbose bool) (map[string][]string, error) {
 		return nil, err
 	}
 
+	byStatus, err := parseDiffStatusLines(stdout, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := []ConfigDiffEntry{}
+	for letter, paths := range byStatus {
+		status := parseConfigDiffStatus(letter)
+		for _, path := range paths {
+			entries = append(entries, ConfigDiffEntry{Status: status, Path: path})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Status < entries[j].Status
+	})
+	return entries, nil
+}
+
+// ConfigDiff runs "ostree admin --sysroot=<root> config-diff" and returns a
+// map whose keys are the status letter (e.g. "A", "M", "D") and whose values
+// are sorted slices of paths that have that status. Paths with an unknown
+// status are reported under the ConfigUnknown key.
+func (o *Ostree) ConfigDiff(verbose bool) (map[string][]string, error) {
+	entries, err := o.ConfigDiffStructured(verbose)
+	if err != nil {
+		return nil, err
+	}
+
 	result := make(map[string][]string)
+	for _, e := range entries {
+		result[string(e.Status)] = append(result[string(e.Status)], e.Path)
+	}
+	return result, nil
+}
 
-	scanner := bufio.NewScanner(stdout)
+// ConfigDiffContent returns, for every path reported as modified by
+// ConfigDiff, the unified diff between its default version (<root>/usr/etc)
+// and its live version (<root>/etc), keyed by path. Paths that are not
+// regular files on both sides (e.g. directories or symlinks) are skipped.
+// The diff is empty when only the file metadata changed.
+func (o *Ostree) ConfigDiffContent(verbose bool) (map[string]string, error) {
+	root, err := o.Root()
+	if err != nil {
+		return nil, err
+	}
+	byStatus, err := o.ConfigDiff(verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, path := range byStatus[string(ConfigModified)] {
+		defaultFile := filepath.Join(root, "usr", "etc", path)
+		liveFile := filepath.Join(root, "etc", path)
+		if !isRegularFile(defaultFile) || !isRegularFile(liveFile) {
+			continue
+		}
+
+		var stdout bytes.Buffer
+		err := o.runner(nil, &stdout, os.Stderr, "diff", "-u",
+			"--label", filepath.Join("usr", "etc", path),
+			"--label", filepath.Join("etc", path),
+			defaultFile, liveFile)
+		// diff exits with 1 when the files differ.
+		if err != nil && stdout.Len() == 0 {
+			return nil, fmt.Errorf("failed to diff %s: %w", path, err)
+		}
+		result[path] = stdout.String()
+	}
+	return result, nil
+}
+
+// isRegularFile returns whether path is a regular file, without following
+// symlinks.
+func isRegularFile(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// parseDiffStatusLines parses "<status> <path>" lines as printed by
+// "ostree diff" and "ostree admin config-diff" into a map whose keys are the
+// status letter and whose values are sorted slices of paths. If statuses is
+// non-empty, lines with any other status are ignored. Malformed lines are
+// skipped.
+func parseDiffStatusLines(r io.Reader, statuses []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
@@ -2683,6 +5122,9 @@ func (o *Ostree) ConfigDiff(verbose bool) (map[string][]string, error) {
 		}
 
 		status := fields[0]
+		if len(statuses) > 0 && !slices.Contains(statuses, status) {
+			continue
+		}
 		path := fields[1]
 		result[status] = append(result[status], path)
 	}
@@ -2697,3 +5139,154 @@ func (o *Ostree) ConfigDiff(verbose bool) (map[string][]string, error) {
 
 	return result, nil
 }
+
+// DiffCommits runs "ostree diff --repo=<repo> <fromRef> <toRef>" and returns
+// the file-level changes between the two commits, in the same shape as
+// ConfigDiff. Only the "A", "M" and "D" statuses are reported.
+func (o *Ostree) DiffCommits(fromRef, toRef string, verbose bool) (map[string][]string, error) {
+	if fromRef == "" {
+		return nil, errors.New("missing fromRef parameter")
+	}
+	if toRef == "" {
+		return nil, errors.New("missing toRef parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := o.ostreeRunCapture(verbose, "diff", "--repo="+repoDir, fromRef, toRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s and %s: %w", fromRef, toRef, err)
+	}
+	return parseDiffStatusLines(stdout, []string{"A", "M", "D"})
+}
+
+// PackageDiff describes the packages added and removed between two commits.
+type PackageDiff struct {
+	Added   []string // Packages only present in the new commit (sorted)
+	Removed []string // Packages only present in the old commit (sorted)
+}
+
+// DiffPackages compares the packages of fromCommit and toCommit.
+func (o *Ostree) DiffPackages(fromCommit, toCommit string, verbose bool) (*PackageDiff, error) {
+	if fromCommit == "" {
+		return nil, errors.New("missing fromCommit parameter")
+	}
+	if toCommit == "" {
+		return nil, errors.New("missing toCommit parameter")
+	}
+	oldPkgs, err := o.ListPackages(fromCommit, verbose)
+	if err != nil {
+		return nil, err
+	}
+	newPkgs, err := o.ListPackages(toCommit, verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &PackageDiff{}
+	for _, pkg := range newPkgs {
+		if !slices.Contains(oldPkgs, pkg) {
+			diff.Added = append(diff.Added, pkg)
+		}
+	}
+	for _, pkg := range oldPkgs {
+		if !slices.Contains(newPkgs, pkg) {
+			diff.Removed = append(diff.Removed, pkg)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
+
+// ChangelogEntry is a single commit as reported by `ostree log`.
+type ChangelogEntry struct {
+	Commit  string
+	Date    string
+	Subject string
+}
+
+// Changelog returns the commits from toCommit (newest first) back to, but
+// excluding, fromCommit, by walking `ostree log`.
+func (o *Ostree) Changelog(fromCommit, toCommit string, verbose bool) ([]ChangelogEntry, error) {
+	if fromCommit == "" {
+		return nil, errors.New("missing fromCommit parameter")
+	}
+	if toCommit == "" {
+		return nil, errors.New("missing toCommit parameter")
+	}
+	repoDir, err := o.RepoDir()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := o.ostreeRunCapture(verbose, "log", "--repo="+repoDir, toCommit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the log of %s: %w", toCommit, err)
+	}
+
+	var entries []ChangelogEntry
+	var cur *ChangelogEntry
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "commit "):
+			commit := strings.TrimSpace(strings.TrimPrefix(line, "commit "))
+			if commit == fromCommit {
+				return entries, nil
+			}
+			entries = append(entries, ChangelogEntry{Commit: commit})
+			cur = &entries[len(entries)-1]
+		case cur == nil:
+			continue
+		case strings.HasPrefix(line, "Date:"):
+			cur.Date = strings.TrimSpace(strings.TrimPrefix(line, "Date:"))
+		case strings.HasPrefix(line, "    ") && cur.Subject == "":
+			cur.Subject = strings.TrimSpace(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// UpgradeReport summarizes what changes between two commits. Each section is
+// computed independently: if one fails, its error is recorded and the other
+// sections are still filled in.
+type UpgradeReport struct {
+	FromCommit string
+	ToCommit   string
+
+	Changelog    []ChangelogEntry
+	ChangelogErr error
+
+	Packages    *PackageDiff
+	PackagesErr error
+
+	EtcChanges    []EtcChange
+	EtcChangesErr error
+}
+
+// UpgradeReport builds an UpgradeReport combining the changelog, the package
+// diff and the /etc changes between fromCommit and toCommit.
+func (o *Ostree) UpgradeReport(fromCommit, toCommit string, verbose bool) (*UpgradeReport, error) {
+	if fromCommit == "" {
+		return nil, errors.New("missing fromCommit parameter")
+	}
+	if toCommit == "" {
+		return nil, errors.New("missing toCommit parameter")
+	}
+
+	report := &UpgradeReport{
+		FromCommit: fromCommit,
+		ToCommit:   toCommit,
+	}
+	report.Changelog, report.ChangelogErr = o.Changelog(fromCommit, toCommit, verbose)
+	report.Packages, report.PackagesErr = o.DiffPackages(fromCommit, toCommit, verbose)
+	report.EtcChanges, report.EtcChangesErr = o.ListEtcChanges(fromCommit, toCommit)
+	return report, nil
+}
@@ -1,15 +1,23 @@
 package cds
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"matrixos/vector/lib/config"
 	fslib "matrixos/vector/lib/filesystems"
+	"matrixos/vector/lib/runner"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBranchHelpers(t *testing.T) {
@@ -58,6 +66,156 @@ func TestBranchShortnameToNormal(t *testing.T) {
 	if gotProd != wantProd {
 		t.Errorf("BranchShortnameToNormal(prod) = %q, want %q", gotProd, wantProd)
 	}
+
+	gotStaging, err := BranchShortnameToNormal("staging", "gnome", "matrixos", "amd64")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantStaging := "matrixos/amd64/staging/gnome"
+	if gotStaging != wantStaging {
+		t.Errorf("BranchShortnameToNormal(staging) = %q, want %q", gotStaging, wantStaging)
+	}
+
+	if _, err := BranchShortnameToNormal("stagin", "gnome", "matrixos", "amd64"); err == nil {
+		t.Error("BranchShortnameToNormal should reject an unknown release stage")
+	}
+}
+
+func TestBranchShortnameToFull_ReleaseStages(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.FullBranchSuffix": {"full"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	got, err := o.BranchShortnameToFull("gnome", "staging", "matrixos", "amd64")
+	if err != nil {
+		t.Fatalf("BranchShortnameToFull failed: %v", err)
+	}
+	if want := "matrixos/amd64/staging/gnome-full"; got != want {
+		t.Errorf("BranchShortnameToFull(staging) = %q, want %q", got, want)
+	}
+
+	if _, err := o.BranchShortnameToFull("gnome", "stagin", "matrixos", "amd64"); err == nil {
+		t.Error("BranchShortnameToFull should reject an unknown release stage")
+	}
+}
+
+func TestValidateRefFormat(t *testing.T) {
+	valid := []string{
+		"origin:matrixos/amd64/dev/gnome",
+		"matrixos/amd64/gnome",
+		"gnome",
+	}
+	for _, ref := range valid {
+		if err := ValidateRefFormat(ref); err != nil {
+			t.Errorf("ValidateRefFormat(%q) unexpected error: %v", ref, err)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		ref  string
+	}{
+		{"Empty", ""},
+		{"Whitespace", "origin:matrixos/amd64/dev gnome"},
+		{"TrailingNewline", "matrixos/amd64/gnome\n"},
+		{"MultipleColons", "origin:mirror:matrixos/amd64/gnome"},
+		{"EmptyRemote", ":matrixos/amd64/gnome"},
+		{"EmptyPath", "origin:"},
+		{"LeadingSlash", "/matrixos/amd64/gnome"},
+		{"TrailingSlash", "origin:matrixos/amd64/gnome/"},
+		{"EmptyComponent", "matrixos//gnome"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateRefFormat(tt.ref); err == nil {
+				t.Errorf("ValidateRefFormat(%q) should have failed", tt.ref)
+			}
+		})
+	}
+}
+
+func TestValidateRefFormat_Callers(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+			"Ostree.Sysroot": {t.TempDir()},
+			"Ostree.Remote":  {"origin"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		t.Fatalf("ostree should not run for a malformed ref, got: %v", args)
+		return nil
+	}
+
+	const badRef = "origin:matrixos//gnome"
+	if err := o.Pull(badRef, false); err == nil {
+		t.Error("Pull should reject a malformed ref")
+	}
+	if err := o.Deploy(badRef, nil, false); err == nil {
+		t.Error("Deploy should reject a malformed ref")
+	}
+	if err := o.Switch(badRef, false); err == nil {
+		t.Error("Switch should reject a malformed ref")
+	}
+}
+
+func TestParseNormalBranch(t *testing.T) {
+	tests := []struct {
+		name          string
+		ref           string
+		wantStage     string
+		wantShortname string
+		wantErr       bool
+	}{
+		{"Dev", "matrixos/amd64/dev/gnome", "dev", "gnome", false},
+		{"Prod", "matrixos/amd64/gnome", "prod", "gnome", false},
+		{"Staging", "matrixos/amd64/staging/gnome", "staging", "gnome", false},
+		{"UnknownStage", "matrixos/amd64/stagin/gnome", "", "", true},
+		{"WithRemote", "origin:matrixos/amd64/dev/gnome", "dev", "gnome", false},
+		{"WrongOsName", "otheros/amd64/gnome", "", "", true},
+		{"WrongArch", "matrixos/arm64/gnome", "", "", true},
+		{"PrefixOnly", "matrixos/amd64/", "", "", true},
+		{"EmptyShortname", "matrixos/amd64/dev/", "", "", true},
+		{"Empty", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage, shortname, err := ParseNormalBranch(tt.ref, "matrixos", "amd64")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseNormalBranch(%q) should have failed", tt.ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stage != tt.wantStage || shortname != tt.wantShortname {
+				t.Errorf("ParseNormalBranch(%q) = (%q, %q), want (%q, %q)",
+					tt.ref, stage, shortname, tt.wantStage, tt.wantShortname)
+			}
+
+			// Round trip through BranchShortnameToNormal.
+			normal, err := BranchShortnameToNormal(stage, shortname, "matrixos", "amd64")
+			if err != nil {
+				t.Fatalf("BranchShortnameToNormal failed: %v", err)
+			}
+			if normal != CleanRemoteFromRef(tt.ref) {
+				t.Errorf("round trip = %q, want %q", normal, CleanRemoteFromRef(tt.ref))
+			}
+		})
+	}
 }
 
 func checkOstreeAvailable(t *testing.T) {
@@ -394,6 +552,154 @@ func TestDeploy(t *testing.T) {
 	}
 }
 
+func TestDeployStaged(t *testing.T) {
+	fakeCommit := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	repoDir := "/fake/repo"
+	ref := "matrixos/dev/gnome"
+
+	tests := []struct {
+		name        string
+		initialized bool
+		expected    func(sysroot string) []string
+	}{
+		{
+			name: "fresh sysroot",
+			expected: func(sysroot string) []string {
+				return []string{
+					fmt.Sprintf("ostree rev-parse --repo=%s %s", repoDir, ref),
+					fmt.Sprintf("ostree admin init-fs %s", sysroot),
+					fmt.Sprintf("ostree admin os-init matrixos --sysroot=%s", sysroot),
+					fmt.Sprintf("ostree pull-local --repo=%s/ostree/repo %s %s", sysroot, repoDir, fakeCommit),
+					fmt.Sprintf("ostree refs --repo=%s/ostree/repo --create=origin:%s %s", sysroot, ref, fakeCommit),
+					fmt.Sprintf("ostree config --repo=%s/ostree/repo set sysroot.bootloader none", sysroot),
+					fmt.Sprintf("ostree config --repo=%s/ostree/repo set sysroot.bootprefix false", sysroot),
+					fmt.Sprintf("ostree admin deploy --sysroot=%s --os=matrixos --karg-append=arg1=val1 --stage origin:%s", sysroot, ref),
+				}
+			},
+		},
+		{
+			name:        "initialized sysroot",
+			initialized: true,
+			expected: func(sysroot string) []string {
+				return []string{
+					fmt.Sprintf("ostree rev-parse --repo=%s/ostree/repo origin:%s", sysroot, ref),
+					fmt.Sprintf("ostree admin deploy --sysroot=%s --os=matrixos --karg-append=arg1=val1 --stage origin:%s", sysroot, ref),
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysroot := t.TempDir()
+			if tt.initialized {
+				if err := os.MkdirAll(filepath.Join(sysroot, "ostree", "deploy", "matrixos"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir":  {repoDir},
+					"Ostree.Sysroot":  {sysroot},
+					"Ostree.Remote":   {"origin"},
+					"matrixOS.OsName": {"matrixos"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var commands []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+				if len(args) > 0 && args[0] == "rev-parse" {
+					stdout.Write([]byte(fakeCommit + "\n"))
+				}
+				return nil
+			}
+
+			if err := o.DeployStaged(ref, []string{"arg1=val1"}, false); err != nil {
+				t.Fatalf("DeployStaged failed: %v", err)
+			}
+
+			expected := tt.expected(sysroot)
+			if len(commands) != len(expected) {
+				t.Fatalf("Expected %d commands, got %d: %v", len(expected), len(commands), commands)
+			}
+			for i := range expected {
+				if commands[i] != expected[i] {
+					t.Errorf("Command %d mismatch:\nGot:  %s\nWant: %s", i, commands[i], expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDeployWithOptions(t *testing.T) {
+	fakeCommit := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	ref := "matrixos/dev/gnome"
+
+	tests := []struct {
+		name     string
+		opts     DeployOptions
+		expected []string
+	}{
+		{"none", DeployOptions{}, nil},
+		{"retain rollback", DeployOptions{RetainRollback: true}, []string{"--retain-rollback"}},
+		{"retain", DeployOptions{Retain: true}, []string{"--retain"}},
+		{"no merge", DeployOptions{NoMerge: true}, []string{"--no-merge"}},
+		{
+			"all",
+			DeployOptions{RetainRollback: true, Retain: true, NoMerge: true},
+			[]string{"--retain-rollback", "--retain", "--no-merge"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysroot := t.TempDir()
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir":  {"/fake/repo"},
+					"Ostree.Sysroot":  {sysroot},
+					"Ostree.Remote":   {"origin"},
+					"matrixOS.OsName": {"matrixos"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var deployCmd []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				if len(args) > 0 && args[0] == "rev-parse" {
+					stdout.Write([]byte(fakeCommit + "\n"))
+				}
+				if len(args) > 1 && args[0] == "admin" && args[1] == "deploy" {
+					deployCmd = args
+				}
+				return nil
+			}
+
+			if err := o.DeployWithOptions(ref, nil, tt.opts, false); err != nil {
+				t.Fatalf("DeployWithOptions failed: %v", err)
+			}
+
+			expected := append([]string{
+				"admin", "deploy", "--sysroot=" + sysroot, "--os=matrixos",
+			}, tt.expected...)
+			expected = append(expected, "origin:"+ref)
+			got := strings.Join(deployCmd, " ")
+			want := strings.Join(expected, " ")
+			if got != want {
+				t.Errorf("Deploy command mismatch:\nGot:  %s\nWant: %s", got, want)
+			}
+		})
+	}
+}
+
 func TestDeployIntegration(t *testing.T) {
 	checkOstreeAvailable(t)
 	if os.Getuid() != 0 {
@@ -635,66 +941,336 @@ func TestOstreeCommandsMocked(t *testing.T) {
 	}
 }
 
-func TestBootedStatus(t *testing.T) {
+func TestPruneConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   map[string][]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Defaults",
+			want: "--repo=/repo prune --depth=5 --refs-only --keep-younger-than=2023-01-01 --only-branch=ref",
+		},
+		{
+			name:  "CustomDepth",
+			items: map[string][]string{"Ostree.PruneDepth": {"10"}},
+			want:  "--repo=/repo prune --depth=10 --refs-only --keep-younger-than=2023-01-01 --only-branch=ref",
+		},
+		{
+			name:  "FullHistory",
+			items: map[string][]string{"Ostree.PruneDepth": {"-1"}},
+			want:  "--repo=/repo prune --depth=-1 --refs-only --keep-younger-than=2023-01-01 --only-branch=ref",
+		},
+		{
+			name:  "NoRefsOnly",
+			items: map[string][]string{"Ostree.PruneRefsOnly": {"false"}},
+			want:  "--repo=/repo prune --depth=5 --keep-younger-than=2023-01-01 --only-branch=ref",
+		},
+		{
+			name:    "InvalidDepth",
+			items:   map[string][]string{"Ostree.PruneDepth": {"-2"}},
+			wantErr: true,
+		},
+		{
+			name:    "NonNumericDepth",
+			items:   map[string][]string{"Ostree.PruneDepth": {"five"}},
+			wantErr: true,
+		},
+		{
+			name:    "InvalidRefsOnly",
+			items:   map[string][]string{"Ostree.PruneRefsOnly": {"maybe"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := map[string][]string{
+				"Ostree.RepoDir":                {"/repo"},
+				"Ostree.KeepObjectsYoungerThan": {"2023-01-01"},
+			}
+			for k, v := range tt.items {
+				items[k] = v
+			}
+			o, err := NewOstree(&config.MockConfig{Items: items})
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var cmds []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				cmds = append(cmds, strings.Join(args, " "))
+				return nil
+			}
+
+			err = o.Prune("ref", false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if len(cmds) != 0 {
+					t.Errorf("expected no commands, got %v", cmds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+			if len(cmds) != 1 || cmds[0] != tt.want {
+				t.Errorf("Command mismatch:\nGot:  %v\nWant: %s", cmds, tt.want)
+			}
+		})
+	}
+}
+
+func TestInRootVariants(t *testing.T) {
+	root := "/myroot"
 	cfg := &config.MockConfig{
 		Items: map[string][]string{
-			"Ostree.Root": {"/"},
+			"Ostree.Root":                   {root},
+			"Ostree.RepoDir":                {"/configured/repo"},
+			"Ostree.KeepObjectsYoungerThan": {"2023-01-01"},
 		},
 	}
 	o, err := NewOstree(cfg)
 	if err != nil {
 		t.Fatalf("NewOstree failed: %v", err)
 	}
-
+	var cmds [][]string
 	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
-		// Mock ostree admin status --json
-		jsonOutput := `{
-			"deployments": [
-				{
-					"booted": true,
-					"checksum": "hash123",
-					"refspec": "origin:branch"
-				},
-				{
-					"booted": false,
-					"checksum": "hash456",
-					"refspec": "origin:old"
-				}
-			]
-		}`
-		stdout.Write([]byte(jsonOutput))
+		cmds = append(cmds, args)
+		if slices.Contains(args, "rev-parse") {
+			fmt.Fprintln(stdout, "commit-hash")
+		}
 		return nil
 	}
+	wantRepo := "--repo=" + filepath.Join(root, "ostree", "repo")
 
-	ref, err := o.BootedRef(false)
-	if err != nil {
-		t.Fatalf("BootedRef failed: %v", err)
-	}
-	if ref != "origin:branch" {
-		t.Errorf("BootedRef = %q, want origin:branch", ref)
-	}
-
-	hash, err := o.BootedHash(false)
-	if err != nil {
-		t.Fatalf("BootedHash failed: %v", err)
-	}
-	if hash != "hash123" {
-		t.Errorf("BootedHash = %q, want hash123", hash)
-	}
-}
+	t.Run("PruneInRoot", func(t *testing.T) {
+		cmds = nil
+		if err := o.PruneInRoot("ref", false); err != nil {
+			t.Fatalf("PruneInRoot failed: %v", err)
+		}
+		if len(cmds) != 1 || cmds[0][0] != wantRepo || cmds[0][1] != "prune" {
+			t.Errorf("PruneInRoot commands = %v, want prune with %s", cmds, wantRepo)
+		}
+	})
 
-func TestSetupEnvironment(t *testing.T) {
-	os.Unsetenv("LC_TIME")
-	SetupEnvironment()
-	if got := os.Getenv("LC_TIME"); got != "C" {
-		t.Errorf("LC_TIME = %q, want C", got)
-	}
-}
+	t.Run("GenerateStaticDeltaInRoot", func(t *testing.T) {
+		cmds = nil
+		if err := o.GenerateStaticDeltaInRoot("ref", false); err != nil {
+			t.Fatalf("GenerateStaticDeltaInRoot failed: %v", err)
+		}
+		if len(cmds) == 0 {
+			t.Fatal("no command run")
+		}
+		for _, cmd := range cmds {
+			if !slices.Contains(cmd, wantRepo) {
+				t.Errorf("command %v does not use %s", cmd, wantRepo)
+			}
+		}
+		last := cmds[len(cmds)-1]
+		if len(last) < 3 || last[1] != "static-delta" || last[2] != "generate" {
+			t.Errorf("last command = %v, want static-delta generate", last)
+		}
+	})
 
-func TestGpgHelpers(t *testing.T) {
-	if got := GpgSignedFilePath("file"); got != "file.asc" {
-		t.Errorf("GpgSignedFilePath(file) = %q, want file.asc", got)
-	}
+	t.Run("MissingRoot", func(t *testing.T) {
+		o, err := NewOstree(&config.MockConfig{})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		if err := o.PruneInRoot("ref", false); err == nil {
+			t.Error("PruneInRoot should fail without Ostree.Root")
+		}
+		if err := o.GenerateStaticDeltaInRoot("ref", false); err == nil {
+			t.Error("GenerateStaticDeltaInRoot should fail without Ostree.Root")
+		}
+	})
+}
+
+func TestPrunePreview(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		wantBytes   uint64
+		wantObjects int
+	}{
+		{
+			name:        "WouldDelete",
+			output:      "Total objects: 36524\nWould delete: 1234 objects, freeing 56.7 MB\n",
+			wantBytes:   56700000,
+			wantObjects: 1234,
+		},
+		{
+			name:        "SingleObject",
+			output:      "Total objects: 10\nWould delete: 1 object, freeing 512 bytes\n",
+			wantBytes:   512,
+			wantObjects: 1,
+		},
+		{
+			name:   "NothingToPrune",
+			output: "Total objects: 36524\nNo unreachable objects\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir":                {"/repo"},
+					"Ostree.KeepObjectsYoungerThan": {"2023-01-01"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var cmd string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				cmd = strings.Join(append([]string{name}, args...), " ")
+				fmt.Fprint(stdout, tt.output)
+				return nil
+			}
+
+			freed, objects, err := o.PrunePreview("matrixos/amd64/gnome", false)
+			if err != nil {
+				t.Fatalf("PrunePreview failed: %v", err)
+			}
+			want := "ostree --repo=/repo prune --depth=5 --refs-only --keep-younger-than=2023-01-01 --only-branch=matrixos/amd64/gnome --no-prune"
+			if cmd != want {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", cmd, want)
+			}
+			if freed != tt.wantBytes {
+				t.Errorf("freedBytes = %d, want %d", freed, tt.wantBytes)
+			}
+			if objects != tt.wantObjects {
+				t.Errorf("prunedObjects = %d, want %d", objects, tt.wantObjects)
+			}
+		})
+	}
+}
+
+func TestGenerateStaticDeltaBetween(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "FromTo",
+			from: "aaa111",
+			to:   "bbb222",
+			want: "ostree --repo=/repo static-delta generate --to=bbb222 --inline --min-fallback-size=0 --disable-bsdiff --max-chunk-size=64 --from=aaa111",
+		},
+		{
+			name: "EmptyFrom",
+			to:   "bbb222",
+			want: "ostree --repo=/repo static-delta generate --to=bbb222 --inline --min-fallback-size=0 --disable-bsdiff --max-chunk-size=64 --empty",
+		},
+		{
+			name:    "MissingTo",
+			from:    "aaa111",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir": {"/repo"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var commands []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+				return nil
+			}
+
+			err = o.GenerateStaticDeltaBetween(tt.from, tt.to, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GenerateStaticDeltaBetween failed: %v", err)
+			}
+			if len(commands) != 1 || commands[0] != tt.want {
+				t.Errorf("Command mismatch:\nGot:  %v\nWant: %s", commands, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootedStatus(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {"/"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		// Mock ostree admin status --json
+		jsonOutput := `{
+			"deployments": [
+				{
+					"booted": true,
+					"checksum": "hash123",
+					"refspec": "origin:branch"
+				},
+				{
+					"booted": false,
+					"checksum": "hash456",
+					"refspec": "origin:old"
+				}
+			]
+		}`
+		stdout.Write([]byte(jsonOutput))
+		return nil
+	}
+
+	ref, err := o.BootedRef(false)
+	if err != nil {
+		t.Fatalf("BootedRef failed: %v", err)
+	}
+	if ref != "origin:branch" {
+		t.Errorf("BootedRef = %q, want origin:branch", ref)
+	}
+
+	hash, err := o.BootedHash(false)
+	if err != nil {
+		t.Fatalf("BootedHash failed: %v", err)
+	}
+	if hash != "hash123" {
+		t.Errorf("BootedHash = %q, want hash123", hash)
+	}
+}
+
+func TestSetupEnvironment(t *testing.T) {
+	os.Unsetenv("LC_TIME")
+	SetupEnvironment()
+	if got := os.Getenv("LC_TIME"); got != "C" {
+		t.Errorf("LC_TIME = %q, want C", got)
+	}
+}
+
+func TestGpgHelpers(t *testing.T) {
+	if got := GpgSignedFilePath("file"); got != "file.asc" {
+		t.Errorf("GpgSignedFilePath(file) = %q, want file.asc", got)
+	}
 }
 
 func TestPatchGpgHomeDir(t *testing.T) {
@@ -752,38 +1328,201 @@ func TestGpgKeyID(t *testing.T) {
 	}
 }
 
-func TestBootCommit(t *testing.T) {
-	sysroot := t.TempDir()
-	osName := "matrixos"
+func TestSignSummary(t *testing.T) {
+	t.Run("GpgDisabled", func(t *testing.T) {
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"Ostree.RepoDir": {"/repo"},
+			},
+			Bools: map[string]bool{"Ostree.Gpg": false},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		called := false
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			called = true
+			return nil
+		}
+		if err := o.SignSummary(false); err == nil {
+			t.Fatal("expected error when GPG is disabled")
+		}
+		if called {
+			t.Error("no command should run when GPG is disabled")
+		}
+	})
 
-	cfg := &config.MockConfig{
-		Items: map[string][]string{
-			"matrixOS.OsName": {osName},
+	t.Run("GpgEnabled", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		pubKey := filepath.Join(tmpDir, "pub.key")
+		if err := os.WriteFile(pubKey, []byte("dummy"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		homeDir := filepath.Join(tmpDir, "gpg")
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"Ostree.RepoDir":       {"/repo"},
+				"Ostree.DevGpgHomedir": {homeDir},
+				"Ostree.GpgPublicKey":  {pubKey},
+			},
+			Bools: map[string]bool{"Ostree.Gpg": true},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		var lastCmd string
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			if name == "gpg" && slices.Contains(args, "--show-keys") {
+				fmt.Fprintln(stdout, "pub:u:4096:1:KEYID123:1678752000:::u:::scESC:")
+				return nil
+			}
+			lastCmd = strings.Join(append([]string{name}, args...), " ")
+			return nil
+		}
+
+		if err := o.SignSummary(false); err != nil {
+			t.Fatalf("SignSummary failed: %v", err)
+		}
+		want := "ostree --repo=/repo summary --gpg-sign=KEYID123 --gpg-homedir=" + homeDir
+		if lastCmd != want {
+			t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", lastCmd, want)
+		}
+	})
+}
+
+func TestGpgKeyExpiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		pubLine     string
+		wantExpiry  time.Time
+		wantExpired bool
+	}{
+		{
+			name:        "Expired",
+			pubLine:     "pub:e:4096:1:3260D9CC6D9275DD:1678752000:1710374400::u:::sc:",
+			wantExpiry:  time.Unix(1710374400, 0),
+			wantExpired: true,
+		},
+		{
+			name:       "Valid",
+			pubLine:    "pub:u:4096:1:3260D9CC6D9275DD:1678752000:4102444800::u:::scESC:",
+			wantExpiry: time.Unix(4102444800, 0),
+		},
+		{
+			name:    "NoExpiry",
+			pubLine: "pub:u:4096:1:3260D9CC6D9275DD:1678752000:::u:::scESC:",
 		},
-	}
-	o, err := NewOstree(cfg)
-	if err != nil {
-		t.Fatalf("NewOstree failed: %v", err)
 	}
 
-	// Setup directory structure: sysroot/ostree/boot.1/matrixos/COMMIT_HASH
-	bootDir := filepath.Join(sysroot, "ostree", "boot.1", osName)
-	if err := os.MkdirAll(bootDir, 0755); err != nil {
-		t.Fatal(err)
-	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			pubKey := filepath.Join(tmpDir, "pub.key")
+			if err := os.WriteFile(pubKey, []byte("dummy"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.DevGpgHomedir": {filepath.Join(tmpDir, "gpg")},
+					"Ostree.GpgPublicKey":  {pubKey},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				fmt.Fprintln(stdout, tt.pubLine)
+				return nil
+			}
 
-	commitHash := "a1b2c3d4"
-	if err := os.Mkdir(filepath.Join(bootDir, commitHash), 0755); err != nil {
-		t.Fatal(err)
+			expiry, expired, err := o.GpgKeyExpiry()
+			if err != nil {
+				t.Fatalf("GpgKeyExpiry failed: %v", err)
+			}
+			if !expiry.Equal(tt.wantExpiry) {
+				t.Errorf("expiry = %v, want %v", expiry, tt.wantExpiry)
+			}
+			if expired != tt.wantExpired {
+				t.Errorf("expired = %v, want %v", expired, tt.wantExpired)
+			}
+		})
 	}
+}
 
-	got, err := o.BootCommit(sysroot)
-	if err != nil {
-		t.Fatalf("BootCommit failed: %v", err)
-	}
-	if got != commitHash {
-		t.Errorf("BootCommit = %q, want %q", got, commitHash)
+func TestBootCommit(t *testing.T) {
+	const osName = "matrixos"
+	const statusJSON = `{"deployments": [{"checksum": "c0ffee", "booted": true}]}`
+
+	// setup creates ostree/boot.1/matrixos/<bootDir>/0 links to the
+	// deployment dir of each given checksum.
+	setup := func(t *testing.T, links map[string]string) (*Ostree, string) {
+		sysroot := t.TempDir()
+		bootPrefix := filepath.Join(sysroot, "ostree", "boot.1", osName)
+		if err := os.MkdirAll(bootPrefix, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for bootDir, checksum := range links {
+			if err := os.Mkdir(filepath.Join(bootPrefix, bootDir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			target := "../../../deploy/" + osName + "/deploy/" + checksum + ".0"
+			if err := os.Symlink(target, filepath.Join(bootPrefix, bootDir, "0")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"matrixOS.OsName": {osName},
+			},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = func(_ io.Reader, stdout, _ io.Writer, _ string, args ...string) error {
+			if !slices.Equal(args, []string{"--sysroot=" + sysroot, "admin", "status", "--json"}) {
+				t.Errorf("unexpected ostree args: %v", args)
+			}
+			io.WriteString(stdout, statusJSON)
+			return nil
+		}
+		return o, sysroot
 	}
+
+	t.Run("One", func(t *testing.T) {
+		o, sysroot := setup(t, map[string]string{"a1b2c3d4": "c0ffee"})
+		got, err := o.BootCommit(sysroot)
+		if err != nil {
+			t.Fatalf("BootCommit failed: %v", err)
+		}
+		if got != "a1b2c3d4" {
+			t.Errorf("BootCommit = %q, want %q", got, "a1b2c3d4")
+		}
+	})
+
+	t.Run("Zero", func(t *testing.T) {
+		o, sysroot := setup(t, nil)
+		if _, err := o.BootCommit(sysroot); err == nil || !strings.Contains(err.Error(), "no commit found") {
+			t.Errorf("expected a no commit error, got %v", err)
+		}
+	})
+
+	t.Run("Two", func(t *testing.T) {
+		o, sysroot := setup(t, map[string]string{"a1b2c3d4": "c0ffee", "e5f6a7b8": "c0ffee"})
+		if _, err := o.BootCommit(sysroot); err == nil || !strings.Contains(err.Error(), "multiple boot directories") {
+			t.Errorf("expected an ambiguous boot commit error, got %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		o, sysroot := setup(t, map[string]string{"a1b2c3d4": "deadbeef"})
+		if _, err := o.BootCommit(sysroot); err == nil || !strings.Contains(err.Error(), "does not match any deployment") {
+			t.Errorf("expected a mismatch error, got %v", err)
+		}
+	})
 }
 
 func TestMaybeInitializeRemote(t *testing.T) {
@@ -818,6 +1557,37 @@ func TestMaybeInitializeRemote(t *testing.T) {
 	}
 }
 
+func TestMaybeInitializeRemoteExtraArgs(t *testing.T) {
+	var cmds []string
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir":         {repoDir},
+			"Ostree.Remote":          {"origin"},
+			"Ostree.RemoteUrl":       {"http://url"},
+			"Ostree.RemoteExtraArgs": {"--set=tls-permissive=true --no-sign-verify"},
+		},
+		Bools: map[string]bool{"Ostree.Gpg": false},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		cmds = append(cmds, strings.Join(args, " "))
+		return nil
+	}
+
+	if err := o.MaybeInitializeRemote(false); err != nil {
+		t.Fatalf("MaybeInitializeRemote failed: %v", err)
+	}
+	want := "--repo=" + repoDir + " remote add --no-gpg-verify --set=tls-permissive=true --no-sign-verify origin http://url"
+	if !slices.Contains(cmds, want) {
+		t.Errorf("commands = %v, want %q", cmds, want)
+	}
+}
+
 func TestAddRemoteWithSysroot(t *testing.T) {
 	var lastArgs []string
 	cfg := &config.MockConfig{
@@ -854,7 +1624,190 @@ func TestAddRemoteWithSysroot(t *testing.T) {
 	}
 }
 
-func TestGpgSignFile(t *testing.T) {
+// newRecordingOstree returns an Ostree configured with items whose runner
+// records every command, as its space separated arguments. respond, if not
+// nil, produces the output and the error of each command.
+func newRecordingOstree(t *testing.T, items map[string][]string, respond func(stdout io.Writer, args []string) error) (*Ostree, *[]string) {
+	t.Helper()
+	o, err := NewOstree(&config.MockConfig{Items: items})
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	var cmds []string
+	o.runner = func(_ io.Reader, stdout, _ io.Writer, _ string, args ...string) error {
+		cmds = append(cmds, strings.Join(args, " "))
+		if respond == nil {
+			return nil
+		}
+		return respond(stdout, args)
+	}
+	return o, &cmds
+}
+
+func TestAddRemoteExtraArgs(t *testing.T) {
+	repoDir := t.TempDir()
+
+	t.Run("Inserted", func(t *testing.T) {
+		o, cmds := newRecordingOstree(t, map[string][]string{
+			"Ostree.RepoDir":         {repoDir},
+			"Ostree.Remote":          {"origin"},
+			"Ostree.RemoteUrl":       {"http://url"},
+			"Ostree.RemoteExtraArgs": {"--set=tls-permissive=true  --no-sign-verify"},
+		}, nil)
+		if err := o.AddRemote(false); err != nil {
+			t.Fatalf("AddRemote failed: %v", err)
+		}
+		want := "--set=tls-permissive=true --no-sign-verify origin http://url"
+		if len(*cmds) != 1 || !strings.HasSuffix((*cmds)[0], want) {
+			t.Errorf("AddRemote commands = %v, want suffix %q", *cmds, want)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, extra := range []string{"contenturl=http://mirror", "-v", "--=x", "--"} {
+			o, cmds := newRecordingOstree(t, map[string][]string{
+				"Ostree.RepoDir":         {repoDir},
+				"Ostree.Remote":          {"origin"},
+				"Ostree.RemoteUrl":       {"http://url"},
+				"Ostree.RemoteExtraArgs": {extra},
+			}, nil)
+			if err := o.AddRemote(false); err == nil {
+				t.Errorf("AddRemote with extra %q should fail", extra)
+			}
+			if len(*cmds) != 0 {
+				t.Errorf("ostree should not run with extra %q, ran %v", extra, *cmds)
+			}
+		}
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		o, _ := newRecordingOstree(t, nil, nil)
+		err := o.addRemote(AddRemoteOptions{
+			Remote:    "origin",
+			RemoteURL: "http://url",
+			ExtraArgs: []string{"origin2"},
+		}, false)
+		if err == nil {
+			t.Error("addRemote should reject a positional extra argument")
+		}
+	})
+}
+
+func TestAddRemoteTlsClientCert(t *testing.T) {
+	tmpDir := t.TempDir()
+	cert := filepath.Join(tmpDir, "client.crt")
+	key := filepath.Join(tmpDir, "client.key")
+	for _, p := range []string{cert, key} {
+		if err := os.WriteFile(p, []byte("pem"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items := map[string][]string{
+		"Ostree.Remote":        {"origin"},
+		"Ostree.RemoteUrl":     {"https://url"},
+		"Ostree.TlsClientCert": {cert},
+		"Ostree.TlsClientKey":  {key},
+	}
+	tlsArgs := "--set=tls-client-cert-path=" + cert + " --set=tls-client-key-path=" + key
+
+	t.Run("AddRemote", func(t *testing.T) {
+		items["Ostree.RepoDir"] = []string{t.TempDir()}
+		o, cmds := newRecordingOstree(t, items, nil)
+		if err := o.AddRemote(false); err != nil {
+			t.Fatalf("AddRemote failed: %v", err)
+		}
+		if len(*cmds) != 1 || !strings.HasSuffix((*cmds)[0], tlsArgs+" origin https://url") {
+			t.Errorf("AddRemote commands = %v, want TLS args %q", *cmds, tlsArgs)
+		}
+	})
+
+	t.Run("MaybeInitializeRemote", func(t *testing.T) {
+		items["Ostree.RepoDir"] = []string{t.TempDir()}
+		o, cmds := newRecordingOstree(t, items, nil)
+		if err := o.MaybeInitializeRemote(false); err != nil {
+			t.Fatalf("MaybeInitializeRemote failed: %v", err)
+		}
+		found := false
+		for _, cmd := range *cmds {
+			if strings.Contains(cmd, "remote add") {
+				found = strings.HasSuffix(cmd, tlsArgs+" origin https://url")
+			}
+		}
+		if !found {
+			t.Errorf("remote add missing TLS args %q: %v", tlsArgs, *cmds)
+		}
+	})
+
+	t.Run("ExistingRemote", func(t *testing.T) {
+		repoDir := t.TempDir()
+		items["Ostree.RepoDir"] = []string{repoDir}
+		o, cmds := newRecordingOstree(t, items, func(stdout io.Writer, args []string) error {
+			if len(args) >= 3 && args[1] == "remote" {
+				switch args[2] {
+				case "list":
+					fmt.Fprintln(stdout, "origin")
+				case "show-url":
+					fmt.Fprintln(stdout, "https://url")
+				}
+			}
+			return nil
+		})
+		if err := o.MaybeInitializeRemote(false); err != nil {
+			t.Fatalf("MaybeInitializeRemote failed: %v", err)
+		}
+		for _, want := range []string{
+			"--repo=" + repoDir + ` config set remote "origin".tls-client-cert-path ` + cert,
+			"--repo=" + repoDir + ` config set remote "origin".tls-client-key-path ` + key,
+		} {
+			if !slices.Contains(*cmds, want) {
+				t.Errorf("commands = %v, want %q", *cmds, want)
+			}
+		}
+		for _, cmd := range *cmds {
+			if strings.Contains(cmd, "remote add") {
+				t.Errorf("remote should not be added again: %v", *cmds)
+			}
+		}
+	})
+
+	t.Run("OnlyOne", func(t *testing.T) {
+		for _, tc := range [][2]string{{cert, ""}, {"", key}} {
+			o, cmds := newRecordingOstree(t, map[string][]string{
+				"Ostree.RepoDir":       {t.TempDir()},
+				"Ostree.Remote":        {"origin"},
+				"Ostree.RemoteUrl":     {"https://url"},
+				"Ostree.TlsClientCert": {tc[0]},
+				"Ostree.TlsClientKey":  {tc[1]},
+			}, nil)
+			if err := o.AddRemote(false); err == nil {
+				t.Errorf("AddRemote with cert %q and key %q should fail", tc[0], tc[1])
+			}
+			if err := o.MaybeInitializeRemote(false); err == nil {
+				t.Errorf("MaybeInitializeRemote with cert %q and key %q should fail", tc[0], tc[1])
+			}
+			for _, cmd := range *cmds {
+				if strings.Contains(cmd, "remote add") {
+					t.Errorf("remote should not be added: %v", *cmds)
+				}
+			}
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		o, _ := newRecordingOstree(t, map[string][]string{
+			"Ostree.RepoDir":       {t.TempDir()},
+			"Ostree.Remote":        {"origin"},
+			"Ostree.RemoteUrl":     {"https://url"},
+			"Ostree.TlsClientCert": {cert},
+			"Ostree.TlsClientKey":  {filepath.Join(tmpDir, "missing.key")},
+		}, nil)
+		if err := o.AddRemote(false); err == nil {
+			t.Error("AddRemote with a missing key should fail")
+		}
+	})
+}
+
+func TestGpgSignFile(t *testing.T) {
 	var cmds []string
 	tmpDir := t.TempDir()
 	dummyFile := filepath.Join(tmpDir, "file.txt")
@@ -908,6 +1861,60 @@ func TestGpgSignFile(t *testing.T) {
 	}
 }
 
+func TestGpgExportPublicKey(t *testing.T) {
+	const armored = "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmQINBGQfake\n-----END PGP PUBLIC KEY BLOCK-----\n"
+
+	tmpDir := t.TempDir()
+	pubKey := filepath.Join(tmpDir, "pub.key")
+	if err := os.WriteFile(pubKey, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	homeDir := filepath.Join(tmpDir, "gpg")
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.DevGpgHomedir": {homeDir},
+			"Ostree.GpgPublicKey":  {pubKey},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var exportCmd []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		if slices.Contains(args, "--show-keys") {
+			fmt.Fprintln(stdout, "pub:u:4096:1:KEYID123:1678752000:::u:::scESC:")
+			return nil
+		}
+		exportCmd = append([]string{name}, args...)
+		fmt.Fprint(stdout, armored)
+		return nil
+	}
+
+	outPath := filepath.Join(tmpDir, "release", "matrixos.asc")
+	if err := o.GpgExportPublicKey(outPath); err != nil {
+		t.Fatalf("GpgExportPublicKey failed: %v", err)
+	}
+
+	want := "gpg --homedir " + homeDir + " --armor --export KEYID123"
+	if got := strings.Join(exportCmd, " "); got != want {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", got, want)
+	}
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("failed to read exported key: %v", err)
+	}
+	if string(data) != armored {
+		t.Errorf("exported key = %q, want %q", data, armored)
+	}
+
+	if err := o.GpgExportPublicKey(""); err == nil {
+		t.Error("expected error for empty outPath")
+	}
+}
+
 func TestImportGpgKey(t *testing.T) {
 	var lastArgs []string
 	tmpDir := t.TempDir()
@@ -1079,12 +2086,11 @@ func TestMaybeInitializeGpg(t *testing.T) {
 		t.Fatalf("MaybeInitializeGpg failed: %v", err)
 	}
 
-	// We expect calls for each key:
-	// 1. ImportGpgKey (gpg --import)
-	// 2. remote gpg-import (ostree remote gpg-import)
+	// We expect a single gpg --import call for all the keys, then one
+	// remote gpg-import (ostree remote gpg-import) call for each key.
 	// Keys: priv, pub, off. (pub is best, off is different)
 
-	// We should see at least 3 ostree remote gpg-import calls and 3 gpg --import calls.
+	// We should see 3 ostree remote gpg-import calls and 1 gpg --import call.
 	ostreeImports := 0
 	gpgImports := 0
 
@@ -1107,8 +2113,8 @@ func TestMaybeInitializeGpg(t *testing.T) {
 	if ostreeImports != 3 {
 		t.Errorf("Expected 3 ostree remote gpg-import calls, got %d", ostreeImports)
 	}
-	if gpgImports != 3 {
-		t.Errorf("Expected 3 gpg --import calls, got %d", gpgImports)
+	if gpgImports != 1 {
+		t.Errorf("Expected 1 gpg --import call, got %d", gpgImports)
 	}
 }
 
@@ -1221,17 +2227,17 @@ func TestInitializeSigningGpg(t *testing.T) {
 		t.Fatalf("InitializeSigningGpg failed: %v", err)
 	}
 
-	gpgImports := 0
+	var gpgImports [][]string
 	for _, cmd := range cmds {
-		for _, arg := range cmd {
-			if arg == "--import" {
-				gpgImports++
-				break
-			}
+		if slices.Contains(cmd, "--import") {
+			gpgImports = append(gpgImports, cmd)
 		}
 	}
-	if gpgImports != 3 {
-		t.Errorf("Expected 3 gpg --import calls, got %d", gpgImports)
+	if len(gpgImports) != 1 {
+		t.Fatalf("Expected 1 gpg --import call, got %d", len(gpgImports))
+	}
+	if !slices.Contains(gpgImports[0], privKey) || !slices.Contains(gpgImports[0], pubKey) || !slices.Contains(gpgImports[0], offKey) {
+		t.Errorf("gpg --import call missing keys: %v", gpgImports[0])
 	}
 
 	// Ensure NO ostree remote gpg-import calls were made
@@ -1242,6 +2248,71 @@ func TestInitializeSigningGpg(t *testing.T) {
 	}
 }
 
+func TestImportGpgKeys(t *testing.T) {
+	type call struct {
+		name string
+		args []string
+	}
+	var calls []call
+	tmpDir := t.TempDir()
+	key1 := filepath.Join(tmpDir, "key1.asc")
+	key2 := filepath.Join(tmpDir, "key2.asc")
+	missing := filepath.Join(tmpDir, "missing.asc")
+	for _, f := range []string{key1, key2} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir":       {"/repo"},
+			"Ostree.Remote":        {"origin"},
+			"Ostree.DevGpgHomedir": {filepath.Join(tmpDir, "gpg")},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		calls = append(calls, call{name, args})
+		return nil
+	}
+
+	if err := o.ImportGpgKeys([]string{key1, missing, key2}); err != nil {
+		t.Fatalf("ImportGpgKeys failed: %v", err)
+	}
+
+	var gpgCalls, remoteImports []call
+	for _, c := range calls {
+		switch {
+		case c.name == "gpg":
+			gpgCalls = append(gpgCalls, c)
+		case len(c.args) > 2 && c.args[1] == "remote" && c.args[2] == "gpg-import":
+			remoteImports = append(remoteImports, c)
+		}
+	}
+
+	if len(gpgCalls) != 1 {
+		t.Fatalf("Expected 1 gpg call, got %d", len(gpgCalls))
+	}
+	gpgArgs := gpgCalls[0].args
+	if i := slices.Index(gpgArgs, "--import"); i < 0 || !slices.Equal(gpgArgs[i+1:], []string{key1, key2}) {
+		t.Errorf("gpg --import args mismatch: %v", gpgArgs)
+	}
+
+	if len(remoteImports) != 2 {
+		t.Fatalf("Expected 2 ostree remote gpg-import calls, got %d", len(remoteImports))
+	}
+	for i, key := range []string{key1, key2} {
+		want := "--repo=/repo remote gpg-import origin -k " + key
+		if got := strings.Join(remoteImports[i].args, " "); got != want {
+			t.Errorf("Command %d mismatch:\nGot:  %s\nWant: %s", i, got, want)
+		}
+	}
+}
+
 func TestInitializeRemoteSigningGpg(t *testing.T) {
 	var cmds [][]string
 	tmpDir := t.TempDir()
@@ -1340,6 +2411,207 @@ func TestPullWithRemoteExplicit(t *testing.T) {
 	}
 }
 
+func TestPullWithDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		depth   int
+		want    string
+		wantErr bool
+	}{
+		{name: "FullHistory", ref: "origin:matrixos/amd64/gnome", depth: -1, want: "ostree --repo=/repo pull --depth=-1 origin matrixos/amd64/gnome"},
+		{name: "CommitOnly", ref: "origin:matrixos/amd64/gnome", depth: 0, want: "ostree --repo=/repo pull --depth=0 origin matrixos/amd64/gnome"},
+		{name: "Depth", ref: "origin:matrixos/amd64/gnome", depth: 5, want: "ostree --repo=/repo pull --depth=5 origin matrixos/amd64/gnome"},
+		{name: "MissingRemote", ref: "matrixos/amd64/gnome", depth: 1, wantErr: true},
+		{name: "InvalidDepth", ref: "origin:matrixos/amd64/gnome", depth: -2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir": {"/repo"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var commands []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+				return nil
+			}
+
+			err = o.PullWithDepth(tt.ref, tt.depth, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if len(commands) != 0 {
+					t.Errorf("expected no commands, got %v", commands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PullWithDepth failed: %v", err)
+			}
+			if len(commands) != 1 || commands[0] != tt.want {
+				t.Errorf("Command mismatch:\nGot:  %v\nWant: %s", commands, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRefsWithCommits(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {"/repo"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	commits := map[string]string{
+		"matrixos/amd64/gnome":         "1111111111111111111111111111111111111111111111111111111111111111",
+		"matrixos/amd64/server":        "2222222222222222222222222222222222222222222222222222222222222222",
+		"origin:matrixos/amd64/cosmic": "3333333333333333333333333333333333333333333333333333333333333333",
+	}
+	var listArgs []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		switch {
+		case len(args) >= 2 && args[1] == "refs":
+			listArgs = args
+			fmt.Fprintln(stdout, "matrixos/amd64/gnome")
+			fmt.Fprintln(stdout, "ostree-metadata")
+			fmt.Fprintln(stdout, "matrixos/amd64/server")
+			fmt.Fprintln(stdout, "origin:matrixos/amd64/cosmic")
+		case len(args) >= 3 && args[0] == "rev-parse":
+			commit, ok := commits[args[2]]
+			if !ok {
+				return fmt.Errorf("unexpected rev-parse of %s", args[2])
+			}
+			fmt.Fprintln(stdout, commit)
+		}
+		return nil
+	}
+
+	got, err := o.LocalRefsWithCommits(false)
+	if err != nil {
+		t.Fatalf("LocalRefsWithCommits failed: %v", err)
+	}
+	if want := []string{"--repo=/repo", "refs"}; !slices.Equal(listArgs, want) {
+		t.Errorf("refs args = %v, want %v", listArgs, want)
+	}
+	if len(got) != len(commits) {
+		t.Errorf("got %d refs, want %d: %v", len(got), len(commits), got)
+	}
+	for ref, want := range commits {
+		if got[ref] != want {
+			t.Errorf("commit of %s = %q, want %q", ref, got[ref], want)
+		}
+	}
+	if _, ok := got[ostreeMetadataRef]; ok {
+		t.Errorf("%s should be excluded", ostreeMetadataRef)
+	}
+}
+
+func TestRepoSize(t *testing.T) {
+	t.Run("SumsObjects", func(t *testing.T) {
+		repoDir := t.TempDir()
+		objects := map[string]int{
+			"objects/ab/cdef.commit":  120,
+			"objects/12/3456.filez":   4096,
+			"objects/12/7890.dirtree": 64,
+		}
+		for name, size := range objects {
+			path := filepath.Join(repoDir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Files outside of objects/ are not part of the object store.
+		if err := os.WriteFile(filepath.Join(repoDir, "summary"), make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := NewOstree(&config.MockConfig{
+			Items: map[string][]string{"Ostree.RepoDir": {repoDir}},
+		})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		size, err := o.RepoSize()
+		if err != nil {
+			t.Fatalf("RepoSize failed: %v", err)
+		}
+		if size != 120+4096+64 {
+			t.Errorf("RepoSize = %d, want %d", size, 120+4096+64)
+		}
+	})
+
+	t.Run("MissingObjectsDir", func(t *testing.T) {
+		o, err := NewOstree(&config.MockConfig{
+			Items: map[string][]string{"Ostree.RepoDir": {t.TempDir()}},
+		})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		if _, err := o.RepoSize(); err == nil {
+			t.Fatal("expected error for a repository without objects dir")
+		}
+	})
+}
+
+func TestMirrorRemote(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {"/repo"},
+			"Ostree.Remote":  {"origin"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var pulled []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		if len(args) >= 3 && args[1] == "remote" && args[2] == "refs" {
+			stdout.Write([]byte("origin:matrixos/amd64/gnome\norigin:matrixos/amd64/server\norigin:matrixos/amd64/dev/gnome\n"))
+			return nil
+		}
+		if len(args) >= 4 && args[1] == "pull" {
+			pulled = append(pulled, args[2]+":"+args[3])
+			if args[3] == "matrixos/amd64/server" {
+				return errors.New("network unreachable")
+			}
+		}
+		return nil
+	}
+
+	err = o.MirrorRemote(false)
+	if err == nil {
+		t.Fatal("expected error when a pull fails")
+	}
+	if !strings.Contains(err.Error(), "origin:matrixos/amd64/server") {
+		t.Errorf("error %q does not mention the failed ref", err)
+	}
+	if strings.Contains(err.Error(), "matrixos/amd64/gnome") {
+		t.Errorf("error %q mentions refs that were mirrored", err)
+	}
+
+	want := []string{"origin:matrixos/amd64/gnome", "origin:matrixos/amd64/server", "origin:matrixos/amd64/dev/gnome"}
+	if !slices.Equal(pulled, want) {
+		t.Errorf("pulled = %v, want %v", pulled, want)
+	}
+}
+
 func TestConfigGettersErrors(t *testing.T) {
 	cfg := &config.MockConfig{
 		Items: map[string][]string{},
@@ -1428,16 +2700,77 @@ func TestMaybeInitializeRemoteIdempotency(t *testing.T) {
 	}
 }
 
-func setupMinimalHierarchy(t *testing.T, imageDir string) {
-	t.Helper()
-	dirs := []string{"tmp", "etc", "var/db/pkg", "opt", "srv", "usr/local"}
-	for _, d := range dirs {
-		if err := os.MkdirAll(filepath.Join(imageDir, d), 0755); err != nil {
-			t.Fatalf("failed to create dir %s: %v", d, err)
-		}
-	}
-	if err := os.WriteFile(filepath.Join(imageDir, "etc", "machine-id"), []byte("id"), 0644); err != nil {
-		t.Fatalf("failed to write machine-id: %v", err)
+func TestMaybeInitializeRemoteURLChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		currentURL string
+		wantSetURL bool
+	}{
+		{name: "StaleURL", currentURL: "http://old-url", wantSetURL: true},
+		{name: "MatchingURL", currentURL: "http://url", wantSetURL: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmds []string
+			repoDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(repoDir, "objects"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir":   {repoDir},
+					"Ostree.Remote":    {"origin"},
+					"Ostree.RemoteUrl": {"http://url"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				cmds = append(cmds, strings.Join(args, " "))
+				if len(args) >= 3 && args[1] == "remote" {
+					switch args[2] {
+					case "list":
+						fmt.Fprintln(stdout, "origin")
+					case "show-url":
+						fmt.Fprintln(stdout, tt.currentURL)
+					}
+				}
+				return nil
+			}
+
+			if err := o.MaybeInitializeRemote(false); err != nil {
+				t.Fatalf("MaybeInitializeRemote failed: %v", err)
+			}
+
+			want := "--repo=" + repoDir + ` config set remote "origin".url http://url`
+			gotSetURL := slices.Contains(cmds, want)
+			if gotSetURL != tt.wantSetURL {
+				t.Errorf("set-url invoked = %v, want %v (commands: %v)", gotSetURL, tt.wantSetURL, cmds)
+			}
+			for _, cmd := range cmds {
+				if strings.Contains(cmd, "remote add") {
+					t.Error("Should not have added remote")
+				}
+			}
+		})
+	}
+}
+
+func setupMinimalHierarchy(t *testing.T, imageDir string) {
+	t.Helper()
+	dirs := []string{"tmp", "etc", "var/db/pkg", "opt", "srv", "usr/local"}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(imageDir, d), 0755); err != nil {
+			t.Fatalf("failed to create dir %s: %v", d, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "etc", "machine-id"), []byte("id"), 0644); err != nil {
+		t.Fatalf("failed to write machine-id: %v", err)
 	}
 }
 
@@ -1490,6 +2823,174 @@ func TestPrepareFilesystemHierarchyEdgeCases(t *testing.T) {
 	})
 }
 
+// snapshotTree returns a description of every entry below root, used to
+// check that a tree has not been modified.
+func snapshotTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	snap := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		desc := info.Mode().String()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			desc += " -> " + link
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			desc += " " + string(data)
+		}
+		snap[path] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to snapshot %s: %v", root, err)
+	}
+	return snap
+}
+
+func TestPrepareFilesystemHierarchyDryRun(t *testing.T) {
+	imageDir := t.TempDir()
+	setupMinimalHierarchy(t, imageDir)
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Releaser.ReadOnlyVdb": {"/usr/var-db-pkg"},
+			"Imager.EfiRoot":       {"/efi"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	before := snapshotTree(t, imageDir)
+	ops, err := o.PrepareFilesystemHierarchyDryRun(imageDir)
+	if err != nil {
+		t.Fatalf("PrepareFilesystemHierarchyDryRun failed: %v", err)
+	}
+
+	want := []string{
+		"mkdir sysroot",
+		"symlink ostree -> sysroot/ostree",
+		"move tmp -> sysroot/tmp",
+		"symlink tmp -> sysroot/tmp",
+		"truncate etc/machine-id",
+		"move etc -> usr/etc",
+		"move var/db/pkg -> usr/var-db-pkg",
+		"symlink var/db/pkg -> ../../usr/var-db-pkg",
+		"move opt -> usr/opt",
+		"symlink opt -> usr/opt",
+		"move srv -> var/srv",
+		"symlink srv -> var/srv",
+		"mkdir -p lab",
+		"mkdir -p snap",
+		"mkdir -p usr/src",
+		"mkdir -p var/home",
+		"symlink home -> var/home",
+		"mkdir -p var/roothome",
+		"symlink root -> var/roothome",
+		"mkdir -p efi",
+		"move usr/local -> var/usrlocal",
+		"symlink usr/local -> ../var/usrlocal",
+		"create var/.matrixos-prepared",
+	}
+	if !slices.Equal(ops, want) {
+		t.Errorf("planned operations mismatch:\nGot:  %q\nWant: %q", ops, want)
+	}
+
+	after := snapshotTree(t, imageDir)
+	if !maps.Equal(before, after) {
+		t.Errorf("dry run modified the tree:\nBefore: %v\nAfter:  %v", before, after)
+	}
+
+	// Once the real run has written the marker, the dry run refuses too.
+	if err := o.PrepareFilesystemHierarchy(imageDir); err != nil {
+		t.Fatalf("PrepareFilesystemHierarchy failed: %v", err)
+	}
+	if _, err := o.PrepareFilesystemHierarchyDryRun(imageDir); err == nil {
+		t.Error("Expected dry run to fail once the marker file exists")
+	}
+}
+
+func TestUndoFilesystemHierarchy(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Releaser.ReadOnlyVdb": {"/usr/var-db-pkg"},
+			"Imager.EfiRoot":       {"/efi"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	t.Run("RefusesUnprepared", func(t *testing.T) {
+		imageDir := t.TempDir()
+		setupMinimalHierarchy(t, imageDir)
+		err := o.UndoFilesystemHierarchy(imageDir)
+		if err == nil || !strings.Contains(err.Error(), "not prepared") {
+			t.Errorf("Expected not prepared error, got %v", err)
+		}
+		assertDir(t, filepath.Join(imageDir, "etc"))
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		imageDir := t.TempDir()
+		setupMinimalHierarchy(t, imageDir)
+		for _, d := range []string{"home/user", "root"} {
+			if err := os.MkdirAll(filepath.Join(imageDir, d), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(imageDir, "opt", "app"), []byte("app"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := o.PrepareFilesystemHierarchy(imageDir); err != nil {
+			t.Fatalf("PrepareFilesystemHierarchy failed: %v", err)
+		}
+		if err := o.UndoFilesystemHierarchy(imageDir); err != nil {
+			t.Fatalf("UndoFilesystemHierarchy failed: %v", err)
+		}
+
+		for _, d := range []string{"tmp", "etc", "var/db/pkg", "opt", "srv", "home/user", "root", "usr/local"} {
+			path := filepath.Join(imageDir, d)
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Errorf("%s missing after undo: %v", d, err)
+				continue
+			}
+			if !info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("%s should be a real directory, got mode %v", d, info.Mode())
+			}
+		}
+		for _, p := range []string{
+			"ostree", "sysroot", "usr/etc", "usr/opt", "usr/var-db-pkg",
+			"var/srv", "var/home", "var/roothome", "var/usrlocal", "var/.matrixos-prepared",
+		} {
+			if _, err := os.Lstat(filepath.Join(imageDir, p)); !os.IsNotExist(err) {
+				t.Errorf("%s should not exist after undo", p)
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(imageDir, "opt", "app")); err != nil || string(data) != "app" {
+			t.Errorf("opt contents not restored: %q, %v", data, err)
+		}
+
+		// The tree can be prepared again.
+		if err := o.PrepareFilesystemHierarchy(imageDir); err != nil {
+			t.Errorf("PrepareFilesystemHierarchy after undo failed: %v", err)
+		}
+	})
+}
+
 func TestListPackagesErrors(t *testing.T) {
 	cfg := &config.MockConfig{
 		Items: map[string][]string{}, // Missing ReadOnlyVdb
@@ -1586,6 +3087,58 @@ func TestDeployedRootfsWithSysroot(t *testing.T) {
 	}
 }
 
+func TestRunWithStdoutCaptureTimeout(t *testing.T) {
+	origRunCommand, origRunCommandCtx := runCommand, runCommandCtx
+	defer func() { runCommand, runCommandCtx = origRunCommand, origRunCommandCtx }()
+	runCommand = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		fmt.Fprintln(stdout, "plain")
+		return nil
+	}
+	runCommandCtx = func(ctx context.Context, _ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		if slices.Contains(args, "stall") {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("signal: killed")
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}
+		fmt.Fprintln(stdout, "ctx")
+		return nil
+	}
+
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := RunWithStdoutCaptureTimeout(20*time.Millisecond, false, "stall")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("RunWithStdoutCaptureTimeout returned after %v", elapsed)
+		}
+	})
+
+	t.Run("WithinDeadline", func(t *testing.T) {
+		stdout, err := RunWithStdoutCaptureTimeout(time.Minute, false, "refs")
+		if err != nil {
+			t.Fatalf("RunWithStdoutCaptureTimeout failed: %v", err)
+		}
+		if lines, _ := readerToList(stdout); !slices.Equal(lines, []string{"ctx"}) {
+			t.Errorf("stdout = %v, want [ctx]", lines)
+		}
+	})
+
+	t.Run("NoTimeout", func(t *testing.T) {
+		stdout, err := RunWithStdoutCapture(false, "refs")
+		if err != nil {
+			t.Fatalf("RunWithStdoutCapture failed: %v", err)
+		}
+		if lines, _ := readerToList(stdout); !slices.Equal(lines, []string{"plain"}) {
+			t.Errorf("stdout = %v, want [plain]", lines)
+		}
+	})
+}
+
 type errorReader struct{}
 
 func (e *errorReader) Read(p []byte) (n int, err error) {
@@ -2182,6 +3735,151 @@ func TestRemoteRefs(t *testing.T) {
 	})
 }
 
+func TestFindPath(t *testing.T) {
+	setup := func(t *testing.T, output, errOutput string, cmdErr error) (*Ostree, *[]string) {
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"Ostree.RepoDir": {"/repo"},
+			},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		var cmd []string
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			cmd = append([]string{name}, args...)
+			stdout.Write([]byte(output))
+			stderr.Write([]byte(errOutput))
+			return cmdErr
+		}
+		return o, &cmd
+	}
+
+	t.Run("File", func(t *testing.T) {
+		o, cmd := setup(t, "-00644 0 0 42 ccc333 /etc/hostname\n", "", nil)
+		pi, err := o.FindPath("abc123", "/etc/hostname", false)
+		if err != nil {
+			t.Fatalf("FindPath failed: %v", err)
+		}
+		want := "ostree --repo=/repo ls -C -d abc123 -- /etc/hostname"
+		if got := strings.Join(*cmd, " "); got != want {
+			t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", got, want)
+		}
+		if pi.Mode.Type != "-" || pi.Path != "/etc/hostname" || pi.Size != 42 || pi.OSTreeChecksum != "ccc333" {
+			t.Errorf("unexpected PathInfo: %+v", *pi)
+		}
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		o, _ := setup(t, "l00777 0 0 0 ddd444 /etc/localtime -> /usr/share/zoneinfo/UTC\n", "", nil)
+		pi, err := o.FindPath("abc123", "/etc/localtime", false)
+		if err != nil {
+			t.Fatalf("FindPath failed: %v", err)
+		}
+		if pi.Mode.Type != "l" {
+			t.Errorf("type = %q, want %q", pi.Mode.Type, "l")
+		}
+		if pi.Link != "/usr/share/zoneinfo/UTC" {
+			t.Errorf("link = %q, want %q", pi.Link, "/usr/share/zoneinfo/UTC")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		o, _ := setup(t, "", "error: No such file or directory\n", errors.New("exit status 1"))
+		_, err := o.FindPath("abc123", "/etc/missing", false)
+		var notFound *PathNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("expected PathNotFoundError, got %v", err)
+		}
+		if notFound.Path != "/etc/missing" || notFound.Commit != "abc123" {
+			t.Errorf("unexpected PathNotFoundError: %+v", *notFound)
+		}
+	})
+
+	t.Run("CommandError", func(t *testing.T) {
+		o, _ := setup(t, "", "error: opening repo: permission denied\n", errors.New("exit status 1"))
+		_, err := o.FindPath("abc123", "/etc/hostname", false)
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		var notFound *PathNotFoundError
+		if errors.As(err, &notFound) {
+			t.Errorf("command error should not be a PathNotFoundError: %v", err)
+		}
+	})
+
+	t.Run("MissingParams", func(t *testing.T) {
+		o, _ := setup(t, "", "", nil)
+		if _, err := o.FindPath("", "/etc", false); err == nil {
+			t.Error("expected error for empty commit")
+		}
+		if _, err := o.FindPath("abc123", "", false); err == nil {
+			t.Error("expected error for empty path")
+		}
+	})
+}
+
+func TestReadFile(t *testing.T) {
+	content := []byte("root:x:0:0:root:/root:/bin/bash\n\x00binary\ttail")
+
+	t.Run("Success", func(t *testing.T) {
+		o, err := NewOstree(&config.MockConfig{
+			Items: map[string][]string{"Ostree.RepoDir": {"/repo"}},
+		})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		var cmd string
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			cmd = strings.Join(append([]string{name}, args...), " ")
+			stdout.Write(content)
+			return nil
+		}
+
+		got, err := o.ReadFile("abc123", "/usr/etc/passwd", false)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if want := "ostree --repo=/repo cat abc123 /usr/etc/passwd"; cmd != want {
+			t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", cmd, want)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("ReadFile = %q, want %q", got, content)
+		}
+	})
+
+	t.Run("CatFails", func(t *testing.T) {
+		o, err := NewOstree(&config.MockConfig{
+			Items: map[string][]string{"Ostree.RepoDir": {"/repo"}},
+		})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			return errors.New("exit status 1")
+		}
+		if _, err := o.ReadFile("abc123", "/usr/etc/missing", false); err == nil {
+			t.Fatal("expected error when ostree cat fails")
+		}
+	})
+
+	t.Run("MissingParams", func(t *testing.T) {
+		o, err := NewOstree(&config.MockConfig{
+			Items: map[string][]string{"Ostree.RepoDir": {"/repo"}},
+		})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		if _, err := o.ReadFile("", "/usr/etc/passwd", false); err == nil {
+			t.Error("expected error for empty commit")
+		}
+		if _, err := o.ReadFile("abc123", "", false); err == nil {
+			t.Error("expected error for empty path")
+		}
+	})
+}
+
 func TestListContents(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		cfg := &config.MockConfig{
@@ -2611,6 +4309,69 @@ func TestListDeployments_InvalidJSON(t *testing.T) {
 	}
 }
 
+func TestDeploymentByRef(t *testing.T) {
+	statusJSON := `{"deployments": [
+		{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome", "index": 0},
+		{"rollback": true, "checksum": "def456", "refspec": "origin:matrixos/amd64/server", "index": 1},
+		{"checksum": "ghi789", "refspec": "origin:matrixos/amd64/server", "index": 2}
+	]}`
+
+	setup := func(t *testing.T, cmdErr error) *Ostree {
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"Ostree.Root": {t.TempDir()},
+			},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			if cmdErr != nil {
+				return cmdErr
+			}
+			stdout.Write([]byte(statusJSON))
+			return nil
+		}
+		return o
+	}
+
+	t.Run("Found", func(t *testing.T) {
+		o := setup(t, nil)
+		d, err := o.DeploymentByRef("origin:matrixos/amd64/server", false)
+		if err != nil {
+			t.Fatalf("DeploymentByRef failed: %v", err)
+		}
+		if d.Checksum != "def456" || d.Index != 1 {
+			t.Errorf("got deployment %+v, want the first server deployment", *d)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		o := setup(t, nil)
+		_, err := o.DeploymentByRef("origin:matrixos/amd64/cosmic", false)
+		var notFound *DeploymentNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("expected DeploymentNotFoundError, got %v", err)
+		}
+		if notFound.Refspec != "origin:matrixos/amd64/cosmic" {
+			t.Errorf("Refspec = %q, want %q", notFound.Refspec, "origin:matrixos/amd64/cosmic")
+		}
+	})
+
+	t.Run("CommandError", func(t *testing.T) {
+		o := setup(t, fmt.Errorf("ostree command failed"))
+		_, err := o.DeploymentByRef("origin:matrixos/amd64/gnome", false)
+		if err == nil {
+			t.Fatal("expected error when ostree command fails, got nil")
+		}
+		var notFound *DeploymentNotFoundError
+		if errors.As(err, &notFound) {
+			t.Errorf("command error should not be a DeploymentNotFoundError: %v", err)
+		}
+	})
+}
+
 func TestSwitch(t *testing.T) {
 	var lastCmdArgs []string
 	sysroot := t.TempDir()
@@ -2816,21 +4577,169 @@ A    ostree
 	}
 }
 
-func TestConfigDiff_CommandArgs(t *testing.T) {
-	root := t.TempDir()
-	var lastCmdArgs []string
+func TestSummaryRefs(t *testing.T) {
+	const summaryView = `* matrixos/amd64/gnome
+    Latest Commit (1.2 kB):
+      2f1d0c8e4a
+    Version (ostree.commit.version): 20260215
+    Timestamp (ostree.commit.timestamp): 2026-02-15T10:00:00Z
 
-	cfg := &config.MockConfig{
-		Items: map[string][]string{
-			"Ostree.Root": {root},
-		},
-	}
-	o, err := NewOstree(cfg)
-	if err != nil {
-		t.Fatalf("NewOstree failed: %v", err)
+* matrixos/amd64/cosmic
+    Latest Commit (1.1 kB):
+      9a8b7c6d5e
+    Timestamp (ostree.commit.timestamp): 2026-02-14T10:00:00Z
+
+Last-Modified (ostree.summary.last-modified): 2026-02-15T10:05:00Z
+Has Tombstone Commits (ostree.summary.tombstone-commits): No
+`
+	writeSummaryView := func(stdout io.Writer, _ []string) error {
+		_, err := io.WriteString(stdout, summaryView)
+		return err
 	}
 
-	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	t.Run("Success", func(t *testing.T) {
+		repoDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(repoDir, "summary"), []byte("summary"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		o, cmds := newRecordingOstree(t, map[string][]string{"Ostree.RepoDir": {repoDir}}, writeSummaryView)
+		got, err := o.SummaryRefs(false)
+		if err != nil {
+			t.Fatalf("SummaryRefs failed: %v", err)
+		}
+		want := map[string]string{
+			"matrixos/amd64/gnome":  "2f1d0c8e4a",
+			"matrixos/amd64/cosmic": "9a8b7c6d5e",
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("SummaryRefs = %v, want %v", got, want)
+		}
+		if want := []string{"--repo=" + repoDir + " summary --view"}; !slices.Equal(*cmds, want) {
+			t.Errorf("commands = %v, want %v", *cmds, want)
+		}
+	})
+
+	t.Run("NoSummary", func(t *testing.T) {
+		o, cmds := newRecordingOstree(t, map[string][]string{"Ostree.RepoDir": {t.TempDir()}}, writeSummaryView)
+		_, err := o.SummaryRefs(false)
+		var notFound *SummaryNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("expected SummaryNotFoundError, got %v", err)
+		}
+		if len(*cmds) != 0 {
+			t.Errorf("ostree should not run without a summary, ran %v", *cmds)
+		}
+	})
+}
+
+func TestConfigDiffContent(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"usr/etc/hostname":      "matrixos\n",
+		"etc/hostname":          "wormhole\n",
+		"usr/etc/sudoers":       "root ALL=(ALL) ALL\n",
+		"etc/sudoers":           "root ALL=(ALL) ALL\n",
+		"usr/etc/vconsole.conf": "KEYMAP=us\n",
+	}
+	for path, content := range files {
+		p := filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+	}
+	// A modified directory is skipped.
+	os.MkdirAll(filepath.Join(root, "usr", "etc", "sudoers.d"), 0755)
+	os.MkdirAll(filepath.Join(root, "etc", "sudoers.d"), 0755)
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {root},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var diffed []string
+	o.runner = func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+		if name == "ostree" {
+			io.WriteString(stdout, "M    hostname\nM    sudoers\nM    sudoers.d\nD    vconsole.conf\n")
+			return nil
+		}
+		if name != "diff" {
+			t.Fatalf("unexpected command %s %v", name, args)
+		}
+		old, live := args[len(args)-2], args[len(args)-1]
+		diffed = append(diffed, strings.TrimPrefix(live, root+"/"))
+		a, _ := os.ReadFile(old)
+		b, _ := os.ReadFile(live)
+		if string(a) == string(b) {
+			return nil
+		}
+		fmt.Fprintf(stdout, "--- %s\n+++ %s\n@@ -1 +1 @@\n-%s+%s", args[2], args[4], a, b)
+		return errors.New("exit status 1")
+	}
+
+	got, err := o.ConfigDiffContent(false)
+	if err != nil {
+		t.Fatalf("ConfigDiffContent failed: %v", err)
+	}
+	if want := []string{"etc/hostname", "etc/sudoers"}; !slices.Equal(diffed, want) {
+		t.Errorf("diffed %v, want %v", diffed, want)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %v", got)
+	}
+	if want := "--- usr/etc/hostname\n+++ etc/hostname\n@@ -1 +1 @@\n-matrixos\n+wormhole\n"; got["hostname"] != want {
+		t.Errorf("hostname diff = %q, want %q", got["hostname"], want)
+	}
+	if diff, ok := got["sudoers"]; !ok || diff != "" {
+		t.Errorf("sudoers diff = %q, %v, want an empty diff", diff, ok)
+	}
+}
+
+func TestConfigDiffContentDiffError(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/etc", "etc"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+		os.WriteFile(filepath.Join(root, dir, "hostname"), []byte(dir), 0644)
+	}
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {root},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, _ io.Writer, name string, _ ...string) error {
+		if name == "ostree" {
+			io.WriteString(stdout, "M    hostname\n")
+			return nil
+		}
+		return errors.New("exit status 2")
+	}
+	if _, err := o.ConfigDiffContent(false); err == nil {
+		t.Error("expected an error when diff fails without output")
+	}
+}
+
+func TestConfigDiff_CommandArgs(t *testing.T) {
+	root := t.TempDir()
+	var lastCmdArgs []string
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {root},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
 		lastCmdArgs = append([]string{name}, args...)
 		return nil
 	}
@@ -2944,6 +4853,82 @@ func TestConfigDiff_CommandError(t *testing.T) {
 	}
 }
 
+func TestConfigDiffStructured(t *testing.T) {
+	root := t.TempDir()
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {root},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	mockOutput := `M    sudoers
+D    tmpfiles.d/matrixos-live-home.conf
+A    vconsole.conf
+X    weird.conf
+M    hostname
+A    NetworkManager/system-connections/Wormhole.nmconnection
+`
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		stdout.Write([]byte(mockOutput))
+		return nil
+	}
+
+	entries, err := o.ConfigDiffStructured(false)
+	if err != nil {
+		t.Fatalf("ConfigDiffStructured failed: %v", err)
+	}
+	want := []ConfigDiffEntry{
+		{ConfigAdded, "NetworkManager/system-connections/Wormhole.nmconnection"},
+		{ConfigModified, "hostname"},
+		{ConfigModified, "sudoers"},
+		{ConfigDeleted, "tmpfiles.d/matrixos-live-home.conf"},
+		{ConfigAdded, "vconsole.conf"},
+		{ConfigUnknown, "weird.conf"},
+	}
+	if !slices.Equal(entries, want) {
+		t.Errorf("ConfigDiffStructured() =\n%v\nwant\n%v", entries, want)
+	}
+
+	result, err := o.ConfigDiff(false)
+	if err != nil {
+		t.Fatalf("ConfigDiff failed: %v", err)
+	}
+	if got := result[string(ConfigUnknown)]; !slices.Equal(got, []string{"weird.conf"}) {
+		t.Errorf("ConfigDiff unknown entries = %v, want [weird.conf]", got)
+	}
+	if got := result["M"]; !slices.Equal(got, []string{"hostname", "sudoers"}) {
+		t.Errorf("ConfigDiff M entries = %v, want [hostname sudoers]", got)
+	}
+}
+
+func TestConfigDiffStructured_EmptyOutput(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		return nil
+	}
+
+	entries, err := o.ConfigDiffStructured(false)
+	if err != nil {
+		t.Fatalf("ConfigDiffStructured failed: %v", err)
+	}
+	if entries == nil || len(entries) != 0 {
+		t.Errorf("expected an empty, non-nil slice, got %#v", entries)
+	}
+}
+
 // --- helpers for 3-way diff tests ---
 
 func mkPI(path, typ string, perms uint32, uid, gid, size uint64, link string) fslib.PathInfo {
@@ -3267,3 +5252,2288 @@ func TestComputeEtcDiffDirectories(t *testing.T) {
 func ptr(pi fslib.PathInfo) *fslib.PathInfo {
 	return &pi
 }
+
+func TestComputeKargDelta(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    []string
+		desired    []string
+		wantAdd    []string
+		wantDelete []string
+	}{
+		{
+			name:    "NoOp",
+			current: []string{"quiet", "splash", "rootflags=discard=async"},
+			desired: []string{"quiet", "rootflags=discard=async"},
+		},
+		{
+			name:    "AddMissing",
+			current: []string{"quiet"},
+			desired: []string{"quiet", "mitigations=off"},
+			wantAdd: []string{"mitigations=off"},
+		},
+		{
+			name:       "ReplaceValue",
+			current:    []string{"quiet", "rootflags=discard=async", "splash"},
+			desired:    []string{"rootflags=discard=sync"},
+			wantAdd:    []string{"rootflags=discard=sync"},
+			wantDelete: []string{"rootflags=discard=async"},
+		},
+		{
+			name:       "MixedDelta",
+			current:    []string{"console=tty0", "loglevel=7"},
+			desired:    []string{"loglevel=3", "nowatchdog", "console=tty0"},
+			wantAdd:    []string{"loglevel=3", "nowatchdog"},
+			wantDelete: []string{"loglevel=7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotAdd, gotDelete := ComputeKargDelta(tt.current, tt.desired)
+			if !slices.Equal(gotAdd, tt.wantAdd) {
+				t.Errorf("add = %v, want %v", gotAdd, tt.wantAdd)
+			}
+			if !slices.Equal(gotDelete, tt.wantDelete) {
+				t.Errorf("delete = %v, want %v", gotDelete, tt.wantDelete)
+			}
+		})
+	}
+}
+
+func TestKargMigrationNeeded(t *testing.T) {
+	bootedJSON := `{"deployments": [{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome"}]}`
+
+	setup := func(t *testing.T, statusJSON, cmdline string) *Ostree {
+		root := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(root, "proc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "proc", "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &config.MockConfig{
+			Items: map[string][]string{
+				"Ostree.Root": {root},
+			},
+		}
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			stdout.Write([]byte(statusJSON))
+			return nil
+		}
+		return o
+	}
+
+	t.Run("MigrationNeeded", func(t *testing.T) {
+		o := setup(t, bootedJSON, "BOOT_IMAGE=/vmlinuz quiet rootflags=discard=async\n")
+		add, del, err := o.KargMigrationNeeded([]string{"quiet", "rootflags=discard=sync", "nowatchdog"}, false)
+		if err != nil {
+			t.Fatalf("KargMigrationNeeded failed: %v", err)
+		}
+		if want := []string{"rootflags=discard=sync", "nowatchdog"}; !slices.Equal(add, want) {
+			t.Errorf("add = %v, want %v", add, want)
+		}
+		if want := []string{"rootflags=discard=async"}; !slices.Equal(del, want) {
+			t.Errorf("delete = %v, want %v", del, want)
+		}
+	})
+
+	t.Run("NoMigration", func(t *testing.T) {
+		o := setup(t, bootedJSON, "BOOT_IMAGE=/vmlinuz quiet rootflags=discard=async\n")
+		add, del, err := o.KargMigrationNeeded([]string{"quiet", "rootflags=discard=async"}, false)
+		if err != nil {
+			t.Fatalf("KargMigrationNeeded failed: %v", err)
+		}
+		if len(add) != 0 || len(del) != 0 {
+			t.Errorf("expected no migration, got add=%v delete=%v", add, del)
+		}
+	})
+
+	t.Run("NoBootedDeployment", func(t *testing.T) {
+		o := setup(t, `{"deployments": [{"booted": false, "checksum": "abc123"}]}`, "quiet\n")
+		if _, _, err := o.KargMigrationNeeded([]string{"quiet"}, false); err == nil {
+			t.Fatal("expected error when no deployment is booted")
+		}
+	})
+}
+
+func TestGetKargs(t *testing.T) {
+	bootedJSON := `{"deployments": [{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome"}]}`
+
+	tests := []struct {
+		name    string
+		cmdline string
+		want    []string
+	}{
+		{
+			name:    "Simple",
+			cmdline: "BOOT_IMAGE=/vmlinuz quiet rootflags=discard=async\n",
+			want:    []string{"BOOT_IMAGE=/vmlinuz", "quiet", "rootflags=discard=async"},
+		},
+		{
+			name:    "SurroundingWhitespace",
+			cmdline: "  \tquiet   splash\t nowatchdog  \n\n",
+			want:    []string{"quiet", "splash", "nowatchdog"},
+		},
+		{
+			name:    "Empty",
+			cmdline: " \n",
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(root, "proc"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "proc", "cmdline"), []byte(tt.cmdline), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.Root": {root},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				stdout.Write([]byte(bootedJSON))
+				return nil
+			}
+
+			got, err := o.GetKargs(false)
+			if err != nil {
+				t.Fatalf("GetKargs failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GetKargs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetKargs(t *testing.T) {
+	tests := []struct {
+		name    string
+		appends []string
+		deletes []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "AppendsOnly",
+			appends: []string{"quiet", "nowatchdog"},
+			want:    "ostree admin kargs edit-in-place --sysroot=/sysroot --append-if-missing=quiet --append-if-missing=nowatchdog",
+		},
+		{
+			name:    "DeletesOnly",
+			deletes: []string{"rootflags=discard=async"},
+			want:    "ostree admin kargs edit-in-place --sysroot=/sysroot --delete-if-present=rootflags=discard=async",
+		},
+		{
+			name:    "Both",
+			appends: []string{"rootflags=discard=sync"},
+			deletes: []string{"rootflags=discard=async"},
+			want:    "ostree admin kargs edit-in-place --sysroot=/sysroot --append-if-missing=rootflags=discard=sync --delete-if-present=rootflags=discard=async",
+		},
+		{
+			name:    "Nothing",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.Sysroot": {"/sysroot"},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var commands []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				commands = append(commands, strings.Join(append([]string{name}, args...), " "))
+				return nil
+			}
+
+			err = o.SetKargs(tt.appends, tt.deletes, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if len(commands) != 0 {
+					t.Errorf("expected no commands, got %v", commands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetKargs failed: %v", err)
+			}
+			if len(commands) != 1 {
+				t.Fatalf("expected 1 command, got %d: %v", len(commands), commands)
+			}
+			if commands[0] != tt.want {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", commands[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusJSON string
+		cmdErr     error
+		wantErr    bool
+		wantCmd    bool
+	}{
+		{
+			name: "HasRollback",
+			statusJSON: `{"deployments": [
+				{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome"},
+				{"rollback": true, "checksum": "def456", "stateroot": "matrixos", "refspec": "origin:matrixos/amd64/gnome"}
+			]}`,
+			wantCmd: true,
+		},
+		{
+			name:       "NoRollback",
+			statusJSON: `{"deployments": [{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome"}]}`,
+			wantErr:    true,
+		},
+		{
+			name:       "NoBooted",
+			statusJSON: `{"deployments": [{"rollback": true, "checksum": "def456", "refspec": "origin:matrixos/amd64/gnome"}]}`,
+			wantErr:    true,
+		},
+		{
+			name: "CommandFails",
+			statusJSON: `{"deployments": [
+				{"booted": true, "checksum": "abc123", "refspec": "origin:matrixos/amd64/gnome"},
+				{"rollback": true, "checksum": "def456", "stateroot": "matrixos", "refspec": "origin:matrixos/amd64/gnome"}
+			]}`,
+			cmdErr:  fmt.Errorf("ostree admin deploy failed"),
+			wantErr: true,
+			wantCmd: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.Root": {root},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var deployCmd []string
+			var origin string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				if slices.Contains(args, "status") {
+					stdout.Write([]byte(tt.statusJSON))
+					return nil
+				}
+				deployCmd = append([]string{name}, args...)
+				for _, arg := range args {
+					if path, ok := strings.CutPrefix(arg, "--origin-file="); ok {
+						data, err := os.ReadFile(path)
+						if err != nil {
+							t.Errorf("reading origin file: %v", err)
+						}
+						origin = string(data)
+					}
+				}
+				return tt.cmdErr
+			}
+
+			err = o.Rollback(false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantCmd {
+				if deployCmd != nil {
+					t.Errorf("unexpected deploy command: %v", deployCmd)
+				}
+				return
+			}
+			// The origin file is a temp file: compare everything but its path.
+			if len(deployCmd) != 8 || !strings.HasPrefix(deployCmd[6], "--origin-file=") {
+				t.Fatalf("unexpected deploy command: %q", deployCmd)
+			}
+			want := []string{
+				"ostree", "admin", "deploy", "--sysroot=" + root, "--retain", "--os=matrixos",
+				deployCmd[6], "def456",
+			}
+			if !slices.Equal(deployCmd, want) {
+				t.Errorf("Command mismatch:\nGot:  %q\nWant: %q", deployCmd, want)
+			}
+			if wantOrigin := "[origin]\nrefspec=origin:matrixos/amd64/gnome\n"; origin != wantOrigin {
+				t.Errorf("origin = %q, want %q", origin, wantOrigin)
+			}
+		})
+	}
+}
+
+func TestUndeploy(t *testing.T) {
+	var lastCmdArgs []string
+	sysroot := t.TempDir()
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Sysroot": {sysroot},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		lastCmdArgs = append([]string{name}, args...)
+		return nil
+	}
+
+	if err := o.Undeploy(1, false); err != nil {
+		t.Fatalf("Undeploy failed: %v", err)
+	}
+	expectedCmd := fmt.Sprintf("ostree admin undeploy --sysroot=%s 1", sysroot)
+	if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+	}
+
+	if err := o.Undeploy(-1, false); err == nil {
+		t.Error("Undeploy should fail for a negative index")
+	}
+}
+
+func TestUndeploy_MissingSysroot(t *testing.T) {
+	o, err := NewOstree(&config.MockConfig{Items: map[string][]string{}})
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		return nil
+	}
+
+	if err := o.Undeploy(0, false); err == nil {
+		t.Fatal("Undeploy should fail when Ostree.Sysroot is missing")
+	}
+}
+
+func TestUndeploy_CommandError(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Sysroot": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	cmdErr := fmt.Errorf("ostree admin undeploy failed")
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		return cmdErr
+	}
+
+	if err := o.Undeploy(0, false); err != cmdErr {
+		t.Fatalf("Undeploy error = %v, want %v", err, cmdErr)
+	}
+}
+
+func TestPinDeployment(t *testing.T) {
+	sysroot := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Sysroot": {sysroot},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		index   int
+		pinned  bool
+		wantCmd string
+		wantErr bool
+	}{
+		{
+			name:    "Pin",
+			index:   1,
+			pinned:  true,
+			wantCmd: fmt.Sprintf("ostree admin pin --sysroot=%s 1", sysroot),
+		},
+		{
+			name:    "Unpin",
+			index:   2,
+			pinned:  false,
+			wantCmd: fmt.Sprintf("ostree admin pin --sysroot=%s 2 --unpin", sysroot),
+		},
+		{
+			name:    "NegativeIndex",
+			index:   -1,
+			pinned:  true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var lastCmdArgs []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				lastCmdArgs = append([]string{name}, args...)
+				return nil
+			}
+
+			err = o.PinDeployment(tt.index, tt.pinned, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("PinDeployment should have failed")
+				}
+				if lastCmdArgs != nil {
+					t.Errorf("no command should run, got: %v", lastCmdArgs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PinDeployment failed: %v", err)
+			}
+			if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != tt.wantCmd {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, tt.wantCmd)
+			}
+		})
+	}
+}
+
+func TestPinDeployment_CommandError(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Sysroot": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	cmdErr := fmt.Errorf("ostree admin pin failed")
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		return cmdErr
+	}
+
+	if err := o.PinDeployment(0, true, false); err != cmdErr {
+		t.Fatalf("PinDeployment error = %v, want %v", err, cmdErr)
+	}
+}
+
+func TestDiffCommits(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		cmdErr  error
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name: "MixedChanges",
+			output: `M    /usr/bin/bash
+A    /usr/lib/libnew.so
+D    /usr/share/doc/old
+M    /usr/bin/awk
+A    /etc/default/new
+`,
+			want: map[string][]string{
+				"A": {"/etc/default/new", "/usr/lib/libnew.so"},
+				"M": {"/usr/bin/awk", "/usr/bin/bash"},
+				"D": {"/usr/share/doc/old"},
+			},
+		},
+		{
+			name: "MalformedLines",
+			output: `M
+garbage line here
+X    /usr/bin/unknown
+
+D    /usr/lib/libold.so
+`,
+			want: map[string][]string{
+				"D": {"/usr/lib/libold.so"},
+			},
+		},
+		{
+			name:   "EmptyOutput",
+			output: "",
+			want:   map[string][]string{},
+		},
+		{
+			name:    "CommandError",
+			cmdErr:  fmt.Errorf("ostree diff failed"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var lastCmdArgs []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				lastCmdArgs = append([]string{name}, args...)
+				stdout.Write([]byte(tt.output))
+				return tt.cmdErr
+			}
+
+			got, err := o.DiffCommits("abc123", "def456", false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("DiffCommits should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DiffCommits failed: %v", err)
+			}
+
+			expectedCmd := fmt.Sprintf("ostree diff --repo=%s abc123 def456", repoDir)
+			if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got %d status keys, want %d: %v", len(got), len(tt.want), got)
+			}
+			for status, paths := range tt.want {
+				if !slices.Equal(got[status], paths) {
+					t.Errorf("%s entries = %v, want %v", status, got[status], paths)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffCommits_MissingRefs(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		t.Fatal("runner should not be called")
+		return nil
+	}
+
+	if _, err := o.DiffCommits("", "def456", false); err == nil {
+		t.Error("DiffCommits should fail with an empty fromRef")
+	}
+	if _, err := o.DiffCommits("abc123", "", false); err == nil {
+		t.Error("DiffCommits should fail with an empty toRef")
+	}
+}
+
+func TestVerifyCommitSignature(t *testing.T) {
+	repoDir := t.TempDir()
+	const commit = "0123456789abcdef"
+
+	tests := []struct {
+		name       string
+		gpg        bool
+		verifyErr  error
+		wantErr    bool
+		wantVerify bool
+	}{
+		{name: "GoodSignature", gpg: true, wantVerify: true},
+		{name: "BadSignature", gpg: true, verifyErr: fmt.Errorf("no valid signature"), wantErr: true, wantVerify: true},
+		{name: "GpgDisabled", gpg: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir": {repoDir},
+					"Ostree.Remote":  {"origin"},
+				},
+				Bools: map[string]bool{"Ostree.Gpg": tt.gpg},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var cmds []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				cmds = append(cmds, strings.Join(append([]string{name}, args...), " "))
+				switch args[0] {
+				case "rev-parse":
+					stdout.Write([]byte(commit + "\n"))
+				case "show":
+					return tt.verifyErr
+				}
+				return nil
+			}
+
+			err = o.VerifyCommitSignature("matrixos/amd64/gnome", false)
+			if tt.wantErr && err == nil {
+				t.Fatal("VerifyCommitSignature should have failed")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("VerifyCommitSignature failed: %v", err)
+			}
+
+			expectedCmd := fmt.Sprintf("ostree show --repo=%s --gpg-verify-remote=origin %s", repoDir, commit)
+			if tt.wantVerify {
+				if !slices.Contains(cmds, expectedCmd) {
+					t.Errorf("expected command %q, got: %v", expectedCmd, cmds)
+				}
+			} else if len(cmds) != 0 {
+				t.Errorf("no command should run when GPG is disabled, got: %v", cmds)
+			}
+		})
+	}
+}
+
+func TestPullVerified(t *testing.T) {
+	repoDir := t.TempDir()
+	const commit = "0123456789abcdef"
+
+	tests := []struct {
+		name      string
+		lsErrs    []error
+		wantPulls int
+		wantErr   bool
+	}{
+		{name: "CompleteFirstAttempt", lsErrs: []error{nil}, wantPulls: 1},
+		{name: "IncompleteThenComplete", lsErrs: []error{&exec.ExitError{}, nil}, wantPulls: 2},
+		{
+			name:      "StaysIncomplete",
+			lsErrs:    []error{&exec.ExitError{}, &exec.ExitError{}},
+			wantPulls: 2,
+			wantErr:   true,
+		},
+		{
+			name:      "ExecError",
+			lsErrs:    []error{exec.ErrNotFound},
+			wantPulls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir": {repoDir},
+				},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var pulls, lists int
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				switch {
+				case slices.Contains(args, "pull"):
+					pulls++
+					want := fmt.Sprintf("ostree --repo=%s pull origin matrixos/amd64/gnome", repoDir)
+					if got := strings.Join(append([]string{name}, args...), " "); got != want {
+						t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", got, want)
+					}
+				case args[0] == "rev-parse":
+					stdout.Write([]byte(commit + "\n"))
+				case slices.Contains(args, "ls"):
+					want := fmt.Sprintf("--repo=%s ls -R %s", repoDir, commit)
+					if got := strings.Join(args, " "); got != want {
+						t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", got, want)
+					}
+					if lists >= len(tt.lsErrs) {
+						t.Fatalf("unexpected ls call #%d", lists+1)
+					}
+					err := tt.lsErrs[lists]
+					lists++
+					return err
+				case args[0] == "fsck":
+					t.Errorf("CommitComplete should not fsck the whole repo: %v", args)
+				}
+				return nil
+			}
+
+			err = o.PullVerified("origin:matrixos/amd64/gnome", false)
+			if tt.wantErr && err == nil {
+				t.Fatal("PullVerified should have failed")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("PullVerified failed: %v", err)
+			}
+			if pulls != tt.wantPulls {
+				t.Errorf("pulls = %d, want %d", pulls, tt.wantPulls)
+			}
+		})
+	}
+}
+
+func TestPullVerified_InvalidRef(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		t.Fatal("runner should not be called")
+		return nil
+	}
+
+	if err := o.PullVerified("", false); err == nil {
+		t.Error("PullVerified should fail with an empty ref")
+	}
+	if err := o.PullVerified("matrixos/amd64/gnome", false); err == nil {
+		t.Error("PullVerified should fail without a remote: prefix")
+	}
+}
+
+func TestPullRetry(t *testing.T) {
+	// failPulls makes the first n pulls fail.
+	failPulls := func(t *testing.T, n int) func(io.Writer, []string) error {
+		return func(_ io.Writer, args []string) error {
+			if !slices.Contains(args, "pull") {
+				t.Errorf("unexpected command: %v", args)
+			}
+			if n > 0 {
+				n--
+				return errors.New("connection reset")
+			}
+			return nil
+		}
+	}
+
+	t.Run("SucceedsAfterFailures", func(t *testing.T) {
+		o, cmds := newRecordingOstree(t, map[string][]string{"Ostree.RepoDir": {t.TempDir()}}, failPulls(t, 2))
+		if err := o.PullRetry("origin:matrixos/amd64/gnome", 3, time.Millisecond, false); err != nil {
+			t.Fatalf("PullRetry failed: %v", err)
+		}
+		if len(*cmds) != 3 {
+			t.Errorf("expected 3 pull invocations, got %d", len(*cmds))
+		}
+	})
+
+	t.Run("ExhaustsAttempts", func(t *testing.T) {
+		o, cmds := newRecordingOstree(t, map[string][]string{"Ostree.RepoDir": {t.TempDir()}}, failPulls(t, 5))
+		err := o.PullRetry("origin:matrixos/amd64/gnome", 2, time.Millisecond, false)
+		if err == nil {
+			t.Fatal("PullRetry should fail when every attempt fails")
+		}
+		if !strings.Contains(err.Error(), "after 2 attempts") || !strings.Contains(err.Error(), "connection reset") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if len(*cmds) != 2 {
+			t.Errorf("expected 2 pull invocations, got %d", len(*cmds))
+		}
+	})
+
+	t.Run("InvalidRef", func(t *testing.T) {
+		o, cmds := newRecordingOstree(t, map[string][]string{"Ostree.RepoDir": {t.TempDir()}}, nil)
+		err := o.PullRetry("matrixos/amd64/gnome", 3, time.Millisecond, false)
+		if !errors.Is(err, ErrNoRemotePrefix) {
+			t.Errorf("expected ErrNoRemotePrefix, got %v", err)
+		}
+		if err := o.PullRetry("origin:matrixos/amd64/gnome", 0, time.Millisecond, false); err == nil {
+			t.Error("PullRetry should fail with zero attempts")
+		}
+		if len(*cmds) != 0 {
+			t.Errorf("runner should not be called, got %v", *cmds)
+		}
+	})
+}
+
+func TestCommitComplete_Partial(t *testing.T) {
+	repoDir := t.TempDir()
+	const commit = "0123456789abcdef"
+	if err := os.MkdirAll(filepath.Join(repoDir, "state"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "state", commit+".commitpartial"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		return nil
+	}
+
+	complete, err := o.CommitComplete(commit, false)
+	if err != nil {
+		t.Fatalf("CommitComplete failed: %v", err)
+	}
+	if complete {
+		t.Error("commit with a .commitpartial marker should be incomplete")
+	}
+}
+
+func TestCommit(t *testing.T) {
+	const hash = "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"
+
+	for _, gpg := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Gpg=%v", gpg), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			repoDir := filepath.Join(tmpDir, "repo")
+			gpgHome := filepath.Join(tmpDir, "gpg")
+			pubKey := filepath.Join(tmpDir, "pub.key")
+			if err := os.WriteFile(pubKey, []byte("key"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &config.MockConfig{
+				Items: map[string][]string{
+					"Ostree.RepoDir":       {repoDir},
+					"Ostree.DevGpgHomedir": {gpgHome},
+					"Ostree.GpgPublicKey":  {pubKey},
+				},
+				Bools: map[string]bool{"Ostree.Gpg": gpg},
+			}
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+
+			var commitCmd string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				if name == "gpg" {
+					fmt.Fprintln(stdout, "pub:u:4096:1:KEYID123:1678752000:::u:::scESC:")
+					return nil
+				}
+				commitCmd = strings.Join(append([]string{name}, args...), " ")
+				fmt.Fprintln(stdout, hash)
+				return nil
+			}
+
+			got, err := o.Commit("matrixos/amd64/gnome", "test build", "/tmp/image", false)
+			if err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if got != hash {
+				t.Errorf("Commit = %q, want %q", got, hash)
+			}
+
+			expectedCmd := fmt.Sprintf("ostree commit --repo=%s --branch=matrixos/amd64/gnome --subject=test build", repoDir)
+			if gpg {
+				expectedCmd += fmt.Sprintf(" --gpg-sign=KEYID123 --gpg-homedir=%s", gpgHome)
+			}
+			expectedCmd += " /tmp/image"
+			if commitCmd != expectedCmd {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", commitCmd, expectedCmd)
+			}
+		})
+	}
+}
+
+func TestCommit_Errors(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var output string
+	var cmdErr error
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		fmt.Fprint(stdout, output)
+		return cmdErr
+	}
+
+	if _, err := o.Commit("", "subject", "/tmp/image", false); err == nil {
+		t.Error("Commit should fail with an empty branch")
+	}
+	if _, err := o.Commit("branch", "", "/tmp/image", false); err == nil {
+		t.Error("Commit should fail with an empty subject")
+	}
+	if _, err := o.Commit("branch", "subject", "", false); err == nil {
+		t.Error("Commit should fail with an empty dir")
+	}
+	if _, err := o.Commit("branch", "subject", "/tmp/image", false); err == nil {
+		t.Error("Commit should fail when no hash is returned")
+	}
+
+	cmdErr = fmt.Errorf("ostree commit failed")
+	if _, err := o.Commit("branch", "subject", "/tmp/image", false); err == nil {
+		t.Error("Commit should fail when the command fails")
+	}
+}
+
+func TestDiffPackages(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Releaser.ReadOnlyVdb": {"/var/db/pkg"},
+			"Ostree.Root":          {"/"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		output := "d00755 0 0 0 abc abc /var/db/pkg/sys-apps/systemd-257\n" +
+			"d00755 0 0 0 abc abc /var/db/pkg/app-shells/bash-5.2\n"
+		if slices.Contains(args, "new") {
+			output = "d00755 0 0 0 abc abc /var/db/pkg/sys-apps/systemd-258\n" +
+				"d00755 0 0 0 abc abc /var/db/pkg/app-shells/bash-5.2\n" +
+				"d00755 0 0 0 abc abc /var/db/pkg/app-editors/vim-9.1\n"
+		}
+		stdout.Write([]byte(output))
+		return nil
+	}
+
+	diff, err := o.DiffPackages("old", "new", false)
+	if err != nil {
+		t.Fatalf("DiffPackages failed: %v", err)
+	}
+	wantAdded := []string{"app-editors/vim-9.1", "sys-apps/systemd-258"}
+	wantRemoved := []string{"sys-apps/systemd-257"}
+	if !slices.Equal(diff.Added, wantAdded) {
+		t.Errorf("Added = %v, want %v", diff.Added, wantAdded)
+	}
+	if !slices.Equal(diff.Removed, wantRemoved) {
+		t.Errorf("Removed = %v, want %v", diff.Removed, wantRemoved)
+	}
+
+	if _, err := o.DiffPackages("", "new", false); err == nil {
+		t.Error("DiffPackages should fail with an empty fromCommit")
+	}
+	if _, err := o.DiffPackages("old", "", false); err == nil {
+		t.Error("DiffPackages should fail with an empty toCommit")
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var lastCmdArgs []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		lastCmdArgs = append([]string{name}, args...)
+		stdout.Write([]byte(`commit ccc
+Parent:  bbb
+ContentChecksum:  c0
+Date:  2026-02-21 10:00:00 +0000
+Version: 20260221
+
+    Bump systemd to 258
+
+commit bbb
+Parent:  aaa
+ContentChecksum:  b0
+Date:  2026-02-20 10:00:00 +0000
+
+    Add vim
+
+commit aaa
+ContentChecksum:  a0
+Date:  2026-02-19 10:00:00 +0000
+
+    Initial build
+
+`))
+		return nil
+	}
+
+	entries, err := o.Changelog("aaa", "ccc", false)
+	if err != nil {
+		t.Fatalf("Changelog failed: %v", err)
+	}
+	expectedCmd := fmt.Sprintf("ostree log --repo=%s ccc", repoDir)
+	if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+	}
+	want := []ChangelogEntry{
+		{Commit: "ccc", Date: "2026-02-21 10:00:00 +0000", Subject: "Bump systemd to 258"},
+		{Commit: "bbb", Date: "2026-02-20 10:00:00 +0000", Subject: "Add vim"},
+	}
+	if !slices.Equal(entries, want) {
+		t.Errorf("Changelog = %+v, want %+v", entries, want)
+	}
+}
+
+func TestUpgradeReport(t *testing.T) {
+	origListLocalContents := listLocalContents
+	defer func() { listLocalContents = origListLocalContents }()
+	listLocalContents = func(string) ([]*fslib.PathInfo, error) {
+		return nil, nil
+	}
+
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir":       {repoDir},
+			"Ostree.Root":          {"/"},
+			"Releaser.ReadOnlyVdb": {"/var/db/pkg"},
+		},
+	}
+
+	newRunner := func(logErr error) runner.Func {
+		return func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			switch {
+			case slices.Contains(args, "log"):
+				if logErr != nil {
+					return logErr
+				}
+				stdout.Write([]byte("commit new\nDate:  2026-02-21\n\n    New build\n\ncommit old\n"))
+			case slices.Contains(args, "/usr/etc"):
+				if slices.Contains(args, "new") {
+					stdout.Write([]byte("-00644 0 0 0 abc /usr/etc/new.conf\n"))
+				}
+			case slices.Contains(args, "new"):
+				stdout.Write([]byte("d00755 0 0 0 abc abc /var/db/pkg/app-editors/vim-9.1\n"))
+			}
+			return nil
+		}
+	}
+
+	t.Run("AllSections", func(t *testing.T) {
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = newRunner(nil)
+
+		report, err := o.UpgradeReport("old", "new", false)
+		if err != nil {
+			t.Fatalf("UpgradeReport failed: %v", err)
+		}
+		if report.ChangelogErr != nil || report.PackagesErr != nil || report.EtcChangesErr != nil {
+			t.Fatalf("unexpected section errors: %v, %v, %v",
+				report.ChangelogErr, report.PackagesErr, report.EtcChangesErr)
+		}
+		if len(report.Changelog) != 1 || report.Changelog[0].Subject != "New build" {
+			t.Errorf("Changelog = %+v", report.Changelog)
+		}
+		if !slices.Equal(report.Packages.Added, []string{"app-editors/vim-9.1"}) {
+			t.Errorf("Packages.Added = %v", report.Packages.Added)
+		}
+		if len(report.EtcChanges) != 1 || report.EtcChanges[0].Path != "new.conf" ||
+			report.EtcChanges[0].Action != EtcActionAdd {
+			t.Errorf("EtcChanges = %+v", report.EtcChanges)
+		}
+	})
+
+	t.Run("FailingSection", func(t *testing.T) {
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		o.runner = newRunner(fmt.Errorf("ostree log failed"))
+
+		report, err := o.UpgradeReport("old", "new", false)
+		if err != nil {
+			t.Fatalf("UpgradeReport failed: %v", err)
+		}
+		if report.ChangelogErr == nil {
+			t.Error("expected ChangelogErr to be recorded")
+		}
+		if report.PackagesErr != nil || report.Packages == nil {
+			t.Errorf("Packages section should still be computed, err: %v", report.PackagesErr)
+		}
+		if report.EtcChangesErr != nil || len(report.EtcChanges) != 1 {
+			t.Errorf("EtcChanges section should still be computed, err: %v", report.EtcChangesErr)
+		}
+	})
+
+	t.Run("MissingCommits", func(t *testing.T) {
+		o, err := NewOstree(cfg)
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		if _, err := o.UpgradeReport("", "new", false); err == nil {
+			t.Error("UpgradeReport should fail with an empty fromCommit")
+		}
+		if _, err := o.UpgradeReport("old", "", false); err == nil {
+			t.Error("UpgradeReport should fail with an empty toCommit")
+		}
+	})
+}
+
+func TestContextCancellation(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir":  {filepath.Join(tmpDir, "repo")},
+			"Ostree.Sysroot":  {filepath.Join(tmpDir, "sysroot")},
+			"Ostree.Remote":   {"origin"},
+			"matrixOS.OsName": {"matrixos"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, o *Ostree) error
+	}{
+		{"PullContext", func(ctx context.Context, o *Ostree) error {
+			return o.PullContext(ctx, "origin:matrixos/amd64/gnome", false)
+		}},
+		{"DeployContext", func(ctx context.Context, o *Ostree) error {
+			return o.DeployContext(ctx, "matrixos/amd64/gnome", nil, false)
+		}},
+		{"GenerateStaticDeltaContext", func(ctx context.Context, o *Ostree) error {
+			return o.GenerateStaticDeltaContext(ctx, "matrixos/amd64/gnome", false)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				t.Fatal("the plain runner should not be used with a cancellable context")
+				return nil
+			}
+			started := make(chan struct{})
+			o.runnerCtx = func(ctx context.Context, _ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				close(started)
+				<-ctx.Done()
+				return fmt.Errorf("%s: %w", name, ctx.Err())
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-started
+				cancel()
+			}()
+
+			err = tt.call(ctx, o)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("error = %v, want it to wrap context.Canceled", err)
+			}
+		})
+	}
+}
+
+func TestParsePullProgressLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   PullProgress
+		wantOK bool
+	}{
+		{
+			line:   "Receiving objects: 45% (1234/2740) 12.3 MB/s 56.7 MB",
+			want:   PullProgress{Percent: 45, ObjectsFetched: 1234, ObjectsTotal: 2740, BytesTransferred: 56700000},
+			wantOK: true,
+		},
+		{
+			line:   "Receiving objects: 100% (10/10) 512 B",
+			want:   PullProgress{Percent: 100, ObjectsFetched: 10, ObjectsTotal: 10, BytesTransferred: 512},
+			wantOK: true,
+		},
+		{
+			line:   "Receiving objects: 3% (3/100)",
+			want:   PullProgress{Percent: 3, ObjectsFetched: 3, ObjectsTotal: 100},
+			wantOK: true,
+		},
+		{line: "Receiving metadata objects: 12/(estimating) 1.0 MB/s 2.0 MB"},
+		{line: "1 metadata, 12 content objects fetched; 3 KiB transferred in 1 seconds"},
+		{line: ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := parsePullProgressLine(tt.line)
+		if ok != tt.wantOK {
+			t.Errorf("parsePullProgressLine(%q) ok = %v, want %v", tt.line, ok, tt.wantOK)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePullProgressLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestPullWithProgress(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var lastCmdArgs []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		lastCmdArgs = append([]string{name}, args...)
+		// Progress updates are \r terminated, and writes may split lines.
+		io.WriteString(stderr, "Receiving metadata objects: 1/(estimating) 0 B/s 0 B\r")
+		io.WriteString(stderr, "Receiving objects: 10% (10/100) 1.0 MB/s 1.5 MB\r")
+		io.WriteString(stderr, "Receiving objects: 50% (50/")
+		io.WriteString(stderr, "100) 2.0 MB/s 7.5 MB\r")
+		io.WriteString(stderr, "garbage\n")
+		io.WriteString(stderr, "Receiving objects: 100% (100/100) 2.0 MB/s 15.0 MB")
+		return nil
+	}
+
+	var got []PullProgress
+	err = o.PullWithProgress("origin:matrixos/amd64/gnome", func(p PullProgress) {
+		got = append(got, p)
+	}, false)
+	if err != nil {
+		t.Fatalf("PullWithProgress failed: %v", err)
+	}
+
+	expectedCmd := fmt.Sprintf("ostree --repo=%s pull origin matrixos/amd64/gnome", repoDir)
+	if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+	}
+	want := []PullProgress{
+		{Percent: 10, ObjectsFetched: 10, ObjectsTotal: 100, BytesTransferred: 1500000},
+		{Percent: 50, ObjectsFetched: 50, ObjectsTotal: 100, BytesTransferred: 7500000},
+		{Percent: 100, ObjectsFetched: 100, ObjectsTotal: 100, BytesTransferred: 15000000},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("progress = %+v, want %+v", got, want)
+	}
+}
+
+func TestPullWithProgress_InvalidRef(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		t.Fatal("runner should not be called")
+		return nil
+	}
+
+	noop := func(PullProgress) {}
+	if err := o.PullWithProgress("", noop, false); err == nil {
+		t.Error("PullWithProgress should fail with an empty ref")
+	}
+	if err := o.PullWithProgress("matrixos/amd64/gnome", noop, false); err == nil {
+		t.Error("PullWithProgress should fail without a remote: prefix")
+	}
+	if err := o.PullWithProgress("origin:matrixos/amd64/gnome", nil, false); err == nil {
+		t.Error("PullWithProgress should fail with a nil callback")
+	}
+}
+
+func TestRemoteDelete(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+			"Ostree.Remote":  {"origin"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var lastCmdArgs []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		lastCmdArgs = append([]string{name}, args...)
+		return nil
+	}
+
+	if err := o.RemoteDelete(false); err != nil {
+		t.Fatalf("RemoteDelete failed: %v", err)
+	}
+	expectedCmd := fmt.Sprintf("ostree remote delete --repo=%s origin", repoDir)
+	if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+	}
+}
+
+func TestRemoteSetURL(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+			"Ostree.Remote":  {"origin"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var lastCmdArgs []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		lastCmdArgs = append([]string{name}, args...)
+		return nil
+	}
+
+	if err := o.RemoteSetURL("https://mirror.example.com/repo", false); err != nil {
+		t.Fatalf("RemoteSetURL failed: %v", err)
+	}
+	expectedArgs := []string{"ostree", "--repo=" + repoDir, "config", "set", `remote "origin".url`, "https://mirror.example.com/repo"}
+	if !slices.Equal(lastCmdArgs, expectedArgs) {
+		t.Errorf("Command mismatch:\nGot:  %q\nWant: %q", lastCmdArgs, expectedArgs)
+	}
+
+	if err := o.RemoteSetURL("", false); err == nil {
+		t.Error("RemoteSetURL should fail with an empty url")
+	}
+}
+
+func TestRemoteDeleteAndSetURL_MissingConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		items map[string][]string
+	}{
+		{"MissingRepoDir", map[string][]string{"Ostree.Remote": {"origin"}}},
+		{"MissingRemote", map[string][]string{"Ostree.RepoDir": {"/tmp/repo"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(&config.MockConfig{Items: tt.items})
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				t.Fatal("runner should not be called")
+				return nil
+			}
+
+			if err := o.RemoteDelete(false); err == nil {
+				t.Error("RemoteDelete should fail")
+			}
+			if err := o.RemoteSetURL("https://mirror.example.com/repo", false); err == nil {
+				t.Error("RemoteSetURL should fail")
+			}
+		})
+	}
+}
+
+func TestDeleteLocalRef(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var cmds []string
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		cmds = append(cmds, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	if err := o.DeleteLocalRef("origin:matrixos/amd64/dev/gnome", false); err != nil {
+		t.Fatalf("DeleteLocalRef failed: %v", err)
+	}
+	expectedCmd := fmt.Sprintf("ostree refs --repo=%s --delete origin:matrixos/amd64/dev/gnome", repoDir)
+	if len(cmds) != 1 || cmds[0] != expectedCmd {
+		t.Errorf("Command mismatch:\nGot:  %v\nWant: %s", cmds, expectedCmd)
+	}
+
+	cmds = nil
+	if err := o.DeleteLocalRef("ostree-metadata", false); err == nil {
+		t.Error("DeleteLocalRef should refuse to delete ostree-metadata")
+	}
+	if err := o.DeleteLocalRef("", false); err == nil {
+		t.Error("DeleteLocalRef should fail with an empty ref")
+	}
+	if len(cmds) != 0 {
+		t.Errorf("no command should run for rejected refs, got: %v", cmds)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		fn      func(o *Ostree) error
+		wantCmd string
+	}{
+		{"Fsck", func(o *Ostree) error { return o.Fsck(false) }, fmt.Sprintf("ostree fsck --repo=%s", repoDir)},
+		{"FsckWithDelta", func(o *Ostree) error { return o.FsckWithDelta(false) }, fmt.Sprintf("ostree fsck --repo=%s --delete", repoDir)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var lastCmdArgs []string
+			var cmdErr error
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				lastCmdArgs = append([]string{name}, args...)
+				return cmdErr
+			}
+
+			if err := tt.fn(o); err != nil {
+				t.Fatalf("%s failed: %v", tt.name, err)
+			}
+			if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != tt.wantCmd {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, tt.wantCmd)
+			}
+
+			cmdErr = &exec.ExitError{}
+			if err := tt.fn(o); !errors.Is(err, cmdErr) {
+				t.Errorf("%s error = %v, want it to wrap %v", tt.name, err, cmdErr)
+			}
+		})
+	}
+}
+
+func TestListStaticDeltas(t *testing.T) {
+	repoDir := t.TempDir()
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {repoDir},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		cmdErr  error
+		want    []StaticDelta
+		wantErr bool
+	}{
+		{
+			name:   "FullAndFromScratch",
+			output: "aaa111-bbb222\n\nccc333\nbbb222-ccc333\n",
+			want: []StaticDelta{
+				{From: "aaa111", To: "bbb222"},
+				{From: "", To: "ccc333"},
+				{From: "bbb222", To: "ccc333"},
+			},
+		},
+		{
+			name:   "NoDeltas",
+			output: "(No static deltas)\n",
+			want:   []StaticDelta{},
+		},
+		{
+			name:    "CommandError",
+			cmdErr:  fmt.Errorf("ostree static-delta list failed"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOstree(cfg)
+			if err != nil {
+				t.Fatalf("NewOstree failed: %v", err)
+			}
+			var lastCmdArgs []string
+			o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				lastCmdArgs = append([]string{name}, args...)
+				stdout.Write([]byte(tt.output))
+				return tt.cmdErr
+			}
+
+			got, err := o.ListStaticDeltas(false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ListStaticDeltas should have failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListStaticDeltas failed: %v", err)
+			}
+			expectedCmd := fmt.Sprintf("ostree static-delta list --repo=%s", repoDir)
+			if gotCmd := strings.Join(lastCmdArgs, " "); gotCmd != expectedCmd {
+				t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", gotCmd, expectedCmd)
+			}
+			if got == nil || !slices.Equal(got, tt.want) {
+				t.Errorf("ListStaticDeltas = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillMissingChecksums(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "cfg")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := fslib.OstreeChecksumFileAt(file, fslib.OstreeObjectTypeFile, fslib.OstreeChecksumFlagsNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := mkPI(file, "-", 0644, 0, 0, 5, "")
+	dummy := mkPI(file, "-", 0644, 0, 0, 5, "")
+	dummy.OSTreeChecksum = "0"
+	present := mkPI(file, "-", 0644, 0, 0, 5, "")
+	present.OSTreeChecksum = "keep"
+	dir := mkPI(tmpDir, "d", 0755, 0, 0, 0, "")
+
+	pis := []*fslib.PathInfo{&missing, &dummy, &present, &dir}
+	if err := fillMissingChecksums(pis); err != nil {
+		t.Fatalf("fillMissingChecksums failed: %v", err)
+	}
+	if missing.OSTreeChecksum != want || dummy.OSTreeChecksum != want {
+		t.Errorf("checksums = %q, %q, want %q", missing.OSTreeChecksum, dummy.OSTreeChecksum, want)
+	}
+	if present.OSTreeChecksum != "keep" {
+		t.Errorf("existing checksum overwritten: %q", present.OSTreeChecksum)
+	}
+	if dir.OSTreeChecksum != "" {
+		t.Errorf("directory should not be checksummed: %q", dir.OSTreeChecksum)
+	}
+
+	gone := mkPI(filepath.Join(tmpDir, "gone"), "-", 0644, 0, 0, 5, "")
+	if err := fillMissingChecksums([]*fslib.PathInfo{&gone}); err == nil {
+		t.Error("fillMissingChecksums should fail for a missing file")
+	}
+}
+
+func TestListEtcChangesChecksummed(t *testing.T) {
+	origListLocalContents := listLocalContents
+	defer func() { listLocalContents = origListLocalContents }()
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		stdout.Write([]byte("-00644 0 0 100 aaaa /usr/etc/cfg\n"))
+		return nil
+	}
+
+	t.Run("SameSizeEdit", func(t *testing.T) {
+		listLocalContents = func(string) ([]*fslib.PathInfo, error) {
+			user := mkPI("/etc/cfg", "-", 0644, 0, 0, 100, "")
+			user.OSTreeChecksum = "bbbb"
+			return []*fslib.PathInfo{&user}, nil
+		}
+		changes, err := o.ListEtcChangesChecksummed("old", "new")
+		if err != nil {
+			t.Fatalf("ListEtcChangesChecksummed failed: %v", err)
+		}
+		c := findChange(changes, "cfg")
+		if c == nil || c.Action != EtcActionUserOnly {
+			t.Errorf("Expected user-only change for cfg, got %+v", changes)
+		}
+	})
+
+	t.Run("ChecksumError", func(t *testing.T) {
+		listLocalContents = func(string) ([]*fslib.PathInfo, error) {
+			user := mkPI(filepath.Join(t.TempDir(), "missing"), "-", 0644, 0, 0, 100, "")
+			return []*fslib.PathInfo{&user}, nil
+		}
+		if _, err := o.ListEtcChangesChecksummed("old", "new"); err == nil {
+			t.Error("ListEtcChangesChecksummed should fail when a live file cannot be hashed")
+		}
+	})
+}
+
+// etcMergeStatus is the ostree admin status of the sysroot created by
+// setupEtcTrees: new123 is pending, old456 is booted.
+const etcMergeStatus = `{"deployments": [
+	{"checksum": "new123", "stateroot": "matrixos", "pending": true, "index": 0, "serial": 0},
+	{"checksum": "old456", "stateroot": "matrixos", "booted": true, "index": 1, "serial": 0}
+]}`
+
+// setupEtcTrees points liveEtcDir at a fresh temp directory for the
+// duration of the test and creates a sysroot holding a pending deployment
+// with an empty /usr/etc. It returns an Ostree using that sysroot, the live
+// /etc and the root of the pending deployment.
+func setupEtcTrees(t *testing.T) (*Ostree, string, string) {
+	t.Helper()
+	origLive := liveEtcDir
+	t.Cleanup(func() {
+		liveEtcDir = origLive
+	})
+	liveEtcDir = filepath.Join(t.TempDir(), "etc")
+	sysroot := t.TempDir()
+	newDeployRoot := BuildDeploymentRootfs(sysroot, "matrixos", "new123", 0)
+	for _, dir := range []string{liveEtcDir, filepath.Join(newDeployRoot, "usr", "etc")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o, _ := newRecordingOstree(t, map[string][]string{"Ostree.Root": {sysroot}}, func(stdout io.Writer, _ []string) error {
+		_, err := io.WriteString(stdout, etcMergeStatus)
+		return err
+	})
+	return o, liveEtcDir, newDeployRoot
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyEtcChanges(t *testing.T) {
+	uid, gid := uint64(os.Getuid()), uint64(os.Getgid())
+
+	newChanges := func() []EtcChange {
+		addPI := mkPI("/usr/etc/conf.d/new.conf", "-", 0600, uid, gid, 3, "")
+		updPI := mkPI("/usr/etc/upd.conf", "-", 0640, uid, gid, 7, "")
+		linkPI := mkPI("/usr/etc/link", "l", 0777, uid, gid, 0, "upd.conf")
+		oldRm := mkPI("/usr/etc/rm.conf", "-", 0644, uid, gid, 2, "")
+		conflictPI := mkPI("/usr/etc/conflict.conf", "-", 0644, uid, gid, 8, "")
+		userPI := mkPI("/etc/user.conf", "-", 0644, uid, gid, 4, "")
+		return []EtcChange{
+			{Path: "conf.d/new.conf", Action: EtcActionAdd, New: &addPI},
+			{Path: "conflict.conf", Action: EtcActionConflict, New: &conflictPI},
+			{Path: "link", Action: EtcActionAdd, New: &linkPI},
+			{Path: "rm.conf", Action: EtcActionRemove, Old: &oldRm},
+			{Path: "upd.conf", Action: EtcActionUpdate, New: &updPI},
+			{Path: "user.conf", Action: EtcActionUserOnly, User: &userPI},
+		}
+	}
+	setup := func(t *testing.T) (*Ostree, string, string) {
+		o, live, root := setupEtcTrees(t)
+		pristine := filepath.Join(root, "usr", "etc")
+		writeTestFile(t, filepath.Join(pristine, "conf.d", "new.conf"), "new")
+		writeTestFile(t, filepath.Join(pristine, "upd.conf"), "updated")
+		writeTestFile(t, filepath.Join(pristine, "conflict.conf"), "upstream")
+		writeTestFile(t, filepath.Join(live, "upd.conf"), "old")
+		writeTestFile(t, filepath.Join(live, "rm.conf"), "rm")
+		writeTestFile(t, filepath.Join(live, "conflict.conf"), "mine")
+		writeTestFile(t, filepath.Join(live, "user.conf"), "user")
+		return o, live, root
+	}
+	appliedPaths := func(changes []EtcChange) []string {
+		var paths []string
+		for _, c := range changes {
+			paths = append(paths, c.Path)
+		}
+		slices.Sort(paths)
+		return paths
+	}
+	wantApplied := []string{"conf.d/new.conf", "link", "rm.conf", "upd.conf"}
+
+	t.Run("Apply", func(t *testing.T) {
+		o, live, _ := setup(t)
+		applied, err := o.ApplyEtcChanges(newChanges(), false)
+		if err != nil {
+			t.Fatalf("ApplyEtcChanges failed: %v", err)
+		}
+		if got := appliedPaths(applied); !slices.Equal(got, wantApplied) {
+			t.Errorf("applied = %v, want %v", got, wantApplied)
+		}
+
+		for path, want := range map[string]string{
+			"conf.d/new.conf": "new",
+			"upd.conf":        "updated",
+			"conflict.conf":   "mine",
+			"user.conf":       "user",
+		} {
+			data, err := os.ReadFile(filepath.Join(live, path))
+			if err != nil {
+				t.Errorf("reading %s: %v", path, err)
+				continue
+			}
+			if string(data) != want {
+				t.Errorf("%s = %q, want %q", path, data, want)
+			}
+		}
+		for path, want := range map[string]os.FileMode{
+			"conf.d/new.conf": 0600,
+			"upd.conf":        0640,
+		} {
+			info, err := os.Stat(filepath.Join(live, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != want {
+				t.Errorf("%s mode = %o, want %o", path, info.Mode().Perm(), want)
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(live, "link")); err != nil || target != "upd.conf" {
+			t.Errorf("link = %q, %v; want upd.conf", target, err)
+		}
+		if _, err := os.Stat(filepath.Join(live, "rm.conf")); !os.IsNotExist(err) {
+			t.Errorf("rm.conf should have been removed, stat err = %v", err)
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		o, live, _ := setup(t)
+		applied, err := o.ApplyEtcChanges(newChanges(), true)
+		if err != nil {
+			t.Fatalf("ApplyEtcChanges failed: %v", err)
+		}
+		if got := appliedPaths(applied); !slices.Equal(got, wantApplied) {
+			t.Errorf("applied = %v, want %v", got, wantApplied)
+		}
+		if _, err := os.Stat(filepath.Join(live, "conf.d")); !os.IsNotExist(err) {
+			t.Errorf("dry run created conf.d, stat err = %v", err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(live, "upd.conf")); string(data) != "old" {
+			t.Errorf("dry run modified upd.conf: %q", data)
+		}
+		if _, err := os.Stat(filepath.Join(live, "rm.conf")); err != nil {
+			t.Errorf("dry run removed rm.conf: %v", err)
+		}
+	})
+
+	t.Run("RemoveDirectoryAfterContents", func(t *testing.T) {
+		o, live, _ := setup(t)
+		writeTestFile(t, filepath.Join(live, "gone.d", "a.conf"), "a")
+		dirPI := mkPI("/usr/etc/gone.d", "d", 0755, uid, gid, 0, "")
+		filePI := mkPI("/usr/etc/gone.d/a.conf", "-", 0644, uid, gid, 1, "")
+		changes := []EtcChange{
+			{Path: "gone.d", Action: EtcActionRemove, Old: &dirPI},
+			{Path: "gone.d/a.conf", Action: EtcActionRemove, Old: &filePI},
+		}
+		if _, err := o.ApplyEtcChanges(changes, false); err != nil {
+			t.Fatalf("ApplyEtcChanges failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(live, "gone.d")); !os.IsNotExist(err) {
+			t.Errorf("gone.d should have been removed, stat err = %v", err)
+		}
+	})
+
+	t.Run("MissingSource", func(t *testing.T) {
+		o, _, _ := setupEtcTrees(t)
+		pi := mkPI("/usr/etc/missing.conf", "-", 0644, uid, gid, 1, "")
+		changes := []EtcChange{{Path: "missing.conf", Action: EtcActionAdd, New: &pi}}
+		if _, err := o.ApplyEtcChanges(changes, false); err == nil {
+			t.Error("ApplyEtcChanges should fail when the pristine file is missing")
+		}
+		noPending, _ := newRecordingOstree(t, map[string][]string{"Ostree.Root": {t.TempDir()}}, func(stdout io.Writer, _ []string) error {
+			_, err := io.WriteString(stdout, `{"deployments": [{"checksum": "old456", "stateroot": "matrixos", "booted": true}]}`)
+			return err
+		})
+		if _, err := noPending.ApplyEtcChanges(changes, false); err == nil {
+			t.Error("ApplyEtcChanges should fail without a pending deployment")
+		}
+	})
+
+	t.Run("CopiesFromNewDeployment", func(t *testing.T) {
+		o, live, newRoot := setup(t)
+		// The booted deployment still ships the old defaults.
+		bootedRoot := filepath.Join(filepath.Dir(newRoot), "old456.0")
+		writeTestFile(t, filepath.Join(bootedRoot, "usr", "etc", "upd.conf"), "stale")
+		writeTestFile(t, filepath.Join(bootedRoot, "usr", "etc", "conf.d", "new.conf"), "stale")
+
+		if _, err := o.ApplyEtcChanges(newChanges(), false); err != nil {
+			t.Fatalf("ApplyEtcChanges failed: %v", err)
+		}
+		for path, want := range map[string]string{
+			"conf.d/new.conf": "new",
+			"upd.conf":        "updated",
+		} {
+			data, err := os.ReadFile(filepath.Join(live, path))
+			if err != nil {
+				t.Fatalf("reading %s: %v", path, err)
+			}
+			if string(data) != want {
+				t.Errorf("%s = %q, want %q from the new deployment", path, data, want)
+			}
+		}
+	})
+}
+
+func TestBackupConflicts(t *testing.T) {
+	o, live, _ := setupEtcTrees(t)
+	backupDir := filepath.Join(t.TempDir(), "backup")
+
+	writeTestFile(t, filepath.Join(live, "conflict.conf"), "mine")
+	if err := os.Chmod(filepath.Join(live, "conflict.conf"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(live, "nested", "deep", "c.conf"), "deep")
+	writeTestFile(t, filepath.Join(live, "upd.conf"), "old")
+	writeTestFile(t, filepath.Join(live, "user.conf"), "user")
+	if err := os.Symlink("conflict.conf", filepath.Join(live, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []EtcChange{
+		{Path: "conflict.conf", Action: EtcActionConflict},
+		{Path: "gone.conf", Action: EtcActionConflict}, // removed by the user
+		{Path: "link", Action: EtcActionConflict},
+		{Path: "nested/deep/c.conf", Action: EtcActionConflict},
+		{Path: "new.conf", Action: EtcActionAdd},
+		{Path: "upd.conf", Action: EtcActionUpdate},
+		{Path: "user.conf", Action: EtcActionUserOnly},
+	}
+	backups, err := o.BackupConflicts(changes, backupDir)
+	if err != nil {
+		t.Fatalf("BackupConflicts failed: %v", err)
+	}
+
+	want := []string{
+		filepath.Join(backupDir, "conflict.conf.orig"),
+		filepath.Join(backupDir, "link.orig"),
+		filepath.Join(backupDir, "nested", "deep", "c.conf.orig"),
+	}
+	if !slices.Equal(backups, want) {
+		t.Errorf("backups = %v, want %v", backups, want)
+	}
+
+	if data, err := os.ReadFile(want[0]); err != nil || string(data) != "mine" {
+		t.Errorf("conflict.conf.orig = %q, %v; want %q", data, err, "mine")
+	}
+	info, err := os.Stat(want[0])
+	if err != nil {
+		t.Fatalf("stat conflict.conf.orig: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("conflict.conf.orig mode = %v, want 0600", info.Mode().Perm())
+	}
+	if target, err := os.Readlink(want[1]); err != nil || target != "conflict.conf" {
+		t.Errorf("link.orig = %q, %v; want conflict.conf", target, err)
+	}
+	if data, err := os.ReadFile(want[2]); err != nil || string(data) != "deep" {
+		t.Errorf("c.conf.orig = %q, %v; want %q", data, err, "deep")
+	}
+	for _, name := range []string{"upd.conf.orig", "user.conf.orig", "new.conf.orig", "gone.conf.orig"} {
+		if _, err := os.Lstat(filepath.Join(backupDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist, stat err = %v", name, err)
+		}
+	}
+
+	if _, err := o.BackupConflicts(changes, ""); err == nil {
+		t.Error("BackupConflicts should fail without a backup directory")
+	}
+}
+
+func TestEtcChangesJSON(t *testing.T) {
+	origListLocalContents := listLocalContents
+	defer func() { listLocalContents = origListLocalContents }()
+
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {t.TempDir()},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		if slices.Contains(args, "old") {
+			stdout.Write([]byte("-00644 0 0 100 aaaa /usr/etc/cfg\n"))
+		} else {
+			stdout.Write([]byte("-00644 0 0 120 cccc /usr/etc/cfg\n"))
+		}
+		return nil
+	}
+	listLocalContents = func(string) ([]*fslib.PathInfo, error) {
+		cfgPI := mkPI("/etc/cfg", "-", 0644, 0, 0, 110, "")
+		cfgPI.OSTreeChecksum = "bbbb"
+		userPI := mkPI("/etc/local.conf", "-", 0600, 0, 0, 10, "")
+		userPI.OSTreeChecksum = "dddd"
+		return []*fslib.PathInfo{&cfgPI, &userPI}, nil
+	}
+
+	data, err := o.EtcChangesJSON("old", "new")
+	if err != nil {
+		t.Fatalf("EtcChangesJSON failed: %v", err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		`"action":"conflict"`,
+		`"action":"user-only"`,
+		`"path":"cfg"`,
+		`"path":"local.conf"`,
+		`"perms":"0644"`,
+		`"perms":"0600"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("JSON output missing %s:\n%s", want, got)
+		}
+	}
+
+	var decoded []EtcChange
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	if len(decoded) != 2 || decoded[0].New == nil || decoded[0].New.Mode.Perms != 0644 {
+		t.Errorf("unexpected round trip result: %+v", decoded)
+	}
+
+	t.Run("NoChanges", func(t *testing.T) {
+		listLocalContents = func(string) ([]*fslib.PathInfo, error) { return nil, nil }
+		o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			return nil
+		}
+		data, err := o.EtcChangesJSON("old", "new")
+		if err != nil {
+			t.Fatalf("EtcChangesJSON failed: %v", err)
+		}
+		if string(data) != "[]" {
+			t.Errorf("EtcChangesJSON = %s, want []", data)
+		}
+	})
+}
+
+func TestSentinelErrors(t *testing.T) {
+	newOstree := func(t *testing.T, items map[string][]string, runner func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error) *Ostree {
+		o, err := NewOstree(&config.MockConfig{Items: items})
+		if err != nil {
+			t.Fatalf("NewOstree failed: %v", err)
+		}
+		if runner != nil {
+			o.runner = runner
+		}
+		return o
+	}
+	noop := func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error { return nil }
+
+	t.Run("NoRemotePrefix", func(t *testing.T) {
+		o := newOstree(t, map[string][]string{"Ostree.RepoDir": {"/repo"}}, noop)
+		err := o.Pull("matrixos/amd64/gnome", false)
+		if !errors.Is(err, ErrNoRemotePrefix) {
+			t.Fatalf("Pull error = %v, want ErrNoRemotePrefix", err)
+		}
+		if !strings.Contains(err.Error(), "matrixos/amd64/gnome") {
+			t.Errorf("error %q does not mention the ref", err)
+		}
+	})
+
+	t.Run("NoBootedDeployment", func(t *testing.T) {
+		o := newOstree(t, map[string][]string{"Ostree.Root": {t.TempDir()}},
+			func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+				stdout.Write([]byte(`{"deployments": [{"booted": false, "checksum": "abc123"}]}`))
+				return nil
+			})
+		if _, err := o.BootedRef(false); !errors.Is(err, ErrNoBootedDeployment) {
+			t.Fatalf("BootedRef error = %v, want ErrNoBootedDeployment", err)
+		}
+	})
+
+	t.Run("RefNotFoundEmptyOutput", func(t *testing.T) {
+		o := newOstree(t, nil, noop)
+		_, err := o.lastCommitFromRepo("/repo", "matrixos/amd64/gnome", false)
+		if !errors.Is(err, ErrRefNotFound) {
+			t.Fatalf("lastCommitFromRepo error = %v, want ErrRefNotFound", err)
+		}
+	})
+
+	t.Run("RefNotFoundReported", func(t *testing.T) {
+		o := newOstree(t, nil, func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			fmt.Fprintln(stderr, "error: Refspec 'matrixos/amd64/gnome' not found")
+			return errors.New("exit status 1")
+		})
+		_, err := o.lastCommitFromRepo("/repo", "matrixos/amd64/gnome", false)
+		if !errors.Is(err, ErrRefNotFound) {
+			t.Fatalf("lastCommitFromRepo error = %v, want ErrRefNotFound", err)
+		}
+	})
+
+	t.Run("OtherRevParseFailure", func(t *testing.T) {
+		o := newOstree(t, nil, func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+			fmt.Fprintln(stderr, "error: opening repo: Permission denied")
+			return errors.New("exit status 1")
+		})
+		_, err := o.lastCommitFromRepo("/repo", "matrixos/amd64/gnome", false)
+		if err == nil || errors.Is(err, ErrRefNotFound) {
+			t.Fatalf("lastCommitFromRepo error = %v, want a non ErrRefNotFound error", err)
+		}
+	})
+
+	t.Run("RepoDirMissing", func(t *testing.T) {
+		o := newOstree(t, nil, nil)
+		if _, err := o.RepoDir(); !errors.Is(err, ErrRepoDirMissing) {
+			t.Fatalf("RepoDir error = %v, want ErrRepoDirMissing", err)
+		}
+	})
+}
+
+func TestRunCmdStdin(t *testing.T) {
+	o, err := NewOstree(&config.MockConfig{})
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	var received []byte
+	var gotArgs []string
+	o.runner = func(stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		if stdin == nil {
+			return errors.New("stdin not provided")
+		}
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		received = data
+		gotArgs = append([]string{name}, args...)
+		return nil
+	}
+
+	input := "-----BEGIN PGP PUBLIC KEY BLOCK-----\nfake\n"
+	if err := o.runCmd(strings.NewReader(input), io.Discard, io.Discard, false, "--repo=/repo", "remote", "gpg-import", "--stdin", "origin"); err != nil {
+		t.Fatalf("runCmd failed: %v", err)
+	}
+	if string(received) != input {
+		t.Errorf("stdin = %q, want %q", received, input)
+	}
+	if want := "ostree --repo=/repo remote gpg-import --stdin origin"; strings.Join(gotArgs, " ") != want {
+		t.Errorf("Command mismatch:\nGot:  %s\nWant: %s", strings.Join(gotArgs, " "), want)
+	}
+}
+
+func TestRequiredItemAccessors(t *testing.T) {
+	keys := []string{
+		"Ostree.RepoDir", "Ostree.Remote", "Ostree.RemoteUrl", "Ostree.Sysroot",
+		"Ostree.Root", "matrixOS.OsName", "matrixOS.Arch",
+	}
+	items := map[string][]string{}
+	for _, k := range keys {
+		items[k] = []string{""}
+	}
+	o, err := NewOstree(&config.MockConfig{Items: items})
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	tests := []struct {
+		key string
+		fn  func() (string, error)
+	}{
+		{"Ostree.RepoDir", o.RepoDir},
+		{"Ostree.Remote", o.Remote},
+		{"Ostree.RemoteUrl", o.RemoteURL},
+		{"Ostree.Sysroot", o.Sysroot},
+		{"Ostree.Root", o.Root},
+		{"matrixOS.OsName", o.OsName},
+		{"matrixOS.Arch", o.Arch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			_, err := tt.fn()
+			if !errors.Is(err, ErrEmptyConfigItem) {
+				t.Fatalf("error = %v, want ErrEmptyConfigItem", err)
+			}
+			want := "invalid " + tt.key + ": must not be empty"
+			if err.Error() != want {
+				t.Errorf("error = %q, want %q", err.Error(), want)
+			}
+		})
+	}
+
+	if _, err := o.RepoDir(); !errors.Is(err, ErrRepoDirMissing) {
+		t.Errorf("RepoDir error = %v, want ErrRepoDirMissing", err)
+	}
+
+	o, _ = NewOstree(&config.MockConfig{Items: map[string][]string{"Ostree.Remote": {"origin"}}})
+	if got, err := o.Remote(); err != nil || got != "origin" {
+		t.Errorf("Remote() = %q, %v, want origin", got, err)
+	}
+}
+
+func TestRemoteRefsWithPrefix(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.RepoDir": {"/repo"},
+			"Ostree.Remote":  {"origin"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		stdout.Write([]byte("origin:matrixos/amd64/gnome\norigin:matrixos/arm64/gnome\norigin:matrixos/amd64/dev/gnome\n"))
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{"BarePrefix", "matrixos/amd64/", []string{"origin:matrixos/amd64/gnome", "origin:matrixos/amd64/dev/gnome"}},
+		{"RemotePrefix", "origin:matrixos/arm64/", []string{"origin:matrixos/arm64/gnome"}},
+		{"NoMatch", "matrixos/riscv64/", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := o.RemoteRefsWithPrefix(tt.prefix, false)
+			if err != nil {
+				t.Fatalf("RemoteRefsWithPrefix failed: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := o.RemoteRefsWithPrefix("", false); err == nil {
+		t.Error("Expected error for empty prefix")
+	}
+}
+
+func TestRefToShortName(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.FullBranchSuffix": {"full"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{"Prod", "matrixos/amd64/gnome", "gnome", false},
+		{"DevFull", "matrixos/amd64/dev/gnome-full", "gnome", false},
+		{"WithRemote", "origin:matrixos/amd64/staging/server-full", "server", false},
+		{"OtherArch", "matrixos/arm64/gnome", "", true},
+		{"OtherOs", "otheros/amd64/gnome", "", true},
+		{"Empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := o.RefToShortName(tt.ref, "matrixos", "amd64")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RefToShortName(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RefToShortName(%q) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootedDeployment(t *testing.T) {
+	cfg := &config.MockConfig{
+		Items: map[string][]string{
+			"Ostree.Root": {"/"},
+		},
+	}
+	o, err := NewOstree(cfg)
+	if err != nil {
+		t.Fatalf("NewOstree failed: %v", err)
+	}
+
+	statusJSON := `{
+		"deployments": [
+			{
+				"checksum": "def456",
+				"stateroot": "matrixos",
+				"refspec": "origin:matrixos/amd64/server",
+				"booted": false,
+				"index": 0,
+				"serial": 0
+			},
+			{
+				"checksum": "abc123",
+				"stateroot": "matrixos",
+				"refspec": "origin:matrixos/amd64/gnome",
+				"booted": true,
+				"index": 1,
+				"serial": 2
+			}
+		]
+	}`
+	o.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		stdout.Write([]byte(statusJSON))
+		return nil
+	}
+
+	d, err := o.BootedDeployment(false)
+	if err != nil {
+		t.Fatalf("BootedDeployment failed: %v", err)
+	}
+	want := Deployment{
+		Checksum:  "abc123",
+		Stateroot: "matrixos",
+		Refspec:   "origin:matrixos/amd64/gnome",
+		Booted:    true,
+		Index:     1,
+		Serial:    2,
+	}
+	if *d != want {
+		t.Errorf("BootedDeployment = %+v, want %+v", *d, want)
+	}
+
+	statusJSON = `{"deployments": [{"booted": false, "checksum": "def456"}]}`
+	if _, err := o.BootedDeployment(false); !errors.Is(err, ErrNoBootedDeployment) {
+		t.Errorf("BootedDeployment error = %v, want ErrNoBootedDeployment", err)
+	}
+	if _, err := o.BootedRef(false); !errors.Is(err, ErrNoBootedDeployment) {
+		t.Errorf("BootedRef error = %v, want ErrNoBootedDeployment", err)
+	}
+	if _, err := o.BootedHash(false); !errors.Is(err, ErrNoBootedDeployment) {
+		t.Errorf("BootedHash error = %v, want ErrNoBootedDeployment", err)
+	}
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// EnvOverridePrefix is the prefix of the environment variables that override
+// config items when using WithEnvOverrides.
+const EnvOverridePrefix = "MATRIXOS_"
+
+// EnvOverrideName returns the name of the environment variable that overrides
+// the given config key. E.g. "Imager.ImageSize" -> "MATRIXOS_IMAGER_IMAGESIZE".
+func EnvOverrideName(key string) string {
+	name := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+	return EnvOverridePrefix + name
+}
+
+// EnvOverrideConfig is an IConfig decorator that consults environment
+// variables (see EnvOverrideName) before falling through to the base config.
+// It is meant for one-off builds where editing config files is overkill.
+type EnvOverrideConfig struct {
+	base IConfig
+}
+
+// WithEnvOverrides wraps base so that environment variables take precedence
+// over the values it provides.
+func WithEnvOverrides(base IConfig) *EnvOverrideConfig {
+	return &EnvOverrideConfig{base: base}
+}
+
+// Load loads the base config.
+func (c *EnvOverrideConfig) Load() error {
+	return c.base.Load()
+}
+
+// GetItem returns the environment override for key if set, otherwise the
+// base config value.
+func (c *EnvOverrideConfig) GetItem(key string) (string, error) {
+	if val, ok := os.LookupEnv(EnvOverrideName(key)); ok {
+		return val, nil
+	}
+	return c.base.GetItem(key)
+}
+
+// GetBool returns the environment override for key, cast to bool, if set,
+// otherwise the base config value.
+func (c *EnvOverrideConfig) GetBool(key string) (bool, error) {
+	if val, ok := os.LookupEnv(EnvOverrideName(key)); ok {
+		return val == "true", nil
+	}
+	return c.base.GetBool(key)
+}
+
+// GetItems returns the environment override for key as a single value list if
+// set, otherwise the base config values.
+func (c *EnvOverrideConfig) GetItems(key string) ([]string, error) {
+	if val, ok := os.LookupEnv(EnvOverrideName(key)); ok {
+		return []string{val}, nil
+	}
+	return c.base.GetItems(key)
+}
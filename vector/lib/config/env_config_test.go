@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEnvOverrideName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"Imager.ImageSize", "MATRIXOS_IMAGER_IMAGESIZE"},
+		{"matrixOS.OsName", "MATRIXOS_MATRIXOS_OSNAME"},
+		{"Ostree.Gpg", "MATRIXOS_OSTREE_GPG"},
+	}
+	for _, tt := range tests {
+		if got := EnvOverrideName(tt.key); got != tt.want {
+			t.Errorf("EnvOverrideName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestWithEnvOverrides(t *testing.T) {
+	base := &MockConfig{
+		Items: map[string][]string{
+			"Imager.ImageSize":  {"32G"},
+			"Imager.Compressor": {"xz -f -0 -T0"},
+		},
+		Bools: map[string]bool{
+			"Ostree.Gpg": true,
+		},
+	}
+	cfg := WithEnvOverrides(base)
+
+	t.Run("EnvOverridesItem", func(t *testing.T) {
+		t.Setenv("MATRIXOS_IMAGER_IMAGESIZE", "64G")
+		got, err := cfg.GetItem("Imager.ImageSize")
+		if err != nil {
+			t.Fatalf("GetItem failed: %v", err)
+		}
+		if got != "64G" {
+			t.Errorf("GetItem = %q, want 64G", got)
+		}
+		items, err := cfg.GetItems("Imager.ImageSize")
+		if err != nil {
+			t.Fatalf("GetItems failed: %v", err)
+		}
+		if len(items) != 1 || items[0] != "64G" {
+			t.Errorf("GetItems = %v, want [64G]", items)
+		}
+	})
+
+	t.Run("EnvOverridesBool", func(t *testing.T) {
+		t.Setenv("MATRIXOS_OSTREE_GPG", "false")
+		got, err := cfg.GetBool("Ostree.Gpg")
+		if err != nil {
+			t.Fatalf("GetBool failed: %v", err)
+		}
+		if got {
+			t.Error("GetBool = true, want false")
+		}
+	})
+
+	t.Run("FallThrough", func(t *testing.T) {
+		got, err := cfg.GetItem("Imager.Compressor")
+		if err != nil {
+			t.Fatalf("GetItem failed: %v", err)
+		}
+		if got != "xz -f -0 -T0" {
+			t.Errorf("GetItem = %q, want base value", got)
+		}
+		b, err := cfg.GetBool("Ostree.Gpg")
+		if err != nil {
+			t.Fatalf("GetBool failed: %v", err)
+		}
+		if !b {
+			t.Error("GetBool = false, want base value true")
+		}
+	})
+
+	t.Run("EmptyEnvStillOverrides", func(t *testing.T) {
+		t.Setenv("MATRIXOS_IMAGER_IMAGESIZE", "")
+		got, err := cfg.GetItem("Imager.ImageSize")
+		if err != nil {
+			t.Fatalf("GetItem failed: %v", err)
+		}
+		if got != "" {
+			t.Errorf("GetItem = %q, want empty override", got)
+		}
+	})
+
+	t.Run("BaseErrorPropagates", func(t *testing.T) {
+		errCfg := WithEnvOverrides(&ErrConfig{Err: errors.New("broken")})
+		if _, err := errCfg.GetItem("Imager.ImageSize"); err == nil {
+			t.Error("expected base error to propagate")
+		}
+		if err := errCfg.Load(); err == nil {
+			t.Error("expected Load error to propagate")
+		}
+	})
+}
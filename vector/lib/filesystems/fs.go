@@ -1,12 +1,14 @@
 package filesystems
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -36,22 +38,69 @@ const BLKFLSBUF = 0x1261
 
 // PathMode represents the mode of a path.
 type PathMode struct {
-	Type   string      // E.g., "-", "d", "l"
-	SetUID bool        // Set-user-ID bit
-	SetGID bool        // Set-group-ID bit
-	Sticky bool        // Sticky bit
-	Perms  fs.FileMode // Stored as uint32, printed as octal
+	Type   string      `json:"type"`   // E.g., "-", "d", "l"
+	SetUID bool        `json:"setuid"` // Set-user-ID bit
+	SetGID bool        `json:"setgid"` // Set-group-ID bit
+	Sticky bool        `json:"sticky"` // Sticky bit
+	Perms  fs.FileMode `json:"perms"`  // Stored as uint32, printed as octal
+}
+
+// pathModeJSON is the JSON form of PathMode, with Perms as an octal string.
+type pathModeJSON struct {
+	Type   string `json:"type"`
+	SetUID bool   `json:"setuid"`
+	SetGID bool   `json:"setgid"`
+	Sticky bool   `json:"sticky"`
+	Perms  string `json:"perms"`
+}
+
+// MarshalJSON encodes the permission bits as an octal string (e.g. "0644")
+// rather than a raw integer.
+func (m PathMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pathModeJSON{
+		Type:   m.Type,
+		SetUID: m.SetUID,
+		SetGID: m.SetGID,
+		Sticky: m.Sticky,
+		Perms:  fmt.Sprintf("%04o", m.Perms.Perm()),
+	})
+}
+
+// UnmarshalJSON decodes a PathMode produced by MarshalJSON.
+func (m *PathMode) UnmarshalJSON(data []byte) error {
+	var j pathModeJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	perms, err := strconv.ParseUint(j.Perms, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid perms %q: %w", j.Perms, err)
+	}
+	*m = PathMode{
+		Type:   j.Type,
+		SetUID: j.SetUID,
+		SetGID: j.SetGID,
+		Sticky: j.Sticky,
+		Perms:  fs.FileMode(perms),
+	}
+	return nil
 }
 
 // PathInfo represents the information of a path in an ostree commit.
 type PathInfo struct {
-	Mode           *PathMode // Mode information of the path
-	Uid            uint64    // User ID of the owner
-	Gid            uint64    // Group ID of the owner
-	Size           uint64    // Size of the file in bytes
-	OSTreeChecksum string    // Checksum of the path if regular file
-	Path           string    // Full path of the file
-	Link           string    // Target of the symlink if Type is "l"
+	Mode           *PathMode `json:"mode"`           // Mode information of the path
+	Uid            uint64    `json:"uid"`            // User ID of the owner
+	Gid            uint64    `json:"gid"`            // Group ID of the owner
+	Size           uint64    `json:"size"`           // Size of the file in bytes
+	OSTreeChecksum string    `json:"checksum"`       // Checksum of the path if regular file
+	Path           string    `json:"path"`           // Full path of the file
+	Link           string    `json:"link,omitempty"` // Target of the symlink if Type is "l"
+}
+
+// HasChecksum returns whether pi is a regular file with a real OSTree
+// checksum (ListContents uses "0" as a dummy one when hashing fails).
+func (pi *PathInfo) HasChecksum() bool {
+	return pi.Mode.Type == "-" && pi.OSTreeChecksum != "" && pi.OSTreeChecksum != "0"
 }
 
 // Equals compares two PathInfo entries for metadata equality:
@@ -1,6 +1,7 @@
 package filesystems
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -53,6 +54,26 @@ func TestPathInfoMetaEqual(t *testing.T) {
 	}
 }
 
+func TestPathInfoHasChecksum(t *testing.T) {
+	a := mkPI("/etc/foo", "-", 0644, 0, 0, 100, "")
+	a.OSTreeChecksum = "aaaa"
+	if !a.HasChecksum() {
+		t.Error("Expected a real checksum to count")
+	}
+
+	// Missing and dummy checksums do not count, nor do non-regular files.
+	b := mkPI("/etc/foo", "-", 0644, 0, 0, 100, "")
+	c := mkPI("/etc/foo", "-", 0644, 0, 0, 100, "")
+	c.OSTreeChecksum = "0"
+	d := mkPI("/etc/foo.d", "d", 0755, 0, 0, 0, "")
+	d.OSTreeChecksum = "aaaa"
+	for _, pi := range []PathInfo{b, c, d} {
+		if pi.HasChecksum() {
+			t.Errorf("Expected %+v not to have a checksum", pi)
+		}
+	}
+}
+
 // fakeExecCommand mocks exec.Command for testing purposes.
 func fakeExecCommand(command string, args ...string) *exec.Cmd {
 	cs := []string{"-test.run=TestHelperProcess", "--", command}
@@ -1538,3 +1559,27 @@ func TestListContents(t *testing.T) {
 		}
 	})
 }
+
+func TestPathModeJSON(t *testing.T) {
+	m := PathMode{Type: "-", SetGID: true, Perms: 0644}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := `{"type":"-","setuid":false,"setgid":true,"sticky":false,"perms":"0644"}`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+
+	var got PathMode
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got != m {
+		t.Errorf("round trip = %+v, want %+v", got, m)
+	}
+
+	if err := json.Unmarshal([]byte(`{"perms":"rw-"}`), &got); err == nil {
+		t.Error("Unmarshal should reject non-octal perms")
+	}
+}
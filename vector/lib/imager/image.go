@@ -2,14 +2,28 @@ package imager
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"matrixos/vector/lib/cds"
@@ -21,16 +35,23 @@ import (
 // IImage defines the interface for image operations.
 // It mirrors all public methods of Image for testability.
 type IImage interface {
+	SetOutput(stdout, stderr io.Writer)
+	SetDryRun(dryRun bool)
+
 	// Config accessors
 	ImagesOutDir() (string, error)
 	MountDir() (string, error)
 	ImageSize() (string, error)
 	EfiPartitionSize() (string, error)
 	BootPartitionSize() (string, error)
+	SwapPartitionSize() (string, error)
+	RootPartitionNumber() (int, error)
+	PartprobeRetries() (int, error)
 	Compressor() (string, error)
 	EspPartitionType() (string, error)
 	BootPartitionType() (string, error)
 	RootPartitionType() (string, error)
+	RootFilesystem() (string, error)
 	OsName() (string, error)
 	BootRoot() (string, error)
 	EfiRoot() (string, error)
@@ -38,54 +59,94 @@ type IImage interface {
 	EfiExecutable() (string, error)
 	EfiCertificateFileName() (string, error)
 	EfiCertificateFileNameDer() (string, error)
+	MokEnrollmentFileName() (string, error)
 	EfiCertificateFileNameKek() (string, error)
 	EfiCertificateFileNameKekDer() (string, error)
 	ReadOnlyVdb() (string, error)
 	DevDir() (string, error)
 	LockDir() (string, error)
 	LockWaitSeconds() (string, error)
+	BootEntryPerKernel() (bool, error)
+	Bootloader() (string, error)
+	ImageAllocation() (string, error)
+	MemtestPaths() ([]string, error)
+	LuksKeyfile() (string, error)
+	BootMountOptions() (string, error)
 	BuildMetadataFile() (string, error)
 
 	// Operations
 	ReleaseVersion(rootfs string) (string, error)
+	OsRelease(rootfs string) (map[string]string, error)
+	OsReleaseVersion(rootfs string) (string, error)
 	ImagePath(ref string) (string, error)
+	ImagePathWithArch(ref, arch string) (string, error)
 	ImagePathWithReleaseVersion(ref, releaseVersion string) (string, error)
+	UniqueImagePath(ref, releaseVersion string) (string, error)
 	CreateImage(imagePath, imageSize string) error
+	ImageExists(imagePath string) bool
+	CreateImageIfMissing(imagePath, imageSize string) (created bool, err error)
+	GrowImage(imagePath, newSize string) error
+	CompressorExtensions() (map[string]string, error)
 	ImagePathWithCompressorExtension(imagePath, compressor string) (string, error)
-	CompressImage(imagePath, compressor string) error
+	CompressImage(imagePath, compressor string, withChecksum bool) error
+	CompressImageWithProgress(imagePath, compressor string, onProgress func(percent float64)) error
+	PartitionLayout(blockDevice string) ([]Partition, error)
 	BlockDeviceNthPartitionPath(blockDevice string, nth int) (string, error)
 	BlockDeviceForPartitionPath(partitionPath string) (string, error)
 	PartitionNumber(partitionPath string) (string, error)
 	PartitionLabel(partitionPath string) (string, error)
 	ClearPartitionTable(devicePath string) error
 	GetPartitionType(devicePath string) (string, error)
+	VerifyPartitionTypes(blockDevice string) error
+	ValidatePartitionTypeGUIDs() error
 	DatedFsLabel() string
+	CurrentFsLabels(devicePath string) (map[int]string, error)
 	PartitionDevices(efiSize, bootSize, imageSize, devicePath string) error
+	DeviceIsMounted(device string) (bool, error)
 	FormatEfifs(efiDevice string) error
 	MountEfifs(efiDevice, mountEfifs string) error
 	FormatBootfs(bootDevice string) error
 	MountBootfs(bootDevice, mountBootfs string) error
+	FormatSwap(swapDevice string) error
 	FormatRootfs(rootDevice string) error
 	RootfsKernelArgs() []string
 	MountRootfs(rootDevice, mountRootfs string) error
+	RootFsType(mountRootfs string) (string, error)
+	SnapshotRoot(mountRootfs, snapshotName string) error
 	GetKernelPath(ostreeDeployRootfs string) (string, error)
+	GetAllKernelPaths(ostreeDeployRootfs string) ([]string, error)
 	SetupPasswords(ostreeDeployRootfs string) error
+	SetupPasswordsForUsers(ostreeDeployRootfs string, users map[string]string, cost int) error
 	SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir, efibootdir, efiUUID, bootUUID string) error
+	SetupSystemdBootEntry(ref, bootCommit, bootdir string) error
 	SetupVmtestConfig(bootdir string) error
+	SetupRecoveryBootEntry(bootdir string) error
+	SetupKernelBootEntries(ostreeDeployRootfs, bootdir string) error
 	InstallSecurebootCerts(ostreeDeployRootfs, mountEfifs, efibootdir string) error
+	StageMokEnrollment(mountEfifs string) error
 	InstallMemtest(ostreeDeployRootfs, efibootdir string) error
 	GenerateKernelBootArgs(ref, efiDevice, bootDevice, physicalRootDevice, rootDevice string, encryptionEnabled bool) ([]string, error)
 	PackageList(rootfs string) ([]string, error)
+	PackageListDiff(oldRootfs, newRootfs string) (added, removed []string, err error)
 	SetupHooks(ostreeDeployRootfs, ref string) error
 	TestImage(imagePath, ref string) error
+	TestImageParallel(imagePath, ref string) error
+	TestWorkers() (int, error)
+	UnmountAllUnder(mountDir string) ([]string, error)
 	FinalizeFilesystems(mountRootfs, mountBootfs, mountEfifs string) error
 	Qcow2ImagePath(imagePath string) (string, error)
 	CreateQcow2Image(imagePath string) error
+	ConvertImage(imagePath, format string) (string, error)
 	ShowFinalFilesystemInfo(blockDevice, mountBootfs, mountEfifs string) error
 	ShowTestInfo(artifacts []string)
+	ChecksumImage(imagePath string) (string, error)
+	NewReleaseManifest(ref, rootfs, imagePath string) (*ReleaseManifest, error)
+	WriteReleaseManifest(path string, m ReleaseManifest) error
+	GpgSignImage(imagePath string) error
 	RemoveImageFile(imagePath string) error
 	ImageLockDir() (string, error)
 	ImageLockPath(ref string) (string, error)
+	AcquireImageLock(ref string) (release func() error, err error)
 }
 
 // Image provides image creation and manipulation operations.
@@ -93,6 +154,12 @@ type Image struct {
 	cfg    config.IConfig
 	ostree cds.IOstree
 	runner runner.Func
+	stdout io.Writer
+	stderr io.Writer
+	dryRun bool
+	// dryRunner receives the commands skipped in dry-run mode, see
+	// runDestructive. It defaults to printDryRun.
+	dryRunner runner.Func
 }
 
 // NewImage creates a new Image instance.
@@ -104,12 +171,62 @@ func NewImage(cfg config.IConfig, ostree cds.IOstree) (*Image, error) {
 		return nil, errors.New("missing ostree parameter")
 	}
 	return &Image{
-		cfg:    cfg,
-		ostree: ostree,
-		runner: runner.Run,
+		cfg:       cfg,
+		ostree:    ostree,
+		runner:    runner.Run,
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
+		dryRunner: printDryRun,
 	}, nil
 }
 
+// SetDryRun enables or disables dry-run mode. In dry-run mode, the commands
+// that would modify devices or mounts (partitioning, formatting and
+// mounting) are printed instead of being executed.
+func (im *Image) SetDryRun(dryRun bool) {
+	im.dryRun = dryRun
+}
+
+// printDryRun is the default dry-run runner: it prints the command instead
+// of executing it.
+func printDryRun(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+	fmt.Fprintf(stdout, "[dry-run] %s\n", strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+// runDestructive runs a command modifying devices or mounts. In dry-run
+// mode, the command is handed to the dry-run runner instead, which just
+// prints it by default.
+func (im *Image) runDestructive(name string, args ...string) error {
+	if im.dryRun {
+		return im.dryRunner(nil, im.stdout, im.stderr, name, args...)
+	}
+	return im.runner(nil, im.stdout, im.stderr, name, args...)
+}
+
+// mkdirMountPoint creates the mount point dir if it does not exist. Nothing
+// is created in dry-run mode.
+func (im *Image) mkdirMountPoint(dir string) error {
+	if fslib.DirectoryExists(dir) {
+		return nil
+	}
+	if im.dryRun {
+		return im.dryRunner(nil, im.stdout, im.stderr, "mkdir", "-p", dir)
+	}
+	fmt.Fprintf(im.stdout, "Creating %s ...\n", dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %w", dir, err)
+	}
+	return nil
+}
+
+// SetOutput sets where the progress messages and the output of the commands
+// run by im are written. Use io.Discard to silence them.
+func (im *Image) SetOutput(stdout, stderr io.Writer) {
+	im.stdout = stdout
+	im.stderr = stderr
+}
+
 // --- Config accessors ---
 
 // ImagesOutDir returns the directory where generated images are stored.
@@ -172,6 +289,46 @@ func (im *Image) BootPartitionSize() (string, error) {
 	return v, nil
 }
 
+// SwapPartitionSize returns the configured swap partition size (e.g. "4G").
+// An empty value means that no swap partition is created.
+func (im *Image) SwapPartitionSize() (string, error) {
+	return im.cfg.GetItem("Imager.SwapPartitionSize")
+}
+
+// RootPartitionNumber returns the number of the root partition, which is
+// the last one: 4 when a swap partition is configured, 3 otherwise.
+func (im *Image) RootPartitionNumber() (int, error) {
+	swapSize, err := im.SwapPartitionSize()
+	if err != nil {
+		return 0, err
+	}
+	if swapSize != "" {
+		return 4, nil
+	}
+	return 3, nil
+}
+
+// defaultPartprobeRetries is the number of partprobe attempts used when
+// Imager.PartprobeRetries is not set.
+const defaultPartprobeRetries = 3
+
+// PartprobeRetries returns the number of times partprobe is attempted
+// before giving up (Imager.PartprobeRetries, default 3).
+func (im *Image) PartprobeRetries() (int, error) {
+	v, err := im.cfg.GetItem("Imager.PartprobeRetries")
+	if err != nil {
+		return 0, err
+	}
+	if v == "" {
+		return defaultPartprobeRetries, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid Imager.PartprobeRetries %q", v)
+	}
+	return n, nil
+}
+
 // Compressor returns the configured compressor command string (e.g. "xz -f -0 -T0").
 func (im *Image) Compressor() (string, error) {
 	v, err := im.cfg.GetItem("Imager.Compressor")
@@ -220,6 +377,24 @@ func (im *Image) RootPartitionType() (string, error) {
 	return v, nil
 }
 
+// SupportedRootFilesystems lists the filesystem types accepted by
+// Imager.RootFilesystem.
+var SupportedRootFilesystems = []string{"btrfs", "ext4", "xfs"}
+
+// RootFilesystem returns the filesystem type of the root partition
+// (one of SupportedRootFilesystems).
+func (im *Image) RootFilesystem() (string, error) {
+	v, err := im.cfg.GetItem("Imager.RootFilesystem")
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(SupportedRootFilesystems, v) {
+		return "", fmt.Errorf("invalid Imager.RootFilesystem %q, must be one of: %s",
+			v, strings.Join(SupportedRootFilesystems, ", "))
+	}
+	return v, nil
+}
+
 // OsName returns the OS name.
 func (im *Image) OsName() (string, error) {
 	v, err := im.cfg.GetItem("matrixOS.OsName")
@@ -377,6 +552,100 @@ func (im *Image) LockWaitSeconds() (string, error) {
 	return v, nil
 }
 
+// mountOptionsRe matches a comma separated mount options string free of
+// whitespace and shell metacharacters.
+var mountOptionsRe = regexp.MustCompile(`^[A-Za-z0-9,=:._/+-]*$`)
+
+// BootMountOptions returns the mount options used for the boot filesystem
+// (Imager.BootMountOptions, e.g. "noatime,umask=0077"). It is empty when the
+// default options should be used.
+func (im *Image) BootMountOptions() (string, error) {
+	v, err := im.cfg.GetItem("Imager.BootMountOptions")
+	if err != nil {
+		return "", err
+	}
+	if !mountOptionsRe.MatchString(v) {
+		return "", fmt.Errorf("invalid Imager.BootMountOptions %q: unexpected characters", v)
+	}
+	return v, nil
+}
+
+// LuksKeyfile returns the keyfile used to automatically unlock the encrypted
+// root filesystem at boot, as accepted by rd.luks.key= ("<path>" or
+// "<path>:<device>"). It is empty when no keyfile is configured.
+func (im *Image) LuksKeyfile() (string, error) {
+	return im.cfg.GetItem("Imager.LuksKeyfile")
+}
+
+// defaultMemtestPaths are the memtest86+ EFI binaries searched for when
+// Imager.MemtestPaths is not set.
+var defaultMemtestPaths = []string{
+	"/usr/share/memtest86+/memtest.efi64",
+	"/usr/share/memtest86+/memtest.efi",
+	"/boot/memtest*",
+}
+
+// MemtestPaths returns the candidate memtest86+ EFI binary paths, relative to
+// the deployed rootfs, in order of preference (Imager.MemtestPaths, a
+// whitespace separated list that may contain glob patterns).
+func (im *Image) MemtestPaths() ([]string, error) {
+	v, err := im.cfg.GetItem("Imager.MemtestPaths")
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(v) == "" {
+		return defaultMemtestPaths, nil
+	}
+	return strings.Fields(v), nil
+}
+
+// SupportedImageAllocations lists the values accepted by
+// Imager.ImageAllocation.
+var SupportedImageAllocations = []string{"sparse", "full"}
+
+// ImageAllocation returns how image files are allocated by CreateImage (one
+// of SupportedImageAllocations). It defaults to "sparse" when unset.
+func (im *Image) ImageAllocation() (string, error) {
+	v, err := im.cfg.GetItem("Imager.ImageAllocation")
+	if err != nil {
+		return "", err
+	}
+	if v == "" {
+		return "sparse", nil
+	}
+	if !slices.Contains(SupportedImageAllocations, v) {
+		return "", fmt.Errorf("invalid Imager.ImageAllocation %q, must be one of: %s",
+			v, strings.Join(SupportedImageAllocations, ", "))
+	}
+	return v, nil
+}
+
+// SupportedBootloaders lists the bootloaders accepted by Imager.Bootloader.
+var SupportedBootloaders = []string{"grub", "systemd-boot"}
+
+// Bootloader returns the bootloader the image is configured for (one of
+// SupportedBootloaders). It defaults to "grub" when unset.
+func (im *Image) Bootloader() (string, error) {
+	v, err := im.cfg.GetItem("Imager.Bootloader")
+	if err != nil {
+		return "", err
+	}
+	if v == "" {
+		return "grub", nil
+	}
+	if !slices.Contains(SupportedBootloaders, v) {
+		return "", fmt.Errorf("invalid Imager.Bootloader %q, must be one of: %s",
+			v, strings.Join(SupportedBootloaders, ", "))
+	}
+	return v, nil
+}
+
+// BootEntryPerKernel returns whether a boot entry should be generated for
+// every kernel shipped in the image, rather than only for the newest one.
+func (im *Image) BootEntryPerKernel() (bool, error) {
+	return im.cfg.GetBool("Imager.BootEntryPerKernel")
+}
+
 // BuildMetadataFile returns the build metadata file path (combining
 // ChrootMetadataDir and ChrootMetadataDirBuildFileName).
 func (im *Image) BuildMetadataFile() (string, error) {
@@ -445,12 +714,12 @@ func (im *Image) ReleaseVersion(rootfs string) (string, error) {
 	metadataFile := filepath.Join(rootfs, metadataRelPath)
 
 	if fslib.FileExists(metadataFile) {
-		fmt.Fprintf(os.Stderr, "Build metadata:\n")
+		fmt.Fprintf(im.stderr, "Build metadata:\n")
 		data, err := os.ReadFile(metadataFile)
 		if err != nil {
 			return "", fmt.Errorf("failed to read build metadata file %s: %w", metadataFile, err)
 		}
-		fmt.Fprint(os.Stderr, string(data))
+		fmt.Fprint(im.stderr, string(data))
 
 		// Extract version from SEED_NAME= line.
 		scanner := bufio.NewScanner(strings.NewReader(string(data)))
@@ -461,9 +730,9 @@ func (im *Image) ReleaseVersion(rootfs string) (string, error) {
 				// Version is the part after the last '-'.
 				if idx := strings.LastIndex(seedName, "-"); idx >= 0 {
 					releaseVersion = seedName[idx+1:]
-					fmt.Fprintf(os.Stderr, "Extracted release version: %s\n", releaseVersion)
+					fmt.Fprintf(im.stderr, "Extracted release version: %s\n", releaseVersion)
 				} else {
-					fmt.Fprintf(os.Stderr, "WARNING: SEED_NAME= value has no '-' separator\n")
+					fmt.Fprintf(im.stderr, "WARNING: SEED_NAME= value has no '-' separator\n")
 				}
 				break
 			}
@@ -472,12 +741,98 @@ func (im *Image) ReleaseVersion(rootfs string) (string, error) {
 			return "", fmt.Errorf("failed to scan build metadata file: %w", scanner.Err())
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "WARNING! Build metadata file not found: %s\n", metadataFile)
+		fmt.Fprintf(im.stderr, "WARNING! Build metadata file not found: %s\n", metadataFile)
 	}
 
 	return releaseVersion, nil
 }
 
+// osReleaseRelPath is the path of the os-release file relative to a rootfs.
+const osReleaseRelPath = "usr/lib/os-release"
+
+// OsReleaseNotFoundError is returned by OsRelease when the rootfs has no
+// os-release file.
+type OsReleaseNotFoundError struct {
+	Path string
+}
+
+func (e *OsReleaseNotFoundError) Error() string {
+	return fmt.Sprintf("os-release file %s does not exist", e.Path)
+}
+
+// OsRelease parses <rootfs>/usr/lib/os-release and returns its KEY=value
+// assignments, with the quotes around values removed. An
+// *OsReleaseNotFoundError is returned if the file does not exist.
+func (im *Image) OsRelease(rootfs string) (map[string]string, error) {
+	if rootfs == "" {
+		return nil, errors.New("missing rootfs parameter")
+	}
+
+	osReleaseFile := filepath.Join(rootfs, osReleaseRelPath)
+	data, err := os.ReadFile(osReleaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &OsReleaseNotFoundError{Path: osReleaseFile}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", osReleaseFile, err)
+	}
+
+	osRelease := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		osRelease[key] = unquoteOsReleaseValue(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", osReleaseFile, err)
+	}
+	return osRelease, nil
+}
+
+// unquoteOsReleaseValue removes the single or double quotes around an
+// os-release value, undoing the backslash escapes of double quoted ones.
+func unquoteOsReleaseValue(value string) string {
+	if len(value) < 2 {
+		return value
+	}
+	first, last := value[0], value[len(value)-1]
+	switch {
+	case first == '\'' && last == '\'':
+		return value[1 : len(value)-1]
+	case first == '"' && last == '"':
+		var b strings.Builder
+		inner := value[1 : len(value)-1]
+		for i := 0; i < len(inner); i++ {
+			if inner[i] == '\\' && i+1 < len(inner) {
+				i++
+			}
+			b.WriteByte(inner[i])
+		}
+		return b.String()
+	}
+	return value
+}
+
+// OsReleaseVersion returns the VERSION_ID of the os-release file of rootfs.
+func (im *Image) OsReleaseVersion(rootfs string) (string, error) {
+	osRelease, err := im.OsRelease(rootfs)
+	if err != nil {
+		return "", err
+	}
+	version, ok := osRelease["VERSION_ID"]
+	if !ok {
+		return "", fmt.Errorf("VERSION_ID not set in %s", filepath.Join(rootfs, osReleaseRelPath))
+	}
+	return version, nil
+}
+
 // ImagePath returns the image file path for a given ostree ref.
 func (im *Image) ImagePath(ref string) (string, error) {
 	if ref == "" {
@@ -488,6 +843,24 @@ func (im *Image) ImagePath(ref string) (string, error) {
 	return im.imagePath(suffix)
 }
 
+// ImagePathWithArch returns the image file path for a given ostree ref with
+// the architecture embedded, so that images of the same ref built for
+// different architectures do not collide.
+func (im *Image) ImagePathWithArch(ref, arch string) (string, error) {
+	if ref == "" {
+		return "", errors.New("missing ref parameter")
+	}
+	if arch == "" {
+		return "", errors.New("missing arch parameter")
+	}
+	if strings.ContainsRune(arch, '/') {
+		return "", fmt.Errorf("invalid arch %q", arch)
+	}
+	ref = cds.CleanRemoteFromRef(ref)
+	suffix := refToSuffix(ref) + "-" + arch + ".img"
+	return im.imagePath(suffix)
+}
+
 // ImagePathWithReleaseVersion returns the image file path with an embedded release version.
 func (im *Image) ImagePathWithReleaseVersion(ref, releaseVersion string) (string, error) {
 	if ref == "" {
@@ -501,6 +874,32 @@ func (im *Image) ImagePathWithReleaseVersion(ref, releaseVersion string) (string
 	return im.imagePath(suffix)
 }
 
+// UniqueImagePath returns ImagePathWithReleaseVersion(ref, releaseVersion),
+// or, if a file already exists there, the first free path obtained by adding
+// a -2, -3, ... suffix before the .img extension.
+func (im *Image) UniqueImagePath(ref, releaseVersion string) (string, error) {
+	if ref == "" {
+		return "", errors.New("missing ref parameter")
+	}
+	if releaseVersion == "" {
+		return "", errors.New("missing releaseVersion parameter")
+	}
+	imagePath, err := im.ImagePathWithReleaseVersion(ref, releaseVersion)
+	if err != nil {
+		return "", err
+	}
+	if !fslib.PathExists(imagePath) {
+		return imagePath, nil
+	}
+	base := strings.TrimSuffix(imagePath, ".img")
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s-%d.img", base, n)
+		if !fslib.PathExists(candidate) {
+			return candidate, nil
+		}
+	}
+}
+
 // CreateImage creates a sparse image file at imagePath with the given size.
 func (im *Image) CreateImage(imagePath, imageSize string) (retErr error) {
 	if imagePath == "" {
@@ -510,8 +909,13 @@ func (im *Image) CreateImage(imagePath, imageSize string) (retErr error) {
 		return errors.New("missing imageSize parameter")
 	}
 
+	allocation, err := im.ImageAllocation()
+	if err != nil {
+		return err
+	}
+
 	imagesDir := filepath.Dir(imagePath)
-	fmt.Fprintf(os.Stdout, "Creating images directory: %s (if it does not exist)\n", imagesDir)
+	fmt.Fprintf(im.stdout, "Creating images directory: %s (if it does not exist)\n", imagesDir)
 	if err := os.MkdirAll(imagesDir, 0755); err != nil {
 		return fmt.Errorf("failed to create images directory %s: %w", imagesDir, err)
 	}
@@ -521,12 +925,157 @@ func (im *Image) CreateImage(imagePath, imageSize string) (retErr error) {
 		return err
 	}
 
-	fmt.Fprintf(os.Stdout, "Creating block device image file: %s\n", imagePath)
-	return im.runner(nil, os.Stdout, os.Stderr, "truncate", "-s", imageSize, imagePath)
+	fmt.Fprintf(im.stdout, "Creating block device image file: %s (%s)\n", imagePath, allocation)
+	if allocation == "full" {
+		return im.allocateImage(imagePath, imageSize)
+	}
+	return im.runner(nil, im.stdout, im.stderr, "truncate", "-s", imageSize, imagePath)
+}
+
+// allocateImage creates a fully allocated image file of imageSize. It uses
+// fallocate and falls back to writing zeroes with dd on filesystems that do
+// not support it.
+func (im *Image) allocateImage(imagePath, imageSize string) error {
+	var stderr bytes.Buffer
+	err := im.runner(nil, im.stdout, io.MultiWriter(im.stderr, &stderr), "fallocate", "-l", imageSize, imagePath)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(stderr.String(), "not supported") {
+		return fmt.Errorf("failed to allocate image %s: %w", imagePath, err)
+	}
+
+	fmt.Fprintf(im.stdout, "fallocate not supported, writing zeroes to %s ...\n", imagePath)
+	// dd accepts the same size suffixes as truncate and fallocate.
+	if err := im.runner(nil, im.stdout, im.stderr, "dd", "if=/dev/zero", "of="+imagePath,
+		"bs=4M", "count="+imageSize, "iflag=count_bytes", "status=progress"); err != nil {
+		return fmt.Errorf("failed to allocate image %s: %w", imagePath, err)
+	}
+	return nil
+}
+
+// imageSizeRe matches an absolute size as accepted by truncate -s, e.g.
+// "32G", "512MiB" or "1000000".
+var imageSizeRe = regexp.MustCompile(`^(\d+)(?:([KMGTPE])(iB|B)?)?$`)
+
+// parseImageSize parses a size as accepted by truncate -s into a number of
+// bytes. K, M, G, ... and KiB, MiB, ... are powers of 1024, KB, MB, ... are
+// powers of 1000. Relative sizes (e.g. "+1G") are not supported.
+func parseImageSize(size string) (int64, error) {
+	m := imageSizeRe.FindStringSubmatch(size)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	if m[2] == "" {
+		return n, nil
+	}
+	base := int64(1024)
+	if m[3] == "B" {
+		base = 1000
+	}
+	for range strings.Index("KMGTPE", m[2]) + 1 {
+		if n > math.MaxInt64/base {
+			return 0, fmt.Errorf("invalid size %q: too large", size)
+		}
+		n *= base
+	}
+	return n, nil
+}
+
+// GrowImage enlarges the existing image at imagePath to newSize (as
+// accepted by truncate -s, e.g. "64G"). Shrinking an image is refused, as
+// it would cut off the end of its last partition.
+func (im *Image) GrowImage(imagePath, newSize string) error {
+	if imagePath == "" {
+		return errors.New("missing imagePath parameter")
+	}
+	if newSize == "" {
+		return errors.New("missing newSize parameter")
+	}
+	newBytes, err := parseImageSize(newSize)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat image %s: %w", imagePath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("image %s is not a regular file", imagePath)
+	}
+	curBytes := info.Size()
+	if newBytes < curBytes {
+		return fmt.Errorf("refusing to shrink image %s from %d to %d bytes (%s)", imagePath, curBytes, newBytes, newSize)
+	}
+	if newBytes == curBytes {
+		fmt.Fprintf(im.stdout, "Image %s is already %s, nothing to do.\n", imagePath, newSize)
+		return nil
+	}
+
+	fmt.Fprintf(im.stdout, "Growing image %s from %d bytes to %s ...\n", imagePath, curBytes, newSize)
+	return im.runner(nil, im.stdout, im.stderr, "truncate", "-s", newSize, imagePath)
+}
+
+// ImageExists returns whether an image file exists at imagePath.
+func (im *Image) ImageExists(imagePath string) bool {
+	return imagePath != "" && fslib.FileExists(imagePath)
+}
+
+// CreateImageIfMissing is like CreateImage, but leaves an existing image at
+// imagePath untouched. It returns whether a new image was created.
+func (im *Image) CreateImageIfMissing(imagePath, imageSize string) (created bool, err error) {
+	if imagePath == "" {
+		return false, errors.New("missing imagePath parameter")
+	}
+	if imageSize == "" {
+		return false, errors.New("missing imageSize parameter")
+	}
+
+	if im.ImageExists(imagePath) {
+		fmt.Fprintf(im.stdout, "Image file %s already exists, skipping creation.\n", imagePath)
+		return false, nil
+	}
+	if err := im.CreateImage(imagePath, imageSize); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// defaultCompressorExtensions maps compressor commands to the extension of
+// the files they produce, when it differs from the command name.
+var defaultCompressorExtensions = map[string]string{
+	"pigz":   "gz",
+	"pbzip2": "bz2",
+	"pzstd":  "zst",
+}
+
+// CompressorExtensions returns the compressor command to file extension
+// map: defaultCompressorExtensions, overridden by the space separated
+// <command>=<extension> pairs in Imager.CompressorExtensions.
+func (im *Image) CompressorExtensions() (map[string]string, error) {
+	v, err := im.cfg.GetItem("Imager.CompressorExtensions")
+	if err != nil {
+		return nil, err
+	}
+	exts := maps.Clone(defaultCompressorExtensions)
+	for _, pair := range strings.Fields(v) {
+		cmd, ext, ok := strings.Cut(pair, "=")
+		if !ok || cmd == "" || ext == "" || strings.ContainsRune(ext, '/') {
+			return nil, fmt.Errorf("invalid Imager.CompressorExtensions entry %q, want <command>=<extension>", pair)
+		}
+		exts[cmd] = strings.TrimPrefix(ext, ".")
+	}
+	return exts, nil
 }
 
 // ImagePathWithCompressorExtension appends the compressor's file extension to the image path.
-// The extension is derived from the first word of the compressor command string.
+// The extension is looked up in CompressorExtensions by the first word of the compressor
+// command string, falling back to the command name itself.
 func (im *Image) ImagePathWithCompressorExtension(imagePath, compressor string) (string, error) {
 	if imagePath == "" {
 		return "", errors.New("missing imagePath parameter")
@@ -534,12 +1083,22 @@ func (im *Image) ImagePathWithCompressorExtension(imagePath, compressor string)
 	if compressor == "" {
 		return "", errors.New("missing compressor parameter")
 	}
-	parts := strings.Fields(compressor)
-	return imagePath + "." + parts[0], nil
+	exts, err := im.CompressorExtensions()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Fields(compressor)[0]
+	ext, ok := exts[name]
+	if !ok {
+		ext = name
+	}
+	return imagePath + "." + ext, nil
 }
 
 // CompressImage compresses an image file using the configured compressor.
-func (im *Image) CompressImage(imagePath, compressor string) error {
+// If withChecksum is true, the sha256 of the compressed image is written to
+// <compressed image>.sha256 via ChecksumImage.
+func (im *Image) CompressImage(imagePath, compressor string, withChecksum bool) error {
 	if imagePath == "" {
 		return errors.New("missing imagePath parameter")
 	}
@@ -554,7 +1113,21 @@ func (im *Image) CompressImage(imagePath, compressor string) error {
 
 	parts := strings.Fields(compressor)
 	args := append(parts[1:], imagePath)
-	if err := im.runner(nil, os.Stdout, os.Stderr, parts[0], args...); err != nil {
+	if err := im.runCompressor(parts[0], args, im.stderr, imagePathWithExt); err != nil {
+		return err
+	}
+	if withChecksum {
+		if _, err := im.ChecksumImage(imagePathWithExt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCompressor runs the compressor command and checks that it produced
+// the compressed image at imagePathWithExt.
+func (im *Image) runCompressor(name string, args []string, stderr io.Writer, imagePathWithExt string) error {
+	if err := im.runner(nil, im.stdout, stderr, name, args...); err != nil {
 		return fmt.Errorf("compression failed: %w", err)
 	}
 
@@ -564,60 +1137,252 @@ func (im *Image) CompressImage(imagePath, compressor string) error {
 	return nil
 }
 
-// BlockDeviceNthPartitionPath returns the path of the nth partition of a block device.
-func (im *Image) BlockDeviceNthPartitionPath(blockDevice string, nth int) (string, error) {
-	if blockDevice == "" {
-		return "", errors.New("missing blockDevice parameter")
+// xzProgressRe matches the percentage at the start of an xz -v progress
+// line, e.g. "  42.3 %     1,024.0 KiB / 2,048.0 KiB = 0.500 ...".
+var xzProgressRe = regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*%`)
+
+// zstdProgressRe matches the amount of input read out of the total in a
+// zstd --progress line, e.g. "Read : 12 / 100 MB ==> 34%".
+var zstdProgressRe = regexp.MustCompile(`Read\s*:\s*(\d+(?:\.\d+)?)\s*/\s*(\d+(?:\.\d+)?)\s*\w+`)
+
+// compressorProgress describes how to get progress reports out of a
+// compressor: the flag enabling them and the parser of its stderr lines.
+type compressorProgress struct {
+	flag  string
+	parse func(line string) (float64, bool)
+}
+
+// compressorsWithProgress maps the compressors that can report progress,
+// by executable name, to their progress settings.
+var compressorsWithProgress = map[string]compressorProgress{
+	"xz": {
+		flag: "-v",
+		parse: func(line string) (float64, bool) {
+			m := xzProgressRe.FindStringSubmatch(line)
+			if m == nil {
+				return 0, false
+			}
+			percent, err := strconv.ParseFloat(m[1], 64)
+			return percent, err == nil
+		},
+	},
+	"zstd": {
+		flag: "--progress",
+		parse: func(line string) (float64, bool) {
+			m := zstdProgressRe.FindStringSubmatch(line)
+			if m == nil {
+				return 0, false
+			}
+			read, err1 := strconv.ParseFloat(m[1], 64)
+			total, err2 := strconv.ParseFloat(m[2], 64)
+			if err1 != nil || err2 != nil || total <= 0 {
+				return 0, false
+			}
+			return min(read/total*100, 100), true
+		},
+	},
+}
+
+// CompressImageWithProgress is like CompressImage, but calls onProgress with
+// the completion percentage every time the compressor reports progress.
+// Progress is only available for xz and zstd; other compressors run as in
+// CompressImage and onProgress is never called.
+func (im *Image) CompressImageWithProgress(imagePath, compressor string, onProgress func(percent float64)) error {
+	if imagePath == "" {
+		return errors.New("missing imagePath parameter")
 	}
-	if nth <= 0 {
-		return "", errors.New("invalid nth parameter")
+	if compressor == "" {
+		return errors.New("missing compressor parameter")
+	}
+	if onProgress == nil {
+		return errors.New("missing onProgress parameter")
 	}
 
-	cmd := exec.Command("lsblk", "-nr", "-o", "PATH,PARTN", blockDevice)
-	out, err := cmd.Output()
+	imagePathWithExt, err := im.ImagePathWithCompressorExtension(imagePath, compressor)
 	if err != nil {
-		return "", fmt.Errorf("lsblk failed for %s: %w", blockDevice, err)
+		return err
 	}
 
-	nthStr := fmt.Sprintf("%d", nth)
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) >= 2 && fields[1] == nthStr {
-			return fields[0], nil
-		}
+	parts := strings.Fields(compressor)
+	progress, ok := compressorsWithProgress[filepath.Base(parts[0])]
+	if !ok {
+		args := append(parts[1:], imagePath)
+		return im.runCompressor(parts[0], args, im.stderr, imagePathWithExt)
 	}
-	return "", fmt.Errorf("partition %d not found on %s", nth, blockDevice)
-}
 
-// BlockDeviceForPartitionPath returns the parent block device for a partition path.
-func (im *Image) BlockDeviceForPartitionPath(partitionPath string) (string, error) {
-	if partitionPath == "" {
-		return "", errors.New("missing partitionPath parameter")
+	var args []string
+	if !slices.Contains(parts[1:], progress.flag) {
+		args = append(args, progress.flag)
 	}
-	cmd := exec.Command("lsblk", "-no", "PKNAME", "-p", partitionPath)
-	out, err := cmd.Output()
+	args = append(args, parts[1:]...)
+	args = append(args, imagePath)
+
+	pw := &runner.LineWriter{Out: im.stderr, OnLine: func(line string) {
+		if percent, ok := progress.parse(line); ok {
+			onProgress(percent)
+		}
+	}}
+	err = im.runCompressor(parts[0], args, pw, imagePathWithExt)
+	pw.Flush()
+	return err
+}
+
+// Partition describes a block device partition as reported by lsblk.
+type Partition struct {
+	Path     string
+	Number   int
+	Label    string
+	PartType string
+	Size     string
+}
+
+// lsblkRawEscapeRe matches the \xHH escapes lsblk -r uses for unsafe
+// characters (including spaces) in values.
+var lsblkRawEscapeRe = regexp.MustCompile(`\\x[0-9A-Fa-f]{2}`)
+
+// unescapeLsblkRaw decodes the \xHH escapes of an lsblk -r value.
+func unescapeLsblkRaw(v string) string {
+	return lsblkRawEscapeRe.ReplaceAllStringFunc(v, func(esc string) string {
+		b, _ := strconv.ParseUint(esc[2:], 16, 8)
+		return string([]byte{byte(b)})
+	})
+}
+
+// lsblkLayout returns one entry per device listed by lsblk for device,
+// including device itself. Entries that are not partitions have Number 0.
+func (im *Image) lsblkLayout(device string) ([]Partition, error) {
+	var out bytes.Buffer
+	err := im.runner(nil, &out, im.stderr, "lsblk", "-nr", "-o", "PATH,PARTN,LABEL,PARTTYPE,SIZE", device)
 	if err != nil {
-		return "", fmt.Errorf("lsblk failed for %s: %w", partitionPath, err)
-	}
-	result := strings.TrimSpace(string(out))
-	if result == "" {
-		return "", fmt.Errorf("no parent block device found for %s", partitionPath)
+		return nil, fmt.Errorf("lsblk failed for %s: %w", device, err)
 	}
-	return result, nil
+	return parseLsblkLayout(out.String())
 }
 
-// PartitionNumber returns the partition number of a partition path.
-func (im *Image) PartitionNumber(partitionPath string) (string, error) {
+// parseLsblkLayout parses the output of lsblk -nr -o PATH,PARTN,LABEL,PARTTYPE,SIZE.
+func parseLsblkLayout(out string) ([]Partition, error) {
+	var parts []Partition
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Empty values show up as consecutive separators in raw mode.
+		fields := strings.Split(line, " ")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected lsblk output line %q", line)
+		}
+		p := Partition{
+			Path:     unescapeLsblkRaw(fields[0]),
+			Label:    unescapeLsblkRaw(fields[2]),
+			PartType: strings.ToUpper(fields[3]),
+			Size:     fields[4],
+		}
+		if fields[1] != "" {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid partition number in lsblk output line %q", line)
+			}
+			p.Number = n
+		}
+		parts = append(parts, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// PartitionLayout returns all the partitions of blockDevice, as reported by
+// a single lsblk invocation.
+func (im *Image) PartitionLayout(blockDevice string) ([]Partition, error) {
+	if blockDevice == "" {
+		return nil, errors.New("missing blockDevice parameter")
+	}
+	entries, err := im.lsblkLayout(blockDevice)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Partition
+	for _, e := range entries {
+		if e.Number > 0 {
+			parts = append(parts, e)
+		}
+	}
+	return parts, nil
+}
+
+// BlockDeviceNthPartitionPath returns the path of the nth partition of a block device.
+func (im *Image) BlockDeviceNthPartitionPath(blockDevice string, nth int) (string, error) {
+	if blockDevice == "" {
+		return "", errors.New("missing blockDevice parameter")
+	}
+	if nth <= 0 {
+		return "", errors.New("invalid nth parameter")
+	}
+
+	parts, err := im.PartitionLayout(blockDevice)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range parts {
+		if p.Number == nth {
+			return p.Path, nil
+		}
+	}
+	return "", fmt.Errorf("partition %d not found on %s", nth, blockDevice)
+}
+
+// partitionEntry returns the lsblk entry of partitionPath itself.
+func (im *Image) partitionEntry(partitionPath string) (*Partition, error) {
+	entries, err := im.lsblkLayout(partitionPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i].Path == partitionPath {
+			return &entries[i], nil
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("lsblk returned nothing for %s", partitionPath)
+	}
+	// partitionPath may be a symlink (e.g. /dev/disk/by-uuid/...), in which
+	// case lsblk lists the resolved device first.
+	return &entries[0], nil
+}
+
+// BlockDeviceForPartitionPath returns the parent block device for a partition path.
+func (im *Image) BlockDeviceForPartitionPath(partitionPath string) (string, error) {
 	if partitionPath == "" {
 		return "", errors.New("missing partitionPath parameter")
 	}
-	cmd := exec.Command("lsblk", "-no", "PARTN", "-p", partitionPath)
+	cmd := exec.Command("lsblk", "-no", "PKNAME", "-p", partitionPath)
 	out, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("lsblk failed for %s: %w", partitionPath, err)
 	}
-	return strings.TrimSpace(string(out)), nil
+	result := strings.TrimSpace(string(out))
+	if result == "" {
+		return "", fmt.Errorf("no parent block device found for %s", partitionPath)
+	}
+	return result, nil
+}
+
+// PartitionNumber returns the partition number of a partition path.
+func (im *Image) PartitionNumber(partitionPath string) (string, error) {
+	if partitionPath == "" {
+		return "", errors.New("missing partitionPath parameter")
+	}
+	p, err := im.partitionEntry(partitionPath)
+	if err != nil {
+		return "", err
+	}
+	if p.Number == 0 {
+		return "", nil
+	}
+	return strconv.Itoa(p.Number), nil
 }
 
 // PartitionLabel returns the label of a partition.
@@ -625,12 +1390,11 @@ func (im *Image) PartitionLabel(partitionPath string) (string, error) {
 	if partitionPath == "" {
 		return "", errors.New("missing partitionPath parameter")
 	}
-	cmd := exec.Command("lsblk", "-no", "LABEL", "-p", partitionPath)
-	out, err := cmd.Output()
+	p, err := im.partitionEntry(partitionPath)
 	if err != nil {
-		return "", fmt.Errorf("lsblk failed for %s: %w", partitionPath, err)
+		return "", err
 	}
-	return strings.TrimSpace(string(out)), nil
+	return p.Label, nil
 }
 
 // ClearPartitionTable clears the partition table on a device using sgdisk.
@@ -639,11 +1403,11 @@ func (im *Image) ClearPartitionTable(devicePath string) error {
 		return errors.New("missing devicePath parameter")
 	}
 
-	fmt.Fprintf(os.Stdout, "Clearing partition table on %s ...\n", devicePath)
-	if err := im.runner(nil, os.Stdout, os.Stderr, "sgdisk", "-g", "-o", devicePath); err != nil {
+	fmt.Fprintf(im.stdout, "Clearing partition table on %s ...\n", devicePath)
+	if err := im.runDestructive("sgdisk", "-g", "-o", devicePath); err != nil {
 		return fmt.Errorf("sgdisk -g -o failed on %s: %w", devicePath, err)
 	}
-	return im.runner(nil, os.Stdout, os.Stderr, "sgdisk", "-Z", devicePath)
+	return im.runDestructive("sgdisk", "-Z", devicePath)
 }
 
 // GetPartitionType returns the partition type GUID (uppercased) for a device.
@@ -659,12 +1423,126 @@ func (im *Image) GetPartitionType(devicePath string) (string, error) {
 	return strings.ToUpper(strings.TrimSpace(string(out))), nil
 }
 
+// partitionTypeGUIDRe matches a GPT partition type GUID in its canonical
+// 8-4-4-4-12 hexadecimal form.
+var partitionTypeGUIDRe = regexp.MustCompile(
+	`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+// ValidatePartitionTypeGUIDs checks that all the configured partition type
+// GUIDs are well-formed, so that typos are caught before sgdisk runs.
+func (im *Image) ValidatePartitionTypeGUIDs() error {
+	checks := []struct {
+		key string
+		fn  func() (string, error)
+	}{
+		{"Imager.EspPartitionType", im.EspPartitionType},
+		{"Imager.BootPartitionType", im.BootPartitionType},
+		{"Imager.RootPartitionType", im.RootPartitionType},
+	}
+
+	var errs []error
+	for _, c := range checks {
+		guid, err := c.fn()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !partitionTypeGUIDRe.MatchString(guid) {
+			errs = append(errs, fmt.Errorf("malformed %s: %q", c.key, guid))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyPartitionTypes checks that the partitions of blockDevice have the
+// configured ESP, boot and root partition type GUIDs, and that the swap
+// partition, when configured, has the Linux swap type. GUIDs are compared
+// case-insensitively. All mismatches are reported.
+func (im *Image) VerifyPartitionTypes(blockDevice string) error {
+	if blockDevice == "" {
+		return errors.New("missing blockDevice parameter")
+	}
+	swapSize, err := im.SwapPartitionSize()
+	if err != nil {
+		return err
+	}
+	rootNum, err := im.RootPartitionNumber()
+	if err != nil {
+		return err
+	}
+	type check struct {
+		num int
+		key string
+		fn  func() (string, error)
+	}
+	checks := []check{
+		{1, "Imager.EspPartitionType", im.EspPartitionType},
+		{2, "Imager.BootPartitionType", im.BootPartitionType},
+	}
+	if swapSize != "" {
+		checks = append(checks, check{3, "swap partition type", func() (string, error) {
+			return swapPartitionType, nil
+		}})
+	}
+	checks = append(checks, check{rootNum, "Imager.RootPartitionType", im.RootPartitionType})
+
+	layout, err := im.PartitionLayout(blockDevice)
+	if err != nil {
+		return err
+	}
+	types := make(map[int]string)
+	for _, p := range layout {
+		types[p.Number] = p.PartType
+	}
+
+	var errs []error
+	for _, c := range checks {
+		want, err := c.fn()
+		if err != nil {
+			return err
+		}
+		got, ok := types[c.num]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("partition %d is missing, expected %s %s", c.num, c.key, want))
+		case !strings.EqualFold(got, want):
+			errs = append(errs, fmt.Errorf("partition %d has type %s, expected %s %s", c.num, got, c.key, want))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("partition type mismatch on %s:\n%w", blockDevice, err)
+	}
+	return nil
+}
+
 // DatedFsLabel returns a filesystem label based on the current date (YYYYMMDD).
 func (im *Image) DatedFsLabel() string {
 	return time.Now().Format("20060102")
 }
 
-// PartitionDevices creates the EFI, boot, and root partitions on a device.
+// CurrentFsLabels returns a map of partition number to filesystem label for
+// all the partitions of a device. Partitions without a label map to "".
+// This is useful to detect stale dated labels (see DatedFsLabel).
+func (im *Image) CurrentFsLabels(devicePath string) (map[int]string, error) {
+	if devicePath == "" {
+		return nil, errors.New("missing devicePath parameter")
+	}
+	parts, err := im.PartitionLayout(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[int]string, len(parts))
+	for _, p := range parts {
+		labels[p.Number] = p.Label
+	}
+	return labels, nil
+}
+
+// swapPartitionType is the GPT partition type GUID of Linux swap partitions.
+const swapPartitionType = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+
+// PartitionDevices creates the EFI, boot, optional swap (see
+// SwapPartitionSize) and root partitions on a device.
 func (im *Image) PartitionDevices(efiSize, bootSize, imageSize, devicePath string) error {
 	if efiSize == "" {
 		return errors.New("missing efiSize parameter")
@@ -691,14 +1569,25 @@ func (im *Image) PartitionDevices(efiSize, bootSize, imageSize, devicePath strin
 	if err != nil {
 		return err
 	}
+	swapSize, err := im.SwapPartitionSize()
+	if err != nil {
+		return err
+	}
+	rootPartNum, err := im.RootPartitionNumber()
+	if err != nil {
+		return err
+	}
 
-	fmt.Fprintf(os.Stdout, "Partitioning %s:\n", devicePath)
-	fmt.Fprintf(os.Stdout, " --> p1 (EFI: %s)\n", efiSize)
-	fmt.Fprintf(os.Stdout, " --> p2 (BOOT: %s)\n", bootSize)
-	fmt.Fprintf(os.Stdout, " --> p3 (ROOT: Remainder of %s, plus autogrow)\n\n", imageSize)
+	fmt.Fprintf(im.stdout, "Partitioning %s:\n", devicePath)
+	fmt.Fprintf(im.stdout, " --> p1 (EFI: %s)\n", efiSize)
+	fmt.Fprintf(im.stdout, " --> p2 (BOOT: %s)\n", bootSize)
+	if swapSize != "" {
+		fmt.Fprintf(im.stdout, " --> p3 (SWAP: %s)\n", swapSize)
+	}
+	fmt.Fprintf(im.stdout, " --> p%d (ROOT: Remainder of %s, plus autogrow)\n\n", rootPartNum, imageSize)
 
 	// Create EFI partition.
-	if err := im.runner(nil, os.Stdout, os.Stderr, "sgdisk",
+	if err := im.runDestructive("sgdisk",
 		"-n", fmt.Sprintf("1:0:+%s", efiSize),
 		"-t", fmt.Sprintf("1:%s", espPartType),
 		devicePath); err != nil {
@@ -706,46 +1595,111 @@ func (im *Image) PartitionDevices(efiSize, bootSize, imageSize, devicePath strin
 	}
 
 	// Create boot partition.
-	if err := im.runner(nil, os.Stdout, os.Stderr, "sgdisk",
+	if err := im.runDestructive("sgdisk",
 		"-n", fmt.Sprintf("2:0:+%s", bootSize),
 		"-t", fmt.Sprintf("2:%s", bootPartType),
 		devicePath); err != nil {
 		return fmt.Errorf("sgdisk boot partition failed: %w", err)
 	}
 
+	// Create the optional swap partition.
+	if swapSize != "" {
+		if err := im.runDestructive("sgdisk",
+			"-n", fmt.Sprintf("3:0:+%s", swapSize),
+			"-t", fmt.Sprintf("3:%s", swapPartitionType),
+			devicePath); err != nil {
+			return fmt.Errorf("sgdisk swap partition failed: %w", err)
+		}
+	}
+
 	// Create root partition with -10M padding for systemd-repart.
-	if err := im.runner(nil, os.Stdout, os.Stderr, "sgdisk",
-		"-n", "3:0:-10M",
-		"-t", fmt.Sprintf("3:%s", rootPartType),
+	if err := im.runDestructive("sgdisk",
+		"-n", fmt.Sprintf("%d:0:-10M", rootPartNum),
+		"-t", fmt.Sprintf("%d:%s", rootPartNum, rootPartType),
 		devicePath); err != nil {
 		return fmt.Errorf("sgdisk root partition failed: %w", err)
 	}
 
-	// Set the auto-grow flag (bit 59) on partition 3.
-	if err := im.runner(nil, os.Stdout, os.Stderr, "sgdisk",
-		"-A", "3:set:59",
+	// Set the auto-grow flag (bit 59) on the root partition, which must
+	// be the last one.
+	if err := im.runDestructive("sgdisk",
+		"-A", fmt.Sprintf("%d:set:59", rootPartNum),
 		devicePath); err != nil {
 		return fmt.Errorf("sgdisk set auto-grow flag failed: %w", err)
 	}
 
-	fmt.Fprintln(os.Stdout, "Refreshing partition table ...")
-	if err := im.runner(nil, os.Stdout, os.Stderr, "partprobe", "-s", devicePath); err != nil {
-		return fmt.Errorf("partprobe failed: %w", err)
+	fmt.Fprintln(im.stdout, "Refreshing partition table ...")
+	if err := im.partprobe(devicePath); err != nil {
+		return err
 	}
 
 	fslib.DevicesSettle()
 	return nil
 }
 
+// partprobeRetryDelay is the time to wait between partprobe attempts.
+var partprobeRetryDelay = 2 * time.Second
+
+// partprobe runs partprobe on devicePath, retrying up to PartprobeRetries
+// times since it intermittently fails on busy loop devices.
+func (im *Image) partprobe(devicePath string) error {
+	retries, err := im.PartprobeRetries()
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= retries; attempt++ {
+		lastErr = im.runDestructive("partprobe", "-s", devicePath)
+		if lastErr == nil {
+			return nil
+		}
+		if attempt < retries {
+			fmt.Fprintf(im.stderr, "partprobe attempt %d/%d failed: %v, retrying ...\n", attempt, retries, lastErr)
+			time.Sleep(partprobeRetryDelay)
+		}
+	}
+	return fmt.Errorf("partprobe failed after %d attempts: %w", retries, lastErr)
+}
+
+// DeviceIsMounted reports whether device, or any device stacked on top of
+// it (e.g. a partition or an opened LUKS container), is mounted.
+func (im *Image) DeviceIsMounted(device string) (bool, error) {
+	if device == "" {
+		return false, errors.New("missing device parameter")
+	}
+	var out bytes.Buffer
+	if err := im.runner(nil, &out, im.stderr, "lsblk", "-no", "MOUNTPOINT", device); err != nil {
+		return false, fmt.Errorf("lsblk failed for %s: %w", device, err)
+	}
+	return strings.TrimSpace(out.String()) != "", nil
+}
+
+// ensureNotMounted returns an error if device is mounted, so that it is
+// never reformatted while in use.
+func (im *Image) ensureNotMounted(device string) error {
+	mounted, err := im.DeviceIsMounted(device)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("refusing to format %s: device is mounted", device)
+	}
+	return nil
+}
+
 // FormatEfifs creates a FAT32 filesystem on the EFI partition.
 func (im *Image) FormatEfifs(efiDevice string) error {
 	if efiDevice == "" {
 		return errors.New("missing efiDevice parameter")
 	}
+	if err := im.ensureNotMounted(efiDevice); err != nil {
+		return err
+	}
 
-	fmt.Fprintf(os.Stdout, "Creating EFI partition on %s\n", efiDevice)
+	fmt.Fprintf(im.stdout, "Creating EFI partition on %s\n", efiDevice)
 	label := "ME" + im.DatedFsLabel()
-	return im.runner(nil, os.Stdout, os.Stderr, "mkfs.vfat", "-F", "32", "-n", label, efiDevice)
+	return im.runDestructive("mkfs.vfat", "-F", "32", "-n", label, efiDevice)
 }
 
 // MountEfifs mounts the EFI partition.
@@ -757,15 +1711,12 @@ func (im *Image) MountEfifs(efiDevice, mountEfifs string) error {
 		return errors.New("missing mountEfifs parameter")
 	}
 
-	if !fslib.DirectoryExists(mountEfifs) {
-		fmt.Fprintf(os.Stdout, "Creating %s ...\n", mountEfifs)
-		if err := os.MkdirAll(mountEfifs, 0755); err != nil {
-			return fmt.Errorf("failed to create mount point %s: %w", mountEfifs, err)
-		}
+	if err := im.mkdirMountPoint(mountEfifs); err != nil {
+		return err
 	}
 
-	fmt.Fprintf(os.Stdout, "Mounting %s to %s\n", efiDevice, mountEfifs)
-	return im.runner(nil, os.Stdout, os.Stderr, "mount", "-t", "vfat", efiDevice, mountEfifs)
+	fmt.Fprintf(im.stdout, "Mounting %s to %s\n", efiDevice, mountEfifs)
+	return im.runDestructive("mount", "-t", "vfat", efiDevice, mountEfifs)
 }
 
 // FormatBootfs creates a btrfs filesystem on the boot partition.
@@ -773,10 +1724,24 @@ func (im *Image) FormatBootfs(bootDevice string) error {
 	if bootDevice == "" {
 		return errors.New("missing bootDevice parameter")
 	}
+	if err := im.ensureNotMounted(bootDevice); err != nil {
+		return err
+	}
 
 	label := "MB" + im.DatedFsLabel()
-	fmt.Fprintf(os.Stdout, "Creating btrfs on %s (boot)\n", bootDevice)
-	return im.runner(nil, os.Stdout, os.Stderr, "mkfs.btrfs", "-f", "-L", label, bootDevice)
+	fmt.Fprintf(im.stdout, "Creating btrfs on %s (boot)\n", bootDevice)
+	return im.runDestructive("mkfs.btrfs", "-f", "-L", label, bootDevice)
+}
+
+// FormatSwap creates a swap area on the swap partition.
+func (im *Image) FormatSwap(swapDevice string) error {
+	if swapDevice == "" {
+		return errors.New("missing swapDevice parameter")
+	}
+
+	label := "MS" + im.DatedFsLabel()
+	fmt.Fprintf(im.stdout, "Creating swap on %s\n", swapDevice)
+	return im.runDestructive("mkswap", "-L", label, swapDevice)
 }
 
 // MountBootfs mounts the boot partition.
@@ -788,34 +1753,59 @@ func (im *Image) MountBootfs(bootDevice, mountBootfs string) error {
 		return errors.New("missing mountBootfs parameter")
 	}
 
-	if !fslib.DirectoryExists(mountBootfs) {
-		fmt.Fprintf(os.Stdout, "Creating %s ...\n", mountBootfs)
-		if err := os.MkdirAll(mountBootfs, 0755); err != nil {
-			return fmt.Errorf("failed to create mount point %s: %w", mountBootfs, err)
-		}
+	if err := im.mkdirMountPoint(mountBootfs); err != nil {
+		return err
+	}
+
+	opts, err := im.BootMountOptions()
+	if err != nil {
+		return err
+	}
+	args := []string{bootDevice, mountBootfs}
+	if opts != "" {
+		args = append([]string{"-o", opts}, args...)
 	}
 
-	fmt.Fprintf(os.Stdout, "Mounting %s to %s\n", bootDevice, mountBootfs)
-	return im.runner(nil, os.Stdout, os.Stderr, "mount", bootDevice, mountBootfs)
+	fmt.Fprintf(im.stdout, "Mounting %s to %s\n", bootDevice, mountBootfs)
+	return im.runDestructive("mount", args...)
 }
 
-// FormatRootfs creates a btrfs filesystem on the root partition.
+// FormatRootfs creates the configured root filesystem (see RootFilesystem)
+// on the root partition.
 func (im *Image) FormatRootfs(rootDevice string) error {
 	if rootDevice == "" {
 		return errors.New("missing rootDevice parameter")
 	}
+	fsType, err := im.RootFilesystem()
+	if err != nil {
+		return err
+	}
+	if err := im.ensureNotMounted(rootDevice); err != nil {
+		return err
+	}
 
+	// All the supported mkfs tools take -L for the label, while the flag
+	// to overwrite an existing filesystem is -F for ext4 and -f otherwise.
+	force := "-f"
+	if fsType == "ext4" {
+		force = "-F"
+	}
 	label := "MR" + im.DatedFsLabel()
-	fmt.Fprintf(os.Stdout, "Creating btrfs on %s (root)\n", rootDevice)
-	return im.runner(nil, os.Stdout, os.Stderr, "mkfs.btrfs", "-f", "-L", label, rootDevice)
+	fmt.Fprintf(im.stdout, "Creating %s on %s (root)\n", fsType, rootDevice)
+	return im.runDestructive("mkfs."+fsType, force, "-L", label, rootDevice)
 }
 
 // RootfsKernelArgs returns the default kernel arguments for the root filesystem.
+// If the root filesystem type cannot be determined, the btrfs defaults are used.
 func (im *Image) RootfsKernelArgs() []string {
+	if fsType, err := im.RootFilesystem(); err == nil && fsType != "btrfs" {
+		return []string{"rootflags=discard"}
+	}
 	return []string{"rootflags=discard=async"}
 }
 
-// MountRootfs mounts the root partition with btrfs compression options.
+// MountRootfs mounts the root partition. btrfs filesystems are mounted with
+// compression options, the other filesystem types with default options.
 func (im *Image) MountRootfs(rootDevice, mountRootfs string) error {
 	if rootDevice == "" {
 		return errors.New("missing rootDevice parameter")
@@ -823,23 +1813,89 @@ func (im *Image) MountRootfs(rootDevice, mountRootfs string) error {
 	if mountRootfs == "" {
 		return errors.New("missing mountRootfs parameter")
 	}
+	fsType, err := im.RootFilesystem()
+	if err != nil {
+		return err
+	}
 
+	fmt.Fprintf(im.stdout, "Mounting %s to %s\n", rootDevice, mountRootfs)
+	if fsType != "btrfs" {
+		return im.runDestructive("mount", "-t", fsType, rootDevice, mountRootfs)
+	}
 	compression := "zstd:6"
 	btrfsOpts := fmt.Sprintf("compress-force=%s,space_cache=v2,commit=120", compression)
-	fmt.Fprintf(os.Stdout, "Mounting %s to %s\n", rootDevice, mountRootfs)
-	return im.runner(nil, os.Stdout, os.Stderr, "mount", "-o", btrfsOpts, rootDevice, mountRootfs)
+	return im.runDestructive("mount", "-o", btrfsOpts, rootDevice, mountRootfs)
 }
 
-// GetKernelPath returns the kernel version directory name from the deployed rootfs.
+// RootFsType returns the filesystem type (e.g. "btrfs") of the filesystem
+// mounted at mountRootfs.
+func (im *Image) RootFsType(mountRootfs string) (string, error) {
+	if mountRootfs == "" {
+		return "", errors.New("missing mountRootfs parameter")
+	}
+	var out bytes.Buffer
+	err := im.runner(nil, &out, im.stderr, "findmnt", "-n", "-o", "FSTYPE", "--target", mountRootfs)
+	if err != nil {
+		return "", fmt.Errorf("findmnt failed for %s: %w", mountRootfs, err)
+	}
+	fsType := strings.TrimSpace(out.String())
+	if fsType == "" {
+		return "", fmt.Errorf("unable to determine filesystem type of %s", mountRootfs)
+	}
+	return fsType, nil
+}
+
+// SnapshotRoot takes a read-only btrfs snapshot of mountRootfs into
+// <mountRootfs>/.snapshots/<snapshotName>, to be used for recovery.
+func (im *Image) SnapshotRoot(mountRootfs, snapshotName string) error {
+	if mountRootfs == "" {
+		return errors.New("missing mountRootfs parameter")
+	}
+	if snapshotName == "" {
+		return errors.New("missing snapshotName parameter")
+	}
+	if strings.Contains(snapshotName, "/") || snapshotName == "." || snapshotName == ".." {
+		return fmt.Errorf("invalid snapshotName parameter: %s", snapshotName)
+	}
+
+	fsType, err := im.RootFsType(mountRootfs)
+	if err != nil {
+		return err
+	}
+	if fsType != "btrfs" {
+		return fmt.Errorf("cannot snapshot %s: filesystem is %s, not btrfs", mountRootfs, fsType)
+	}
+
+	snapshotsDir := filepath.Join(mountRootfs, ".snapshots")
+	if err := os.MkdirAll(snapshotsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", snapshotsDir, err)
+	}
+	snapshotPath := filepath.Join(snapshotsDir, snapshotName)
+	fmt.Fprintf(im.stdout, "Snapshotting %s to %s ...\n", mountRootfs, snapshotPath)
+	return im.runner(nil, im.stdout, im.stderr, "btrfs", "subvolume", "snapshot", "-r", mountRootfs, snapshotPath)
+}
+
+// GetKernelPath returns the newest kernel version directory name from the
+// deployed rootfs.
 func (im *Image) GetKernelPath(ostreeDeployRootfs string) (string, error) {
+	kernels, err := im.GetAllKernelPaths(ostreeDeployRootfs)
+	if err != nil {
+		return "", err
+	}
+	return kernels[0], nil
+}
+
+// GetAllKernelPaths returns every kernel version directory name from the
+// deployed rootfs, sorted newest first.
+func (im *Image) GetAllKernelPaths(ostreeDeployRootfs string) ([]string, error) {
 	if ostreeDeployRootfs == "" {
-		return "", errors.New("missing ostreeDeployRootfs parameter")
+		return nil, errors.New("missing ostreeDeployRootfs parameter")
 	}
 
 	modulesDir := filepath.Join(ostreeDeployRootfs, "usr", "lib", "modules")
 	entries, err := os.ReadDir(modulesDir)
 	if err != nil {
-		return "", fmt.Errorf("failed to read modules directory %s: %w", modulesDir, err)
+		return nil, fmt.Errorf("failed to read modules directory %s: %w", modulesDir, err)
 	}
 
 	var dirs []string
@@ -849,28 +1905,158 @@ func (im *Image) GetKernelPath(ostreeDeployRootfs string) (string, error) {
 		}
 	}
 	if len(dirs) == 0 {
-		return "", fmt.Errorf("no kernel directory found in %s", modulesDir)
+		return nil, fmt.Errorf("no kernel directory found in %s", modulesDir)
+	}
+	sortKernelVersionsDesc(dirs)
+	return dirs, nil
+}
+
+// kernelPreReleaseRe matches the pre-release tag that may follow the numeric
+// part of a kernel version, e.g. the "rc3" in "6.10.0-rc3-matrixos".
+var kernelPreReleaseRe = regexp.MustCompile(`^(rc|alpha|beta|pre)\.?(\d*)$`)
+
+// kernelVersion is the parsed form of a kernel version directory name.
+type kernelVersion struct {
+	nums       []int // numeric components, e.g. [6 10 0]
+	preRelease bool  // whether a pre-release tag follows the numbers
+	preNum     int   // number of the pre-release tag, e.g. 3 for "rc3"
+}
+
+// parseKernelVersion parses a kernel version directory name such as
+// "6.10.0-matrixos" or "6.10.0-rc3-matrixos". Numeric components stop at
+// the first non-digit, so "6.10.0" and "6.10.0+" parse the same way.
+func parseKernelVersion(name string) kernelVersion {
+	var kv kernelVersion
+	base, rest, _ := strings.Cut(name, "-")
+	for _, part := range strings.Split(base, ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, _ := strconv.Atoi(part[:end])
+		kv.nums = append(kv.nums, n)
+		if end != len(part) {
+			break
+		}
+	}
+	tag, _, _ := strings.Cut(rest, "-")
+	if m := kernelPreReleaseRe.FindStringSubmatch(tag); m != nil {
+		kv.preRelease = true
+		kv.preNum, _ = strconv.Atoi(m[2])
+	}
+	return kv
+}
+
+// compareKernelVersions compares two kernel version directory names and
+// returns a negative number if a is older than b, a positive number if it
+// is newer and zero if they are the same. Numeric components are compared
+// as numbers, so 6.10.0 is newer than 6.9.0, and a pre-release is older
+// than the final release of the same version. Names that compare equal as
+// versions are ordered by plain string comparison.
+func compareKernelVersions(a, b string) int {
+	va, vb := parseKernelVersion(a), parseKernelVersion(b)
+	for i := 0; i < max(len(va.nums), len(vb.nums)); i++ {
+		var na, nb int
+		if i < len(va.nums) {
+			na = va.nums[i]
+		}
+		if i < len(vb.nums) {
+			nb = vb.nums[i]
+		}
+		if na != nb {
+			return na - nb
+		}
 	}
-	sort.Strings(dirs)
-	return dirs[0], nil
+	if va.preRelease != vb.preRelease {
+		if va.preRelease {
+			return -1
+		}
+		return 1
+	}
+	if va.preRelease && va.preNum != vb.preNum {
+		return va.preNum - vb.preNum
+	}
+	return strings.Compare(a, b)
+}
+
+// sortKernelVersionsDesc sorts kernel version directory names newest first.
+func sortKernelVersionsDesc(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return compareKernelVersions(versions[i], versions[j]) > 0
+	})
 }
 
 // SetupPasswords sets default passwords for the matrix and root users.
 func (im *Image) SetupPasswords(ostreeDeployRootfs string) error {
+	return im.SetupPasswordsForUsers(ostreeDeployRootfs, map[string]string{
+		"matrix": "matrix",
+		"root":   "matrix",
+	}, 0)
+}
+
+// SHA-512 crypt round count bounds, see crypt(5).
+const (
+	minShaCryptRounds = 1000
+	maxShaCryptRounds = 999999999
+)
+
+// shaCryptSaltChars is the alphabet allowed in a crypt(3) salt.
+const shaCryptSaltChars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// hashPassword returns the SHA-512 crypt hash of password, computed with
+// openssl. A zero cost uses the default round count (5000), otherwise cost
+// is the number of rounds.
+func (im *Image) hashPassword(password string, cost int) (string, error) {
+	args := []string{"passwd", "-6", "-stdin"}
+	if cost != 0 {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("failed to generate salt: %w", err)
+		}
+		for i, b := range salt {
+			salt[i] = shaCryptSaltChars[int(b)%len(shaCryptSaltChars)]
+		}
+		args = append(args, "-salt", fmt.Sprintf("rounds=%d$%s", cost, salt))
+	}
+	var out bytes.Buffer
+	if err := im.runner(strings.NewReader(password), &out, im.stderr, "openssl", args...); err != nil {
+		return "", fmt.Errorf("openssl passwd failed: %w", err)
+	}
+	hash := strings.TrimSpace(out.String())
+	if hash == "" {
+		return "", errors.New("openssl passwd returned an empty hash")
+	}
+	return hash, nil
+}
+
+// SetupPasswordsForUsers sets the password of every user in users (a
+// username to plaintext password map) in the shadow file of
+// ostreeDeployRootfs, replacing any existing entry for those users. cost is
+// the SHA-512 crypt round count, 0 meaning the default.
+func (im *Image) SetupPasswordsForUsers(ostreeDeployRootfs string, users map[string]string, cost int) error {
 	if ostreeDeployRootfs == "" {
 		return errors.New("missing ostreeDeployRootfs parameter")
 	}
-
-	shadowFile := filepath.Join(ostreeDeployRootfs, "etc", "shadow")
-
-	cmd := exec.Command("openssl", "passwd", "-6", "matrix")
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("openssl passwd failed: %w", err)
+	if len(users) == 0 {
+		return errors.New("missing users parameter")
 	}
-	passHash := strings.TrimSpace(string(out))
-	lastChange := fmt.Sprintf("%d", time.Now().Unix()/86400)
+	if cost != 0 && (cost < minShaCryptRounds || cost > maxShaCryptRounds) {
+		return fmt.Errorf("invalid cost parameter %d, must be 0 or between %d and %d",
+			cost, minShaCryptRounds, maxShaCryptRounds)
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		if name == "" || strings.ContainsAny(name, ":\n") {
+			return fmt.Errorf("invalid user name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
+	shadowFile := filepath.Join(ostreeDeployRootfs, "etc", "shadow")
 	data, err := os.ReadFile(shadowFile)
 	if err != nil {
 		return fmt.Errorf("failed to read shadow file: %w", err)
@@ -880,26 +2066,29 @@ func (im *Image) SetupPasswords(ostreeDeployRootfs string) error {
 	scanner := bufio.NewScanner(strings.NewReader(string(data)))
 	for scanner.Scan() {
 		line := scanner.Text()
-		// Remove existing matrix: and root: lines.
-		if strings.HasPrefix(line, "matrix:") || strings.HasPrefix(line, "root:") {
+		// Remove existing lines of the users being set up.
+		if user, _, _ := strings.Cut(line, ":"); slices.Contains(names, user) {
 			continue
 		}
 		lines = append(lines, line)
 	}
 
-	shadowEntry := func(user string) string {
-		return fmt.Sprintf("%s:%s:%s:0:99999:7:::", user, passHash, lastChange)
+	lastChange := fmt.Sprintf("%d", time.Now().Unix()/86400)
+	for _, name := range names {
+		passHash, err := im.hashPassword(users[name], cost)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(im.stdout, "Setting the default password of %s ...\n", name)
+		lines = append(lines, fmt.Sprintf("%s:%s:%s:0:99999:7:::", name, passHash, lastChange))
 	}
 
-	fmt.Fprintln(os.Stdout, "Setting the default password of matrix to matrix ...")
-	lines = append(lines, shadowEntry("matrix"))
-	fmt.Fprintln(os.Stdout, "Setting the default password of root to matrix ...")
-	lines = append(lines, shadowEntry("root"))
-
 	return os.WriteFile(shadowFile, []byte(strings.Join(lines, "\n")+"\n"), 0640)
 }
 
-// SetupBootloaderConfig sets up the GRUB bootloader configuration.
+// SetupBootloaderConfig sets up the bootloader configuration selected by
+// Imager.Bootloader: a templated grub.cfg in efibootdir for GRUB, or a
+// loader/entries/<osname>-<commit>.conf entry in bootdir for systemd-boot.
 func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir, efibootdir, efiUUID, bootUUID string) error {
 	if ref == "" {
 		return errors.New("missing ref parameter")
@@ -937,8 +2126,38 @@ func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir
 	if err != nil || bootCommit == "" {
 		return fmt.Errorf("cannot determine ostree boot commit: %w", err)
 	}
-	fmt.Fprintf(os.Stdout, "Found boot commit: %s\n", bootCommit)
+	fmt.Fprintf(im.stdout, "Found boot commit: %s\n", bootCommit)
+
+	bootloader, err := im.Bootloader()
+	if err != nil {
+		return err
+	}
+	switch bootloader {
+	case "systemd-boot":
+		err = im.SetupSystemdBootEntry(ref, bootCommit, bootdir)
+	default:
+		err = im.setupGrubConfig(ref, ostreeDeployRootfs, bootdir, efibootdir, efiUUID, bootUUID)
+	}
+	if err != nil {
+		return err
+	}
 
+	perKernel, err := im.BootEntryPerKernel()
+	if err != nil {
+		return err
+	}
+	if perKernel {
+		if err := im.SetupKernelBootEntries(ostreeDeployRootfs, bootdir); err != nil {
+			return fmt.Errorf("failed to set up per-kernel boot entries: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// setupGrubConfig copies the grub.cfg shipped for ref into efibootdir and
+// fills in its template variables.
+func (im *Image) setupGrubConfig(ref, ostreeDeployRootfs, bootdir, efibootdir, efiUUID, bootUUID string) error {
 	devDir, err := im.DevDir()
 	if err != nil {
 		return err
@@ -954,7 +2173,7 @@ func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir
 	if !fslib.FileExists(srcGrubCfg) {
 		return fmt.Errorf("grub config %s does not exist", srcGrubCfg)
 	}
-	fmt.Fprintf(os.Stdout, "Using grub config from %s\n", srcGrubCfg)
+	fmt.Fprintf(im.stdout, "Using grub config from %s\n", srcGrubCfg)
 
 	// Ensure efibootdir exists.
 	if err := os.MkdirAll(efibootdir, 0755); err != nil {
@@ -962,7 +2181,7 @@ func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir
 	}
 
 	dstGrubCfg := filepath.Join(efibootdir, "grub.cfg")
-	fmt.Fprintf(os.Stdout, "Copying grub: %s -> %s\n", srcGrubCfg, dstGrubCfg)
+	fmt.Fprintf(im.stdout, "Copying grub: %s -> %s\n", srcGrubCfg, dstGrubCfg)
 	if err := copyFile(srcGrubCfg, dstGrubCfg); err != nil {
 		return fmt.Errorf("failed to copy grub config: %w", err)
 	}
@@ -974,12 +2193,12 @@ func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir
 	}
 	themesDir := filepath.Join(ostreeDeployRootfs, "usr", "share", "grub", "themes", osName+"-theme")
 	if fslib.DirectoryExists(themesDir) {
-		fmt.Fprintf(os.Stdout, "Copying GRUB themes from %s ...\n", themesDir)
+		fmt.Fprintf(im.stdout, "Copying GRUB themes from %s ...\n", themesDir)
 		dstThemesDir := filepath.Join(bootdir, "grub", "themes")
 		if err := os.MkdirAll(dstThemesDir, 0755); err != nil {
 			return fmt.Errorf("failed to create themes dir: %w", err)
 		}
-		if err := im.runner(nil, os.Stdout, os.Stderr, "cp", "-v", "-rp", themesDir, dstThemesDir+"/"); err != nil {
+		if err := im.runner(nil, im.stdout, im.stderr, "cp", "-v", "-rp", themesDir, dstThemesDir+"/"); err != nil {
 			return fmt.Errorf("failed to copy themes: %w", err)
 		}
 	}
@@ -1011,14 +2230,212 @@ func (im *Image) SetupBootloaderConfig(ref, ostreeDeployRootfs, sysroot, bootdir
 	grubContent = strings.ReplaceAll(grubContent, "%BOOTUUID%", bootUUID)
 	grubContent = strings.ReplaceAll(grubContent, "%EFIUUID%", efiUUID)
 	grubContent = strings.ReplaceAll(grubContent, "%OSNAME%", osName)
+	if leftover := unresolvedPlaceholders(grubContent); len(leftover) > 0 {
+		return fmt.Errorf("unknown template variables in %s: %s",
+			srcGrubCfg, strings.Join(leftover, ", "))
+	}
 	if err := os.WriteFile(dstGrubCfg, []byte(grubContent), 0644); err != nil {
 		return fmt.Errorf("failed to write substituted grub config: %w", err)
 	}
 
-	fmt.Fprintln(os.Stdout, "Current grub.cfg:")
-	fmt.Fprintln(os.Stdout, grubContent)
-	fmt.Fprintln(os.Stdout, "EOF")
+	fmt.Fprintln(im.stdout, "Current grub.cfg:")
+	fmt.Fprintln(im.stdout, grubContent)
+	fmt.Fprintln(im.stdout, "EOF")
+	return nil
+}
+
+// grubPlaceholderRe matches a %NAME% template variable in grub.cfg.
+var grubPlaceholderRe = regexp.MustCompile(`%[A-Za-z0-9_]+%`)
+
+// unresolvedPlaceholders returns the distinct %NAME% template variables left
+// in content, in order of appearance.
+func unresolvedPlaceholders(content string) []string {
+	var found []string
+	for _, m := range grubPlaceholderRe.FindAllString(content, -1) {
+		if !slices.Contains(found, m) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// parseBootEntry parses a BLS boot entry into a map of its keys (title,
+// linux, initrd, options, ...).
+func parseBootEntry(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read boot entry %s: %w", path, err)
+	}
+	entry := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, val, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			entry[key] = strings.TrimSpace(val)
+		}
+	}
+	return entry, nil
+}
+
+// ostreeBootEntries returns the paths of the ostree-generated boot entries
+// found in entriesDir, sorted by name.
+func ostreeBootEntries(entriesDir string) ([]string, error) {
+	ostreeEntries, err := filepath.Glob(filepath.Join(entriesDir, "ostree-*.conf"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot entries in %s: %w", entriesDir, err)
+	}
+	if len(ostreeEntries) == 0 {
+		return nil, fmt.Errorf("no ostree boot entry found in %s", entriesDir)
+	}
+	sort.Strings(ostreeEntries)
+	return ostreeEntries, nil
+}
+
+// readOstreeBootEntry parses the first ostree-generated boot entry found in
+// entriesDir into a map of its keys (title, linux, initrd, options, ...).
+func readOstreeBootEntry(entriesDir string) (map[string]string, error) {
+	ostreeEntries, err := ostreeBootEntries(entriesDir)
+	if err != nil {
+		return nil, err
+	}
+	return parseBootEntry(ostreeEntries[0])
+}
+
+// readOstreeBootEntryForCommit parses the ostree-generated boot entry of
+// bootCommit found in entriesDir, i.e. the one whose ostree= kernel argument
+// points to /ostree/boot.N/<osName>/<bootCommit>/<serial>.
+func readOstreeBootEntryForCommit(entriesDir, osName, bootCommit string) (map[string]string, error) {
+	ostreeEntries, err := ostreeBootEntries(entriesDir)
+	if err != nil {
+		return nil, err
+	}
+	bootPath := "/" + osName + "/" + bootCommit + "/"
+	for _, path := range ostreeEntries {
+		entry, err := parseBootEntry(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, opt := range strings.Fields(entry["options"]) {
+			if v, ok := strings.CutPrefix(opt, "ostree="); ok && strings.Contains(v, bootPath) {
+				return entry, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no ostree boot entry for boot commit %s found in %s", bootCommit, entriesDir)
+}
 
+// SetupSystemdBootEntry writes a systemd-boot loader/entries/<osname>-<commit>.conf
+// entry in bootdir for the deployment of ref at bootCommit. The kernel, initrd
+// and options are taken from the ostree-generated boot entry of bootCommit,
+// which is left in place.
+func (im *Image) SetupSystemdBootEntry(ref, bootCommit, bootdir string) error {
+	if ref == "" {
+		return errors.New("missing ref parameter")
+	}
+	if bootCommit == "" {
+		return errors.New("missing bootCommit parameter")
+	}
+	if bootdir == "" {
+		return errors.New("missing bootdir parameter")
+	}
+	osName, err := im.OsName()
+	if err != nil {
+		return err
+	}
+
+	entriesDir := filepath.Join(bootdir, "loader", "entries")
+	ostreeEntry, err := readOstreeBootEntryForCommit(entriesDir, osName, bootCommit)
+	if err != nil {
+		return err
+	}
+	if ostreeEntry["linux"] == "" {
+		return fmt.Errorf("ostree boot entry of %s in %s has no linux line", bootCommit, entriesDir)
+	}
+
+	lines := []string{
+		fmt.Sprintf("title %s (%s)", osName, ref),
+		"linux " + ostreeEntry["linux"],
+	}
+	if initrd := ostreeEntry["initrd"]; initrd != "" {
+		lines = append(lines, "initrd "+initrd)
+	}
+	if options := ostreeEntry["options"]; options != "" {
+		lines = append(lines, "options "+options)
+	}
+
+	entry := filepath.Join(entriesDir, fmt.Sprintf("%s-%s.conf", osName, bootCommit))
+	fmt.Fprintf(im.stdout, "Writing systemd-boot entry %s ...\n", entry)
+	if err := os.WriteFile(entry, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write boot entry %s: %w", entry, err)
+	}
+	return nil
+}
+
+// SetupKernelBootEntries writes a loader/entries/<osname>-<kver>.conf boot
+// entry for every kernel found in the deployed rootfs, newest first. The
+// kernel image (vmlinuz) and, when present, the initramfs are copied from
+// usr/lib/modules/<kver> into <bootdir>/<osname>/kernels/<kver>, and the
+// kernel options are taken from the ostree-generated boot entry.
+func (im *Image) SetupKernelBootEntries(ostreeDeployRootfs, bootdir string) error {
+	if ostreeDeployRootfs == "" {
+		return errors.New("missing ostreeDeployRootfs parameter")
+	}
+	if bootdir == "" {
+		return errors.New("missing bootdir parameter")
+	}
+
+	kernels, err := im.GetAllKernelPaths(ostreeDeployRootfs)
+	if err != nil {
+		return err
+	}
+	osName, err := im.OsName()
+	if err != nil {
+		return err
+	}
+
+	entriesDir := filepath.Join(bootdir, "loader", "entries")
+	ostreeEntry, err := readOstreeBootEntry(entriesDir)
+	if err != nil {
+		return err
+	}
+	options := ostreeEntry["options"]
+
+	for _, kver := range kernels {
+		srcDir := filepath.Join(ostreeDeployRootfs, "usr", "lib", "modules", kver)
+		relDir := filepath.Join(osName, "kernels", kver)
+		dstDir := filepath.Join(bootdir, relDir)
+		if err := os.MkdirAll(dstDir, 0755); err != nil {
+			return fmt.Errorf("failed to create kernel dir %s: %w", dstDir, err)
+		}
+
+		vmlinuz := filepath.Join(srcDir, "vmlinuz")
+		if !fslib.FileExists(vmlinuz) {
+			return fmt.Errorf("kernel image %s does not exist", vmlinuz)
+		}
+		if err := copyFile(vmlinuz, filepath.Join(dstDir, "vmlinuz")); err != nil {
+			return fmt.Errorf("failed to copy kernel %s: %w", vmlinuz, err)
+		}
+		lines := []string{
+			fmt.Sprintf("title %s (%s)", osName, kver),
+			"version " + kver,
+			"linux /" + filepath.Join(relDir, "vmlinuz"),
+		}
+
+		initramfs := filepath.Join(srcDir, "initramfs.img")
+		if fslib.FileExists(initramfs) {
+			if err := copyFile(initramfs, filepath.Join(dstDir, "initramfs.img")); err != nil {
+				return fmt.Errorf("failed to copy initramfs %s: %w", initramfs, err)
+			}
+			lines = append(lines, "initrd /"+filepath.Join(relDir, "initramfs.img"))
+		}
+		if options != "" {
+			lines = append(lines, "options "+options)
+		}
+
+		entry := filepath.Join(entriesDir, fmt.Sprintf("%s-%s.conf", osName, kver))
+		fmt.Fprintf(im.stdout, "Writing boot entry %s ...\n", entry)
+		if err := os.WriteFile(entry, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write boot entry %s: %w", entry, err)
+		}
+	}
 	return nil
 }
 
@@ -1028,7 +2445,7 @@ func (im *Image) SetupVmtestConfig(bootdir string) error {
 		return errors.New("missing bootdir parameter")
 	}
 
-	fmt.Fprintf(os.Stdout, "Setting up vmtest grub config based on the ostree boot config in %s ...\n", bootdir)
+	fmt.Fprintf(im.stdout, "Setting up vmtest grub config based on the ostree boot config in %s ...\n", bootdir)
 
 	ostreeBootCfg := filepath.Join(bootdir, "loader", "entries", "ostree-1.conf")
 	if !fslib.FileExists(ostreeBootCfg) {
@@ -1064,14 +2481,94 @@ func (im *Image) SetupVmtestConfig(bootdir string) error {
 		return fmt.Errorf("failed to write vmtest config: %w", err)
 	}
 
-	fmt.Fprintf(os.Stdout, "Set up vmtest grub config at %s\n", vmtestBootCfg)
-	fmt.Fprintln(os.Stdout, "Current vmtest grub config:")
-	fmt.Fprintln(os.Stdout, content)
-	fmt.Fprintln(os.Stdout, "EOF")
+	fmt.Fprintf(im.stdout, "Set up vmtest grub config at %s\n", vmtestBootCfg)
+	fmt.Fprintln(im.stdout, "Current vmtest grub config:")
+	fmt.Fprintln(im.stdout, content)
+	fmt.Fprintln(im.stdout, "EOF")
 
 	return nil
 }
 
+// rollbackBootEntry returns the path to the BLS entry ostree wrote for the
+// deployment at the given index. ostree numbers entries in reverse deployment
+// order, optionally suffixed with the stateroot.
+func rollbackBootEntry(entriesDir string, d cds.Deployment, numDeployments int) (string, error) {
+	n := numDeployments - d.Index
+	candidates := []string{
+		filepath.Join(entriesDir, fmt.Sprintf("ostree-%d-%s.conf", n, d.Stateroot)),
+		filepath.Join(entriesDir, fmt.Sprintf("ostree-%d.conf", n)),
+	}
+	for _, c := range candidates {
+		if fslib.FileExists(c) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("no boot entry found for rollback deployment %s in %s", d.Checksum, entriesDir)
+}
+
+// SetupRecoveryBootEntry writes a loader/entries/recovery.conf boot entry that
+// always targets the rollback deployment. It clones the kernel, initrd and
+// options of the rollback deployment boot entry. If there is no rollback
+// deployment, nothing is written.
+func (im *Image) SetupRecoveryBootEntry(bootdir string) error {
+	if bootdir == "" {
+		return errors.New("missing bootdir parameter")
+	}
+
+	deployments, err := im.ostree.ListDeployments(false)
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	var rollback *cds.Deployment
+	for i := range deployments {
+		if deployments[i].Rollback {
+			rollback = &deployments[i]
+			break
+		}
+	}
+	if rollback == nil {
+		fmt.Fprintln(im.stdout, "No rollback deployment available, skipping recovery boot entry.")
+		return nil
+	}
+
+	osName, err := im.OsName()
+	if err != nil {
+		return err
+	}
+
+	entriesDir := filepath.Join(bootdir, "loader", "entries")
+	srcEntry, err := rollbackBootEntry(entriesDir, *rollback, len(deployments))
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(srcEntry)
+	if err != nil {
+		return fmt.Errorf("failed to read boot entry %s: %w", srcEntry, err)
+	}
+
+	lines := []string{fmt.Sprintf("title %s Recovery (%s)", osName, rollback.Checksum)}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, _, _ := strings.Cut(line, " ")
+		switch key {
+		case "version", "linux", "initrd", "devicetree", "options":
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan boot entry %s: %w", srcEntry, err)
+	}
+
+	recoveryEntry := filepath.Join(entriesDir, "recovery.conf")
+	fmt.Fprintf(im.stdout, "Writing recovery boot entry %s (from %s) ...\n", recoveryEntry, srcEntry)
+	if err := os.WriteFile(recoveryEntry, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write recovery boot entry: %w", err)
+	}
+	return nil
+}
+
 // InstallSecurebootCerts installs SecureBoot certificates on the EFI partition.
 func (im *Image) InstallSecurebootCerts(ostreeDeployRootfs, mountEfifs, efibootdir string) error {
 	if ostreeDeployRootfs == "" {
@@ -1104,43 +2601,165 @@ func (im *Image) InstallSecurebootCerts(ostreeDeployRootfs, mountEfifs, efibootd
 	// SecureBoot certificate (db).
 	sbCert := filepath.Join(ostreeDeployRootfs, "etc", "portage", "secureboot.pem")
 	if fslib.FileExists(sbCert) {
-		fmt.Fprintln(os.Stdout, "Copying SecureBoot cert to EFI partition ...")
+		fmt.Fprintln(im.stdout, "Copying SecureBoot cert to EFI partition ...")
 		if err := copyFile(sbCert, filepath.Join(mountEfifs, certFileName)); err != nil {
 			return fmt.Errorf("failed to copy SecureBoot cert: %w", err)
 		}
 
-		fmt.Fprintln(os.Stdout, "Generating SecureBoot MOK ...")
-		if err := im.runner(nil, os.Stdout, os.Stderr,
+		fmt.Fprintln(im.stdout, "Generating SecureBoot MOK ...")
+		if err := im.runner(nil, im.stdout, im.stderr,
 			"openssl", "x509", "-in", sbCert,
 			"-outform", "DER", "-out", filepath.Join(mountEfifs, certDerFileName)); err != nil {
 			return fmt.Errorf("openssl DER conversion failed: %w", err)
 		}
+		if err := im.StageMokEnrollment(mountEfifs); err != nil {
+			return err
+		}
+		requestFileName, err := im.MokEnrollmentFileName()
+		if err != nil {
+			return err
+		}
+		if fslib.FileExists(filepath.Join(mountEfifs, requestFileName)) {
+			if err := im.installMokEnrollUnit(ostreeDeployRootfs); err != nil {
+				return err
+			}
+		}
 	} else {
-		fmt.Fprintf(os.Stderr, "NO SECUREBOOT CERT AT: %s -- ignoring.\n", sbCert)
+		fmt.Fprintf(im.stderr, "NO SECUREBOOT CERT AT: %s -- ignoring.\n", sbCert)
 	}
 
 	// SecureBoot KEK certificate.
 	sbKek := filepath.Join(ostreeDeployRootfs, "etc", "portage", "secureboot-kek.pem")
 	if fslib.FileExists(sbKek) {
-		fmt.Fprintln(os.Stdout, "Copying SecureBoot KEK cert to EFI partition ...")
+		fmt.Fprintln(im.stdout, "Copying SecureBoot KEK cert to EFI partition ...")
 		if err := copyFile(sbKek, filepath.Join(mountEfifs, kekFileName)); err != nil {
 			return fmt.Errorf("failed to copy SecureBoot KEK cert: %w", err)
 		}
 
-		fmt.Fprintln(os.Stdout, "Generating SecureBoot KEK DER for convenience ...")
-		if err := im.runner(nil, os.Stdout, os.Stderr,
+		fmt.Fprintln(im.stdout, "Generating SecureBoot KEK DER for convenience ...")
+		if err := im.runner(nil, im.stdout, im.stderr,
 			"openssl", "x509", "-in", sbKek,
 			"-outform", "DER", "-out", filepath.Join(mountEfifs, kekDerFileName)); err != nil {
 			return fmt.Errorf("openssl KEK DER conversion failed: %w", err)
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "NO SECUREBOOT CERT AT: %s -- ignoring.\n", sbKek)
+		fmt.Fprintf(im.stderr, "NO SECUREBOOT CERT AT: %s -- ignoring.\n", sbKek)
 	}
 
 	// Copy the shim binaries.
 	shimDir := filepath.Join(ostreeDeployRootfs, "usr", "share", "shim")
-	fmt.Fprintf(os.Stdout, "Copying shim for Secureboot from %s to %s ...\n", shimDir, efibootdir)
-	return im.runner(nil, os.Stdout, os.Stderr, "cp", "-v", shimDir+"/.", efibootdir+"/")
+	fmt.Fprintf(im.stdout, "Copying shim for Secureboot from %s to %s ...\n", shimDir, efibootdir)
+	return im.runner(nil, im.stdout, im.stderr, "cp", "-v", shimDir+"/.", efibootdir+"/")
+}
+
+// MokEnrollmentFileName returns the file name, relative to the ESP, of the
+// MOK enrollment request staged by StageMokEnrollment. It is derived from
+// EfiCertificateFileNameDer, e.g. secureboot-enroll.der.
+func (im *Image) MokEnrollmentFileName() (string, error) {
+	der, err := im.EfiCertificateFileNameDer()
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(der)
+	return strings.TrimSuffix(der, ext) + "-enroll" + ext, nil
+}
+
+// StageMokEnrollment writes a MOK enrollment request for the DER SecureBoot
+// certificate (see EfiCertificateFileNameDer) to the ESP mounted at
+// mountEfifs. The request (see MokEnrollmentFileName) is a copy of the
+// certificate in the DER format accepted by mokutil --import, and its
+// presence on the ESP marks the enrollment as pending: the first-boot unit
+// installed by InstallSecurebootCerts imports it and then removes it.
+// Nothing is written if the DER certificate is not on the ESP.
+func (im *Image) StageMokEnrollment(mountEfifs string) error {
+	if mountEfifs == "" {
+		return errors.New("missing mountEfifs parameter")
+	}
+	certDerFileName, err := im.EfiCertificateFileNameDer()
+	if err != nil {
+		return err
+	}
+	requestFileName, err := im.MokEnrollmentFileName()
+	if err != nil {
+		return err
+	}
+
+	certDer := filepath.Join(mountEfifs, certDerFileName)
+	if !fslib.FileExists(certDer) {
+		fmt.Fprintf(im.stderr, "No DER SecureBoot cert at %s, not staging MOK enrollment.\n", certDer)
+		return nil
+	}
+	der, err := os.ReadFile(certDer)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", certDer, err)
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return fmt.Errorf("invalid DER SecureBoot cert %s: %w", certDer, err)
+	}
+
+	requestFile := filepath.Join(mountEfifs, requestFileName)
+	fmt.Fprintf(im.stdout, "Staging MOK enrollment request %s ...\n", requestFile)
+	if err := os.WriteFile(requestFile, der, 0644); err != nil {
+		return fmt.Errorf("failed to write MOK enrollment request %s: %w", requestFile, err)
+	}
+	return nil
+}
+
+// mokEnrollUnitName is the systemd unit installed by installMokEnrollUnit.
+const mokEnrollUnitName = "matrixos-mok-enroll.service"
+
+// installMokEnrollUnit installs and enables, in the deployment at
+// ostreeDeployRootfs, a oneshot unit handing the request staged by
+// StageMokEnrollment over to shim. shim only picks up enrollment requests
+// from NVRAM, so the unit runs mokutil --import on the request, and
+// MokManager asks to confirm the enrollment with the root password on the
+// next reboot. The request is then removed, so that it is imported once.
+func (im *Image) installMokEnrollUnit(ostreeDeployRootfs string) error {
+	requestFileName, err := im.MokEnrollmentFileName()
+	if err != nil {
+		return err
+	}
+	efiRoot, err := im.EfiRoot()
+	if err != nil {
+		return err
+	}
+
+	bootRequest := filepath.Join(efiRoot, requestFileName)
+	unit := strings.Join([]string{
+		"[Unit]",
+		"Description=Request the enrollment of the matrixOS SecureBoot certificate",
+		"ConditionPathIsDirectory=/sys/firmware/efi",
+		"ConditionPathExists=" + bootRequest,
+		"RequiresMountsFor=" + efiRoot,
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=/usr/bin/mokutil --import " + bootRequest + " --root-pw",
+		"ExecStartPost=/usr/bin/rm -f " + bootRequest,
+		"",
+		"[Install]",
+		"WantedBy=multi-user.target",
+		"",
+	}, "\n")
+
+	unitsDir := filepath.Join(ostreeDeployRootfs, "etc", "systemd", "system")
+	wantsDir := filepath.Join(unitsDir, "multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", wantsDir, err)
+	}
+	unitFile := filepath.Join(unitsDir, mokEnrollUnitName)
+	fmt.Fprintf(im.stdout, "Installing MOK enrollment unit %s ...\n", unitFile)
+	if err := os.WriteFile(unitFile, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", unitFile, err)
+	}
+	wantsLink := filepath.Join(wantsDir, mokEnrollUnitName)
+	if err := os.Remove(wantsLink); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace %s: %w", wantsLink, err)
+	}
+	if err := os.Symlink(filepath.Join("/etc/systemd/system", mokEnrollUnitName), wantsLink); err != nil {
+		return fmt.Errorf("failed to enable %s: %w", mokEnrollUnitName, err)
+	}
+	return nil
 }
 
 // InstallMemtest installs the memtest86+ EFI binary to the EFI boot directory.
@@ -1152,12 +2771,61 @@ func (im *Image) InstallMemtest(ostreeDeployRootfs, efibootdir string) error {
 		return errors.New("missing efibootdir parameter")
 	}
 
-	memtestBin := filepath.Join(ostreeDeployRootfs, "usr", "share", "memtest86+", "memtest.efi64")
-	if !fslib.PathExists(memtestBin) {
-		fmt.Fprintf(os.Stderr, "WARNING: %s not available, please install memtest86+\n", memtestBin)
+	candidates, err := im.MemtestPaths()
+	if err != nil {
+		return err
+	}
+	memtestBin, err := findFirstFile(ostreeDeployRootfs, candidates)
+	if err != nil {
+		return err
+	}
+	if memtestBin == "" {
+		fmt.Fprintf(im.stderr, "WARNING: none of %s available in %s, please install memtest86+\n",
+			strings.Join(candidates, ", "), ostreeDeployRootfs)
 		return nil
 	}
-	return copyFile(memtestBin, filepath.Join(efibootdir, "memtest86plus.efi"))
+	dst := filepath.Join(efibootdir, "memtest86plus.efi")
+	fmt.Fprintf(im.stdout, "Installing %s -> %s\n", memtestBin, dst)
+	return copyFile(memtestBin, dst)
+}
+
+// findFirstFile returns the first regular file under root matching one of
+// patterns (glob patterns are expanded in lexical order), or "" if none does.
+func findFirstFile(root string, patterns []string) (string, error) {
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return "", fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+		for _, m := range matches {
+			if fslib.FileExists(m) {
+				return m, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// luksKernelArgs returns the kernel arguments unlocking the LUKS root
+// device with the given UUID. When Imager.LuksKeyfile is set, the keyfile
+// is passed with rd.luks.key=; if it lives on a separate device
+// ("<path>:<device>"), rd.luks.options= adds a timeout after which
+// systemd-cryptsetup falls back to asking for the passphrase.
+func (im *Image) luksKernelArgs(rootDeviceUUID string) ([]string, error) {
+	args := []string{fmt.Sprintf("rd.luks.uuid=%s", rootDeviceUUID)}
+
+	keyfile, err := im.LuksKeyfile()
+	if err != nil {
+		return nil, err
+	}
+	if keyfile == "" {
+		return args, nil
+	}
+	args = append(args, fmt.Sprintf("rd.luks.key=%s=%s", rootDeviceUUID, keyfile))
+	if strings.Contains(keyfile, ":") {
+		args = append(args, fmt.Sprintf("rd.luks.options=%s=keyfile-timeout=10s", rootDeviceUUID))
+	}
+	return args, nil
 }
 
 // GenerateKernelBootArgs generates the kernel boot arguments for the image.
@@ -1187,7 +2855,11 @@ func (im *Image) GenerateKernelBootArgs(ref, efiDevice, bootDevice, physicalRoot
 		return nil, fmt.Errorf("unable to get device UUID for %s: %w", physicalRootDevice, err)
 	}
 	if encryptionEnabled {
-		bootArgs = append(bootArgs, fmt.Sprintf("rd.luks.uuid=%s", rootDeviceUUID))
+		luksArgs, err := im.luksKernelArgs(rootDeviceUUID)
+		if err != nil {
+			return nil, err
+		}
+		bootArgs = append(bootArgs, luksArgs...)
 	}
 
 	// EFI partition mount via systemd.
@@ -1219,7 +2891,7 @@ func (im *Image) GenerateKernelBootArgs(ref, efiDevice, bootDevice, physicalRoot
 	}
 	cmdlineFile := filepath.Join(devDir, "image", "boot", ref, "cmdline.conf")
 	if fslib.FileExists(cmdlineFile) {
-		fmt.Fprintf(os.Stdout, "Reading additional kernel cmdline params from %s ...\n", cmdlineFile)
+		fmt.Fprintf(im.stdout, "Reading additional kernel cmdline params from %s ...\n", cmdlineFile)
 		data, err := os.ReadFile(cmdlineFile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read cmdline file: %w", err)
@@ -1233,7 +2905,7 @@ func (im *Image) GenerateKernelBootArgs(ref, efiDevice, bootDevice, physicalRoot
 			bootArgs = append(bootArgs, line)
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "WARNING: no additional kernel cmdline params available, %s does not exist.\n", cmdlineFile)
+		fmt.Fprintf(im.stderr, "WARNING: no additional kernel cmdline params available, %s does not exist.\n", cmdlineFile)
 	}
 
 	return bootArgs, nil
@@ -1252,7 +2924,7 @@ func (im *Image) PackageList(rootfs string) ([]string, error) {
 
 	vdb := filepath.Join(strings.TrimRight(rootfs, "/"), roVdb)
 	if !fslib.DirectoryExists(vdb) {
-		fmt.Fprintf(os.Stderr, "%s does not exist. cannot generate pkglist\n", vdb)
+		fmt.Fprintf(im.stderr, "%s does not exist. cannot generate pkglist\n", vdb)
 		return nil, nil
 	}
 
@@ -1275,14 +2947,52 @@ func (im *Image) PackageList(rootfs string) ([]string, error) {
 		}
 	}
 
-	fmt.Fprintln(os.Stdout, "Generated package list:")
+	fmt.Fprintln(im.stdout, "Generated package list:")
 	for _, pkg := range pkgList {
-		fmt.Fprintf(os.Stdout, ">> %s\n", pkg)
+		fmt.Fprintf(im.stdout, ">> %s\n", pkg)
 	}
 	return pkgList, nil
 }
 
-// SetupHooks runs image-specific hook scripts.
+// PackageListDiff compares the packages installed in oldRootfs and
+// newRootfs and returns the sorted lists of packages only found in the new
+// one (added) and only found in the old one (removed). A rootfs without a
+// package database counts as having no packages.
+func (im *Image) PackageListDiff(oldRootfs, newRootfs string) (added, removed []string, err error) {
+	if oldRootfs == "" {
+		return nil, nil, errors.New("missing oldRootfs parameter")
+	}
+	if newRootfs == "" {
+		return nil, nil, errors.New("missing newRootfs parameter")
+	}
+
+	oldPkgs, err := im.PackageList(oldRootfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	newPkgs, err := im.PackageList(newRootfs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, pkg := range newPkgs {
+		if !slices.Contains(oldPkgs, pkg) {
+			added = append(added, pkg)
+		}
+	}
+	for _, pkg := range oldPkgs {
+		if !slices.Contains(newPkgs, pkg) {
+			removed = append(removed, pkg)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	return added, removed, nil
+}
+
+// SetupHooks runs image-specific hook scripts: first image/hooks/<ref>.sh,
+// then the executable scripts in image/hooks/<ref>.d/ in lexical order
+// (e.g. 10-foo.sh, 20-bar.sh).
 func (im *Image) SetupHooks(ostreeDeployRootfs, ref string) error {
 	if ostreeDeployRootfs == "" {
 		return errors.New("missing ostreeDeployRootfs parameter")
@@ -1303,87 +3013,199 @@ func (im *Image) SetupHooks(ostreeDeployRootfs, ref string) error {
 
 	hooksSrcDir := filepath.Join(devDir, "image", "hooks")
 	if !fslib.DirectoryExists(hooksSrcDir) {
-		fmt.Fprintf(os.Stderr, "hooks source dir %s does not exist\n", hooksSrcDir)
+		fmt.Fprintf(im.stderr, "hooks source dir %s does not exist\n", hooksSrcDir)
 		return nil
 	}
 
+	releaseVersion, err := im.ReleaseVersion(ostreeDeployRootfs)
+	if err != nil {
+		return err
+	}
+	buildEnv, err := im.scriptBuildEnv(releaseVersion)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(),
+		"MATRIXOS_DEV_DIR="+devDir,
+		"ROOTFS="+ostreeDeployRootfs,
+		"REF="+ref,
+	)
+	env = append(env, buildEnv...)
+
 	hookExec := filepath.Join(hooksSrcDir, ref+".sh")
 	if !fslib.FileExists(hookExec) {
-		fmt.Fprintf(os.Stderr, "hook script %s does not exist\n", hookExec)
+		fmt.Fprintf(im.stderr, "hook script %s does not exist\n", hookExec)
+	} else {
+		info, err := os.Stat(hookExec)
+		if err != nil {
+			return fmt.Errorf("failed to stat hook script: %w", err)
+		}
+		if info.Mode()&0111 == 0 {
+			return fmt.Errorf("hook script %s is not executable", hookExec)
+		}
+		if err := im.runHook(hookExec, env); err != nil {
+			return err
+		}
+	}
+
+	// Then the numbered hooks in <ref>.d/, in lexical order.
+	hooksDir := filepath.Join(hooksSrcDir, ref+".d")
+	if !fslib.DirectoryExists(hooksDir) {
 		return nil
 	}
+	entries, err := os.ReadDir(hooksDir)
+	if err != nil {
+		return fmt.Errorf("failed to read hooks dir: %w", err)
+	}
+	for _, entry := range entries {
+		hook := filepath.Join(hooksDir, entry.Name())
+		info, err := os.Stat(hook)
+		if err != nil {
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+			fmt.Fprintf(im.stderr, "WARNING: skipping non-executable hook script %s\n", hook)
+			continue
+		}
+		if err := im.runHook(hook, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	info, err := os.Stat(hookExec)
+// scriptBuildEnv returns the RELEASE_VERSION and OS_NAME environment
+// variables passed to hook and test scripts. Callers compute it once per
+// rootfs or image, so that all the scripts run against it see the same values.
+func (im *Image) scriptBuildEnv(releaseVersion string) ([]string, error) {
+	osName, err := im.OsName()
 	if err != nil {
-		return fmt.Errorf("failed to stat hook script: %w", err)
+		return nil, err
 	}
-	if info.Mode()&0111 == 0 {
-		return fmt.Errorf("hook script %s is not executable", hookExec)
+	return []string{
+		"RELEASE_VERSION=" + releaseVersion,
+		"OS_NAME=" + osName,
+	}, nil
+}
+
+// releaseVersionFromImagePath extracts the release version from the name of
+// an image created with ImagePathWithReleaseVersion or UniqueImagePath, i.e.
+// <suffix>-<version>.img or <suffix>-<version>-<n>.img, where the version is
+// numeric like the ones returned by ReleaseVersion. It falls back to the
+// current date (YYYYMMDD), like ReleaseVersion, for any other name, such as
+// the <suffix>-<arch>.img ones of ImagePathWithArch.
+func (im *Image) releaseVersionFromImagePath(imagePath, ref string) string {
+	nameRe := regexp.MustCompile(`^` + regexp.QuoteMeta(refToSuffix(ref)) + `-([0-9]+(?:\.[0-9]+)*)(?:-[0-9]+)?\.img$`)
+	m := nameRe.FindStringSubmatch(filepath.Base(imagePath))
+	if m == nil {
+		fmt.Fprintf(im.stderr, "WARNING! Cannot determine the release version of %s, using the current date\n", imagePath)
+		return time.Now().Format("20060102")
+	}
+	return m[1]
+}
+
+// runHook runs the hook script hook with the environment env.
+func (im *Image) runHook(hook string, env []string) error {
+	fmt.Fprintf(im.stdout, "Running hook script %s ...\n", hook)
+	cmd := exec.Command(hook)
+	cmd.Stdout = im.stdout
+	cmd.Stderr = im.stderr
+	cmd.Env = env
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook script %s failed: %w", hook, err)
 	}
+	return nil
+}
+
+// imageTest holds the state shared by the test scripts run against an
+// image by TestImage and TestImageParallel.
+type imageTest struct {
+	ref       string
+	devDir    string
+	logsDir   string
+	imagePath string
+	tempDir   string
+	buildEnv  []string
+	scripts   []string
+	cleanup   func()
+}
 
-	cmd := exec.Command(hookExec)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// command returns the command running the test script ts against the image
+// copy at imagePath.
+func (it *imageTest) command(ts, imagePath string) *exec.Cmd {
+	cmd := exec.Command(ts)
 	cmd.Env = append(os.Environ(),
-		"MATRIXOS_DEV_DIR="+devDir,
-		"ROOTFS="+ostreeDeployRootfs,
-		"REF="+ref,
+		"MATRIXOS_DEV_DIR="+it.devDir,
+		"MATRIXOS_LOGS_DIR="+it.logsDir,
+		"IMAGE_PATH="+imagePath,
+		"REF="+it.ref,
 	)
-	return cmd.Run()
+	cmd.Env = append(cmd.Env, it.buildEnv...)
+	return cmd
 }
 
-// TestImage copies an image to a temp directory and runs test scripts against it.
-func (im *Image) TestImage(imagePath, ref string) error {
+// copyTestImage copies the image under test into dir, which is created if
+// needed, and returns the path of the copy. Test scripts boot VMs on the
+// image, so each concurrently running script needs its own writable copy.
+func (im *Image) copyTestImage(it *imageTest, dir string, stdout, stderr io.Writer) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	testImagePath := filepath.Join(dir, filepath.Base(it.imagePath))
+	fmt.Fprintf(stdout, "Copying image to %s for testing ...\n", testImagePath)
+	if err := im.runner(nil, stdout, stderr, "cp", "--reflink=auto", "-v", it.imagePath, testImagePath); err != nil {
+		return "", fmt.Errorf("failed to copy image for testing: %w", err)
+	}
+	return testImagePath, nil
+}
+
+// prepareImageTest creates a temp directory for the image copies and lists
+// the executable test scripts for ref. It returns nil if ref has no test
+// dir. The caller must call cleanup on the returned imageTest.
+func (im *Image) prepareImageTest(imagePath, ref string) (*imageTest, error) {
 	if imagePath == "" {
-		return errors.New("missing imagePath parameter")
+		return nil, errors.New("missing imagePath parameter")
 	}
 	if ref == "" {
-		return errors.New("missing ref parameter")
+		return nil, errors.New("missing ref parameter")
 	}
 
 	ref, err := im.cleanAndStripRef(ref)
 	if err != nil {
-		return fmt.Errorf("failed to clean ref: %w", err)
+		return nil, fmt.Errorf("failed to clean ref: %w", err)
 	}
 
 	devDir, err := im.DevDir()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	testDir := filepath.Join(devDir, "image", "tests", ref)
 	if !fslib.DirectoryExists(testDir) {
-		fmt.Fprintf(os.Stderr, "test dir %s does not exist, skipping test\n", testDir)
-		return nil
+		fmt.Fprintf(im.stderr, "test dir %s does not exist, skipping test\n", testDir)
+		return nil, nil
 	}
 
 	mountDir, err := im.MountDir()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	imageTempDir, err := fslib.CreateTempDir(mountDir, refToSuffix(ref))
+	logsDir, err := im.cfg.GetItem("matrixOS.LogsDir")
 	if err != nil {
-		return fmt.Errorf("failed to create temp dir for testing: %w", err)
-	}
-	defer os.RemoveAll(imageTempDir)
-
-	imageName := filepath.Base(imagePath)
-	testImagePath := filepath.Join(imageTempDir, imageName)
-	fmt.Fprintf(os.Stdout, "Copying image to %s for testing ...\n", testImagePath)
-	if err := im.runner(nil, os.Stdout, os.Stderr, "cp", "--reflink=auto", "-v", imagePath, testImagePath); err != nil {
-		return fmt.Errorf("failed to copy image for testing: %w", err)
+		return nil, err
 	}
 
-	logsDir, err := im.cfg.GetItem("matrixOS.LogsDir")
+	buildEnv, err := im.scriptBuildEnv(im.releaseVersionFromImagePath(imagePath, ref))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	entries, err := os.ReadDir(testDir)
 	if err != nil {
-		return fmt.Errorf("failed to read test dir: %w", err)
+		return nil, fmt.Errorf("failed to read test dir: %w", err)
 	}
+	var scripts []string
 	for _, entry := range entries {
 		ts := filepath.Join(testDir, entry.Name())
 		info, err := os.Stat(ts)
@@ -1391,20 +3213,48 @@ func (im *Image) TestImage(imagePath, ref string) error {
 			continue
 		}
 		if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
-			fmt.Fprintf(os.Stderr, "Skipping non-executable test script %s\n", ts)
+			fmt.Fprintf(im.stderr, "Skipping non-executable test script %s\n", ts)
 			continue
 		}
+		scripts = append(scripts, ts)
+	}
+
+	imageTempDir, err := fslib.CreateTempDir(mountDir, refToSuffix(ref))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir for testing: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(imageTempDir) }
+
+	return &imageTest{
+		ref:       ref,
+		devDir:    devDir,
+		logsDir:   logsDir,
+		imagePath: imagePath,
+		tempDir:   imageTempDir,
+		buildEnv:  buildEnv,
+		scripts:   scripts,
+		cleanup:   cleanup,
+	}, nil
+}
+
+// TestImage copies an image to a temp directory and runs test scripts against it.
+// Scripts run sequentially, stopping at the first failure.
+func (im *Image) TestImage(imagePath, ref string) error {
+	it, err := im.prepareImageTest(imagePath, ref)
+	if err != nil || it == nil {
+		return err
+	}
+	defer it.cleanup()
 
-		fmt.Fprintf(os.Stdout, "Running test script %s ...\n", ts)
-		cmd := exec.Command(ts)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = append(os.Environ(),
-			"MATRIXOS_DEV_DIR="+devDir,
-			"MATRIXOS_LOGS_DIR="+logsDir,
-			"IMAGE_PATH="+testImagePath,
-			"REF="+ref,
-		)
+	testImagePath, err := im.copyTestImage(it, it.tempDir, im.stdout, im.stderr)
+	if err != nil {
+		return err
+	}
+	for _, ts := range it.scripts {
+		fmt.Fprintf(im.stdout, "Running test script %s ...\n", ts)
+		cmd := it.command(ts, testImagePath)
+		cmd.Stdout = im.stdout
+		cmd.Stderr = im.stderr
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("test script %s failed: %w", ts, err)
 		}
@@ -1412,6 +3262,140 @@ func (im *Image) TestImage(imagePath, ref string) error {
 	return nil
 }
 
+// TestWorkers returns the maximum number of test scripts run concurrently
+// by TestImageParallel. It defaults to the number of CPUs when unset.
+func (im *Image) TestWorkers() (int, error) {
+	v, err := im.cfg.GetItem("Imager.TestWorkers")
+	if err != nil {
+		return 0, err
+	}
+	if v == "" {
+		return runtime.NumCPU(), nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid Imager.TestWorkers %q: must be a positive integer", v)
+	}
+	return n, nil
+}
+
+// TestImageParallel is like TestImage, but runs all the test scripts
+// concurrently, at most TestWorkers at a time. Each script gets its own copy
+// of the image, removed once the script completes. The combined output of
+// each script is written to <matrixOS.LogsDir>/image-tests/<ref>/<script>.log.
+// All the scripts are run; the returned error names every failed one.
+func (im *Image) TestImageParallel(imagePath, ref string) error {
+	workers, err := im.TestWorkers()
+	if err != nil {
+		return err
+	}
+
+	it, err := im.prepareImageTest(imagePath, ref)
+	if err != nil || it == nil {
+		return err
+	}
+	defer it.cleanup()
+
+	scriptLogsDir := filepath.Join(it.logsDir, "image-tests", refToSuffix(it.ref))
+	if err := os.MkdirAll(scriptLogsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create test logs dir %s: %w", scriptLogsDir, err)
+	}
+
+	errs := make([]error, len(it.scripts))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, ts := range it.scripts {
+		logPath := filepath.Join(scriptLogsDir, filepath.Base(ts)+".log")
+		fmt.Fprintf(im.stdout, "Running test script %s (log: %s) ...\n", ts, logPath)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = im.runImageTestLogged(it, ts, logPath)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// runImageTestLogged runs the test script ts against a private copy of the
+// image, writing its combined output to logPath.
+func (im *Image) runImageTestLogged(it *imageTest, ts, logPath string) error {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return fmt.Errorf("test script %s: failed to create log file: %w", ts, err)
+	}
+	defer logFile.Close()
+
+	copyDir := filepath.Join(it.tempDir, filepath.Base(ts))
+	defer os.RemoveAll(copyDir)
+	testImagePath, err := im.copyTestImage(it, copyDir, logFile, logFile)
+	if err != nil {
+		return fmt.Errorf("test script %s: %w", ts, err)
+	}
+
+	cmd := it.command(ts, testImagePath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("test script %s failed (see %s): %w", ts, logPath, err)
+	}
+	return nil
+}
+
+// listSubmounts lists the mount points starting with a prefix. Replaceable
+// for testing.
+var listSubmounts = fslib.ListSubmounts
+
+// UnmountAllUnder recursively unmounts every mount point found below
+// mountDir (usually MountDir), such as the leftovers of a crashed run, and
+// returns the unmounted paths. Mount points nested in another one are
+// handled by the umount -R of their parent. Mount points that turn out not
+// to be mounted anymore are skipped.
+func (im *Image) UnmountAllUnder(mountDir string) ([]string, error) {
+	if mountDir == "" {
+		return nil, errors.New("missing mountDir parameter")
+	}
+	mountDir = filepath.Clean(mountDir)
+	if mountDir == "/" {
+		return nil, errors.New("refusing to unmount everything under /")
+	}
+
+	mounts, err := listSubmounts(mountDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mounts under %s: %w", mountDir, err)
+	}
+	var below []string
+	for _, mnt := range mounts {
+		if strings.HasPrefix(mnt, mountDir+"/") {
+			below = append(below, mnt)
+		}
+	}
+	sort.Strings(below)
+
+	var unmounted []string
+	for _, mnt := range below {
+		// Skip mount points already covered by a recursive umount.
+		if slices.ContainsFunc(unmounted, func(parent string) bool {
+			return strings.HasPrefix(mnt, parent+"/")
+		}) {
+			continue
+		}
+
+		fmt.Fprintf(im.stdout, "Unmounting stale mount %s ...\n", mnt)
+		var stderr bytes.Buffer
+		if err := im.runner(nil, im.stdout, io.MultiWriter(im.stderr, &stderr), "umount", "-R", mnt); err != nil {
+			if strings.Contains(stderr.String(), "not mounted") {
+				continue
+			}
+			return unmounted, fmt.Errorf("failed to unmount %s: %w", mnt, err)
+		}
+		unmounted = append(unmounted, mnt)
+	}
+	return unmounted, nil
+}
+
 // FinalizeFilesystems runs fstrim on the root and boot filesystems to improve
 // compression ratios for sparse image files.
 func (im *Image) FinalizeFilesystems(mountRootfs, mountBootfs, mountEfifs string) error {
@@ -1425,14 +3409,29 @@ func (im *Image) FinalizeFilesystems(mountRootfs, mountBootfs, mountEfifs string
 		return errors.New("missing mountEfifs parameter")
 	}
 
-	fmt.Fprintf(os.Stdout, "Executing fstrim on %s\n", mountRootfs)
-	// fstrim may fail on USB sticks, so ignore errors.
-	im.runner(nil, os.Stdout, os.Stderr, "fstrim", "-v", mountRootfs)
-
-	fmt.Fprintf(os.Stdout, "Executing fstrim on %s\n", mountBootfs)
-	im.runner(nil, os.Stdout, os.Stderr, "fstrim", "-v", mountBootfs)
+	var errs []error
+	for _, mount := range []string{mountRootfs, mountBootfs, mountEfifs} {
+		if err := im.fstrim(mount); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	return nil
+// fstrim runs fstrim on mount. Filesystems or devices that do not support
+// discard (e.g. FAT32 ESPs, some USB sticks) are not treated as an error.
+func (im *Image) fstrim(mount string) error {
+	fmt.Fprintf(im.stdout, "Executing fstrim on %s\n", mount)
+	var stderr bytes.Buffer
+	err := im.runner(nil, im.stdout, io.MultiWriter(im.stderr, &stderr), "fstrim", "-v", mount)
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(stderr.String(), "not supported") {
+		fmt.Fprintf(im.stdout, "fstrim not supported on %s, skipping\n", mount)
+		return nil
+	}
+	return fmt.Errorf("fstrim failed on %s: %w", mount, err)
 }
 
 // Qcow2ImagePath returns the qcow2 image path for a given .img path.
@@ -1445,12 +3444,57 @@ func (im *Image) Qcow2ImagePath(imagePath string) (string, error) {
 
 // CreateQcow2Image creates a compressed qcow2 image from a raw image.
 func (im *Image) CreateQcow2Image(imagePath string) error {
+	_, err := im.ConvertImage(imagePath, "qcow2")
+	return err
+}
+
+// imageFormat describes how a raw image is converted to a given format.
+type imageFormat struct {
+	qemuFormat string // value passed to qemu-img convert -O
+	ext        string // extension appended to the raw image path
+	compress   bool   // whether the format supports qemu-img's -c flag
+}
+
+// imageFormats maps the formats accepted by ConvertImage to their qemu-img
+// conversion settings. "vhd" is an alias of qemu-img's "vpc" driver.
+var imageFormats = map[string]imageFormat{
+	"qcow2": {qemuFormat: "qcow2", ext: "qcow2", compress: true},
+	"raw":   {qemuFormat: "raw", ext: "raw"},
+	"vdi":   {qemuFormat: "vdi", ext: "vdi"},
+	"vhd":   {qemuFormat: "vpc", ext: "vhd"},
+	"vhdx":  {qemuFormat: "vhdx", ext: "vhdx"},
+	"vmdk":  {qemuFormat: "vmdk", ext: "vmdk"},
+	"vpc":   {qemuFormat: "vpc", ext: "vhd"},
+}
+
+// ConvertImage converts the raw image at imagePath to the given format
+// (qcow2, raw, vdi, vhd, vhdx, vmdk or vpc) with qemu-img, and returns the
+// path of the converted image, <imagePath>.<ext>. qcow2 images are compressed.
+func (im *Image) ConvertImage(imagePath, format string) (string, error) {
 	if imagePath == "" {
-		return errors.New("missing imagePath parameter")
+		return "", errors.New("missing imagePath parameter")
+	}
+	f, ok := imageFormats[format]
+	if !ok {
+		var known []string
+		for k := range imageFormats {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return "", fmt.Errorf("unsupported image format %q, must be one of: %s",
+			format, strings.Join(known, ", "))
+	}
+
+	outPath := imagePath + "." + f.ext
+	args := []string{"convert"}
+	if f.compress {
+		args = append(args, "-c")
+	}
+	args = append(args, "-O", f.qemuFormat, "-p", imagePath, outPath)
+	if err := im.runner(nil, im.stdout, im.stderr, "qemu-img", args...); err != nil {
+		return "", err
 	}
-	qcow2Path, _ := im.Qcow2ImagePath(imagePath)
-	return im.runner(nil, os.Stdout, os.Stderr,
-		"qemu-img", "convert", "-c", "-O", "qcow2", "-p", imagePath, qcow2Path)
+	return outPath, nil
 }
 
 // ShowFinalFilesystemInfo displays information about the final filesystem layout.
@@ -1465,38 +3509,174 @@ func (im *Image) ShowFinalFilesystemInfo(blockDevice, mountBootfs, mountEfifs st
 		return errors.New("missing mountEfifs parameter")
 	}
 
-	fmt.Fprintln(os.Stdout, "Final boot partition directory tree:")
-	im.runner(nil, os.Stdout, os.Stderr, "find", mountBootfs)
+	fmt.Fprintln(im.stdout, "Final boot partition directory tree:")
+	im.runner(nil, im.stdout, im.stderr, "find", mountBootfs)
 
-	fmt.Fprintln(os.Stdout, "Final EFI partition directory tree:")
-	im.runner(nil, os.Stdout, os.Stderr, "find", mountEfifs)
+	fmt.Fprintln(im.stdout, "Final EFI partition directory tree:")
+	im.runner(nil, im.stdout, im.stderr, "find", mountEfifs)
 
-	fmt.Fprintf(os.Stdout, "Block devices on %s:\n", blockDevice)
-	im.runner(nil, os.Stdout, os.Stderr, "blkid", blockDevice)
+	fmt.Fprintf(im.stdout, "Block devices on %s:\n", blockDevice)
+	im.runner(nil, im.stdout, im.stderr, "blkid", blockDevice)
 
-	fmt.Fprintln(os.Stdout, "Filesystem setup complete!")
+	swapSize, err := im.SwapPartitionSize()
+	if err != nil {
+		return err
+	}
+	if swapSize != "" {
+		fmt.Fprintf(im.stdout, "Swap partition: p3 (%s)\n", swapSize)
+	} else {
+		fmt.Fprintln(im.stdout, "Swap partition: none")
+	}
+
+	fmt.Fprintln(im.stdout, "Filesystem setup complete!")
 	return nil
 }
 
 // ShowTestInfo prints information about generated artifacts and how to test them.
 func (im *Image) ShowTestInfo(artifacts []string) {
 	if len(artifacts) == 0 {
-		fmt.Fprintln(os.Stderr, "show_test_info: missing artifacts array parameter")
+		fmt.Fprintln(im.stderr, "show_test_info: missing artifacts array parameter")
 		return
 	}
 
-	fmt.Fprintln(os.Stdout, "Generated artifacts:")
+	fmt.Fprintln(im.stdout, "Generated artifacts:")
 	for _, a := range artifacts {
-		fmt.Fprintf(os.Stdout, ">> %s\n", a)
+		fmt.Fprintf(im.stdout, ">> %s\n", a)
+	}
+
+	fmt.Fprintln(im.stdout)
+	fmt.Fprintln(im.stdout, "How to test:")
+	fmt.Fprintln(im.stdout, "$ vector dev vm -image IMAGE_PATH -memory 8G -interactive")
+	fmt.Fprintln(im.stdout)
+	fmt.Fprintln(im.stdout, "To move to a USB stick:")
+	fmt.Fprintln(im.stdout, "    dd if=IMAGE_PATH of=/dev/sdX bs=4M conv=sparse,sync status=progress")
+	fmt.Fprintln(im.stdout)
+}
+
+// ChecksumImage computes the SHA-256 digest of the image at imagePath and
+// writes it to <imagePath>.sha256 in sha256sum format ("<hash>  <basename>"),
+// so that it can be checked with "sha256sum -c" from the image directory.
+// The image is streamed rather than read into memory. It returns the hex
+// digest.
+func (im *Image) ChecksumImage(imagePath string) (string, error) {
+	if imagePath == "" {
+		return "", errors.New("missing imagePath parameter")
+	}
+	if !fslib.FileExists(imagePath) {
+		return "", fmt.Errorf("image %s does not exist", imagePath)
+	}
+
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image %s: %w", imagePath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read image %s: %w", imagePath, err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	checksumFile := imagePath + ".sha256"
+	line := fmt.Sprintf("%s  %s\n", digest, filepath.Base(imagePath))
+	fmt.Fprintf(im.stdout, "Writing checksum file %s ...\n", checksumFile)
+	if err := os.WriteFile(checksumFile, []byte(line), 0644); err != nil {
+		return "", fmt.Errorf("failed to write checksum file %s: %w", checksumFile, err)
+	}
+	return digest, nil
+}
+
+// ReleaseManifest describes a built image.
+type ReleaseManifest struct {
+	Ref            string   `json:"ref"`
+	Commit         string   `json:"commit"`
+	ReleaseVersion string   `json:"release_version"`
+	Image          string   `json:"image"`
+	Sha256         string   `json:"sha256"`
+	Packages       []string `json:"packages"`
+}
+
+// NewReleaseManifest returns the ReleaseManifest of the image at imagePath,
+// built from ref, whose deployment rootfs is at rootfs. The image checksum
+// file is (re)written as a side effect, see ChecksumImage.
+func (im *Image) NewReleaseManifest(ref, rootfs, imagePath string) (*ReleaseManifest, error) {
+	if ref == "" {
+		return nil, errors.New("missing ref parameter")
+	}
+	if rootfs == "" {
+		return nil, errors.New("missing rootfs parameter")
+	}
+	if imagePath == "" {
+		return nil, errors.New("missing imagePath parameter")
+	}
+
+	commit, err := im.ostree.LastCommit(ref, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the last commit of %s: %w", ref, err)
+	}
+	releaseVersion, err := im.ReleaseVersion(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	pkgList, err := im.PackageList(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := im.ChecksumImage(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseManifest{
+		Ref:            ref,
+		Commit:         commit,
+		ReleaseVersion: releaseVersion,
+		Image:          filepath.Base(imagePath),
+		Sha256:         digest,
+		Packages:       pkgList,
+	}, nil
+}
+
+// WriteReleaseManifest writes m as JSON to path, creating its parent
+// directory if needed.
+func (im *Image) WriteReleaseManifest(path string, m ReleaseManifest) error {
+	if path == "" {
+		return errors.New("missing path parameter")
+	}
+	if m.Packages == nil {
+		// Serialize as [] rather than null.
+		m.Packages = []string{}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode release manifest: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	fmt.Fprintf(im.stdout, "Writing release manifest %s ...\n", path)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write release manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+// GpgSignImage creates a detached, armored GPG signature of the image at
+// imagePath, written next to it as <imagePath>.asc.
+func (im *Image) GpgSignImage(imagePath string) error {
+	if imagePath == "" {
+		return errors.New("missing imagePath parameter")
+	}
+	if !fslib.FileExists(imagePath) {
+		return fmt.Errorf("image %s does not exist", imagePath)
 	}
 
-	fmt.Fprintln(os.Stdout)
-	fmt.Fprintln(os.Stdout, "How to test:")
-	fmt.Fprintln(os.Stdout, "$ vector dev vm -image IMAGE_PATH -memory 8G -interactive")
-	fmt.Fprintln(os.Stdout)
-	fmt.Fprintln(os.Stdout, "To move to a USB stick:")
-	fmt.Fprintln(os.Stdout, "    dd if=IMAGE_PATH of=/dev/sdX bs=4M conv=sparse,sync status=progress")
-	fmt.Fprintln(os.Stdout)
+	fmt.Fprintf(im.stdout, "Creating GPG signature of %s ...\n", imagePath)
+	if err := im.ostree.GpgSignFile(imagePath); err != nil {
+		return fmt.Errorf("failed to sign image %s: %w", imagePath, err)
+	}
+	return nil
 }
 
 // RemoveImageFile removes an image file and its associated .sha256 and .asc files.
@@ -1505,7 +3685,7 @@ func (im *Image) RemoveImageFile(imagePath string) error {
 		return errors.New("missing imagePath parameter")
 	}
 
-	fmt.Fprintf(os.Stdout, "Removing %s ...\n", imagePath)
+	fmt.Fprintf(im.stdout, "Removing %s ...\n", imagePath)
 	for _, path := range []string{imagePath, imagePath + ".sha256", imagePath + ".asc"} {
 		os.Remove(path) // Ignore errors (file may not exist).
 	}
@@ -1543,6 +3723,74 @@ func (im *Image) ImageLockPath(ref string) (string, error) {
 	return lockFile, nil
 }
 
+// lockPollInterval is how often AcquireImageLock retries a busy lock.
+const lockPollInterval = 100 * time.Millisecond
+
+// ErrImageLockTimeout is returned by AcquireImageLock when the image lock
+// could not be acquired within LockWaitSeconds.
+var ErrImageLockTimeout = errors.New("timed out waiting for image lock")
+
+// AcquireImageLock takes an exclusive flock() on the lock file of ref,
+// waiting up to LockWaitSeconds for other holders to release it. The
+// returned release function unlocks and removes the lock file.
+func (im *Image) AcquireImageLock(ref string) (release func() error, err error) {
+	lockPath, err := im.ImageLockPath(ref)
+	if err != nil {
+		return nil, err
+	}
+	waitStr, err := im.LockWaitSeconds()
+	if err != nil {
+		return nil, err
+	}
+	waitSecs, err := strconv.Atoi(waitStr)
+	if err != nil || waitSecs < 0 {
+		return nil, fmt.Errorf("invalid Imager.LockWaitSeconds %q", waitStr)
+	}
+	deadline := time.Now().Add(time.Duration(waitSecs) * time.Second)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file %s: %w", lockPath, err)
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			// The previous holder may have removed the file between our open
+			// and flock: only keep the lock if it is still the one on disk.
+			if sameFile(f, lockPath) {
+				return func() error {
+					removeErr := os.Remove(lockPath)
+					unlockErr := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+					return errors.Join(removeErr, unlockErr, f.Close())
+				}, nil
+			}
+			f.Close()
+			continue
+		}
+		f.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w %s after %ds", ErrImageLockTimeout, lockPath, waitSecs)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// sameFile reports whether the open file f is the file currently at path.
+func sameFile(f *os.File, path string) bool {
+	fInfo, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fInfo, pInfo)
+}
+
 // --- Utility functions ---
 
 // copyFile copies src to dst, preserving content. It creates dst if it doesn't exist.
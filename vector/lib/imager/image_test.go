@@ -1,9 +1,24 @@
 package imager
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -26,6 +41,7 @@ func baseImageConfig() *config.MockConfig {
 			"Imager.EspPartitionType":               {"C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
 			"Imager.BootPartitionType":              {"BC13C2FF-59E6-4262-A352-B275FD6F7172"},
 			"Imager.RootPartitionType":              {"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"},
+			"Imager.RootFilesystem":                 {"btrfs"},
 			"matrixOS.OsName":                       {"matrixos"},
 			"Imager.BootRoot":                       {"/boot"},
 			"Imager.EfiRoot":                        {"/efi"},
@@ -91,6 +107,144 @@ func TestNewImage(t *testing.T) {
 	})
 }
 
+func TestSetOutput(t *testing.T) {
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	im.runner = func(_ io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+		fmt.Fprintf(stdout, "%s: trimmed\n", args[len(args)-1])
+		fmt.Fprintf(stderr, "%s: warning\n", args[len(args)-1])
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	im.SetOutput(&stdout, &stderr)
+
+	if err := im.FinalizeFilesystems("/mnt/rootfs", "/mnt/boot", "/mnt/efi"); err != nil {
+		t.Fatalf("FinalizeFilesystems() error: %v", err)
+	}
+	for _, want := range []string{"Executing fstrim on /mnt/rootfs", "/mnt/rootfs: trimmed", "/mnt/efi: trimmed"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("stdout %q does not contain %q", stdout.String(), want)
+		}
+	}
+	if want := "/mnt/boot: warning"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr %q does not contain %q", stderr.String(), want)
+	}
+	if strings.Contains(stderr.String(), "trimmed") {
+		t.Errorf("command stdout leaked into stderr: %q", stderr.String())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := baseImageConfig()
+	cfg.Items["Imager.PartprobeRetries"] = []string{"1"}
+	runner := runner.NewMockRunner()
+	im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+	im.SetOutput(io.Discard, io.Discard)
+	im.SetDryRun(true)
+
+	var skipped []string
+	im.dryRunner = func(_ io.Reader, _, _ io.Writer, name string, args ...string) error {
+		skipped = append(skipped, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+
+	tmpDir := t.TempDir()
+	mountEfifs := filepath.Join(tmpDir, "efi")
+	mountBootfs := filepath.Join(tmpDir, "boot")
+	steps := []struct {
+		name string
+		fn   func() error
+		want []string
+	}{
+		{"ClearPartitionTable", func() error { return im.ClearPartitionTable("/dev/loop0") }, []string{
+			"sgdisk -g -o /dev/loop0",
+			"sgdisk -Z /dev/loop0",
+		}},
+		{"FormatEfifs", func() error { return im.FormatEfifs("/dev/loop0p1") }, []string{
+			"mkfs.vfat -F 32 -n ME" + im.DatedFsLabel() + " /dev/loop0p1",
+		}},
+		{"FormatSwap", func() error { return im.FormatSwap("/dev/loop0p3") }, []string{
+			"mkswap -L MS" + im.DatedFsLabel() + " /dev/loop0p3",
+		}},
+		{"MountEfifs", func() error { return im.MountEfifs("/dev/loop0p1", mountEfifs) }, []string{
+			"mkdir -p " + mountEfifs,
+			"mount -t vfat /dev/loop0p1 " + mountEfifs,
+		}},
+		{"MountBootfs", func() error { return im.MountBootfs("/dev/loop0p2", mountBootfs) }, []string{
+			"mkdir -p " + mountBootfs,
+			"mount /dev/loop0p2 " + mountBootfs,
+		}},
+	}
+	for _, step := range steps {
+		skipped = nil
+		if err := step.fn(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if !slices.Equal(skipped, step.want) {
+			t.Errorf("%s: skipped commands = %q, want %q", step.name, skipped, step.want)
+		}
+	}
+
+	// The remaining steps only check the command that matters most.
+	prefixSteps := []struct {
+		name string
+		fn   func() error
+		want string
+	}{
+		{"PartitionDevices", func() error { return im.PartitionDevices("200M", "1G", "32G", "/dev/loop0") }, "partprobe -s /dev/loop0"},
+		{"FormatBootfs", func() error { return im.FormatBootfs("/dev/loop0p2") }, "mkfs.btrfs -f"},
+		{"FormatRootfs", func() error { return im.FormatRootfs("/dev/loop0p3") }, "mkfs.btrfs -f"},
+		{"MountRootfs", func() error { return im.MountRootfs("/dev/loop0p3", "/tmp/rootfs") }, "mount -o"},
+	}
+	for _, step := range prefixSteps {
+		skipped = nil
+		if err := step.fn(); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.name, err)
+		}
+		if !slices.ContainsFunc(skipped, func(cmd string) bool { return strings.HasPrefix(cmd, step.want) }) {
+			t.Errorf("%s: skipped commands %q do not include %q", step.name, skipped, step.want)
+		}
+	}
+
+	// Only the read-only mount checks of the Format* methods were run.
+	for _, c := range runner.Calls {
+		if c.Name != "lsblk" {
+			t.Errorf("unexpected command in dry-run mode: %s %v", c.Name, c.Args)
+		}
+	}
+	for _, dir := range []string{mountEfifs, mountBootfs} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("mount point %s should not be created in dry-run mode", dir)
+		}
+	}
+
+	im.SetDryRun(false)
+	skipped = nil
+	if err := im.MountEfifs("/dev/loop0p1", mountEfifs); err != nil {
+		t.Fatalf("MountEfifs() error: %v", err)
+	}
+	if last := runner.Calls[len(runner.Calls)-1]; last.Name != "mount" {
+		t.Errorf("expected mount to run once dry-run is disabled, got %s", last.Name)
+	}
+	if skipped != nil {
+		t.Errorf("no command should be skipped once dry-run is disabled, got %q", skipped)
+	}
+}
+
+func TestPrintDryRun(t *testing.T) {
+	cfg := baseImageConfig()
+	im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner.NewMockRunner())
+	var stdout bytes.Buffer
+	im.SetOutput(&stdout, io.Discard)
+	im.SetDryRun(true)
+	if err := im.ClearPartitionTable("/dev/loop0"); err != nil {
+		t.Fatalf("ClearPartitionTable() error: %v", err)
+	}
+	want := "[dry-run] sgdisk -g -o /dev/loop0\n[dry-run] sgdisk -Z /dev/loop0\n"
+	if !strings.HasSuffix(stdout.String(), want) {
+		t.Errorf("output = %q, want suffix %q", stdout.String(), want)
+	}
+}
+
 // --- Config Accessor Tests ---
 
 func TestConfigAccessors(t *testing.T) {
@@ -111,6 +265,7 @@ func TestConfigAccessors(t *testing.T) {
 		{"EspPartitionType", im.EspPartitionType, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
 		{"BootPartitionType", im.BootPartitionType, "BC13C2FF-59E6-4262-A352-B275FD6F7172"},
 		{"RootPartitionType", im.RootPartitionType, "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"},
+		{"RootFilesystem", im.RootFilesystem, "btrfs"},
 		{"OsName", im.OsName, "matrixos"},
 		{"BootRoot", im.BootRoot, "/boot"},
 		{"EfiRoot", im.EfiRoot, "/efi"},
@@ -139,6 +294,47 @@ func TestConfigAccessors(t *testing.T) {
 	}
 }
 
+func TestValidatePartitionTypeGUIDs(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.ValidatePartitionTypeGUIDs(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.EspPartitionType"] = []string{"C12A7328-F81F-11D2-BA4B-00A0C93EC93"}
+		cfg.Items["Imager.RootPartitionType"] = []string{"4F68BCE3_E8CD_4DB1_96E7_FBCAF984B709"}
+		im := newTestImage(cfg, &cds.MockOstree{})
+
+		err := im.ValidatePartitionTypeGUIDs()
+		if err == nil {
+			t.Fatal("expected error for malformed GUIDs")
+		}
+		msg := err.Error()
+		for _, key := range []string{"Imager.EspPartitionType", "Imager.RootPartitionType"} {
+			if !strings.Contains(msg, key) {
+				t.Errorf("error should name %s, got: %v", key, msg)
+			}
+		}
+		if strings.Contains(msg, "Imager.BootPartitionType") {
+			t.Errorf("error should not name the valid Imager.BootPartitionType, got: %v", msg)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		cfg := baseImageConfig()
+		delete(cfg.Items, "Imager.BootPartitionType")
+		im := newTestImage(cfg, &cds.MockOstree{})
+
+		err := im.ValidatePartitionTypeGUIDs()
+		if err == nil || !strings.Contains(err.Error(), "Imager.BootPartitionType") {
+			t.Errorf("expected error naming Imager.BootPartitionType, got: %v", err)
+		}
+	})
+}
+
 func TestConfigAccessorsEmptyValue(t *testing.T) {
 	accessors := []struct {
 		key  string
@@ -306,6 +502,29 @@ func TestImagePath(t *testing.T) {
 	})
 }
 
+func TestImagePathWithArch(t *testing.T) {
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	for _, ref := range []string{"matrixos/amd64/gnome", "origin:matrixos/amd64/gnome"} {
+		result, err := im.ImagePathWithArch(ref, "arm64")
+		if err != nil {
+			t.Fatalf("ImagePathWithArch(%q) error: %v", ref, err)
+		}
+		expected := "/tmp/images/matrixos_amd64_gnome-arm64.img"
+		if result != expected {
+			t.Errorf("ImagePathWithArch(%q) = %q, want %q", ref, result, expected)
+		}
+	}
+
+	if _, err := im.ImagePathWithArch("", "arm64"); err == nil {
+		t.Error("should error for empty ref")
+	}
+	for _, arch := range []string{"", "arm/64"} {
+		if _, err := im.ImagePathWithArch("matrixos/amd64/gnome", arch); err == nil {
+			t.Errorf("should error for arch %q", arch)
+		}
+	}
+}
+
 // --- ImagePathWithReleaseVersion Tests ---
 
 func TestImagePathWithReleaseVersion(t *testing.T) {
@@ -338,6 +557,55 @@ func TestImagePathWithReleaseVersion(t *testing.T) {
 	})
 }
 
+func TestUniqueImagePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{"Free", nil, "matrixos_amd64_gnome-20260221.img"},
+		{"Taken", []string{"matrixos_amd64_gnome-20260221.img"}, "matrixos_amd64_gnome-20260221-2.img"},
+		{"SeveralTaken", []string{
+			"matrixos_amd64_gnome-20260221.img",
+			"matrixos_amd64_gnome-20260221-2.img",
+			"matrixos_amd64_gnome-20260221-3.img",
+		}, "matrixos_amd64_gnome-20260221-4.img"},
+		{"GapReused", []string{
+			"matrixos_amd64_gnome-20260221.img",
+			"matrixos_amd64_gnome-20260221-3.img",
+		}, "matrixos_amd64_gnome-20260221-2.img"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagesDir := t.TempDir()
+			for _, f := range tt.existing {
+				os.WriteFile(filepath.Join(imagesDir, f), nil, 0644)
+			}
+			cfg := baseImageConfig()
+			cfg.Items["Imager.ImagesDir"] = []string{imagesDir}
+			im := newTestImage(cfg, &cds.MockOstree{})
+
+			got, err := im.UniqueImagePath("origin:matrixos/amd64/gnome", "20260221")
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if want := filepath.Join(imagesDir, tt.want); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.UniqueImagePath("", "20260221"); err == nil {
+			t.Error("should error for empty ref")
+		}
+		if _, err := im.UniqueImagePath("ref", ""); err == nil {
+			t.Error("should error for empty releaseVersion")
+		}
+	})
+}
+
 // --- ImagePathWithCompressorExtension Tests ---
 
 func TestImagePathWithCompressorExtension(t *testing.T) {
@@ -363,6 +631,47 @@ func TestImagePathWithCompressorExtension(t *testing.T) {
 		}
 	})
 
+	t.Run("Mapped", func(t *testing.T) {
+		for compressor, want := range map[string]string{
+			"pigz -9":   "/tmp/test.img.gz",
+			"pbzip2":    "/tmp/test.img.bz2",
+			"pzstd -19": "/tmp/test.img.zst",
+			"lz4 -9":    "/tmp/test.img.lz4",
+		} {
+			result, err := im.ImagePathWithCompressorExtension("/tmp/test.img", compressor)
+			if err != nil {
+				t.Fatalf("%s: error: %v", compressor, err)
+			}
+			if result != want {
+				t.Errorf("%s: got %q, want %q", compressor, result, want)
+			}
+		}
+	})
+
+	t.Run("ConfiguredExtensions", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.CompressorExtensions"] = []string{"zstd=zst pigz=.gzip"}
+		im := newTestImage(cfg, &cds.MockOstree{})
+		for compressor, want := range map[string]string{
+			"zstd -3": "/tmp/test.img.zst",
+			"pigz":    "/tmp/test.img.gzip",
+			"pbzip2":  "/tmp/test.img.bz2",
+		} {
+			result, err := im.ImagePathWithCompressorExtension("/tmp/test.img", compressor)
+			if err != nil {
+				t.Fatalf("%s: error: %v", compressor, err)
+			}
+			if result != want {
+				t.Errorf("%s: got %q, want %q", compressor, result, want)
+			}
+		}
+
+		cfg.Items["Imager.CompressorExtensions"] = []string{"zstd"}
+		if _, err := im.ImagePathWithCompressorExtension("/tmp/test.img", "zstd"); err == nil {
+			t.Error("should error for a malformed Imager.CompressorExtensions")
+		}
+	})
+
 	t.Run("EmptyPath", func(t *testing.T) {
 		_, err := im.ImagePathWithCompressorExtension("", "xz")
 		if err == nil {
@@ -427,6 +736,232 @@ func TestCreateImage(t *testing.T) {
 			t.Error("should propagate truncate error")
 		}
 	})
+
+	t.Run("Allocation", func(t *testing.T) {
+		tests := []struct {
+			allocation string
+			want       string
+		}{
+			{"", "truncate"},
+			{"sparse", "truncate"},
+			{"full", "fallocate"},
+		}
+		for _, tt := range tests {
+			imagePath := filepath.Join(t.TempDir(), "test.img")
+			cfg := baseImageConfig()
+			cfg.Items["Imager.ImageAllocation"] = []string{tt.allocation}
+			runner := runner.NewMockRunner()
+			im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+			if err := im.CreateImage(imagePath, "32G"); err != nil {
+				t.Fatalf("%q: CreateImage() error: %v", tt.allocation, err)
+			}
+			if len(runner.Calls) != 1 || runner.Calls[0].Name != tt.want {
+				t.Errorf("%q: expected a single %s call, got %v", tt.allocation, tt.want, runner.Calls)
+			}
+		}
+	})
+
+	t.Run("FallocateUnsupported", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "test.img")
+		cfg := baseImageConfig()
+		cfg.Items["Imager.ImageAllocation"] = []string{"full"}
+		im := newTestImage(cfg, &cds.MockOstree{})
+		var calls []string
+		im.runner = func(_ io.Reader, _, stderr io.Writer, name string, args ...string) error {
+			calls = append(calls, name)
+			if name == "fallocate" {
+				fmt.Fprintln(stderr, "fallocate: fallocate failed: Operation not supported")
+				return errors.New("exit status 1")
+			}
+			return nil
+		}
+
+		if err := im.CreateImage(imagePath, "32G"); err != nil {
+			t.Fatalf("CreateImage() error: %v", err)
+		}
+		if !slices.Equal(calls, []string{"fallocate", "dd"}) {
+			t.Errorf("expected fallocate then dd, got %v", calls)
+		}
+	})
+
+	t.Run("InvalidAllocation", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.ImageAllocation"] = []string{"thick"}
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+		if err := im.CreateImage(filepath.Join(t.TempDir(), "test.img"), "32G"); err == nil {
+			t.Error("should error for an invalid Imager.ImageAllocation")
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("expected no runner calls, got %v", runner.Calls)
+		}
+	})
+}
+
+func TestParseImageSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+	}{
+		{"4096", 4096},
+		{"1K", 1024},
+		{"32G", 32 << 30},
+		{"512MiB", 512 << 20},
+		{"2MB", 2000000},
+	}
+	for _, tt := range tests {
+		got, err := parseImageSize(tt.size)
+		if err != nil || got != tt.want {
+			t.Errorf("parseImageSize(%q) = %d, %v, want %d", tt.size, got, err, tt.want)
+		}
+	}
+	for _, size := range []string{"", "+1G", "1.5G", "1X", "G", "99999E"} {
+		if _, err := parseImageSize(size); err == nil {
+			t.Errorf("parseImageSize(%q) should fail", size)
+		}
+	}
+}
+
+func TestGrowImage(t *testing.T) {
+	newImageFile := func(t *testing.T, size int64) string {
+		imagePath := filepath.Join(t.TempDir(), "test.img")
+		if err := os.WriteFile(imagePath, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(imagePath, size); err != nil {
+			t.Fatal(err)
+		}
+		return imagePath
+	}
+
+	t.Run("Grow", func(t *testing.T) {
+		imagePath := newImageFile(t, 1<<20)
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		if err := im.GrowImage(imagePath, "2M"); err != nil {
+			t.Fatalf("GrowImage() error: %v", err)
+		}
+		if len(runner.Calls) != 1 || runner.Calls[0].Name != "truncate" ||
+			!slices.Equal(runner.Calls[0].Args, []string{"-s", "2M", imagePath}) {
+			t.Errorf("expected truncate -s 2M %s, got %v", imagePath, runner.Calls)
+		}
+	})
+
+	t.Run("SameSize", func(t *testing.T) {
+		imagePath := newImageFile(t, 1<<20)
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		if err := im.GrowImage(imagePath, "1M"); err != nil {
+			t.Fatalf("GrowImage() error: %v", err)
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("expected no runner calls, got %v", runner.Calls)
+		}
+	})
+
+	t.Run("Shrink", func(t *testing.T) {
+		imagePath := newImageFile(t, 2<<20)
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		err := im.GrowImage(imagePath, "1M")
+		if err == nil || !strings.Contains(err.Error(), "refusing to shrink") {
+			t.Errorf("expected a shrink error, got %v", err)
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("expected no runner calls, got %v", runner.Calls)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.GrowImage("", "2M"); err == nil {
+			t.Error("should error for empty imagePath")
+		}
+		if err := im.GrowImage(newImageFile(t, 0), ""); err == nil {
+			t.Error("should error for empty newSize")
+		}
+		if err := im.GrowImage(newImageFile(t, 0), "+1M"); err == nil {
+			t.Error("should error for a relative newSize")
+		}
+		if err := im.GrowImage(filepath.Join(t.TempDir(), "missing.img"), "2M"); err == nil {
+			t.Error("should error for a missing image")
+		}
+	})
+}
+
+// --- CreateImageIfMissing Tests ---
+
+func TestImageExists(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "test.img")
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	if im.ImageExists(imagePath) {
+		t.Error("ImageExists should be false before the image is created")
+	}
+	os.WriteFile(imagePath, []byte("data"), 0644)
+	if !im.ImageExists(imagePath) {
+		t.Error("ImageExists should be true for an existing image")
+	}
+	if im.ImageExists("") {
+		t.Error("ImageExists should be false for an empty path")
+	}
+}
+
+func TestCreateImageIfMissing(t *testing.T) {
+	t.Run("Missing", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "subdir", "test.img")
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		created, err := im.CreateImageIfMissing(imagePath, "32G")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if !created {
+			t.Error("expected the image to be created")
+		}
+		if len(runner.Calls) != 1 || runner.Calls[0].Name != "truncate" {
+			t.Errorf("expected a truncate call, got %v", runner.Calls)
+		}
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		imagePath := filepath.Join(t.TempDir(), "test.img")
+		os.WriteFile(imagePath, []byte("data"), 0644)
+		os.WriteFile(imagePath+".sha256", []byte("hash"), 0644)
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		created, err := im.CreateImageIfMissing(imagePath, "32G")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if created {
+			t.Error("expected the existing image to be kept")
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("expected no runner calls, got %v", runner.Calls)
+		}
+		for _, p := range []string{imagePath, imagePath + ".sha256"} {
+			if _, err := os.Stat(p); err != nil {
+				t.Errorf("%s should not have been removed: %v", p, err)
+			}
+		}
+	})
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.CreateImageIfMissing("", "32G"); err == nil {
+			t.Error("should error for empty imagePath")
+		}
+		if _, err := im.CreateImageIfMissing("/tmp/test.img", ""); err == nil {
+			t.Error("should error for empty imageSize")
+		}
+	})
 }
 
 // --- CompressImage Tests ---
@@ -435,7 +970,7 @@ func TestCompressImage(t *testing.T) {
 	t.Run("EmptyPath", func(t *testing.T) {
 		runner := runner.NewMockRunner()
 		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
-		err := im.CompressImage("", "xz -f")
+		err := im.CompressImage("", "xz -f", false)
 		if err == nil {
 			t.Error("should error for empty imagePath")
 		}
@@ -444,7 +979,7 @@ func TestCompressImage(t *testing.T) {
 	t.Run("EmptyCompressor", func(t *testing.T) {
 		runner := runner.NewMockRunner()
 		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
-		err := im.CompressImage("/tmp/test.img", "")
+		err := im.CompressImage("/tmp/test.img", "", false)
 		if err == nil {
 			t.Error("should error for empty compressor")
 		}
@@ -459,7 +994,7 @@ func TestCompressImage(t *testing.T) {
 		runner := runner.NewMockRunner()
 		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
 
-		err := im.CompressImage(imgPath, "xz -f -0 -T0")
+		err := im.CompressImage(imgPath, "xz -f -0 -T0", false)
 		if err != nil {
 			t.Fatalf("CompressImage() error: %v", err)
 		}
@@ -477,34 +1012,164 @@ func TestCompressImage(t *testing.T) {
 		if args[len(args)-1] != imgPath {
 			t.Errorf("last arg should be image path, got %q", args[len(args)-1])
 		}
+		if _, err := os.Stat(imgPath + ".xz.sha256"); !os.IsNotExist(err) {
+			t.Error("checksum file should not be created when not requested")
+		}
 	})
-}
 
-// --- ClearPartitionTable Tests ---
+	t.Run("WithChecksum", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		os.WriteFile(imgPath+".xz", []byte("compressed"), 0644)
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner.NewMockRunner())
 
-func TestClearPartitionTable(t *testing.T) {
-	t.Run("Success", func(t *testing.T) {
-		runner := runner.NewMockRunner()
-		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+		if err := im.CompressImage(imgPath, "xz -f -0 -T0", true); err != nil {
+			t.Fatalf("CompressImage() error: %v", err)
+		}
+		data, err := os.ReadFile(imgPath + ".xz.sha256")
+		if err != nil {
+			t.Fatalf("checksum file not created: %v", err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[1] != "test.img.xz" {
+			t.Errorf("checksum file should reference test.img.xz, got %q", data)
+		}
+		if _, err := os.Stat(imgPath + ".sha256"); !os.IsNotExist(err) {
+			t.Error("the uncompressed image should not be checksummed")
+		}
+	})
+}
 
-		err := im.ClearPartitionTable("/dev/sda")
+func TestCompressImageWithProgress(t *testing.T) {
+	// progressRunner returns a runner that writes stderrData to stderr and
+	// creates the compressed image, recording the command line in cmdline.
+	progressRunner := func(stderrData, outPath string, cmdline *[]string) runner.Func {
+		return func(_ io.Reader, _, stderr io.Writer, name string, args ...string) error {
+			*cmdline = append([]string{name}, args...)
+			io.WriteString(stderr, stderrData)
+			return os.WriteFile(outPath, []byte("compressed"), 0644)
+		}
+	}
+
+	t.Run("Xz", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		var cmdline []string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = progressRunner(
+			"test.img (1/1)\n"+
+				"  12.5 %       1,024 KiB / 8,192 KiB = 0.125   1.0 MiB/s   0:01   0:07\r"+
+				"  50 %         4,096 KiB / 8,192 KiB = 0.500   1.0 MiB/s   0:04   0:04\r"+
+				"  100 %        8,192 KiB / 8,192 KiB = 0.500   1.0 MiB/s   0:08",
+			imgPath+".xz", &cmdline)
+
+		var got []float64
+		err := im.CompressImageWithProgress(imgPath, "xz -f -0 -T0", func(p float64) {
+			got = append(got, p)
+		})
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		if len(runner.Calls) != 2 {
-			t.Fatalf("expected 2 sgdisk calls, got %d", len(runner.Calls))
-		}
-		if runner.Calls[0].Name != "sgdisk" {
-			t.Errorf("call 0: expected sgdisk, got %q", runner.Calls[0].Name)
+		want := []float64{12.5, 50, 100}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("progress = %v, want %v", got, want)
 		}
-		if runner.Calls[1].Name != "sgdisk" {
-			t.Errorf("call 1: expected sgdisk, got %q", runner.Calls[1].Name)
+		wantCmd := "xz -v -f -0 -T0 " + imgPath
+		if strings.Join(cmdline, " ") != wantCmd {
+			t.Errorf("command = %q, want %q", strings.Join(cmdline, " "), wantCmd)
 		}
 	})
 
-	t.Run("EmptyDevice", func(t *testing.T) {
+	t.Run("Zstd", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		var cmdline []string
 		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
-		err := im.ClearPartitionTable("")
+		im.runner = progressRunner(
+			"\rRead : 25 / 100 MB ==> 40%\rRead : 100 / 100 MB ==> 38%\n",
+			imgPath+".zstd", &cmdline)
+
+		var got []float64
+		err := im.CompressImageWithProgress(imgPath, "zstd --progress -19", func(p float64) {
+			got = append(got, p)
+		})
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint([]float64{25, 100}) {
+			t.Errorf("progress = %v, want [25 100]", got)
+		}
+		// The progress flag is not duplicated.
+		wantCmd := "zstd --progress -19 " + imgPath
+		if strings.Join(cmdline, " ") != wantCmd {
+			t.Errorf("command = %q, want %q", strings.Join(cmdline, " "), wantCmd)
+		}
+	})
+
+	t.Run("NoProgressSupport", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		var cmdline []string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = progressRunner("  50 %\n", imgPath+".gzip", &cmdline)
+
+		called := false
+		err := im.CompressImageWithProgress(imgPath, "gzip -9", func(float64) { called = true })
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if called {
+			t.Error("onProgress should not be called for gzip")
+		}
+		if wantCmd := "gzip -9 " + imgPath; strings.Join(cmdline, " ") != wantCmd {
+			t.Errorf("command = %q, want %q", strings.Join(cmdline, " "), wantCmd)
+		}
+	})
+
+	t.Run("MissingOutput", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+		if err := im.CompressImageWithProgress(imgPath, "xz", func(float64) {}); err == nil {
+			t.Error("should error when the compressed image is not created")
+		}
+	})
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.CompressImageWithProgress("", "xz", func(float64) {}); err == nil {
+			t.Error("should error for empty imagePath")
+		}
+		if err := im.CompressImageWithProgress("/tmp/test.img", "", func(float64) {}); err == nil {
+			t.Error("should error for empty compressor")
+		}
+		if err := im.CompressImageWithProgress("/tmp/test.img", "xz", nil); err == nil {
+			t.Error("should error for nil onProgress")
+		}
+	})
+}
+
+// --- ClearPartitionTable Tests ---
+
+func TestClearPartitionTable(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		err := im.ClearPartitionTable("/dev/sda")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if len(runner.Calls) != 2 {
+			t.Fatalf("expected 2 sgdisk calls, got %d", len(runner.Calls))
+		}
+		if runner.Calls[0].Name != "sgdisk" {
+			t.Errorf("call 0: expected sgdisk, got %q", runner.Calls[0].Name)
+		}
+		if runner.Calls[1].Name != "sgdisk" {
+			t.Errorf("call 1: expected sgdisk, got %q", runner.Calls[1].Name)
+		}
+	})
+
+	t.Run("EmptyDevice", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		err := im.ClearPartitionTable("")
 		if err == nil {
 			t.Error("should error for empty devicePath")
 		}
@@ -532,6 +1197,221 @@ func TestDatedFsLabel(t *testing.T) {
 	}
 }
 
+// --- CurrentFsLabels Tests ---
+
+func TestVerifyPartitionTypes(t *testing.T) {
+	newVerifyImage := func(lsblkOut string, swapSize string) *Image {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.SwapPartitionSize"] = []string{swapSize}
+		im := newTestImage(cfg, &cds.MockOstree{})
+		im.runner = func(_ io.Reader, stdout, _ io.Writer, _ string, _ ...string) error {
+			fmt.Fprint(stdout, lsblkOut)
+			return nil
+		}
+		return im
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		im := newVerifyImage(`/dev/loop0    1G
+/dev/loop0p1 1 EFI c12a7328-f81f-11d2-ba4b-00a0c93ec93b 200M
+/dev/loop0p2 2 BOOT bc13c2ff-59e6-4262-a352-b275fd6f7172 1G
+/dev/loop0p3 3 ROOT 4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709 30.8G
+`, "")
+		if err := im.VerifyPartitionTypes("/dev/loop0"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SwapLayout", func(t *testing.T) {
+		const swapLayout = `/dev/loop0    1G
+/dev/loop0p1 1 EFI c12a7328-f81f-11d2-ba4b-00a0c93ec93b 200M
+/dev/loop0p2 2 BOOT bc13c2ff-59e6-4262-a352-b275fd6f7172 1G
+/dev/loop0p3 3  0657fd6d-a4ab-43c4-84e5-0933c84b4f4f 4G
+/dev/loop0p4 4 ROOT 4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709 26.8G
+`
+		im := newVerifyImage(swapLayout, "4G")
+		if err := im.VerifyPartitionTypes("/dev/loop0"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		// Without swap configured, p3 must be the root partition.
+		im = newVerifyImage(swapLayout, "")
+		err := im.VerifyPartitionTypes("/dev/loop0")
+		if err == nil || !strings.Contains(err.Error(), "partition 3 has type 0657FD6D") {
+			t.Errorf("expected a p3 root mismatch, got %v", err)
+		}
+
+		// With swap configured, p3 must be swap and p4 root.
+		im = newVerifyImage(`/dev/loop0    1G
+/dev/loop0p1 1 EFI c12a7328-f81f-11d2-ba4b-00a0c93ec93b 200M
+/dev/loop0p2 2 BOOT bc13c2ff-59e6-4262-a352-b275fd6f7172 1G
+/dev/loop0p3 3 ROOT 4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709 30.8G
+`, "4G")
+		err = im.VerifyPartitionTypes("/dev/loop0")
+		if err == nil {
+			t.Fatal("expected a swap layout mismatch")
+		}
+		for _, want := range []string{"partition 3 has type 4F68BCE3", "swap partition type", "partition 4 is missing"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q does not contain %q", err, want)
+			}
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		im := newVerifyImage(`/dev/loop0    1G
+/dev/loop0p1 1 EFI c12a7328-f81f-11d2-ba4b-00a0c93ec93b 200M
+/dev/loop0p2 2 BOOT 0fc63daf-8483-4772-8e79-3d69d8477de4 1G
+`, "")
+		err := im.VerifyPartitionTypes("/dev/loop0")
+		if err == nil {
+			t.Fatal("expected a mismatch error")
+		}
+		for _, want := range []string{"partition 2 has type 0FC63DAF-8483-4772-8E79-3D69D8477DE4", "partition 3 is missing"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q does not contain %q", err, want)
+			}
+		}
+		if strings.Contains(err.Error(), "partition 1") {
+			t.Errorf("partition 1 should match, got %q", err)
+		}
+	})
+
+	t.Run("EmptyDevice", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.VerifyPartitionTypes(""); err == nil {
+			t.Error("should error for empty blockDevice")
+		}
+	})
+}
+
+func TestPartitionLayout(t *testing.T) {
+	const lsblkOut = `/dev/loop0    1G
+/dev/loop0p1 1 ME20260221 c12a7328-f81f-11d2-ba4b-00a0c93ec93b 200M
+/dev/loop0p2 2 MB\x20boot bc13c2ff-59e6-4262-a352-b275fd6f7172 1G
+/dev/loop0p3 3  4f68bce3-e8cd-4db1-96e7-fbcaf984b709 30.8G
+`
+	newLayoutImage := func(calls *[]string) *Image {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+			*calls = append(*calls, strings.Join(append([]string{name}, args...), " "))
+			fmt.Fprint(stdout, lsblkOut)
+			return nil
+		}
+		return im
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		var calls []string
+		im := newLayoutImage(&calls)
+		parts, err := im.PartitionLayout("/dev/loop0")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		want := []Partition{
+			{"/dev/loop0p1", 1, "ME20260221", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", "200M"},
+			{"/dev/loop0p2", 2, "MB boot", "BC13C2FF-59E6-4262-A352-B275FD6F7172", "1G"},
+			{"/dev/loop0p3", 3, "", "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", "30.8G"},
+		}
+		if !slices.Equal(parts, want) {
+			t.Errorf("layout = %+v\nwant %+v", parts, want)
+		}
+		if want := []string{"lsblk -nr -o PATH,PARTN,LABEL,PARTTYPE,SIZE /dev/loop0"}; !slices.Equal(calls, want) {
+			t.Errorf("commands = %v, want %v", calls, want)
+		}
+	})
+
+	t.Run("HelpersReuseLayout", func(t *testing.T) {
+		var calls []string
+		im := newLayoutImage(&calls)
+		if got, err := im.BlockDeviceNthPartitionPath("/dev/loop0", 3); err != nil || got != "/dev/loop0p3" {
+			t.Errorf("BlockDeviceNthPartitionPath = %q, %v", got, err)
+		}
+		if _, err := im.BlockDeviceNthPartitionPath("/dev/loop0", 4); err == nil {
+			t.Error("should error for a missing partition")
+		}
+		if got, err := im.PartitionNumber("/dev/loop0p2"); err != nil || got != "2" {
+			t.Errorf("PartitionNumber = %q, %v", got, err)
+		}
+		if got, err := im.PartitionLabel("/dev/loop0p2"); err != nil || got != "MB boot" {
+			t.Errorf("PartitionLabel = %q, %v", got, err)
+		}
+		if got, err := im.PartitionNumber("/dev/loop0"); err != nil || got != "" {
+			t.Errorf("PartitionNumber of the whole device = %q, %v", got, err)
+		}
+		if len(calls) != 5 {
+			t.Errorf("expected one lsblk call per helper, got %v", calls)
+		}
+	})
+
+	t.Run("MalformedOutput", func(t *testing.T) {
+		if _, err := parseLsblkLayout("/dev/loop0p1 x ME c12a7328 200M\n"); err == nil {
+			t.Error("should error for a non numeric partition number")
+		}
+		if _, err := parseLsblkLayout("/dev/loop0p1 1\n"); err == nil {
+			t.Error("should error for missing columns")
+		}
+	})
+
+	t.Run("EmptyParam", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.PartitionLayout(""); err == nil {
+			t.Error("should error for empty blockDevice")
+		}
+	})
+}
+
+func TestCurrentFsLabels(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		var gotCmd string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+			gotCmd = strings.Join(append([]string{name}, args...), " ")
+			fmt.Fprint(stdout, `/dev/loop0    8G
+/dev/loop0p1 1 ME20260221 C12A7328-F81F-11D2-BA4B-00A0C93EC93B 200M
+/dev/loop0p2 2 MB20260221 BC13C2FF-59E6-4262-A352-B275FD6F7172 1G
+/dev/loop0p3 3  4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709 6.8G
+`)
+			return nil
+		}
+
+		labels, err := im.CurrentFsLabels("/dev/loop0")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if want := "lsblk -nr -o PATH,PARTN,LABEL,PARTTYPE,SIZE /dev/loop0"; gotCmd != want {
+			t.Errorf("command = %q, want %q", gotCmd, want)
+		}
+		want := map[int]string{1: "ME20260221", 2: "MB20260221", 3: ""}
+		if len(labels) != len(want) {
+			t.Fatalf("labels = %v, want %v", labels, want)
+		}
+		for n, label := range want {
+			got, ok := labels[n]
+			if !ok {
+				t.Errorf("missing partition %d", n)
+			} else if got != label {
+				t.Errorf("labels[%d] = %q, want %q", n, got, label)
+			}
+		}
+	})
+
+	t.Run("EmptyParam", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.CurrentFsLabels(""); err == nil {
+			t.Error("should error for empty devicePath")
+		}
+	})
+
+	t.Run("CommandError", func(t *testing.T) {
+		mr := runner.NewMockRunnerFailOnCall(0, errors.New("lsblk failed"))
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, mr)
+		if _, err := im.CurrentFsLabels("/dev/loop0"); err == nil {
+			t.Error("should propagate lsblk error")
+		}
+	})
+}
+
 // --- PartitionDevices Tests ---
 
 func TestPartitionDevices(t *testing.T) {
@@ -559,6 +1439,50 @@ func TestPartitionDevices(t *testing.T) {
 		}
 	})
 
+	t.Run("NoSwap", func(t *testing.T) {
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		if err := im.PartitionDevices("200M", "1G", "32G", "/dev/loop0"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		for _, c := range runner.Calls {
+			if strings.Contains(strings.Join(c.Args, " "), swapPartitionType) {
+				t.Errorf("unexpected swap partition call: %v", c.Args)
+			}
+		}
+		if got := strings.Join(runner.Calls[3].Args, " "); got != "-A 3:set:59 /dev/loop0" {
+			t.Errorf("auto-grow call = %q, want it on partition 3", got)
+		}
+	})
+
+	t.Run("WithSwap", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.SwapPartitionSize"] = []string{"4G"}
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+		if err := im.PartitionDevices("200M", "1G", "32G", "/dev/loop0"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		// 5 sgdisk calls + 1 partprobe = 6.
+		if len(runner.Calls) != 6 {
+			t.Fatalf("expected 6 runner calls, got %d", len(runner.Calls))
+		}
+		want := []string{
+			"-n 1:0:+200M -t 1:C12A7328-F81F-11D2-BA4B-00A0C93EC93B /dev/loop0",
+			"-n 2:0:+1G -t 2:BC13C2FF-59E6-4262-A352-B275FD6F7172 /dev/loop0",
+			"-n 3:0:+4G -t 3:" + swapPartitionType + " /dev/loop0",
+			"-n 4:0:-10M -t 4:4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709 /dev/loop0",
+			"-A 4:set:59 /dev/loop0",
+		}
+		for i, w := range want {
+			if got := strings.Join(runner.Calls[i].Args, " "); got != w {
+				t.Errorf("sgdisk call %d = %q, want %q", i, got, w)
+			}
+		}
+	})
+
 	t.Run("EmptyParams", func(t *testing.T) {
 		runner := runner.NewMockRunner()
 		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
@@ -587,6 +1511,69 @@ func TestPartitionDevices(t *testing.T) {
 		}
 	})
 
+	t.Run("PartprobeRetries", func(t *testing.T) {
+		origDelay := partprobeRetryDelay
+		partprobeRetryDelay = 0
+		defer func() { partprobeRetryDelay = origDelay }()
+
+		partprobeCalls := 0
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = func(_ io.Reader, _, _ io.Writer, name string, args ...string) error {
+			if name != "partprobe" {
+				return nil
+			}
+			partprobeCalls++
+			if partprobeCalls <= 2 {
+				return errors.New("device busy")
+			}
+			return nil
+		}
+
+		if err := im.PartitionDevices("200M", "1G", "32G", "/dev/loop0"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if partprobeCalls != 3 {
+			t.Errorf("partprobe attempted %d times, want 3", partprobeCalls)
+		}
+	})
+
+	t.Run("PartprobeExhausted", func(t *testing.T) {
+		origDelay := partprobeRetryDelay
+		partprobeRetryDelay = 0
+		defer func() { partprobeRetryDelay = origDelay }()
+
+		cfg := baseImageConfig()
+		cfg.Items["Imager.PartprobeRetries"] = []string{"2"}
+		partprobeErr := errors.New("device busy")
+		partprobeCalls := 0
+		im := newTestImage(cfg, &cds.MockOstree{})
+		im.runner = func(_ io.Reader, _, _ io.Writer, name string, args ...string) error {
+			if name != "partprobe" {
+				return nil
+			}
+			partprobeCalls++
+			return partprobeErr
+		}
+
+		err := im.PartitionDevices("200M", "1G", "32G", "/dev/loop0")
+		if !errors.Is(err, partprobeErr) {
+			t.Errorf("expected last partprobe error, got %v", err)
+		}
+		if partprobeCalls != 2 {
+			t.Errorf("partprobe attempted %d times, want 2", partprobeCalls)
+		}
+	})
+
+	t.Run("InvalidPartprobeRetries", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.PartprobeRetries"] = []string{"0"}
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+		if err := im.PartitionDevices("200M", "1G", "32G", "/dev/loop0"); err == nil {
+			t.Error("should error for an invalid retry count")
+		}
+	})
+
 	t.Run("ConfigError", func(t *testing.T) {
 		ec := &config.ErrConfig{Err: errors.New("cfg error")}
 		im, _ := NewImage(ec, &cds.MockOstree{})
@@ -611,11 +1598,12 @@ func TestFormatEfifs(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		if len(runner.Calls) != 1 {
-			t.Fatalf("expected 1 call, got %d", len(runner.Calls))
+		// The first call is the mount check.
+		if len(runner.Calls) != 2 {
+			t.Fatalf("expected 2 calls, got %d", len(runner.Calls))
 		}
-		if runner.Calls[0].Name != "mkfs.vfat" {
-			t.Errorf("expected mkfs.vfat, got %q", runner.Calls[0].Name)
+		if runner.Calls[1].Name != "mkfs.vfat" {
+			t.Errorf("expected mkfs.vfat, got %q", runner.Calls[1].Name)
 		}
 	})
 
@@ -627,6 +1615,76 @@ func TestFormatEfifs(t *testing.T) {
 	})
 }
 
+func TestFormatRefusesMountedDevice(t *testing.T) {
+	formats := []struct {
+		name   string
+		format func(im *Image) error
+	}{
+		{"Efifs", func(im *Image) error { return im.FormatEfifs("/dev/loop0p1") }},
+		{"Bootfs", func(im *Image) error { return im.FormatBootfs("/dev/loop0p2") }},
+		{"Rootfs", func(im *Image) error { return im.FormatRootfs("/dev/loop0p3") }},
+	}
+	for _, f := range formats {
+		for _, mounted := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/mounted=%v", f.name, mounted), func(t *testing.T) {
+				var cmds []string
+				im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+				im.runner = func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+					cmds = append(cmds, name)
+					if name == "lsblk" && mounted {
+						fmt.Fprintln(stdout, "/mnt/target")
+					}
+					return nil
+				}
+
+				err := f.format(im)
+				mkfsRan := slices.ContainsFunc(cmds, func(c string) bool { return strings.HasPrefix(c, "mkfs.") })
+				if mounted {
+					if err == nil || !strings.Contains(err.Error(), "mounted") {
+						t.Errorf("expected mounted error, got %v", err)
+					}
+					if mkfsRan {
+						t.Errorf("mkfs should not run on a mounted device: %v", cmds)
+					}
+				} else {
+					if err != nil {
+						t.Fatalf("error: %v", err)
+					}
+					if !mkfsRan {
+						t.Errorf("mkfs should run on an unmounted device: %v", cmds)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDeviceIsMounted(t *testing.T) {
+	var gotCmd string
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	im.runner = func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+		gotCmd = strings.Join(append([]string{name}, args...), " ")
+		fmt.Fprint(stdout, "\n/boot\n")
+		return nil
+	}
+	mounted, err := im.DeviceIsMounted("/dev/loop0p2")
+	if err != nil || !mounted {
+		t.Errorf("DeviceIsMounted = %v, %v, want true", mounted, err)
+	}
+	if want := "lsblk -no MOUNTPOINT /dev/loop0p2"; gotCmd != want {
+		t.Errorf("command = %q, want %q", gotCmd, want)
+	}
+
+	mr := runner.NewMockRunnerFailOnCall(0, errors.New("lsblk failed"))
+	im = newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, mr)
+	if _, err := im.DeviceIsMounted("/dev/loop0p2"); err == nil {
+		t.Error("should propagate lsblk error")
+	}
+	if _, err := im.DeviceIsMounted(""); err == nil {
+		t.Error("should error for empty device")
+	}
+}
+
 // --- MountEfifs Tests ---
 
 func TestMountEfifs(t *testing.T) {
@@ -667,8 +1725,9 @@ func TestFormatBootfs(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		if runner.Calls[0].Name != "mkfs.btrfs" {
-			t.Errorf("expected mkfs.btrfs, got %q", runner.Calls[0].Name)
+		// The first call is the mount check.
+		if runner.Calls[1].Name != "mkfs.btrfs" {
+			t.Errorf("expected mkfs.btrfs, got %q", runner.Calls[1].Name)
 		}
 	})
 
@@ -680,6 +1739,46 @@ func TestFormatBootfs(t *testing.T) {
 	})
 }
 
+// --- FormatSwap Tests ---
+
+func TestFormatSwap(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		if err := im.FormatSwap("/dev/loop0p3"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if runner.Calls[0].Name != "mkswap" {
+			t.Errorf("expected mkswap, got %q", runner.Calls[0].Name)
+		}
+		if args := runner.Calls[0].Args; args[len(args)-1] != "/dev/loop0p3" {
+			t.Errorf("last arg should be the swap device, got %v", args)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.FormatSwap(""); err == nil {
+			t.Error("should error for empty device")
+		}
+	})
+}
+
+func TestRootPartitionNumber(t *testing.T) {
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	if n, err := im.RootPartitionNumber(); err != nil || n != 3 {
+		t.Errorf("RootPartitionNumber() = %d, %v; want 3", n, err)
+	}
+
+	cfg := baseImageConfig()
+	cfg.Items["Imager.SwapPartitionSize"] = []string{"2G"}
+	im = newTestImage(cfg, &cds.MockOstree{})
+	if n, err := im.RootPartitionNumber(); err != nil || n != 4 {
+		t.Errorf("RootPartitionNumber() with swap = %d, %v; want 4", n, err)
+	}
+}
+
 // --- MountBootfs Tests ---
 
 func TestMountBootfs(t *testing.T) {
@@ -698,6 +1797,48 @@ func TestMountBootfs(t *testing.T) {
 		}
 	})
 
+	t.Run("MountOptions", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			opts    string
+			want    []string
+			wantErr bool
+		}{
+			{"Unset", "", []string{"/dev/loop0p2", "MOUNTPOINT"}, false},
+			{"Set", "noatime,umask=0077", []string{"-o", "noatime,umask=0077", "/dev/loop0p2", "MOUNTPOINT"}, false},
+			{"ShellMetachars", "noatime;rm -rf /", nil, true},
+			{"Whitespace", "noatime ro", nil, true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				mountPoint := filepath.Join(t.TempDir(), "boot")
+				cfg := baseImageConfig()
+				cfg.Items["Imager.BootMountOptions"] = []string{tt.opts}
+				runner := runner.NewMockRunner()
+				im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+				err := im.MountBootfs("/dev/loop0p2", mountPoint)
+				if tt.wantErr {
+					if err == nil {
+						t.Error("should error for invalid mount options")
+					}
+					if len(runner.Calls) != 0 {
+						t.Errorf("mount should not run, got %v", runner.Calls)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("error: %v", err)
+				}
+				want := slices.Clone(tt.want)
+				want[len(want)-1] = mountPoint
+				if len(runner.Calls) != 1 || !slices.Equal(runner.Calls[0].Args, want) {
+					t.Errorf("mount args = %v, want %v", runner.Calls, want)
+				}
+			})
+		}
+	})
+
 	t.Run("EmptyParams", func(t *testing.T) {
 		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
 		if err := im.MountBootfs("", "/boot"); err == nil {
@@ -712,16 +1853,49 @@ func TestMountBootfs(t *testing.T) {
 // --- FormatRootfs Tests ---
 
 func TestFormatRootfs(t *testing.T) {
-	runner := runner.NewMockRunner()
-	im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
-
-	err := im.FormatRootfs("/dev/loop0p3")
-	if err != nil {
-		t.Fatalf("error: %v", err)
+	tests := []struct {
+		fsType    string
+		wantMkfs  string
+		wantForce string
+	}{
+		{"btrfs", "mkfs.btrfs", "-f"},
+		{"ext4", "mkfs.ext4", "-F"},
+		{"xfs", "mkfs.xfs", "-f"},
 	}
-	if runner.Calls[0].Name != "mkfs.btrfs" {
-		t.Errorf("expected mkfs.btrfs, got %q", runner.Calls[0].Name)
+	for _, tt := range tests {
+		t.Run(tt.fsType, func(t *testing.T) {
+			cfg := baseImageConfig()
+			cfg.Items["Imager.RootFilesystem"] = []string{tt.fsType}
+			runner := runner.NewMockRunner()
+			im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+			if err := im.FormatRootfs("/dev/loop0p3"); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			// The first call is the mount check.
+			call := runner.Calls[1]
+			if call.Name != tt.wantMkfs {
+				t.Errorf("expected %s, got %q", tt.wantMkfs, call.Name)
+			}
+			want := []string{tt.wantForce, "-L", "MR" + im.DatedFsLabel(), "/dev/loop0p3"}
+			if strings.Join(call.Args, " ") != strings.Join(want, " ") {
+				t.Errorf("args = %v, want %v", call.Args, want)
+			}
+		})
 	}
+
+	t.Run("UnsupportedFilesystem", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.RootFilesystem"] = []string{"zfs"}
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+		if err := im.FormatRootfs("/dev/loop0p3"); err == nil {
+			t.Error("should error for an unsupported filesystem")
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("no command should run, got %v", runner.Calls)
+		}
+	})
 }
 
 // --- RootfsKernelArgs Tests ---
@@ -732,6 +1906,56 @@ func TestRootfsKernelArgs(t *testing.T) {
 	if len(args) != 1 || args[0] != "rootflags=discard=async" {
 		t.Errorf("unexpected kernel args: %v", args)
 	}
+
+	cfg := baseImageConfig()
+	cfg.Items["Imager.RootFilesystem"] = []string{"xfs"}
+	im = newTestImage(cfg, &cds.MockOstree{})
+	args = im.RootfsKernelArgs()
+	if len(args) != 1 || args[0] != "rootflags=discard" {
+		t.Errorf("unexpected kernel args for xfs: %v", args)
+	}
+}
+
+func TestLuksKernelArgs(t *testing.T) {
+	const uuid = "1234-abcd"
+	tests := []struct {
+		name    string
+		keyfile string
+		want    []string
+	}{
+		{"NoKeyfile", "", []string{"rd.luks.uuid=1234-abcd"}},
+		{"InitramfsKeyfile", "/etc/cryptsetup-keys.d/root.key", []string{
+			"rd.luks.uuid=1234-abcd",
+			"rd.luks.key=1234-abcd=/etc/cryptsetup-keys.d/root.key",
+		}},
+		{"DeviceKeyfile", "/root.key:LABEL=KEYS", []string{
+			"rd.luks.uuid=1234-abcd",
+			"rd.luks.key=1234-abcd=/root.key:LABEL=KEYS",
+			"rd.luks.options=1234-abcd=keyfile-timeout=10s",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := baseImageConfig()
+			cfg.Items["Imager.LuksKeyfile"] = []string{tt.keyfile}
+			im := newTestImage(cfg, &cds.MockOstree{})
+
+			got, err := im.luksKernelArgs(uuid)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("luksKernelArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("ConfigError", func(t *testing.T) {
+		im, _ := NewImage(&config.ErrConfig{Err: errors.New("cfg error")}, &cds.MockOstree{})
+		if _, err := im.luksKernelArgs(uuid); err == nil {
+			t.Error("should propagate config errors")
+		}
+	})
 }
 
 // --- MountRootfs Tests ---
@@ -761,6 +1985,32 @@ func TestMountRootfs(t *testing.T) {
 		}
 	})
 
+	for _, fsType := range []string{"ext4", "xfs"} {
+		t.Run(fsType, func(t *testing.T) {
+			cfg := baseImageConfig()
+			cfg.Items["Imager.RootFilesystem"] = []string{fsType}
+			runner := runner.NewMockRunner()
+			im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner)
+
+			if err := im.MountRootfs("/dev/loop0p3", "/tmp/rootfs"); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			want := []string{"-t", fsType, "/dev/loop0p3", "/tmp/rootfs"}
+			if strings.Join(runner.Calls[0].Args, " ") != strings.Join(want, " ") {
+				t.Errorf("args = %v, want %v", runner.Calls[0].Args, want)
+			}
+		})
+	}
+
+	t.Run("UnsupportedFilesystem", func(t *testing.T) {
+		cfg := baseImageConfig()
+		cfg.Items["Imager.RootFilesystem"] = []string{""}
+		im := newTestImage(cfg, &cds.MockOstree{})
+		if err := im.MountRootfs("/dev/loop0p3", "/tmp/rootfs"); err == nil {
+			t.Error("should error for an empty filesystem type")
+		}
+	})
+
 	t.Run("EmptyParams", func(t *testing.T) {
 		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
 		if err := im.MountRootfs("", "/tmp/mnt"); err == nil {
@@ -772,6 +2022,92 @@ func TestMountRootfs(t *testing.T) {
 	})
 }
 
+// --- SnapshotRoot Tests ---
+
+// fsTypeRunner returns a runner that reports fsType for findmnt and records
+// all the invoked commands into calls.
+func fsTypeRunner(fsType string, calls *[]string) runner.Func {
+	return func(_ io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+		*calls = append(*calls, strings.Join(append([]string{name}, args...), " "))
+		if name == "findmnt" {
+			fmt.Fprintln(stdout, fsType)
+		}
+		return nil
+	}
+}
+
+func TestRootFsType(t *testing.T) {
+	var calls []string
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	im.runner = fsTypeRunner("btrfs", &calls)
+
+	fsType, err := im.RootFsType("/tmp/rootfs")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if fsType != "btrfs" {
+		t.Errorf("RootFsType() = %q, want %q", fsType, "btrfs")
+	}
+	want := "findmnt -n -o FSTYPE --target /tmp/rootfs"
+	if len(calls) != 1 || calls[0] != want {
+		t.Errorf("calls = %v, want [%s]", calls, want)
+	}
+
+	if _, err := im.RootFsType(""); err == nil {
+		t.Error("should error for empty mountRootfs")
+	}
+}
+
+func TestSnapshotRoot(t *testing.T) {
+	t.Run("Btrfs", func(t *testing.T) {
+		mountRootfs := t.TempDir()
+		var calls []string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = fsTypeRunner("btrfs", &calls)
+
+		if err := im.SnapshotRoot(mountRootfs, "pre-upgrade"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(mountRootfs, ".snapshots")); err != nil {
+			t.Errorf(".snapshots should have been created: %v", err)
+		}
+		want := fmt.Sprintf("btrfs subvolume snapshot -r %s %s/.snapshots/pre-upgrade", mountRootfs, mountRootfs)
+		if len(calls) != 2 || calls[1] != want {
+			t.Errorf("calls = %v, want snapshot command %q", calls, want)
+		}
+	})
+
+	t.Run("NotBtrfs", func(t *testing.T) {
+		mountRootfs := t.TempDir()
+		var calls []string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = fsTypeRunner("ext4", &calls)
+
+		if err := im.SnapshotRoot(mountRootfs, "pre-upgrade"); err == nil {
+			t.Fatal("should error for non-btrfs root")
+		}
+		if len(calls) != 1 {
+			t.Errorf("only findmnt should run, got: %v", calls)
+		}
+		if _, err := os.Stat(filepath.Join(mountRootfs, ".snapshots")); !os.IsNotExist(err) {
+			t.Error(".snapshots should not be created for non-btrfs root")
+		}
+	})
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SnapshotRoot("", "snap"); err == nil {
+			t.Error("should error for empty mountRootfs")
+		}
+		if err := im.SnapshotRoot("/tmp/rootfs", ""); err == nil {
+			t.Error("should error for empty snapshotName")
+		}
+		if err := im.SnapshotRoot("/tmp/rootfs", "../escape"); err == nil {
+			t.Error("should error for snapshotName containing a path separator")
+		}
+	})
+}
+
 // --- GetKernelPath Tests ---
 
 func TestGetKernelPath(t *testing.T) {
@@ -786,9 +2122,25 @@ func TestGetKernelPath(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		// Should return the first sorted (6.1.0).
-		if result != "6.1.0-matrixos" {
-			t.Errorf("got %q, want 6.1.0-matrixos", result)
+		if result != "6.2.0-matrixos" {
+			t.Errorf("got %q, want 6.2.0-matrixos", result)
+		}
+	})
+
+	t.Run("NewestByVersion", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		modulesDir := filepath.Join(tmpDir, "usr", "lib", "modules")
+		for _, v := range []string{"6.9.0-matrixos", "6.10.0-matrixos", "6.1.0-matrixos"} {
+			os.MkdirAll(filepath.Join(modulesDir, v), 0755)
+		}
+
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		result, err := im.GetKernelPath(tmpDir)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if result != "6.10.0-matrixos" {
+			t.Errorf("got %q, want 6.10.0-matrixos", result)
 		}
 	})
 
@@ -820,6 +2172,62 @@ func TestGetKernelPath(t *testing.T) {
 	})
 }
 
+func TestGetAllKernelPaths(t *testing.T) {
+	t.Run("NewestFirst", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		modulesDir := filepath.Join(tmpDir, "usr", "lib", "modules")
+		os.MkdirAll(filepath.Join(modulesDir, "6.9.0-matrixos"), 0755)
+		os.MkdirAll(filepath.Join(modulesDir, "6.10.0-matrixos"), 0755)
+		os.WriteFile(filepath.Join(modulesDir, "README"), []byte("not a kernel"), 0644)
+
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		result, err := im.GetAllKernelPaths(tmpDir)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		want := []string{"6.10.0-matrixos", "6.9.0-matrixos"}
+		if strings.Join(result, ",") != strings.Join(want, ",") {
+			t.Errorf("got %v, want %v", result, want)
+		}
+	})
+
+	t.Run("NoModulesDir", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.GetAllKernelPaths(t.TempDir()); err == nil {
+			t.Error("should error when modules dir doesn't exist")
+		}
+	})
+
+	t.Run("EmptyParam", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.GetAllKernelPaths(""); err == nil {
+			t.Error("should error for empty param")
+		}
+	})
+}
+
+func TestCompareKernelVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int // sign of the result
+	}{
+		{"6.10.0-matrixos", "6.9.0-matrixos", 1},
+		{"6.1.0-matrixos", "6.9.0-matrixos", -1},
+		{"6.9.0-matrixos", "6.9.0-matrixos", 0},
+		{"6.10.0-rc3-matrixos", "6.10.0-matrixos", -1},
+		{"6.10.0-rc10-matrixos", "6.10.0-rc3-matrixos", 1},
+		{"6.10.0-rc1", "6.9.12", 1},
+		{"6.10", "6.10.0", -1}, // same version, ordered by name
+		{"6.10.1", "6.10", 1},
+	}
+	for _, tt := range tests {
+		got := compareKernelVersions(tt.a, tt.b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("compareKernelVersions(%q, %q) = %d, want sign %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
 // --- SetupPasswords Tests ---
 
 func TestSetupPasswords(t *testing.T) {
@@ -830,9 +2238,172 @@ func TestSetupPasswords(t *testing.T) {
 			t.Error("should error for empty param")
 		}
 	})
-}
+}
+
+func TestSetupPasswordsForUsers(t *testing.T) {
+	setup := func(t *testing.T) (string, *Image, *[][]string) {
+		rootfs := t.TempDir()
+		os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+		os.WriteFile(filepath.Join(rootfs, "etc", "shadow"), []byte(
+			"root:*:19000:0:99999:7:::\nbin:*:19000:0:99999:7:::\nalice:old:19000:0:99999:7:::\n"), 0640)
+
+		var calls [][]string
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = func(stdin io.Reader, stdout, _ io.Writer, name string, args ...string) error {
+			password, _ := io.ReadAll(stdin)
+			calls = append(calls, append([]string{name}, args...))
+			fmt.Fprintf(stdout, "$6$hash-of-%s\n", password)
+			return nil
+		}
+		return rootfs, im, &calls
+	}
+
+	t.Run("ReplacesEntries", func(t *testing.T) {
+		rootfs, im, calls := setup(t)
+		users := map[string]string{"root": "toor", "alice": "secret", "bob": "hunter2"}
+		if err := im.SetupPasswordsForUsers(rootfs, users, 0); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(rootfs, "etc", "shadow"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		count := map[string]int{}
+		hashes := map[string]string{}
+		for _, line := range lines {
+			fields := strings.Split(line, ":")
+			count[fields[0]]++
+			hashes[fields[0]] = fields[1]
+		}
+		for user, password := range users {
+			if count[user] != 1 {
+				t.Errorf("%s has %d shadow entries, want 1:\n%s", user, count[user], data)
+			}
+			if want := "$6$hash-of-" + password; hashes[user] != want {
+				t.Errorf("%s hash = %q, want %q", user, hashes[user], want)
+			}
+		}
+		if count["bin"] != 1 || hashes["bin"] != "*" {
+			t.Errorf("unrelated bin entry should be kept as is:\n%s", data)
+		}
+		for _, c := range *calls {
+			if !slices.Equal(c, []string{"openssl", "passwd", "-6", "-stdin"}) {
+				t.Errorf("unexpected command %v", c)
+			}
+		}
+	})
+
+	t.Run("Cost", func(t *testing.T) {
+		rootfs, im, calls := setup(t)
+		if err := im.SetupPasswordsForUsers(rootfs, map[string]string{"root": "toor"}, 10000); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if len(*calls) != 1 {
+			t.Fatalf("expected 1 openssl call, got %v", *calls)
+		}
+		args := (*calls)[0]
+		i := slices.Index(args, "-salt")
+		if i < 0 || i+1 >= len(args) || !strings.HasPrefix(args[i+1], "rounds=10000$") {
+			t.Errorf("expected -salt rounds=10000$..., got %v", args)
+		}
+	})
+
+	t.Run("InvalidParams", func(t *testing.T) {
+		rootfs, im, _ := setup(t)
+		if err := im.SetupPasswordsForUsers(rootfs, nil, 0); err == nil {
+			t.Error("should error for no users")
+		}
+		if err := im.SetupPasswordsForUsers(rootfs, map[string]string{"root": "x"}, 10); err == nil {
+			t.Error("should error for a too low cost")
+		}
+		if err := im.SetupPasswordsForUsers(rootfs, map[string]string{"ro:ot": "x"}, 0); err == nil {
+			t.Error("should error for an invalid user name")
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		rootfs, im, _ := setup(t)
+		if err := im.SetupPasswords(rootfs); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		data, _ := os.ReadFile(filepath.Join(rootfs, "etc", "shadow"))
+		for _, want := range []string{"matrix:$6$hash-of-matrix:", "root:$6$hash-of-matrix:"} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("shadow missing %q:\n%s", want, data)
+			}
+		}
+	})
+}
+
+// --- ReleaseVersion Tests ---
+
+func TestOsRelease(t *testing.T) {
+	const osRelease = `# matrixOS
+NAME="matrixOS"
+ID=matrixos
+ID_LIKE='gentoo'
+PRETTY_NAME="matrixOS \"Gnome\" edition"
+VERSION_ID=20260215
+
+HOME_URL="https://example.org/"
+`
+	newRootfs := func(t *testing.T, content string) string {
+		rootfs := t.TempDir()
+		os.MkdirAll(filepath.Join(rootfs, "usr", "lib"), 0755)
+		os.WriteFile(filepath.Join(rootfs, "usr", "lib", "os-release"), []byte(content), 0644)
+		return rootfs
+	}
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+
+	t.Run("Success", func(t *testing.T) {
+		rootfs := newRootfs(t, osRelease)
+		got, err := im.OsRelease(rootfs)
+		if err != nil {
+			t.Fatalf("OsRelease() error: %v", err)
+		}
+		want := map[string]string{
+			"NAME":        "matrixOS",
+			"ID":          "matrixos",
+			"ID_LIKE":     "gentoo",
+			"PRETTY_NAME": `matrixOS "Gnome" edition`,
+			"VERSION_ID":  "20260215",
+			"HOME_URL":    "https://example.org/",
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("OsRelease() = %v, want %v", got, want)
+		}
+
+		version, err := im.OsReleaseVersion(rootfs)
+		if err != nil || version != "20260215" {
+			t.Errorf("OsReleaseVersion() = %q, %v, want 20260215", version, err)
+		}
+	})
+
+	t.Run("NoVersionID", func(t *testing.T) {
+		rootfs := newRootfs(t, "NAME=matrixOS\n")
+		if _, err := im.OsReleaseVersion(rootfs); err == nil {
+			t.Error("should error when VERSION_ID is missing")
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := im.OsRelease(t.TempDir())
+		var notFound *OsReleaseNotFoundError
+		if !errors.As(err, &notFound) {
+			t.Fatalf("expected OsReleaseNotFoundError, got %v", err)
+		}
+		if _, err := im.OsReleaseVersion(t.TempDir()); !errors.As(err, &notFound) {
+			t.Errorf("OsReleaseVersion should propagate OsReleaseNotFoundError, got %v", err)
+		}
+	})
 
-// --- ReleaseVersion Tests ---
+	t.Run("EmptyRootfs", func(t *testing.T) {
+		if _, err := im.OsRelease(""); err == nil {
+			t.Error("should error for empty rootfs")
+		}
+	})
+}
 
 func TestReleaseVersion(t *testing.T) {
 	t.Run("FallbackToDate", func(t *testing.T) {
@@ -936,6 +2507,341 @@ func TestCreateQcow2Image(t *testing.T) {
 	})
 }
 
+// --- ConvertImage Tests ---
+
+func TestConvertImage(t *testing.T) {
+	tests := []struct {
+		format   string
+		wantArgs string
+		wantPath string
+	}{
+		{"qcow2", "convert -c -O qcow2 -p /tmp/test.img /tmp/test.img.qcow2", "/tmp/test.img.qcow2"},
+		{"vmdk", "convert -O vmdk -p /tmp/test.img /tmp/test.img.vmdk", "/tmp/test.img.vmdk"},
+		{"vhd", "convert -O vpc -p /tmp/test.img /tmp/test.img.vhd", "/tmp/test.img.vhd"},
+		{"vpc", "convert -O vpc -p /tmp/test.img /tmp/test.img.vhd", "/tmp/test.img.vhd"},
+		{"raw", "convert -O raw -p /tmp/test.img /tmp/test.img.raw", "/tmp/test.img.raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			runner := runner.NewMockRunner()
+			im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+			outPath, err := im.ConvertImage("/tmp/test.img", tt.format)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if outPath != tt.wantPath {
+				t.Errorf("output path = %q, want %q", outPath, tt.wantPath)
+			}
+			if len(runner.Calls) != 1 || runner.Calls[0].Name != "qemu-img" {
+				t.Fatalf("expected one qemu-img call, got %v", runner.Calls)
+			}
+			if got := strings.Join(runner.Calls[0].Args, " "); got != tt.wantArgs {
+				t.Errorf("args = %q, want %q", got, tt.wantArgs)
+			}
+		})
+	}
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+		if _, err := im.ConvertImage("/tmp/test.img", "iso"); err == nil {
+			t.Error("should error for an unknown format")
+		}
+		if len(runner.Calls) != 0 {
+			t.Errorf("no command should run, got %v", runner.Calls)
+		}
+	})
+
+	t.Run("CommandError", func(t *testing.T) {
+		runner := runner.NewMockRunner()
+		runner.Err = errors.New("convert failed")
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+		if _, err := im.ConvertImage("/tmp/test.img", "vmdk"); err == nil {
+			t.Error("should propagate qemu-img errors")
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.ConvertImage("", "qcow2"); err == nil {
+			t.Error("should error for empty imagePath")
+		}
+	})
+}
+
+// --- ChecksumImage Tests ---
+
+func TestChecksumImage(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		imgPath := filepath.Join(tmpDir, "test.img")
+		content := []byte("matrixos image data\n")
+		os.WriteFile(imgPath, content, 0644)
+
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		digest, err := im.ChecksumImage(imgPath)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		sum := sha256.Sum256(content)
+		if want := hex.EncodeToString(sum[:]); digest != want {
+			t.Errorf("digest = %s, want %s", digest, want)
+		}
+
+		data, err := os.ReadFile(imgPath + ".sha256")
+		if err != nil {
+			t.Fatalf("checksum file not written: %v", err)
+		}
+		if want := digest + "  test.img\n"; string(data) != want {
+			t.Errorf("checksum file = %q, want %q", data, want)
+		}
+
+		if _, err := exec.LookPath("sha256sum"); err == nil {
+			out, err := exec.Command("sha256sum", imgPath).Output()
+			if err != nil {
+				t.Fatalf("sha256sum failed: %v", err)
+			}
+			if got := strings.Fields(string(out))[0]; got != digest {
+				t.Errorf("sha256sum = %s, want %s", got, digest)
+			}
+			cmd := exec.Command("sha256sum", "-c", "test.img.sha256")
+			cmd.Dir = tmpDir
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("sha256sum -c failed: %v\n%s", err, out)
+			}
+		}
+	})
+
+	t.Run("Nonexistent", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.ChecksumImage(filepath.Join(t.TempDir(), "missing.img")); err == nil {
+			t.Error("should error for a missing image")
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.ChecksumImage(""); err == nil {
+			t.Error("should error for empty path")
+		}
+	})
+}
+
+// --- GpgSignImage Tests ---
+
+func TestReleaseManifest(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		rootfs := filepath.Join(tmpDir, "rootfs")
+		os.MkdirAll(filepath.Join(rootfs, "usr", "var-db-pkg", "sys-libs", "glibc-2.38"), 0755)
+		os.MkdirAll(filepath.Join(rootfs, "etc", "matrixos"), 0755)
+		os.WriteFile(filepath.Join(rootfs, "etc", "matrixos", "build.txt"),
+			[]byte("SEED_NAME=matrixos-gnome-20260215\n"), 0644)
+		imagePath := filepath.Join(tmpDir, "test.img")
+		os.WriteFile(imagePath, []byte("image"), 0644)
+
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{LastCommit_: "abc123"})
+		m, err := im.NewReleaseManifest("matrixos/amd64/gnome", rootfs, imagePath)
+		if err != nil {
+			t.Fatalf("NewReleaseManifest() error: %v", err)
+		}
+
+		manifestPath := filepath.Join(tmpDir, "manifests", "test.json")
+		if err := im.WriteReleaseManifest(manifestPath, *m); err != nil {
+			t.Fatalf("WriteReleaseManifest() error: %v", err)
+		}
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{`"ref"`, `"commit"`, `"release_version"`, `"image"`, `"sha256"`, `"packages"`} {
+			if !strings.Contains(string(data), field) {
+				t.Errorf("manifest lacks %s: %s", field, data)
+			}
+		}
+
+		var got ReleaseManifest
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("json.Unmarshal() error: %v", err)
+		}
+		sum := sha256.Sum256([]byte("image"))
+		want := ReleaseManifest{
+			Ref:            "matrixos/amd64/gnome",
+			Commit:         "abc123",
+			ReleaseVersion: "20260215",
+			Image:          "test.img",
+			Sha256:         hex.EncodeToString(sum[:]),
+			Packages:       []string{"sys-libs/glibc-2.38"},
+		}
+		if got.Ref != want.Ref || got.Commit != want.Commit || got.ReleaseVersion != want.ReleaseVersion ||
+			got.Image != want.Image || got.Sha256 != want.Sha256 || !slices.Equal(got.Packages, want.Packages) {
+			t.Errorf("manifest = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("NoPackages", func(t *testing.T) {
+		manifestPath := filepath.Join(t.TempDir(), "test.json")
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.WriteReleaseManifest(manifestPath, ReleaseManifest{Ref: "ref"}); err != nil {
+			t.Fatalf("WriteReleaseManifest() error: %v", err)
+		}
+		data, _ := os.ReadFile(manifestPath)
+		if !strings.Contains(string(data), `"packages": []`) {
+			t.Errorf("expected an empty packages list, got %s", data)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{LastCommitErr: errors.New("no ref")})
+		if err := im.WriteReleaseManifest("", ReleaseManifest{}); err == nil {
+			t.Error("should error for empty path")
+		}
+		if _, err := im.NewReleaseManifest("ref", t.TempDir(), "/tmp/x.img"); err == nil {
+			t.Error("should propagate the LastCommit error")
+		}
+		if _, err := im.NewReleaseManifest("", "/tmp/rootfs", "/tmp/x.img"); err == nil {
+			t.Error("should error for empty ref")
+		}
+	})
+}
+
+func TestGpgSignImage(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		os.WriteFile(imgPath, []byte("data"), 0644)
+
+		mo := &cds.MockOstree{}
+		im := newTestImage(baseImageConfig(), mo)
+		if err := im.GpgSignImage(imgPath); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if len(mo.SignedFiles) != 1 || mo.SignedFiles[0] != imgPath {
+			t.Fatalf("signed files = %v, want [%s]", mo.SignedFiles, imgPath)
+		}
+		if got := cds.GpgSignedFilePath(mo.SignedFiles[0]); got != imgPath+".asc" {
+			t.Errorf("signature path = %s, want %s.asc", got, imgPath)
+		}
+	})
+
+	t.Run("GpgError", func(t *testing.T) {
+		imgPath := filepath.Join(t.TempDir(), "test.img")
+		os.WriteFile(imgPath, []byte("data"), 0644)
+
+		mo := &cds.MockOstree{GpgSignErr: errors.New("no secret key")}
+		im := newTestImage(baseImageConfig(), mo)
+		err := im.GpgSignImage(imgPath)
+		if err == nil || !errors.Is(err, mo.GpgSignErr) {
+			t.Errorf("expected wrapped gpg error, got %v", err)
+		}
+	})
+
+	t.Run("Nonexistent", func(t *testing.T) {
+		mo := &cds.MockOstree{}
+		im := newTestImage(baseImageConfig(), mo)
+		if err := im.GpgSignImage(filepath.Join(t.TempDir(), "missing.img")); err == nil {
+			t.Error("should error for a missing image")
+		}
+		if len(mo.SignedFiles) != 0 {
+			t.Errorf("nothing should be signed, got %v", mo.SignedFiles)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.GpgSignImage(""); err == nil {
+			t.Error("should error for empty path")
+		}
+	})
+}
+
+// --- UnmountAllUnder Tests ---
+
+func TestUnmountAllUnder(t *testing.T) {
+	stubSubmounts := func(t *testing.T, mounts []string, err error) {
+		orig := listSubmounts
+		listSubmounts = func(string) ([]string, error) { return mounts, err }
+		t.Cleanup(func() { listSubmounts = orig })
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		stubSubmounts(t, []string{
+			"/out/mounts",
+			"/out/mounts/a/rootfs",
+			"/out/mounts/a/rootfs/boot",
+			"/out/mounts/b",
+			"/out/mounts-other/c",
+		}, nil)
+		runner := runner.NewMockRunner()
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+
+		unmounted, err := im.UnmountAllUnder("/out/mounts/")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		want := []string{"/out/mounts/a/rootfs", "/out/mounts/b"}
+		if strings.Join(unmounted, ",") != strings.Join(want, ",") {
+			t.Errorf("unmounted = %v, want %v", unmounted, want)
+		}
+		if len(runner.Calls) != 2 {
+			t.Fatalf("expected 2 umount calls, got %v", runner.Calls)
+		}
+		for i, mnt := range want {
+			c := runner.Calls[i]
+			if got := c.Name + " " + strings.Join(c.Args, " "); got != "umount -R "+mnt {
+				t.Errorf("call %d = %q, want %q", i, got, "umount -R "+mnt)
+			}
+		}
+	})
+
+	t.Run("NotMountedIgnored", func(t *testing.T) {
+		stubSubmounts(t, []string{"/out/mounts/a", "/out/mounts/b"}, nil)
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		im.runner = func(_ io.Reader, _, stderr io.Writer, name string, args ...string) error {
+			if args[len(args)-1] == "/out/mounts/a" {
+				io.WriteString(stderr, "umount: /out/mounts/a: not mounted.\n")
+				return errors.New("exit status 32")
+			}
+			return nil
+		}
+
+		unmounted, err := im.UnmountAllUnder("/out/mounts")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if strings.Join(unmounted, ",") != "/out/mounts/b" {
+			t.Errorf("unmounted = %v, want [/out/mounts/b]", unmounted)
+		}
+	})
+
+	t.Run("UmountError", func(t *testing.T) {
+		stubSubmounts(t, []string{"/out/mounts/a"}, nil)
+		runner := runner.NewMockRunnerFailOnCall(0, errors.New("target is busy"))
+		im := newTestImageWithRunner(baseImageConfig(), &cds.MockOstree{}, runner)
+		if _, err := im.UnmountAllUnder("/out/mounts"); err == nil {
+			t.Error("should propagate umount errors")
+		}
+	})
+
+	t.Run("ListError", func(t *testing.T) {
+		stubSubmounts(t, nil, errors.New("mountinfo unreadable"))
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.UnmountAllUnder("/out/mounts"); err == nil {
+			t.Error("should propagate mount listing errors")
+		}
+	})
+
+	t.Run("InvalidDir", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if _, err := im.UnmountAllUnder(""); err == nil {
+			t.Error("should error for empty mountDir")
+		}
+		if _, err := im.UnmountAllUnder("/"); err == nil {
+			t.Error("should refuse to unmount everything under /")
+		}
+	})
+}
+
 // --- RemoveImageFile Tests ---
 
 func TestRemoveImageFile(t *testing.T) {
@@ -1037,6 +2943,73 @@ func TestImageLockPath(t *testing.T) {
 	})
 }
 
+func TestAcquireImageLock(t *testing.T) {
+	const ref = "matrixos/amd64/gnome"
+	newLockImage := func(t *testing.T, wait string) (*Image, string) {
+		lockDir := filepath.Join(t.TempDir(), "locks")
+		cfg := baseImageConfig()
+		cfg.Items["Imager.LocksDir"] = []string{lockDir}
+		cfg.Items["Imager.LockWaitSeconds"] = []string{wait}
+		return newTestImage(cfg, &cds.MockOstree{}), filepath.Join(lockDir, ref+".lock")
+	}
+
+	t.Run("ContendedAndReleased", func(t *testing.T) {
+		im, lockPath := newLockImage(t, "0")
+		release, err := im.AcquireImageLock(ref)
+		if err != nil {
+			t.Fatalf("first acquisition failed: %v", err)
+		}
+		if _, err := os.Stat(lockPath); err != nil {
+			t.Errorf("lock file should exist while held: %v", err)
+		}
+
+		if _, err := im.AcquireImageLock(ref); !errors.Is(err, ErrImageLockTimeout) {
+			t.Fatalf("second acquisition error = %v, want ErrImageLockTimeout", err)
+		}
+
+		if err := release(); err != nil {
+			t.Fatalf("release failed: %v", err)
+		}
+		if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+			t.Error("lock file should be removed on release")
+		}
+
+		release, err = im.AcquireImageLock(ref)
+		if err != nil {
+			t.Fatalf("acquisition after release failed: %v", err)
+		}
+		release()
+	})
+
+	t.Run("WaitsForRelease", func(t *testing.T) {
+		im, _ := newLockImage(t, "5")
+		release, err := im.AcquireImageLock(ref)
+		if err != nil {
+			t.Fatalf("first acquisition failed: %v", err)
+		}
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			release()
+		}()
+		start := time.Now()
+		release2, err := im.AcquireImageLock(ref)
+		if err != nil {
+			t.Fatalf("waiting acquisition failed: %v", err)
+		}
+		defer release2()
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("acquisition returned after %v, expected it to wait for release", elapsed)
+		}
+	})
+
+	t.Run("InvalidWait", func(t *testing.T) {
+		im, _ := newLockImage(t, "soon")
+		if _, err := im.AcquireImageLock(ref); err == nil {
+			t.Error("should error for an invalid LockWaitSeconds")
+		}
+	})
+}
+
 // --- FinalizeFilesystems Tests ---
 
 func TestFinalizeFilesystems(t *testing.T) {
@@ -1048,14 +3021,59 @@ func TestFinalizeFilesystems(t *testing.T) {
 		if err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		if len(runner.Calls) != 2 {
-			t.Fatalf("expected 2 fstrim calls, got %d", len(runner.Calls))
+		if len(runner.Calls) != 3 {
+			t.Fatalf("expected 3 fstrim calls, got %d", len(runner.Calls))
 		}
-		for _, c := range runner.Calls {
-			if c.Name != "fstrim" {
-				t.Errorf("expected fstrim, got %q", c.Name)
+		for i, mount := range []string{"/mnt/rootfs", "/mnt/boot", "/mnt/efi"} {
+			c := runner.Calls[i]
+			if c.Name != "fstrim" || !slices.Equal(c.Args, []string{"-v", mount}) {
+				t.Errorf("call %d = %s %v, want fstrim -v %s", i, c.Name, c.Args, mount)
+			}
+		}
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		newFstrimImage := func(fail map[string]string) (*Image, *[]string) {
+			var trimmed []string
+			im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+			im.runner = func(_ io.Reader, _, stderr io.Writer, name string, args ...string) error {
+				mount := args[len(args)-1]
+				trimmed = append(trimmed, mount)
+				if msg, ok := fail[mount]; ok {
+					fmt.Fprintln(stderr, msg)
+					return errors.New("exit status 1")
+				}
+				return nil
+			}
+			return im, &trimmed
+		}
+
+		im, trimmed := newFstrimImage(map[string]string{
+			"/mnt/efi": "fstrim: /mnt/efi: the discard operation is not supported",
+		})
+		if err := im.FinalizeFilesystems("/mnt/rootfs", "/mnt/boot", "/mnt/efi"); err != nil {
+			t.Errorf("unsupported discard on the ESP should be ignored: %v", err)
+		}
+		if len(*trimmed) != 3 {
+			t.Errorf("expected 3 fstrim calls, got %v", *trimmed)
+		}
+
+		im, trimmed = newFstrimImage(map[string]string{
+			"/mnt/rootfs": "fstrim: /mnt/rootfs: FITRIM ioctl failed: Input/output error",
+			"/mnt/boot":   "fstrim: /mnt/boot: FITRIM ioctl failed: Input/output error",
+		})
+		err := im.FinalizeFilesystems("/mnt/rootfs", "/mnt/boot", "/mnt/efi")
+		if err == nil {
+			t.Fatal("expected an aggregated error")
+		}
+		for _, mount := range []string{"/mnt/rootfs", "/mnt/boot"} {
+			if !strings.Contains(err.Error(), mount) {
+				t.Errorf("error %q does not mention %s", err, mount)
 			}
 		}
+		if len(*trimmed) != 3 {
+			t.Errorf("all filesystems should be trimmed despite failures, got %v", *trimmed)
+		}
 	})
 
 	t.Run("EmptyParams", func(t *testing.T) {
@@ -1163,6 +3181,72 @@ func TestPackageList(t *testing.T) {
 	})
 }
 
+func TestPackageListDiff(t *testing.T) {
+	newRootfs := func(t *testing.T, pkgs ...string) string {
+		rootfs := t.TempDir()
+		for _, pkg := range pkgs {
+			os.MkdirAll(filepath.Join(rootfs, "usr", "var-db-pkg", pkg), 0755)
+		}
+		return rootfs
+	}
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+
+	tests := []struct {
+		name        string
+		old, new    string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			name:        "Changed",
+			old:         newRootfs(t, "sys-libs/glibc-2.38", "dev-libs/openssl-3.0", "app-misc/screen-4.9"),
+			new:         newRootfs(t, "sys-libs/glibc-2.39", "dev-libs/openssl-3.0", "app-misc/tmux-3.4", "app-editors/vim-9.1"),
+			wantAdded:   []string{"app-editors/vim-9.1", "app-misc/tmux-3.4", "sys-libs/glibc-2.39"},
+			wantRemoved: []string{"app-misc/screen-4.9", "sys-libs/glibc-2.38"},
+		},
+		{
+			name:      "OldWithoutVdb",
+			old:       t.TempDir(),
+			new:       newRootfs(t, "sys-libs/glibc-2.38"),
+			wantAdded: []string{"sys-libs/glibc-2.38"},
+		},
+		{
+			name:        "NewWithoutVdb",
+			old:         newRootfs(t, "sys-libs/glibc-2.38"),
+			new:         t.TempDir(),
+			wantRemoved: []string{"sys-libs/glibc-2.38"},
+		},
+		{
+			name: "Unchanged",
+			old:  newRootfs(t, "sys-libs/glibc-2.38"),
+			new:  newRootfs(t, "sys-libs/glibc-2.38"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed, err := im.PackageListDiff(tt.old, tt.new)
+			if err != nil {
+				t.Fatalf("PackageListDiff() error: %v", err)
+			}
+			if !slices.Equal(added, tt.wantAdded) {
+				t.Errorf("added = %v, want %v", added, tt.wantAdded)
+			}
+			if !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+		})
+	}
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		if _, _, err := im.PackageListDiff("", "/tmp/new"); err == nil {
+			t.Error("should error for empty oldRootfs")
+		}
+		if _, _, err := im.PackageListDiff("/tmp/old", ""); err == nil {
+			t.Error("should error for empty newRootfs")
+		}
+	})
+}
+
 // --- SetupHooks Tests ---
 
 func TestSetupHooks(t *testing.T) {
@@ -1181,24 +3265,86 @@ func TestSetupHooks(t *testing.T) {
 		cfg := baseImageConfig()
 		cfg.Items["matrixOS.Root"] = []string{tmpDir}
 		im := newTestImage(cfg, &cds.MockOstree{})
-		// Should return nil when hooks dir doesn't exist.
+		// Should return nil when hooks dir doesn't exist.
+		err := im.SetupHooks("/tmp/rootfs", "matrixos/amd64/gnome")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoHookScript", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cfg := baseImageConfig()
+		cfg.Items["matrixOS.Root"] = []string{tmpDir}
+		os.MkdirAll(filepath.Join(tmpDir, "image", "hooks"), 0755)
+		im := newTestImage(cfg, &cds.MockOstree{})
+
 		err := im.SetupHooks("/tmp/rootfs", "matrixos/amd64/gnome")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("NoHookScript", func(t *testing.T) {
+	t.Run("OrderedHooks", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		cfg := baseImageConfig()
 		cfg.Items["matrixOS.Root"] = []string{tmpDir}
-		os.MkdirAll(filepath.Join(tmpDir, "image", "hooks"), 0755)
+		hooksDir := filepath.Join(tmpDir, "image", "hooks", "matrixos", "amd64")
+		os.MkdirAll(filepath.Join(hooksDir, "gnome.d"), 0755)
+		outFile := filepath.Join(tmpDir, "ran")
+		hooks := []struct {
+			name string
+			mode os.FileMode
+		}{
+			{"gnome.sh", 0755},
+			{"gnome.d/20-bar.sh", 0755},
+			{"gnome.d/10-foo.sh", 0755},
+			{"gnome.d/15-noexec.sh", 0644},
+		}
+		for _, h := range hooks {
+			script := fmt.Sprintf("#!/bin/sh\necho \"%s $REF\" >> %s\n", filepath.Base(h.name), outFile)
+			os.WriteFile(filepath.Join(hooksDir, h.name), []byte(script), h.mode)
+		}
 		im := newTestImage(cfg, &cds.MockOstree{})
 
-		err := im.SetupHooks("/tmp/rootfs", "matrixos/amd64/gnome")
+		if err := im.SetupHooks("/tmp/rootfs", "matrixos/amd64/gnome"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(outFile)
 		if err != nil {
+			t.Fatal(err)
+		}
+		want := "gnome.sh matrixos/amd64/gnome\n10-foo.sh matrixos/amd64/gnome\n20-bar.sh matrixos/amd64/gnome\n"
+		if string(data) != want {
+			t.Errorf("hooks ran as:\n%s\nwant:\n%s", data, want)
+		}
+	})
+
+	t.Run("BuildEnv", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cfg := baseImageConfig()
+		cfg.Items["matrixOS.Root"] = []string{tmpDir}
+		hooksDir := filepath.Join(tmpDir, "image", "hooks", "matrixos", "amd64")
+		os.MkdirAll(hooksDir, 0755)
+		envFile := filepath.Join(tmpDir, "env")
+		os.WriteFile(filepath.Join(hooksDir, "gnome.sh"),
+			[]byte("#!/bin/sh\necho \"$RELEASE_VERSION $OS_NAME\" > "+envFile+"\n"), 0755)
+		rootfs := filepath.Join(tmpDir, "rootfs")
+		os.MkdirAll(filepath.Join(rootfs, "etc", "matrixos"), 0755)
+		os.WriteFile(filepath.Join(rootfs, "etc", "matrixos", "build.txt"),
+			[]byte("SEED_NAME=matrixos-gnome-20260215\n"), 0644)
+		im := newTestImage(cfg, &cds.MockOstree{})
+
+		if err := im.SetupHooks(rootfs, "matrixos/amd64/gnome"); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		data, err := os.ReadFile(envFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(data)); got != "20260215 matrixos" {
+			t.Errorf("RELEASE_VERSION OS_NAME = %q, want %q", got, "20260215 matrixos")
+		}
 	})
 
 	t.Run("OstreeError", func(t *testing.T) {
@@ -1237,6 +3383,57 @@ func TestTestImageMethod(t *testing.T) {
 		}
 	})
 
+	t.Run("BuildEnv", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cfg := baseImageConfig()
+		cfg.Items["matrixOS.Root"] = []string{tmpDir}
+		cfg.Items["Imager.MountDir"] = []string{t.TempDir()}
+		testDir := filepath.Join(tmpDir, "image", "tests", "matrixos", "amd64", "gnome")
+		os.MkdirAll(testDir, 0755)
+		envFile := filepath.Join(tmpDir, "env")
+		os.WriteFile(filepath.Join(testDir, "env.sh"),
+			[]byte("#!/bin/sh\necho \"$RELEASE_VERSION $OS_NAME\" >> "+envFile+"\n"), 0755)
+
+		tests := []struct {
+			name      string
+			imagePath string
+			want      string
+		}{
+			{"FromImageName", "/tmp/matrixos_amd64_gnome-20260215.img", "20260215 matrixos"},
+			{"UniqueSuffix", "/tmp/matrixos_amd64_gnome-20260215-2.img", "20260215 matrixos"},
+			{"FallbackToDate", "/tmp/custom.img", time.Now().Format("20060102") + " matrixos"},
+			{"ArchSuffix", "/tmp/matrixos_amd64_gnome-amd64.img", time.Now().Format("20060102") + " matrixos"},
+		}
+		for _, tt := range tests {
+			os.Remove(envFile)
+			im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner.NewMockRunner())
+			if err := im.TestImage(tt.imagePath, "matrixos/amd64/gnome"); err != nil {
+				t.Fatalf("%s: unexpected error: %v", tt.name, err)
+			}
+			data, _ := os.ReadFile(envFile)
+			if got := strings.TrimSpace(string(data)); got != tt.want {
+				t.Errorf("%s: RELEASE_VERSION OS_NAME = %q, want %q", tt.name, got, tt.want)
+			}
+		}
+
+		// Nothing leaks from a previous build run by the same Image.
+		os.MkdirAll(filepath.Join(tmpDir, "image", "hooks"), 0755)
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner.NewMockRunner())
+		if err := im.SetupHooks(t.TempDir(), "matrixos/amd64/gnome"); err != nil {
+			t.Fatalf("SetupHooks error: %v", err)
+		}
+		for _, version := range []string{"20260215", "20260301"} {
+			os.Remove(envFile)
+			if err := im.TestImage("/tmp/matrixos_amd64_gnome-"+version+".img", "matrixos/amd64/gnome"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, _ := os.ReadFile(envFile)
+			if want := version + " matrixos"; strings.TrimSpace(string(data)) != want {
+				t.Errorf("RELEASE_VERSION OS_NAME = %q, want %q", strings.TrimSpace(string(data)), want)
+			}
+		}
+	})
+
 	t.Run("OstreeError", func(t *testing.T) {
 		mo := &cds.MockOstree{RemoveFullErr: errors.New("ostree error")}
 		im := newTestImage(baseImageConfig(), mo)
@@ -1247,6 +3444,132 @@ func TestTestImageMethod(t *testing.T) {
 	})
 }
 
+func TestTestImageParallel(t *testing.T) {
+	const ref = "matrixos/amd64/gnome"
+	setup := func(t *testing.T, workers string, scripts map[string]string) (*Image, string) {
+		tmpDir := t.TempDir()
+		testDir := filepath.Join(tmpDir, "image", "tests", ref)
+		if err := os.MkdirAll(testDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, body := range scripts {
+			mode := os.FileMode(0755)
+			if strings.HasPrefix(name, "noexec") {
+				mode = 0644
+			}
+			if err := os.WriteFile(filepath.Join(testDir, name), []byte("#!/bin/sh\n"+body+"\n"), mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		logsDir := filepath.Join(tmpDir, "logs")
+		cfg := baseImageConfig()
+		cfg.Items["matrixOS.Root"] = []string{tmpDir}
+		cfg.Items["matrixOS.LogsDir"] = []string{logsDir}
+		cfg.Items["Imager.MountDir"] = []string{t.TempDir()}
+		cfg.Items["Imager.TestWorkers"] = []string{workers}
+		im := newTestImageWithRunner(cfg, &cds.MockOstree{}, runner.NewMockRunner())
+		return im, filepath.Join(logsDir, "image-tests", refToSuffix(ref))
+	}
+
+	t.Run("AllPass", func(t *testing.T) {
+		im, scriptLogsDir := setup(t, "2", map[string]string{
+			"10-a.sh":   "echo a-ran",
+			"20-b.sh":   "echo b-ran >&2",
+			"30-c.sh":   `echo "image=$IMAGE_PATH"`,
+			"noexec.sh": "exit 1",
+		})
+		if err := im.TestImageParallel("/tmp/test.img", ref); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for name, want := range map[string]string{"10-a.sh": "a-ran", "20-b.sh": "b-ran", "30-c.sh": "image="} {
+			data, err := os.ReadFile(filepath.Join(scriptLogsDir, name+".log"))
+			if err != nil {
+				t.Errorf("missing log for %s: %v", name, err)
+				continue
+			}
+			if !strings.Contains(string(data), want) {
+				t.Errorf("log for %s = %q, want it to contain %q", name, data, want)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(scriptLogsDir, "noexec.sh.log")); !os.IsNotExist(err) {
+			t.Error("non-executable script should not be run")
+		}
+	})
+
+	t.Run("PrivateImageCopies", func(t *testing.T) {
+		im, scriptLogsDir := setup(t, "3", map[string]string{
+			"10-a.sh": `echo "image=$IMAGE_PATH"`,
+			"20-b.sh": `echo "image=$IMAGE_PATH"`,
+			"30-c.sh": `echo "image=$IMAGE_PATH"`,
+		})
+		mr := runner.NewMockRunner()
+		im.runner = mr.Run
+		if err := im.TestImageParallel("/tmp/test.img", ref); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var copies []string
+		for _, c := range mr.Calls {
+			if c.Name != "cp" {
+				continue
+			}
+			if c.Args[len(c.Args)-2] != "/tmp/test.img" {
+				t.Errorf("copy source = %q, want /tmp/test.img", c.Args[len(c.Args)-2])
+			}
+			copies = append(copies, c.Args[len(c.Args)-1])
+		}
+		if len(copies) != 3 {
+			t.Fatalf("expected one copy per script, got %v", copies)
+		}
+		for _, name := range []string{"10-a.sh", "20-b.sh", "30-c.sh"} {
+			data, err := os.ReadFile(filepath.Join(scriptLogsDir, name+".log"))
+			if err != nil {
+				t.Fatalf("missing log for %s: %v", name, err)
+			}
+			_, imagePath, ok := strings.Cut(strings.TrimSpace(string(data)), "image=")
+			if !ok || !slices.Contains(copies, imagePath) || filepath.Base(filepath.Dir(imagePath)) != name {
+				t.Errorf("%s ran on %q, want its own copy among %v", name, imagePath, copies)
+			}
+			if _, err := os.Stat(filepath.Dir(imagePath)); !os.IsNotExist(err) {
+				t.Errorf("copy dir of %s should have been removed, stat err = %v", name, err)
+			}
+		}
+	})
+
+	t.Run("FailuresAggregated", func(t *testing.T) {
+		im, scriptLogsDir := setup(t, "2", map[string]string{
+			"10-ok.sh":    "echo ok",
+			"20-fail.sh":  "echo boom; exit 1",
+			"30-fail.sh":  "exit 2",
+			"40-after.sh": "echo after",
+		})
+		err := im.TestImageParallel("/tmp/test.img", ref)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		for _, name := range []string{"20-fail.sh", "30-fail.sh"} {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("error %q does not name %s", err, name)
+			}
+		}
+		for _, name := range []string{"10-ok.sh", "40-after.sh"} {
+			if strings.Contains(err.Error(), name) {
+				t.Errorf("error %q should not name %s", err, name)
+			}
+			if _, err := os.Stat(filepath.Join(scriptLogsDir, name+".log")); err != nil {
+				t.Errorf("%s should have run: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("InvalidWorkers", func(t *testing.T) {
+		im, _ := setup(t, "0", nil)
+		if err := im.TestImageParallel("/tmp/test.img", ref); err == nil {
+			t.Error("should error for an invalid Imager.TestWorkers")
+		}
+	})
+}
+
 // --- cleanAndStripRef Tests ---
 
 func TestCleanAndStripRef(t *testing.T) {
@@ -1334,6 +3657,248 @@ func TestSetupBootloaderConfig(t *testing.T) {
 	})
 }
 
+const bootloaderTestRef = "matrixos/amd64/gnome"
+
+// setupBootloaderTest creates a deployed rootfs with one kernel, a grub.cfg
+// template for bootloaderTestRef, and a boot directory holding an
+// ostree-generated entry. It returns an Image configured for bootloader.
+func setupBootloaderTest(t *testing.T, bootloader, grubCfg string) (*Image, string, string, string) {
+	t.Helper()
+	devDir := t.TempDir()
+	rootfs := t.TempDir()
+	bootdir := t.TempDir()
+	efibootdir := filepath.Join(t.TempDir(), "EFI", "BOOT")
+
+	os.MkdirAll(filepath.Join(rootfs, "usr", "lib", "modules", "6.10.0-matrixos"), 0755)
+	grubDir := filepath.Join(devDir, "image", "boot", bootloaderTestRef)
+	os.MkdirAll(grubDir, 0755)
+	os.WriteFile(filepath.Join(grubDir, "grub.cfg"), []byte(grubCfg), 0644)
+	entriesDir := filepath.Join(bootdir, "loader", "entries")
+	os.MkdirAll(entriesDir, 0755)
+	// ostree numbers entries in reverse deployment order: ostree-1.conf is
+	// the rollback deployment, ostree-2.conf the one of BootCommitResult.
+	os.WriteFile(filepath.Join(entriesDir, "ostree-1.conf"), []byte(
+		"title matrixOS (rollback)\nversion 1\nlinux /ostree/matrixos-old/vmlinuz\ninitrd /ostree/matrixos-old/initramfs.img\noptions root=UUID=abc rw ostree=/ostree/boot.1/matrixos/oldcommit/0\n"), 0644)
+	os.WriteFile(filepath.Join(entriesDir, "ostree-2.conf"), []byte(
+		"title matrixOS\nversion 2\nlinux /ostree/matrixos-abc/vmlinuz\ninitrd /ostree/matrixos-abc/initramfs.img\noptions root=UUID=abc rw ostree=/ostree/boot.1/matrixos/abc123commit/0\n"), 0644)
+
+	cfg := baseImageConfig()
+	cfg.Items["matrixOS.Root"] = []string{devDir}
+	cfg.Items["Imager.Bootloader"] = []string{bootloader}
+	im := newTestImage(cfg, &cds.MockOstree{BootCommitResult: "abc123commit"})
+	return im, rootfs, bootdir, efibootdir
+}
+
+func TestSetupBootloaderConfigSelection(t *testing.T) {
+	const ref = bootloaderTestRef
+	setup := func(t *testing.T, bootloader string) (*Image, string, string, string) {
+		return setupBootloaderTest(t, bootloader, "search --fs-uuid %BOOTUUID%\n")
+	}
+
+	t.Run("Grub", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setup(t, "grub")
+		if err := im.SetupBootloaderConfig(ref, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(efibootdir, "grub.cfg"))
+		if err != nil {
+			t.Fatalf("grub.cfg not copied: %v", err)
+		}
+		if string(data) != "search --fs-uuid boot-uuid\n" {
+			t.Errorf("grub.cfg = %q", data)
+		}
+		if _, err := os.Stat(filepath.Join(bootdir, "loader", "entries", "matrixos-abc123commit.conf")); !os.IsNotExist(err) {
+			t.Error("grub bootloader should not generate a systemd-boot entry")
+		}
+	})
+
+	t.Run("SystemdBoot", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setup(t, "systemd-boot")
+		if err := im.SetupBootloaderConfig(ref, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(bootdir, "loader", "entries", "matrixos-abc123commit.conf"))
+		if err != nil {
+			t.Fatalf("missing systemd-boot entry: %v", err)
+		}
+		want := "title matrixos (matrixos/amd64/gnome)\n" +
+			"linux /ostree/matrixos-abc/vmlinuz\n" +
+			"initrd /ostree/matrixos-abc/initramfs.img\n" +
+			"options root=UUID=abc rw ostree=/ostree/boot.1/matrixos/abc123commit/0\n"
+		if string(data) != want {
+			t.Errorf("entry = %q, want %q", data, want)
+		}
+		// The ostree entries are left for SetupVmtestConfig and
+		// SetupRecoveryBootEntry.
+		for _, name := range []string{"ostree-1.conf", "ostree-2.conf"} {
+			if _, err := os.Stat(filepath.Join(bootdir, "loader", "entries", name)); err != nil {
+				t.Errorf("ostree entry %s should be kept: %v", name, err)
+			}
+		}
+		if err := im.SetupVmtestConfig(bootdir); err != nil {
+			t.Errorf("SetupVmtestConfig() after systemd-boot setup: %v", err)
+		}
+	})
+
+	t.Run("SystemdBootNoMatchingEntry", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setup(t, "systemd-boot")
+		im.ostree = &cds.MockOstree{BootCommitResult: "unknowncommit"}
+		if err := im.SetupBootloaderConfig(ref, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err == nil {
+			t.Error("should error when no ostree entry matches the boot commit")
+		}
+		if _, err := os.Stat(filepath.Join(efibootdir, "grub.cfg")); !os.IsNotExist(err) {
+			t.Error("systemd-boot bootloader should not copy grub.cfg")
+		}
+	})
+
+	t.Run("SystemdBootPerKernel", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setup(t, "systemd-boot")
+		im.cfg.(*config.MockConfig).Bools = map[string]bool{"Imager.BootEntryPerKernel": true}
+		kernelDir := filepath.Join(rootfs, "usr", "lib", "modules", "6.10.0-matrixos")
+		if err := os.WriteFile(filepath.Join(kernelDir, "vmlinuz"), []byte("kernel"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := im.SetupBootloaderConfig(ref, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		for _, name := range []string{"matrixos-abc123commit.conf", "matrixos-6.10.0-matrixos.conf"} {
+			if _, err := os.Stat(filepath.Join(bootdir, "loader", "entries", name)); err != nil {
+				t.Errorf("missing boot entry %s: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("InvalidBootloader", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setup(t, "lilo")
+		if err := im.SetupBootloaderConfig(ref, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err == nil {
+			t.Error("should error for an unsupported bootloader")
+		}
+	})
+}
+
+func TestSetupBootloaderConfigPlaceholders(t *testing.T) {
+	t.Run("Unknown", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setupBootloaderTest(t, "grub",
+			"search --fs-uuid %BOOTUUID%\nset root=%EFI_UUID%\nset os=%OSNAME% %Foo% %EFI_UUID%\n")
+		err := im.SetupBootloaderConfig(bootloaderTestRef, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid")
+		if err == nil {
+			t.Fatal("should error for unknown template variables")
+		}
+		if !strings.Contains(err.Error(), "%EFI_UUID%, %Foo%") {
+			t.Errorf("error should list the unknown variables once each: %v", err)
+		}
+	})
+
+	t.Run("Clean", func(t *testing.T) {
+		im, rootfs, bootdir, efibootdir := setupBootloaderTest(t, "grub",
+			"search --fs-uuid %BOOTUUID%\nsearch --fs-uuid %EFIUUID%\nmenuentry %OSNAME% {}\n")
+		if err := im.SetupBootloaderConfig(bootloaderTestRef, rootfs, "/sysroot", bootdir, efibootdir, "efi-uuid", "boot-uuid"); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(efibootdir, "grub.cfg"))
+		if err != nil {
+			t.Fatalf("grub.cfg not written: %v", err)
+		}
+		want := "search --fs-uuid boot-uuid\nsearch --fs-uuid efi-uuid\nmenuentry matrixos {}\n"
+		if string(data) != want {
+			t.Errorf("grub.cfg = %q, want %q", data, want)
+		}
+	})
+}
+
+func TestBootloader(t *testing.T) {
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	if got, err := im.Bootloader(); err != nil || got != "grub" {
+		t.Errorf("Bootloader() = %q, %v, want grub by default", got, err)
+	}
+}
+
+// --- SetupKernelBootEntries Tests ---
+
+func TestSetupKernelBootEntries(t *testing.T) {
+	setup := func(t *testing.T) (string, string) {
+		rootfs := t.TempDir()
+		bootdir := t.TempDir()
+		for _, kver := range []string{"6.9.0-matrixos", "6.10.0-matrixos"} {
+			kdir := filepath.Join(rootfs, "usr", "lib", "modules", kver)
+			os.MkdirAll(kdir, 0755)
+			os.WriteFile(filepath.Join(kdir, "vmlinuz"), []byte("kernel "+kver), 0644)
+		}
+		os.WriteFile(filepath.Join(rootfs, "usr", "lib", "modules", "6.10.0-matrixos", "initramfs.img"), []byte("initrd"), 0644)
+		return rootfs, bootdir
+	}
+	writeOstreeEntry := func(t *testing.T, bootdir string) {
+		entriesDir := filepath.Join(bootdir, "loader", "entries")
+		os.MkdirAll(entriesDir, 0755)
+		os.WriteFile(filepath.Join(entriesDir, "ostree-1.conf"), []byte(
+			"title matrixOS\nversion 1\nlinux /ostree/vmlinuz\noptions root=UUID=abc rw ostree=/ostree/boot.1/0\n"), 0644)
+	}
+
+	t.Run("EntryPerKernel", func(t *testing.T) {
+		rootfs, bootdir := setup(t)
+		writeOstreeEntry(t, bootdir)
+
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SetupKernelBootEntries(rootfs, bootdir); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		newest, err := os.ReadFile(filepath.Join(bootdir, "loader", "entries", "matrixos-6.10.0-matrixos.conf"))
+		if err != nil {
+			t.Fatalf("missing newest kernel entry: %v", err)
+		}
+		for _, want := range []string{
+			"title matrixos (6.10.0-matrixos)",
+			"linux /matrixos/kernels/6.10.0-matrixos/vmlinuz",
+			"initrd /matrixos/kernels/6.10.0-matrixos/initramfs.img",
+			"options root=UUID=abc rw ostree=/ostree/boot.1/0",
+		} {
+			if !strings.Contains(string(newest), want) {
+				t.Errorf("entry missing %q:\n%s", want, newest)
+			}
+		}
+
+		older, err := os.ReadFile(filepath.Join(bootdir, "loader", "entries", "matrixos-6.9.0-matrixos.conf"))
+		if err != nil {
+			t.Fatalf("missing older kernel entry: %v", err)
+		}
+		if strings.Contains(string(older), "initrd") {
+			t.Errorf("entry without initramfs should have no initrd line:\n%s", older)
+		}
+		if data, err := os.ReadFile(filepath.Join(bootdir, "matrixos", "kernels", "6.9.0-matrixos", "vmlinuz")); err != nil || string(data) != "kernel 6.9.0-matrixos" {
+			t.Errorf("kernel not copied: %q, %v", data, err)
+		}
+	})
+
+	t.Run("NoOstreeEntry", func(t *testing.T) {
+		rootfs, bootdir := setup(t)
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SetupKernelBootEntries(rootfs, bootdir); err == nil {
+			t.Error("should error without an ostree boot entry")
+		}
+	})
+
+	t.Run("MissingVmlinuz", func(t *testing.T) {
+		rootfs, bootdir := setup(t)
+		writeOstreeEntry(t, bootdir)
+		os.Remove(filepath.Join(rootfs, "usr", "lib", "modules", "6.9.0-matrixos", "vmlinuz"))
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SetupKernelBootEntries(rootfs, bootdir); err == nil {
+			t.Error("should error when a kernel image is missing")
+		}
+	})
+
+	t.Run("EmptyParams", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SetupKernelBootEntries("", "/boot"); err == nil {
+			t.Error("should error for empty ostreeDeployRootfs")
+		}
+		if err := im.SetupKernelBootEntries("/rootfs", ""); err == nil {
+			t.Error("should error for empty bootdir")
+		}
+	})
+}
+
 // --- SetupVmtestConfig Tests ---
 
 func TestSetupVmtestConfig(t *testing.T) {
@@ -1385,6 +3950,89 @@ func TestSetupVmtestConfig(t *testing.T) {
 	})
 }
 
+// --- SetupRecoveryBootEntry Tests ---
+
+func TestSetupRecoveryBootEntry(t *testing.T) {
+	writeEntries := func(t *testing.T) string {
+		bootdir := t.TempDir()
+		loaderDir := filepath.Join(bootdir, "loader", "entries")
+		if err := os.MkdirAll(loaderDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		booted := "title matrixOS (ostree:0)\nversion 2\nlinux /ostree/matrixos-aaa/vmlinuz\ninitrd /ostree/matrixos-aaa/initramfs.img\noptions root=UUID=xxx ostree=/ostree/boot.1/matrixos/aaa/0\n"
+		rollback := "title matrixOS (ostree:1)\nversion 1\nlinux /ostree/matrixos-bbb/vmlinuz\ninitrd /ostree/matrixos-bbb/initramfs.img\noptions root=UUID=xxx ostree=/ostree/boot.1/matrixos/bbb/0\n"
+		os.WriteFile(filepath.Join(loaderDir, "ostree-2-matrixos.conf"), []byte(booted), 0644)
+		os.WriteFile(filepath.Join(loaderDir, "ostree-1-matrixos.conf"), []byte(rollback), 0644)
+		return bootdir
+	}
+
+	t.Run("EmptyParam", func(t *testing.T) {
+		im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+		if err := im.SetupRecoveryBootEntry(""); err == nil {
+			t.Error("should error for empty bootdir")
+		}
+	})
+
+	t.Run("WithRollback", func(t *testing.T) {
+		bootdir := writeEntries(t)
+		mo := &cds.MockOstree{
+			Deployments: []cds.Deployment{
+				{Checksum: "aaa", Stateroot: "matrixos", Booted: true, Index: 0},
+				{Checksum: "bbb", Stateroot: "matrixos", Rollback: true, Index: 1},
+			},
+		}
+		im := newTestImage(baseImageConfig(), mo)
+		if err := im.SetupRecoveryBootEntry(bootdir); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(bootdir, "loader", "entries", "recovery.conf"))
+		if err != nil {
+			t.Fatalf("failed to read recovery entry: %v", err)
+		}
+		content := string(data)
+		if !strings.HasPrefix(content, "title matrixos Recovery (bbb)\n") {
+			t.Errorf("unexpected title in recovery entry:\n%s", content)
+		}
+		for _, want := range []string{
+			"linux /ostree/matrixos-bbb/vmlinuz",
+			"initrd /ostree/matrixos-bbb/initramfs.img",
+			"options root=UUID=xxx ostree=/ostree/boot.1/matrixos/bbb/0",
+		} {
+			if !strings.Contains(content, want) {
+				t.Errorf("recovery entry missing %q:\n%s", want, content)
+			}
+		}
+		if strings.Contains(content, "aaa") {
+			t.Errorf("recovery entry should not reference the booted deployment:\n%s", content)
+		}
+	})
+
+	t.Run("NoRollback", func(t *testing.T) {
+		bootdir := writeEntries(t)
+		mo := &cds.MockOstree{
+			Deployments: []cds.Deployment{
+				{Checksum: "aaa", Stateroot: "matrixos", Booted: true, Index: 0},
+			},
+		}
+		im := newTestImage(baseImageConfig(), mo)
+		if err := im.SetupRecoveryBootEntry(bootdir); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(bootdir, "loader", "entries", "recovery.conf")); !os.IsNotExist(err) {
+			t.Error("recovery entry should not be written without a rollback deployment")
+		}
+	})
+
+	t.Run("DeploymentsError", func(t *testing.T) {
+		mo := &cds.MockOstree{DeploymentsErr: errors.New("status failed")}
+		im := newTestImage(baseImageConfig(), mo)
+		if err := im.SetupRecoveryBootEntry(t.TempDir()); err == nil {
+			t.Error("should propagate ListDeployments error")
+		}
+	})
+}
+
 // --- InstallSecurebootCerts Tests ---
 
 func TestInstallSecurebootCerts(t *testing.T) {
@@ -1411,6 +4059,100 @@ func TestInstallSecurebootCerts(t *testing.T) {
 	})
 }
 
+func TestStageMokEnrollment(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "matrixOS SecureBoot"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	requestPath := func(efi string) string {
+		return filepath.Join(efi, "secureboot-enroll.der")
+	}
+
+	t.Run("Staged", func(t *testing.T) {
+		efi := t.TempDir()
+		os.WriteFile(filepath.Join(efi, "secureboot.der"), der, 0644)
+		if err := im.StageMokEnrollment(efi); err != nil {
+			t.Fatalf("StageMokEnrollment() error: %v", err)
+		}
+		got, err := os.ReadFile(requestPath(efi))
+		if err != nil {
+			t.Fatalf("enrollment request not staged: %v", err)
+		}
+		if !bytes.Equal(got, der) {
+			t.Error("enrollment request should hold the DER cert")
+		}
+	})
+
+	t.Run("NoDerCert", func(t *testing.T) {
+		efi := t.TempDir()
+		if err := im.StageMokEnrollment(efi); err != nil {
+			t.Fatalf("StageMokEnrollment() error: %v", err)
+		}
+		if _, err := os.Stat(requestPath(efi)); !os.IsNotExist(err) {
+			t.Error("no enrollment request should be staged without a DER cert")
+		}
+	})
+
+	t.Run("InvalidDerCert", func(t *testing.T) {
+		efi := t.TempDir()
+		os.WriteFile(filepath.Join(efi, "secureboot.der"), []byte("not a cert"), 0644)
+		if err := im.StageMokEnrollment(efi); err == nil {
+			t.Error("should error for an invalid DER cert")
+		}
+		if _, err := os.Stat(requestPath(efi)); !os.IsNotExist(err) {
+			t.Error("no enrollment request should be staged for an invalid DER cert")
+		}
+	})
+
+	t.Run("EmptyParam", func(t *testing.T) {
+		if err := im.StageMokEnrollment(""); err == nil {
+			t.Error("should error for empty mountEfifs")
+		}
+	})
+}
+
+func TestInstallMokEnrollUnit(t *testing.T) {
+	im := newTestImage(baseImageConfig(), &cds.MockOstree{})
+	rootfs := t.TempDir()
+	if err := im.installMokEnrollUnit(rootfs); err != nil {
+		t.Fatalf("installMokEnrollUnit() error: %v", err)
+	}
+	unit, err := os.ReadFile(filepath.Join(rootfs, "etc", "systemd", "system", mokEnrollUnitName))
+	if err != nil {
+		t.Fatalf("enrollment unit not installed: %v", err)
+	}
+	for _, want := range []string{
+		"ConditionPathExists=/efi/secureboot-enroll.der\n",
+		"ExecStart=/usr/bin/mokutil --import /efi/secureboot-enroll.der --root-pw\n",
+		"ExecStartPost=/usr/bin/rm -f /efi/secureboot-enroll.der\n",
+		"WantedBy=multi-user.target\n",
+	} {
+		if !strings.Contains(string(unit), want) {
+			t.Errorf("unit does not contain %q:\n%s", want, unit)
+		}
+	}
+	wantsLink := filepath.Join(rootfs, "etc", "systemd", "system", "multi-user.target.wants", mokEnrollUnitName)
+	if target, err := os.Readlink(wantsLink); err != nil || target != "/etc/systemd/system/"+mokEnrollUnitName {
+		t.Errorf("unit not enabled: %q, %v", target, err)
+	}
+
+	// Installing again replaces the unit and its enablement link.
+	if err := im.installMokEnrollUnit(rootfs); err != nil {
+		t.Fatalf("second installMokEnrollUnit() error: %v", err)
+	}
+}
+
 // --- InstallMemtest Tests ---
 
 func TestInstallMemtest(t *testing.T) {
@@ -1451,6 +4193,61 @@ func TestInstallMemtest(t *testing.T) {
 			t.Error("memtest86plus.efi should have been copied")
 		}
 	})
+
+	t.Run("CandidateSelection", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			present []string
+			paths   string
+			want    string
+		}{
+			{"Efi64Preferred", []string{"usr/share/memtest86+/memtest.efi64", "usr/share/memtest86+/memtest.efi"}, "", "usr/share/memtest86+/memtest.efi64"},
+			{"EfiFallback", []string{"usr/share/memtest86+/memtest.efi"}, "", "usr/share/memtest86+/memtest.efi"},
+			{"BootGlob", []string{"boot/memtest86+-7.00.efi"}, "", "boot/memtest86+-7.00.efi"},
+			{"Configured", []string{"usr/share/memtest86+/memtest.efi64", "opt/memtest.efi"}, "/opt/memtest.efi /usr/share/memtest86+/memtest.efi64", "opt/memtest.efi"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rootfs := t.TempDir()
+				for _, p := range tt.present {
+					os.MkdirAll(filepath.Dir(filepath.Join(rootfs, p)), 0755)
+					os.WriteFile(filepath.Join(rootfs, p), []byte(p), 0644)
+				}
+				efibootdir := t.TempDir()
+
+				cfg := baseImageConfig()
+				cfg.Items["Imager.MemtestPaths"] = []string{tt.paths}
+				im := newTestImage(cfg, &cds.MockOstree{})
+				if err := im.InstallMemtest(rootfs, efibootdir); err != nil {
+					t.Fatalf("error: %v", err)
+				}
+				data, err := os.ReadFile(filepath.Join(efibootdir, "memtest86plus.efi"))
+				if err != nil {
+					t.Fatalf("memtest86plus.efi not installed: %v", err)
+				}
+				if string(data) != tt.want {
+					t.Errorf("installed %q, want %q", data, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("ConfiguredNoneFound", func(t *testing.T) {
+		rootfs := t.TempDir()
+		os.MkdirAll(filepath.Join(rootfs, "usr", "share", "memtest86+"), 0755)
+		os.WriteFile(filepath.Join(rootfs, "usr", "share", "memtest86+", "memtest.efi64"), []byte("EFI"), 0644)
+		efibootdir := t.TempDir()
+
+		cfg := baseImageConfig()
+		cfg.Items["Imager.MemtestPaths"] = []string{"/opt/memtest.efi"}
+		im := newTestImage(cfg, &cds.MockOstree{})
+		if err := im.InstallMemtest(rootfs, efibootdir); err != nil {
+			t.Fatalf("should only warn when no candidate exists: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(efibootdir, "memtest86plus.efi")); !os.IsNotExist(err) {
+			t.Error("nothing should be installed when no configured candidate exists")
+		}
+	})
 }
 
 // --- copyFile Tests ---
@@ -0,0 +1,43 @@
+package runner
+
+import (
+	"bytes"
+	"io"
+)
+
+// LineWriter is an io.Writer meant to be used as the stdout or stderr of a
+// command. It forwards everything written to it to Out (if set) and calls
+// OnLine for every line, split on either \r or \n, so that progress output
+// redrawn in place with \r is seen line by line too.
+type LineWriter struct {
+	Out    io.Writer
+	OnLine func(line string)
+	buf    []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	if w.Out != nil {
+		if _, err := w.Out.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexAny(w.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		w.OnLine(string(w.buf[:idx]))
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush calls OnLine with any trailing data not terminated by a newline.
+// Call it once the command has exited.
+func (w *LineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.OnLine(string(w.buf))
+		w.buf = nil
+	}
+}
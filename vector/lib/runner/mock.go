@@ -1,6 +1,9 @@
 package runner
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
 // MockRunnerCall records a single command invocation.
 type MockRunnerCall struct {
@@ -11,7 +14,11 @@ type MockRunnerCall struct {
 // MockRunner records calls and returns configurable errors.
 // Use NewMockRunner for a runner that always succeeds, or
 // NewMockRunnerFailOnCall to fail on a specific invocation index.
+// It is safe for concurrent use; Calls must only be read once all the
+// concurrent invocations have returned.
 type MockRunner struct {
+	mu sync.Mutex
+
 	Calls  []MockRunnerCall
 	Err    error
 	FailOn int // Fail on this call index (0-based), -1 means always fail if Err != nil
@@ -24,6 +31,8 @@ type MockRunner struct {
 
 // Run implements the Func signature.
 func (mr *MockRunner) Run(stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
 	mr.Calls = append(mr.Calls, MockRunnerCall{Name: name, Args: args})
 	if mr.FailOn >= 0 && len(mr.Calls)-1 == mr.FailOn {
 		return mr.Err
@@ -56,18 +65,24 @@ func (mr *MockRunner) outputForCall() []byte {
 
 // Output implements the OutputFunc signature.
 func (mr *MockRunner) Output(name string, args ...string) ([]byte, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
 	mr.Calls = append(mr.Calls, MockRunnerCall{Name: name, Args: args})
 	return mr.outputForCall(), mr.errForCall()
 }
 
 // CombinedOutput implements the CombinedOutputFunc signature.
 func (mr *MockRunner) CombinedOutput(name string, args ...string) ([]byte, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
 	mr.Calls = append(mr.Calls, MockRunnerCall{Name: name, Args: args})
 	return mr.outputForCall(), mr.errForCall()
 }
 
 // ChrootRun implements the ChrootRunFunc signature.
 func (mr *MockRunner) ChrootRun(stdin io.Reader, stdout, stderr io.Writer, chrootDir, chrootExec string, args ...string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
 	mr.Calls = append(mr.Calls, MockRunnerCall{Name: "chroot:" + chrootExec, Args: args})
 	if mr.FailOn >= 0 && len(mr.Calls)-1 == mr.FailOn {
 		return mr.Err
@@ -80,6 +95,8 @@ func (mr *MockRunner) ChrootRun(stdin io.Reader, stdout, stderr io.Writer, chroo
 
 // ChrootOutput implements the ChrootOutputFunc signature.
 func (mr *MockRunner) ChrootOutput(chrootDir, chrootExec string, args ...string) ([]byte, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
 	mr.Calls = append(mr.Calls, MockRunnerCall{Name: "chroot:" + chrootExec, Args: args})
 	return mr.outputForCall(), mr.errForCall()
 }
@@ -3,6 +3,8 @@
 package runner
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
@@ -14,6 +16,10 @@ import (
 // real process execution.
 type Func func(stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error
 
+// FuncCtx is the context-aware variant of Func. Cancelling ctx kills the
+// running command.
+type FuncCtx func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error
+
 // OutputFunc is a function type that executes an external command and
 // returns its standard output. It mirrors the (*exec.Cmd).Output() pattern.
 // Tests can replace the default with a mock to avoid real process execution.
@@ -36,6 +42,21 @@ var Run Func = func(stdin io.Reader, stdout, stderr io.Writer, name string, args
 	return cmd.Run()
 }
 
+// RunContext is the default FuncCtx implementation. It behaves like Run, but
+// kills the command when ctx is done. In that case the returned error wraps
+// ctx.Err(), so callers can match it with errors.Is.
+var RunContext FuncCtx = func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%s: %w (%v)", name, ctx.Err(), err)
+	}
+	return err
+}
+
 // Output is the default OutputFunc implementation. It executes the named
 // program and returns its standard output, mirroring (*exec.Cmd).Output().
 var Output OutputFunc = func(name string, args ...string) ([]byte, error) {
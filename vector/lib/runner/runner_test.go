@@ -2,6 +2,7 @@ package runner
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"strings"
@@ -30,6 +31,26 @@ func TestRun_Failure(t *testing.T) {
 	}
 }
 
+func TestRunContext_Echo(t *testing.T) {
+	var stdout bytes.Buffer
+	err := RunContext(context.Background(), nil, &stdout, io.Discard, "echo", "hello")
+	if err != nil {
+		t.Fatalf("RunContext(echo hello): unexpected error: %v", err)
+	}
+	if got := strings.TrimSpace(stdout.String()); got != "hello" {
+		t.Errorf("stdout = %q, want %q", got, "hello")
+	}
+}
+
+func TestRunContext_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := RunContext(ctx, nil, io.Discard, io.Discard, "sleep", "10")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunContext(sleep 10) with canceled ctx: err = %v, want context.Canceled", err)
+	}
+}
+
 func TestOutput_Echo(t *testing.T) {
 	out, err := Output("echo", "world")
 	if err != nil {
@@ -219,3 +240,30 @@ func TestMockRunner_OutputWithData(t *testing.T) {
 		t.Errorf("out1 = %q, want %q", string(out1), "second")
 	}
 }
+
+// ---------------------------------------------------------------------------
+// LineWriter
+// ---------------------------------------------------------------------------
+
+func TestLineWriter_SplitsLines(t *testing.T) {
+	var out bytes.Buffer
+	var lines []string
+	w := &LineWriter{Out: &out, OnLine: func(line string) { lines = append(lines, line) }}
+
+	input := "one\rtw"
+	if _, err := w.Write([]byte(input)); err != nil {
+		t.Fatalf("Write: unexpected error: %v", err)
+	}
+	if _, err := w.Write([]byte("o\nthree")); err != nil {
+		t.Fatalf("Write: unexpected error: %v", err)
+	}
+	w.Flush()
+
+	want := []string{"one", "two", "three"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if got := out.String(); got != "one\rtwo\nthree" {
+		t.Errorf("Out = %q, want %q", got, "one\rtwo\nthree")
+	}
+}